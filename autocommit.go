@@ -0,0 +1,63 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+// autoCommit is the thresholds of dirty nodes which trigger a commit
+type autoCommit struct {
+	maxDirtyNodes int
+	maxDirtyBytes int
+}
+
+// WithAutoCommit persist the trie automatically once an Insert/Delete make the
+// dirty nodes exceed maxDirtyNodes or their total size exceed maxDirtyBytes, a
+// threshold less than or equal to 0 is ignored. It bounds the memory used by
+// dirty nodes when a lot of key values are inserted without Persist. Auto commit
+// is a Commit, so ancestors of the committed trie become stale, use
+// WithAutoCommitCallback to learn the intermediate roots. Errors of the auto
+// commit are returned by the Insert/Delete, and the trie it's called on is
+// unchanged, so the operation can be retried
+func WithAutoCommit(maxDirtyNodes int, maxDirtyBytes int) Option {
+	return func(c *config) {
+		c.autoCommit = &autoCommit{
+			maxDirtyNodes: maxDirtyNodes,
+			maxDirtyBytes: maxDirtyBytes,
+		}
+	}
+}
+
+// WithAutoCommitCallback call fn with the report of every auto commit
+func WithAutoCommitCallback(fn func(report *CommitReport)) Option {
+	return func(c *config) {
+		c.onAutoCommit = fn
+	}
+}
+
+func (c *autoCommit) exceeded(nodes, bytes int) bool {
+	return (c.maxDirtyNodes > 0 && nodes > c.maxDirtyNodes) ||
+		(c.maxDirtyBytes > 0 && bytes > c.maxDirtyBytes)
+}
+
+// DirtyCount return the number and total size of nodes not persisted yet
+func (t *Trie) DirtyCount() (nodes int, bytes int) {
+	return t.log.dirtyNodes, t.log.dirtyBytes
+}
+
+// maybeAutoCommit commit the trie if dirty nodes exceed the auto commit thresholds,
+// and return the trie with an empty log, otherwise the trie itself is returned.
+// Errors of the commit are returned, the dirty nodes are kept by the trie then
+func (t *Trie) maybeAutoCommit() (*Trie, error) {
+	if t.config.autoCommit == nil || !t.config.autoCommit.exceeded(t.DirtyCount()) {
+		return t, nil
+	}
+	report, err := t.Commit()
+	if err != nil {
+		return nil, err
+	}
+	committed := t.derive(t.rootHash, t.log.committed())
+	committed.baseRoot = t.rootHash
+	if t.config.onAutoCommit != nil {
+		t.config.onAutoCommit(report)
+	}
+	return committed, nil
+}
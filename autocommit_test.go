@@ -0,0 +1,90 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirtyCount(t *testing.T) {
+	trie := NewTrie(EmptyHash, memorydb.New())
+	for i := 0; i < 100; i++ {
+		trie = trie.Insert(randomBytes(), randomBytes())
+		changes := trie.log.flatten()
+		size := 0
+		for _, v := range changes.inserted {
+			size += len(v)
+		}
+		nodes, bytes := trie.DirtyCount()
+		assert.Equal(t, len(changes.inserted), nodes)
+		assert.Equal(t, size, bytes)
+	}
+	trie.Persist()
+	trie = NewTrie(trie.StateRoot(), trie.db)
+	nodes, bytes := trie.DirtyCount()
+	assert.Equal(t, 0, nodes)
+	assert.Equal(t, 0, bytes)
+}
+
+func TestAutoCommit(t *testing.T) {
+	memDB := memorydb.New()
+	reports := make([]*CommitReport, 0)
+	trie := NewTrie(EmptyHash, memDB, WithAutoCommit(50, 0), WithAutoCommitCallback(func(report *CommitReport) {
+		reports = append(reports, report)
+	}))
+	m := make(map[string][]byte)
+	for i := 0; i < 500; i++ {
+		key, value := randomBytes(), randomBytes()
+		m[string(key)] = value
+		trie = trie.Insert(key, value)
+		nodes, _ := trie.DirtyCount()
+		assert.True(t, nodes <= 50)
+	}
+	assert.True(t, len(reports) > 0)
+	// the intermediate root is committed
+	last := reports[len(reports)-1]
+	assert.False(t, NewTrie(last.Root, memDB).Stale())
+
+	trie.Persist()
+	reopened := NewTrie(trie.StateRoot(), memDB)
+	for k, v := range m {
+		assert.Equal(t, v, reopened.Get([]byte(k)))
+	}
+}
+
+func TestAutoCommitFailedWrite(t *testing.T) {
+	memDB := memorydb.New()
+	rejecting := &rejectingDB{Database: memDB}
+	kvs := uniqueKVs(100)
+	trie := NewTrie(EmptyHash, rejecting, WithAutoCommit(50, 0))
+	i := 0
+	for ; ; i++ {
+		newTrie, err := trie.TryInsert(kvs[i].k, kvs[i].v)
+		if err != nil {
+			assert.Equal(t, errWriteFailed, err)
+			break
+		}
+		trie = newTrie
+	}
+	// the failed auto commit keep the dirty nodes
+	nodes, _ := trie.DirtyCount()
+	assert.True(t, nodes > 0)
+	_, err := trie.TryApplySorted([]KV{{Key: kvs[i].k, Value: kvs[i].v}})
+	assert.Equal(t, errWriteFailed, err)
+	assert.Equal(t, 0, memDB.Len())
+
+	// retry once puts succeed
+	rejecting.puts = -1
+	for ; i < len(kvs); i++ {
+		trie = trie.Insert(kvs[i].k, kvs[i].v)
+	}
+	trie.Persist()
+	reopened := NewTrie(trie.StateRoot(), memDB)
+	for _, elem := range kvs {
+		assert.Equal(t, elem.v, reopened.Get(elem.k))
+	}
+}
@@ -0,0 +1,230 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+)
+
+// NodeStore is where the nodes built by BuildFromStore are written, nodes are
+// keyed in the same way as Persist, so the store can be the db of tries
+type NodeStore interface {
+	db.KeyValueWriter
+}
+
+// stackBuilder build a trie from key values added in ascending key order. Only
+// the rightmost path of the trie is kept in memory, once a subtree can't change
+// anymore it's written to store and replaced by its hash, so the memory usage is
+// bounded by the depth of the trie rather than the number of key values
+type stackBuilder struct {
+	store   NodeStore
+	root    node
+	lastKey []byte
+	err     error
+	// tagged is true if the child references of built nodes are tagged
+	tagged bool
+}
+
+func newStackBuilder(store NodeStore) *stackBuilder {
+	return &stackBuilder{store: store}
+}
+
+// add add key and value to the trie, key must be greater than the key added last time
+func (b *stackBuilder) add(key, value []byte) error {
+	if b.root != nil && bytes.Compare(key, b.lastKey) <= 0 {
+		return fmt.Errorf("key %x is not greater than the previous key %x", key, b.lastKey)
+	}
+	b.lastKey = common.CopyBytes(key)
+	b.root = b.insert(b.root, bytesToNibbles(key), common.CopyBytes(value))
+	return b.err
+}
+
+func (b *stackBuilder) insert(startNode node, searchKey, value []byte) node {
+	switch n := startNode.(type) {
+	case nil:
+		return newLeafNode(searchKey, value)
+	case *leafNode:
+		// the key of leaf is smaller and not equal, so it's a prefix of searchKey or
+		// they diverge at ml
+		ml := matchingLength(searchKey, n.key)
+		var branch *branchNode
+		if ml == len(n.key) {
+			branch = branchWithTarget(n.value, b.tagged)
+		} else {
+			leaf := b.finalize(newLeafNode(n.key[ml+1:], n.value))
+			branch = branchWithChild(int(n.key[ml]), leaf, nil, b.tagged)
+		}
+		return b.withPrefix(searchKey[:ml], b.insert(branch, searchKey[ml:], value))
+	case *extNode:
+		ml := matchingLength(searchKey, n.key)
+		if ml == len(n.key) {
+			return newExtNode(n.key, b.insert(n.child, searchKey[ml:], value), b.tagged)
+		}
+		// diverge at ml, the child of ext is complete
+		child := b.finalize(b.withPrefix(n.key[ml+1:], n.child))
+		branch := branchWithChild(int(n.key[ml]), child, nil, b.tagged)
+		return b.withPrefix(searchKey[:ml], b.insert(branch, searchKey[ml:], value))
+	case *branchNode:
+		// target of the branch has been added before, so searchKey can't be empty
+		pos := int(searchKey[0])
+		branch := &branchNode{target: n.target, tagged: b.tagged}
+		for i, child := range n.children {
+			if i < pos && child != nil {
+				// children on the left are complete
+				child = b.finalize(child)
+			}
+			branch.children[i] = child
+		}
+		branch.children[pos] = b.insert(n.children[pos], searchKey[1:], value)
+		return branch
+	default:
+		// hash nodes are complete, nothing can be inserted to them
+		panic(fmt.Sprintf("can't insert to %T", n))
+	}
+}
+
+// withPrefix return child wrapped by an ext node with key prefix if prefix is not empty
+func (b *stackBuilder) withPrefix(prefix []byte, child node) node {
+	if len(prefix) == 0 {
+		return child
+	}
+	return newExtNode(common.CopyBytes(prefix), child, b.tagged)
+}
+
+// finalize write the complete subtree of n to store, and return the node which
+// refer to it in the parent, that is a hash node unless n is embedded
+func (b *stackBuilder) finalize(n node) node {
+	switch n := n.(type) {
+	case *hashNode:
+		return n
+	case *extNode:
+		n = newExtNode(n.key, b.finalize(n.child), b.tagged)
+		return b.write(n, false)
+	case *branchNode:
+		branch := &branchNode{target: n.target, tagged: b.tagged}
+		for i, child := range n.children {
+			if child != nil {
+				branch.children[i] = b.finalize(child)
+			}
+		}
+		return b.write(branch, false)
+	default:
+		return b.write(n, false)
+	}
+}
+
+// write write n to store if it's referenced by hash or force is true
+func (b *stackBuilder) write(n node, force bool) node {
+	encoded := n.Encode()
+	if len(encoded) < common.HashLength && !force {
+		return n
+	}
+	hash := n.Hash()
+	if err := b.store.Put(nodeKey(hash), encoded); err != nil && b.err == nil {
+		b.err = err
+	}
+	return &hashNode{hash[:]}
+}
+
+// commit finalize the trie and return the root hash, the root is always stored
+// even if it's less than 32 bytes
+func (b *stackBuilder) commit() (common.Hash, error) {
+	if b.root == nil {
+		return EmptyHash, b.err
+	}
+	root := b.finalize(b.root)
+	if _, ok := root.(*hashNode); !ok {
+		root = b.write(root, true)
+	}
+	b.root = root
+	return root.Hash(), b.err
+}
+
+// BuildFromStore build a trie from all key values of src in key order, nodes are
+// written to dst and the root hash is returned. A trie of the root can be opened
+// by NewTrie with dst as db
+func BuildFromStore(src db.Iteratee, dst NodeStore) (common.Hash, error) {
+	it := src.NewIterator(nil, nil)
+	defer it.Release()
+	builder := newStackBuilder(dst)
+	for it.Next() {
+		if err := builder.add(it.Key(), it.Value()); err != nil {
+			return common.Hash{}, err
+		}
+	}
+	if err := it.Error(); err != nil {
+		return common.Hash{}, err
+	}
+	return builder.commit()
+}
+
+// Rewrite copy the trie of root from src to dst by streaming its key values in key
+// order through the stack builder, so memory is bounded by the depth of the trie.
+// All nodes are encoded again with the canonical encoding, only nodes reachable
+// from root are written, garbage nodes and redundant encodings in src are left
+// behind, so it can be used to compact a trie into a fresh store. The convention
+// of child references in src is read from the root, and the copy use the one of
+// opts, so the root of the copy is the same as root unless Rewrite convert the
+// trie to or from WithTaggedChildRefs.
+//
+// opts configure the copy like the options of NewTrie for a trie of dst: the root
+// of WithEmptyRoot is returned if the trie is empty, values larger than the bound
+// of WithMaxValueSize fail the rewrite with ErrValueTooLarge, branch targets fail
+// it with ErrBranchTarget under WithoutBranchTargets, WithTaggedChildRefs tag the
+// child references of the copy, and WithSchema write the schema descriptor to dst.
+// Other options have no effect on the copy
+func Rewrite(root common.Hash, src db.KeyValueStore, dst NodeStore, opts ...Option) (common.Hash, error) {
+	c := newConfig(opts)
+	if c.schema {
+		if err := writeSchemaTo(dst, c.schemaDescriptor()); err != nil {
+			return common.Hash{}, err
+		}
+	}
+	var srcOpts []Option
+	if encoded, err := src.Get(nodeKey(root)); err == nil && len(encoded) > 0 && encoded[len(encoded)-1]&taggedFlag != 0 {
+		srcOpts = append(srcOpts, WithTaggedChildRefs())
+	}
+	builder := newStackBuilder(dst)
+	builder.tagged = c.taggedRefs
+	var addErr error
+	var lastKey []byte
+	err := NewTrie(root, src, srcOpts...).Iterate(func(key, value []byte) bool {
+		if c.maxValueSize > 0 && len(value) > c.maxValueSize {
+			addErr = ErrValueTooLarge
+			return false
+		}
+		// keys are in order, a key which is a prefix of any later key is a prefix
+		// of the next one
+		if c.noTargets && lastKey != nil && bytes.HasPrefix(key, lastKey) {
+			addErr = ErrBranchTarget
+			return false
+		}
+		lastKey = common.CopyBytes(key)
+		addErr = builder.add(key, value)
+		return addErr == nil
+	})
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if addErr != nil {
+		return common.Hash{}, addErr
+	}
+	newRoot, err := builder.commit()
+	if err == nil && newRoot == EmptyHash {
+		newRoot = c.emptyRoot
+	}
+	return newRoot, err
+}
+
+// writeSchemaTo write d to dst, unless dst can be read and already has a descriptor
+func writeSchemaTo(dst NodeStore, d SchemaDescriptor) error {
+	if r, ok := dst.(db.KeyValueReader); ok {
+		return putSchema(r, dst, d)
+	}
+	return dst.Put(schemaKey(), d.encode())
+}
@@ -0,0 +1,144 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func testBuildFromStore(t *testing.T, kvs []kv) {
+	src := memorydb.New()
+	expected := NewTrie(EmptyHash, memorydb.New())
+	for _, elem := range kvs {
+		src.Put(elem.k, elem.v)
+		expected = expected.Insert(elem.k, elem.v)
+	}
+
+	dst := memorydb.New()
+	root, err := BuildFromStore(src, dst)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.StateRoot(), root)
+
+	trie := NewTrie(root, dst)
+	for _, elem := range kvs {
+		value, err := trie.TryGet(elem.k)
+		assert.Nil(t, err)
+		assert.Equal(t, elem.v, value)
+	}
+	assert.Equal(t, sortedKVs(kvMap(kvs)), collectKVs(t, trie.Iterate))
+}
+
+func TestBuildFromStore(t *testing.T) {
+	testBuildFromStore(t, nil)
+	testBuildFromStore(t, []kv{{k: []byte{0x01}, v: []byte{0x01}}})
+	// keys are prefixes of others, and tiny nodes are embedded
+	testBuildFromStore(t, []kv{
+		{k: []byte{0x01}, v: []byte{0x01}},
+		{k: []byte{0x01, 0x02}, v: []byte{0x02}},
+		{k: []byte{0x01, 0x02, 0x03}, v: []byte{0x03}},
+		{k: []byte{0x01, 0x03}, v: []byte{0x04}},
+		{k: []byte{0x11}, v: []byte{0x05}},
+		{k: []byte{0x12, 0x34}, v: randomBytes()},
+	})
+
+	m := make(map[string][]byte)
+	for i := 0; i < iterateTimes; i++ {
+		m[string(randomBytes())] = randomBytes()
+	}
+	testBuildFromStore(t, sortedKVs(m))
+}
+
+func TestStackBuilderOrder(t *testing.T) {
+	builder := newStackBuilder(memorydb.New())
+	assert.Nil(t, builder.add([]byte{0x02}, []byte{0x01}))
+	assert.NotNil(t, builder.add([]byte{0x02}, []byte{0x01}))
+	assert.NotNil(t, builder.add([]byte{0x01}, []byte{0x01}))
+}
+
+func TestRewrite(t *testing.T) {
+	src := memorydb.New()
+	trie, kvs := persistedTrie(src, 200)
+	// garbage left in src by an unpersisted fork is not copied
+	fork := trie.Insert(randomBytes(), randomBytes())
+	batch := src.NewBatch()
+	for k, v := range fork.DirtyNodes() {
+		batch.Put(nodeKey(k), v)
+	}
+	assert.Nil(t, batch.Write())
+
+	dst := memorydb.New()
+	root, err := Rewrite(trie.StateRoot(), src, dst)
+	assert.Nil(t, err)
+	assert.Equal(t, trie.StateRoot(), root)
+	assert.True(t, dst.Len() < src.Len())
+
+	copied := NewTrie(root, dst)
+	for _, elem := range kvs {
+		assert.Equal(t, elem.v, copied.Get(elem.k))
+	}
+	nodes := 0
+	assert.Nil(t, copied.IterateNodes(PreOrder, func(path []byte, hash common.Hash, encoded []byte) bool {
+		if hash != (common.Hash{}) {
+			nodes++
+		}
+		return true
+	}))
+	assert.Equal(t, nodes, dst.Len())
+
+	_, err = Rewrite(common.BytesToHash(randomBytes()), memorydb.New(), memorydb.New())
+	assert.NotNil(t, err)
+}
+
+func TestRewriteTaggedChildRefs(t *testing.T) {
+	src := memorydb.New()
+	trie, kvs := persistedTrie(src, 200)
+	dst := memorydb.New()
+	root, err := Rewrite(trie.StateRoot(), src, dst, WithTaggedChildRefs(), WithSchema())
+	assert.Nil(t, err)
+	assert.NotEqual(t, trie.StateRoot(), root)
+	d, _, _ := ReadSchema(dst)
+	assert.Equal(t, TaggedSchema, d)
+	copied := NewTrie(root, dst, WithTaggedChildRefs())
+	for _, elem := range kvs {
+		assert.Equal(t, elem.v, copied.Get(elem.k))
+	}
+
+	// the convention of src is read from its root, so the copy can be converted back
+	back, err := Rewrite(root, dst, memorydb.New())
+	assert.Nil(t, err)
+	assert.Equal(t, trie.StateRoot(), back)
+}
+
+func TestRewriteOptions(t *testing.T) {
+	src := memorydb.New()
+	trie := NewTrie(EmptyHash, src)
+	for _, elem := range []kv{{k: []byte{0x01}, v: []byte{0x01}}, {k: []byte{0x01, 0x02}, v: []byte("value")}} {
+		trie = trie.Insert(elem.k, elem.v)
+	}
+	trie.Persist()
+
+	dst := memorydb.New()
+	root, err := Rewrite(trie.StateRoot(), src, dst, WithSchema())
+	assert.Nil(t, err)
+	assert.Equal(t, trie.StateRoot(), root)
+	_, ok, err := ReadSchema(dst)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// bounds of the destination fail the rewrite
+	_, err = Rewrite(trie.StateRoot(), src, memorydb.New(), WithMaxValueSize(1))
+	assert.Equal(t, ErrValueTooLarge, err)
+	_, err = Rewrite(trie.StateRoot(), src, memorydb.New(), WithoutBranchTargets())
+	assert.Equal(t, ErrBranchTarget, err)
+	_, err = Rewrite(trie.StateRoot(), src, memorydb.New(), WithMaxValueSize(5), WithoutBranchTargets())
+	assert.NotNil(t, err)
+
+	root, err = Rewrite(EmptyHash, src, memorydb.New(), WithEmptyRoot(EthereumEmptyRoot))
+	assert.Nil(t, err)
+	assert.Equal(t, EthereumEmptyRoot, root)
+}
@@ -0,0 +1,177 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+
+	db "github.com/ethereum/go-ethereum/ethdb"
+	"github.com/lbqds/mpt/internal/varint"
+)
+
+// CacheCounts is the node resolves of operations, a resolve is a node read by hash,
+// from the changes of the trie, the node cache or underlying db
+type CacheCounts struct {
+	Gets        uint64 `json:"gets"`
+	GetResolves uint64 `json:"getResolves"`
+	Inserts     uint64 `json:"inserts"`
+	InsertReads uint64 `json:"insertReads"`
+	// CacheHits and DBReads are of all operations
+	CacheHits uint64 `json:"cacheHits"`
+	DBReads   uint64 `json:"dbReads"`
+}
+
+// HitRate return the ratio of nodes read from the cache to nodes read from the cache
+// or underlying db, 0 if no node is read
+func (c CacheCounts) HitRate() float64 {
+	return ratio(c.CacheHits, c.CacheHits+c.DBReads)
+}
+
+// ResolvesPerGet return the average number of nodes resolved by a Get
+func (c CacheCounts) ResolvesPerGet() float64 {
+	return ratio(c.GetResolves, c.Gets)
+}
+
+// ReadsPerInsert return the average number of nodes read from underlying db by an
+// Insert
+func (c CacheCounts) ReadsPerInsert() float64 {
+	return ratio(c.InsertReads, c.Inserts)
+}
+
+func ratio(a, b uint64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
+
+func (c *CacheCounts) add(op Op, counts opCounts, delta int) {
+	apply := func(v *uint64, n int) {
+		*v = uint64(int64(*v) + int64(n*delta))
+	}
+	switch op {
+	case OpGet:
+		apply(&c.Gets, 1)
+		apply(&c.GetResolves, counts.resolves)
+	case OpInsert:
+		apply(&c.Inserts, 1)
+		apply(&c.InsertReads, counts.dbReads)
+	}
+	apply(&c.CacheHits, counts.cacheHits)
+	apply(&c.DBReads, counts.dbReads)
+}
+
+type cacheSample struct {
+	op     Op
+	counts opCounts
+}
+
+// CacheStats accumulate the node resolves of operations of tries, so the node cache
+// can be sized by its hit rate and the db reads it saves rather than by guesswork.
+// Counts are kept for all operations, and for a rolling window of recent operations
+// which follow the effect of a resize quickly. Totals can be persisted by Store and
+// restored by LoadCacheStats across restarts. It's safe for concurrent use
+type CacheStats struct {
+	lock   sync.Mutex
+	total  CacheCounts
+	recent CacheCounts
+	window []cacheSample
+	next   int
+	full   bool
+}
+
+// NewCacheStats create empty stats whose rolling window is the last window
+// operations, zero means 1024
+func NewCacheStats(window int) *CacheStats {
+	if window <= 0 {
+		window = 1024
+	}
+	return &CacheStats{window: make([]cacheSample, window)}
+}
+
+// WithCacheStats record the node resolves of every Get, Insert, Delete and commit of
+// the trie to stats
+func WithCacheStats(stats *CacheStats) Option {
+	return func(c *config) {
+		c.cacheStats = stats
+	}
+}
+
+func (s *CacheStats) record(op Op, counts opCounts) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.total.add(op, counts, 1)
+	if s.full {
+		evicted := s.window[s.next]
+		s.recent.add(evicted.op, evicted.counts, -1)
+	}
+	s.window[s.next] = cacheSample{op: op, counts: counts}
+	s.recent.add(op, counts, 1)
+	s.next = (s.next + 1) % len(s.window)
+	if s.next == 0 {
+		s.full = true
+	}
+}
+
+// Total return the counts of all recorded operations
+func (s *CacheStats) Total() CacheCounts {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.total
+}
+
+// Recent return the counts of the operations in the rolling window
+func (s *CacheStats) Recent() CacheCounts {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.recent
+}
+
+// ServeHTTP write the total and recent counts as JSON
+func (s *CacheStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	counts := map[string]CacheCounts{"total": s.Total(), "recent": s.Recent()}
+	if err := json.NewEncoder(w).Encode(counts); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Store write the total counts to w, the rolling window isn't persisted
+func (s *CacheStats) Store(w db.KeyValueWriter) error {
+	total := s.Total()
+	buf := make([]byte, 0, 6*varint.MaxLen)
+	for _, v := range []uint64{total.Gets, total.GetResolves, total.Inserts, total.InsertReads, total.CacheHits, total.DBReads} {
+		buf = varint.Append(buf, v)
+	}
+	return w.Put(cacheStatsKey(), buf)
+}
+
+// LoadCacheStats create stats like NewCacheStats with the total counts written by
+// Store, so the totals accumulate across restarts
+func LoadCacheStats(r db.KeyValueReader, window int) (*CacheStats, error) {
+	encoded, err := r.Get(cacheStatsKey())
+	if err != nil {
+		return nil, err
+	}
+	var fields [6]uint64
+	for i := range fields {
+		var ok bool
+		if fields[i], encoded, ok = varint.Decode(encoded); !ok {
+			return nil, errors.New("invalid cache stats")
+		}
+	}
+	s := NewCacheStats(window)
+	s.total = CacheCounts{
+		Gets:        fields[0],
+		GetResolves: fields[1],
+		Inserts:     fields[2],
+		InsertReads: fields[3],
+		CacheHits:   fields[4],
+		DBReads:     fields[5],
+	}
+	return s, nil
+}
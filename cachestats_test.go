@@ -0,0 +1,59 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheStats(t *testing.T) {
+	memDB := memorydb.New()
+	base, kvs := persistedTrie(memDB, 200)
+	stats := NewCacheStats(4)
+	trie := NewTrie(base.StateRoot(), memDB, WithCacheStats(stats))
+	assert.Equal(t, kvs[0].v, trie.Get(kvs[0].k))
+	first := stats.Total()
+	assert.Equal(t, uint64(1), first.Gets)
+	assert.True(t, first.GetResolves > 0)
+	assert.Equal(t, first.GetResolves, first.DBReads)
+	assert.Equal(t, float64(0), first.HitRate())
+
+	// the same path is read from the cache
+	assert.Equal(t, kvs[0].v, trie.Get(kvs[0].k))
+	total := stats.Total()
+	assert.Equal(t, uint64(2), total.Gets)
+	assert.Equal(t, first.DBReads, total.DBReads)
+	assert.Equal(t, first.GetResolves, total.CacheHits)
+	assert.Equal(t, 0.5, total.HitRate())
+	assert.Equal(t, float64(first.GetResolves), total.ResolvesPerGet())
+
+	updated := trie.Insert(randomKey(), randomBytes())
+	total = stats.Total()
+	assert.Equal(t, uint64(1), total.Inserts)
+	assert.Equal(t, total.InsertReads, total.DBReads-first.DBReads)
+	assert.Equal(t, float64(total.InsertReads), total.ReadsPerInsert())
+	updated.Get(kvs[1].k)
+	updated.Get(kvs[1].k)
+
+	// the window keep the last 4 operations
+	recent := stats.Recent()
+	assert.Equal(t, uint64(3), recent.Gets)
+	assert.Equal(t, uint64(1), recent.Inserts)
+	updated.Get(kvs[1].k)
+	recent = stats.Recent()
+	assert.Equal(t, uint64(3), recent.Gets)
+	assert.Equal(t, stats.Total().Gets, uint64(5))
+
+	kvdb := memorydb.New()
+	assert.Nil(t, stats.Store(kvdb))
+	loaded, err := LoadCacheStats(kvdb, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, stats.Total(), loaded.Total())
+	assert.Equal(t, CacheCounts{}, loaded.Recent())
+	_, err = LoadCacheStats(memorydb.New(), 0)
+	assert.NotNil(t, err)
+}
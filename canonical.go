@@ -0,0 +1,123 @@
+package mpt
+
+import (
+	"github.com/lbqds/mpt/internal/varint"
+)
+
+// protobuf doesn't guarantee the encoding is canonical across library versions,
+// but the hash of a node depends on its encoded bytes, so we write the fields of
+// node messages(defined in node.proto) by hand. The output is the same as proto3
+// encoding with fields in order of field number:
+// - singular bytes field is omitted if it is empty
+// - every element of repeated bytes field is written, even if it is empty
+// The only exception is the target of branch node, which is separated from the
+// children slots and written whenever the branch has a target, so an empty target
+// value is distinguishable from no target
+//
+// A child is referenced by its encoding if it is shorter than a hash, otherwise by
+// its hash, so the length of a reference tell which one it is, unless the reference
+// is tagged, see WithTaggedChildRefs
+const (
+	// wire type of length-delimited field
+	wireBytes = 2
+
+	leafKeyField      = 1
+	leafValueField    = 2
+	extKeyField       = 1
+	extNodeField      = 2
+	branchChildField  = 1
+	branchTargetField = 2
+)
+
+// appendBytesField append a length-delimited field to buf
+func appendBytesField(buf []byte, field int, value []byte) []byte {
+	buf = varint.Append(buf, uint64(field<<3|wireBytes))
+	buf = varint.Append(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// appendOptionalBytesField append a field to buf unless value is empty
+func appendOptionalBytesField(buf []byte, field int, value []byte) []byte {
+	if len(value) == 0 {
+		return buf
+	}
+	return appendBytesField(buf, field, value)
+}
+
+// marshalLeafNode return the canonical encoding of LeafNode message
+func marshalLeafNode(key, value []byte) []byte {
+	buf := make([]byte, 0, len(key)+len(value)+8)
+	buf = appendOptionalBytesField(buf, leafKeyField, key)
+	return appendOptionalBytesField(buf, leafValueField, value)
+}
+
+// marshalExtNode return the canonical encoding of ExtNode message
+func marshalExtNode(key, child []byte) []byte {
+	buf := make([]byte, 0, len(key)+len(child)+8)
+	buf = appendOptionalBytesField(buf, extKeyField, key)
+	return appendOptionalBytesField(buf, extNodeField, child)
+}
+
+// marshalBranchNode return the canonical encoding of BranchNode message
+func marshalBranchNode(children [][]byte, target []byte) []byte {
+	size := len(target) + 4
+	for _, child := range children {
+		size += len(child) + 2
+	}
+	buf := make([]byte, 0, size)
+	for _, child := range children {
+		buf = appendBytesField(buf, branchChildField, child)
+	}
+	if target == nil {
+		return buf
+	}
+	return appendBytesField(buf, branchTargetField, target)
+}
+
+// canonicalMessage report whether encoded is a node message written as above, that
+// is, only length-delimited fields of known numbers in ascending order, varints in
+// the minimal form and no trailing bytes. repeated is the number of the repeated
+// field, and keepEmpty the number of a singular field written even if empty, zero
+// if the message has none of them, other empty fields must be omitted. It doesn't
+// allocate, so the canonical form is checked without re-encoding the node
+func canonicalMessage(encoded []byte, repeated, keepEmpty int) bool {
+	last := 0
+	for len(encoded) > 0 {
+		tag, rest, ok := varint.DecodeMinimal(encoded)
+		if !ok || tag&0x07 != wireBytes {
+			return false
+		}
+		field := int(tag >> 3)
+		if field < 1 || field > 2 || field < last || (field == last && field != repeated) {
+			return false
+		}
+		length, rest, ok := varint.DecodeMinimal(rest)
+		if !ok || uint64(len(rest)) < length {
+			return false
+		}
+		if length == 0 && field != repeated && field != keepEmpty {
+			return false
+		}
+		encoded = rest[length:]
+		last = field
+	}
+	return true
+}
+
+// hasBytesField report whether field present in encoded message, all fields of
+// node messages are length-delimited
+func hasBytesField(encoded []byte, field int) bool {
+	for len(encoded) > 0 {
+		tag, rest, ok := varint.Decode(encoded)
+		if !ok || tag&0x07 != wireBytes {
+			return false
+		}
+		if _, encoded, ok = varint.DecodeBytes(rest); !ok {
+			return false
+		}
+		if int(tag>>3) == field {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package mpt
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+// golden encodings recorded from proto.Marshal, hash of nodes depend on these
+// bytes, so they must never change
+func TestCanonicalGoldenEncoding(t *testing.T) {
+	leaf := newLeafNode([]byte{0x01, 0x02, 0x03}, []byte("value"))
+	big := newLeafNode([]byte{0x0a, 0x0b, 0x0c, 0x0d}, make([]byte, 40))
+	branch := branchWithChild(3, leaf, []byte("t"), false)
+	branch.children[15] = big
+	cases := []struct {
+		n       node
+		encoded string
+	}{
+		{
+			n:       leaf,
+			encoded: "0a021230120576616c756510",
+		},
+		{
+			n:       newLeafNode(nil, []byte{0xff}),
+			encoded: "1201ff00",
+		},
+		{
+			n:       big,
+			encoded: "0a02abcd12280000000000000000000000000000000000000000000000000000000000000000000000000000000000",
+		},
+		{
+			n:       newExtNode([]byte{0x05}, big, false),
+			encoded: "0a0150122055e926cdbf088f11feb6e8b152ebe764da86d09a4999a5e3c46e343eb2f90b9211",
+		},
+		{
+			n: branch,
+			encoded: "0a000a000a000a0c0a021230120576616c7565100a000a000a000a000a000a000a000a000a000a000a00" +
+				"0a2055e926cdbf088f11feb6e8b152ebe764da86d09a4999a5e3c46e343eb2f90b9212017402",
+		},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.encoded, hex.EncodeToString(c.n.Encode()))
+	}
+	hash := newLeafNode([]byte{0x01}, make([]byte, 200)).Hash()
+	assert.Equal(t, "0x452affa8955ef93130e7af865d66e77c21337d44f8ecdfe1ba2dc43cb5d32c61", hash.Hex())
+}
+
+func TestCanonicalMatchProto(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		key, value := randomBytes(), randomBytes()
+		expected, _ := proto.Marshal(&LeafNode{Key: key, Value: value})
+		assert.Equal(t, expected, marshalLeafNode(key, value))
+		expected, _ = proto.Marshal(&ExtNode{Key: key, Node: value})
+		assert.Equal(t, expected, marshalExtNode(key, value))
+
+		children := make([][]byte, 16)
+		for j := range children {
+			if random.Intn(2) == 1 {
+				children[j] = randomBytes()
+			}
+		}
+		expected, _ = proto.Marshal(&BranchNode{Children: children, Target: value})
+		assert.Equal(t, expected, marshalBranchNode(children, value))
+		expected, _ = proto.Marshal(&BranchNode{Children: children})
+		assert.Equal(t, expected, marshalBranchNode(children, nil))
+	}
+}
+
+func TestEmptyBranchTarget(t *testing.T) {
+	leaf := newLeafNode([]byte{0x01}, []byte("value"))
+	withTarget := branchWithChild(0, leaf, []byte{}, false)
+	withoutTarget := branchWithChild(0, leaf, nil, false)
+	encoded := withTarget.Encode()
+	// the empty target is written as a field of zero length
+	assert.Equal(t, append(append([]byte{}, withoutTarget.Encode()[:len(encoded)-3]...), 0x12, 0x00, branchType), encoded)
+
+	decoded, err := decodeNode(encoded)
+	assert.Nil(t, err)
+	assert.True(t, decoded.(*branchNode).hasTarget())
+	assert.Equal(t, 0, len(decoded.(*branchNode).target))
+	decoded, err = decodeNode(withoutTarget.Encode())
+	assert.Nil(t, err)
+	assert.False(t, decoded.(*branchNode).hasTarget())
+
+	assert.False(t, hasBytesField([]byte{0x12}, branchTargetField))
+	assert.False(t, hasBytesField([]byte{0x0a, 0x05, 0x00}, branchTargetField))
+}
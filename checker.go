@@ -0,0 +1,175 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+)
+
+// checkSubtree verify all nodes reachable from hash exist in underlying db,
+// checked record the hashes of nodes already verified and can be shared by
+// several calls to avoid checking the same subtree twice
+func checkSubtree(reader db.KeyValueReader, hash common.Hash, checked map[common.Hash]struct{}) error {
+	if isEmptyRoot(hash) {
+		return nil
+	}
+	if _, ok := checked[hash]; ok {
+		return nil
+	}
+	encoded, err := reader.Get(nodeKey(hash))
+	if err != nil || len(encoded) == 0 {
+		return &MissingNodeError{Hash: hash, Err: err}
+	}
+	n, err := decodeNode(encoded)
+	if err != nil {
+		return &MissingNodeError{Hash: hash, Err: err}
+	}
+	if err := checkChildren(reader, n, checked); err != nil {
+		return err
+	}
+	checked[hash] = struct{}{}
+	return nil
+}
+
+// checkChildren verify all hash nodes embedded in n
+func checkChildren(reader db.KeyValueReader, n node, checked map[common.Hash]struct{}) error {
+	switch n := n.(type) {
+	case *extNode:
+		return checkChildren(reader, n.child, checked)
+	case *branchNode:
+		for _, child := range n.children {
+			if child == nil {
+				continue
+			}
+			if err := checkChildren(reader, child, checked); err != nil {
+				return err
+			}
+		}
+	case *hashNode:
+		return checkSubtree(reader, n.Hash(), checked)
+	}
+	return nil
+}
+
+// StorageRootFunc extract the storage root from an account leaf, return false
+// if the account have no storage trie
+type StorageRootFunc func(key, value []byte) (common.Hash, bool)
+
+// MissingStorage is an account whose storage trie can't be resolved fully
+type MissingStorage struct {
+	Account     []byte
+	StorageRoot common.Hash
+	Err         error
+}
+
+// CheckStorageRoots verify every storage root referenced by account leaves of
+// the account trie resolves fully in underlying db, and return all accounts
+// with missing storage. An error is returned if the account trie itself is
+// incomplete
+func CheckStorageRoots(accountRoot common.Hash, kvs db.KeyValueStore, extract StorageRootFunc) ([]MissingStorage, error) {
+	checked := make(map[common.Hash]struct{})
+	if err := checkSubtree(kvs, accountRoot, checked); err != nil {
+		return nil, err
+	}
+	missing := make([]MissingStorage, 0)
+	err := NewTrie(accountRoot, kvs).Iterate(func(key, value []byte) bool {
+		storageRoot, ok := extract(key, value)
+		if !ok {
+			return true
+		}
+		if err := checkSubtree(kvs, storageRoot, checked); err != nil {
+			missing = append(missing, MissingStorage{
+				Account:     common.CopyBytes(key),
+				StorageRoot: storageRoot,
+				Err:         err,
+			})
+		}
+		return true
+	})
+	return missing, err
+}
+
+// CanonicalViolation is a node breaking the structural invariants of the trie,
+// path is the key nibbles from root to the node
+type CanonicalViolation struct {
+	Path   []byte
+	Reason string
+}
+
+func (v CanonicalViolation) String() string {
+	return fmt.Sprintf("%s at path %x", v.Reason, v.Path)
+}
+
+// CheckCanonical verify the trie of root is in the canonical form produced by
+// Insert and Delete, and return all violations:
+// - an extension node have a non-empty key and a branch child
+// - a branch node have at least two entries, counting the target as an entry
+// Any other trie with the same key values have a different root, so violations
+// point to bugs of fixing nodes after Delete. Nodes are resolved through the log
+// of t, so root can be a trie not persisted yet
+func (t *Trie) CheckCanonical(root common.Hash) ([]CanonicalViolation, error) {
+	violations := make([]CanonicalViolation, 0)
+	if t.empty(root) {
+		return violations, nil
+	}
+	err := t.checkCanonical(&hashNode{root[:]}, nil, &violations)
+	if err != nil {
+		return nil, err
+	}
+	return violations, nil
+}
+
+func (t *Trie) checkCanonical(n node, path []byte, violations *[]CanonicalViolation) error {
+	if ref, ok := n.(*hashNode); ok {
+		resolved, err := t.resolveHash(ref.Hash())
+		if err != nil {
+			return err
+		}
+		n = resolved
+	}
+	violate := func(reason string) {
+		*violations = append(*violations, CanonicalViolation{Path: path, Reason: reason})
+	}
+	switch n := n.(type) {
+	case *extNode:
+		if len(n.key) == 0 {
+			violate("extension node with empty key")
+		}
+		child := n.child
+		if ref, ok := child.(*hashNode); ok {
+			resolved, err := t.resolveHash(ref.Hash())
+			if err != nil {
+				return err
+			}
+			child = resolved
+		}
+		switch child.(type) {
+		case *extNode:
+			violate("extension node with extension child")
+		case *leafNode:
+			violate("extension node with leaf child")
+		}
+		return t.checkCanonical(child, extendPath(path, n.key...), violations)
+	case *branchNode:
+		entries := len(n.childrenIndex())
+		if n.hasTarget() {
+			entries++
+		}
+		if entries < 2 {
+			violate(fmt.Sprintf("branch node with %d entries", entries))
+		}
+		for i, child := range n.children {
+			if child == nil {
+				continue
+			}
+			if err := t.checkCanonical(child, extendPath(path, byte(i)), violations); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func buildStorageTrie(memDB *memorydb.Database, num int) *Trie {
+	trie := NewTrie(EmptyHash, memDB)
+	for i := 0; i < num; i++ {
+		elem := newKV()
+		trie = trie.Insert(elem.k, elem.v)
+	}
+	trie.Persist()
+	return trie
+}
+
+func TestCheckStorageRoots(t *testing.T) {
+	memDB := memorydb.New()
+	accounts := NewTrie(EmptyHash, memDB)
+	storages := make([]*Trie, 0)
+	for i := 0; i < 10; i++ {
+		storage := buildStorageTrie(memDB, 20)
+		storages = append(storages, storage)
+		root := storage.StateRoot()
+		accounts = accounts.Insert([]byte{byte(i)}, root[:])
+	}
+	// account without storage
+	accounts = accounts.Insert([]byte{0xff}, EmptyHash[:])
+	accounts.Persist()
+	extract := func(key, value []byte) (common.Hash, bool) {
+		return common.BytesToHash(value), true
+	}
+
+	missing, err := CheckStorageRoots(accounts.StateRoot(), memDB, extract)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(missing))
+
+	// remove a node of the 4th storage trie
+	for k := range storages[3].log.flatten().inserted {
+		if k != storages[3].StateRoot() {
+			memDB.Delete(k[:])
+			break
+		}
+	}
+	missing, err = CheckStorageRoots(accounts.StateRoot(), memDB, extract)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(missing))
+	assert.Equal(t, []byte{0x03}, missing[0].Account)
+	assert.Equal(t, storages[3].StateRoot(), missing[0].StorageRoot)
+	assert.IsType(t, &MissingNodeError{}, missing[0].Err)
+
+	// remove the root node of account trie
+	root := accounts.StateRoot()
+	memDB.Delete(root[:])
+	_, err = CheckStorageRoots(root, memDB, extract)
+	assert.IsType(t, &MissingNodeError{}, err)
+	assert.Equal(t, root, err.(*MissingNodeError).Hash)
+}
+
+// assertCanonical check the trie have no structural violation
+func assertCanonical(t *testing.T, trie *Trie) {
+	violations, err := trie.CheckCanonical(trie.StateRoot())
+	assert.Nil(t, err)
+	assert.Equal(t, []CanonicalViolation{}, violations)
+}
+
+// logNodes insert n and all its descendants to log
+func logNodes(log *updateLog, n node) {
+	log.insert(n.Hash(), n.Encode())
+	switch n := n.(type) {
+	case *extNode:
+		logNodes(log, n.child)
+	case *branchNode:
+		for _, child := range n.children {
+			if child != nil {
+				logNodes(log, child)
+			}
+		}
+	}
+}
+
+func TestCheckCanonical(t *testing.T) {
+	memDB := memorydb.New()
+	trie := NewTrie(EmptyHash, memDB)
+	assertCanonical(t, trie)
+	live := make([]kv, 0)
+	for i := 0; i < 2000; i++ {
+		if len(live) > 0 && random.Intn(3) == 0 {
+			idx := random.Intn(len(live))
+			trie = trie.Delete(live[idx].k)
+			live = append(live[:idx], live[idx+1:]...)
+		} else {
+			elem := newKV()
+			if len(live) > 0 && random.Intn(4) == 0 {
+				// keys which are prefixes of other keys make branch targets
+				key := live[random.Intn(len(live))].k
+				elem.k = key[:1+random.Intn(len(key))]
+			}
+			trie = trie.Insert(elem.k, elem.v)
+			live = append(live, elem)
+		}
+		if i%100 == 0 {
+			assertCanonical(t, trie)
+			trie.Persist()
+			trie = NewTrie(trie.StateRoot(), memDB)
+		}
+	}
+	assertCanonical(t, trie)
+
+	value := bytes.Repeat([]byte{0x01}, 40)
+	leaf := newLeafNode([]byte{0x02}, []byte{0x01})
+	branch := branchWithChild(1, newLeafNode([]byte{0x01}, value), nil, false)
+	branch = branch.updateChild(5, branchWithTarget(value, false))
+	cases := []struct {
+		root       node
+		violations []CanonicalViolation
+	}{
+		{newExtNode([]byte{0x01}, leaf, false), []CanonicalViolation{{Path: nil, Reason: "extension node with leaf child"}}},
+		{newExtNode([]byte{0x01}, newExtNode([]byte{0x02}, branch, false), false), []CanonicalViolation{
+			{Path: nil, Reason: "extension node with extension child"},
+			{Path: []byte{0x01, 0x02, 0x05}, Reason: "branch node with 1 entries"},
+		}},
+		{newExtNode(nil, branch, false), []CanonicalViolation{
+			{Path: nil, Reason: "extension node with empty key"},
+			{Path: []byte{0x05}, Reason: "branch node with 1 entries"},
+		}},
+		{branchWithChild(3, leaf, nil, false), []CanonicalViolation{{Path: nil, Reason: "branch node with 1 entries"}}},
+	}
+	for _, c := range cases {
+		memDB := memorydb.New()
+		trie := NewTrie(EmptyHash, memDB)
+		log := newUpdateLog()
+		logNodes(log, c.root)
+		trie = trie.derive(c.root.Hash(), log)
+		violations, err := trie.CheckCanonical(trie.StateRoot())
+		assert.Nil(t, err)
+		assert.Equal(t, c.violations, violations)
+	}
+
+	_, err := NewTrie(common.BytesToHash([]byte{0x01}), memDB).CheckCanonical(common.BytesToHash([]byte{0x01}))
+	assert.NotNil(t, err)
+}
+
+// TestCheckCanonicalEveryOperation check the canonical form after every insert and
+// delete of a fixed sequence, so a violation is reported with the operation which
+// made it and fail the same way in every run
+func TestCheckCanonicalEveryOperation(t *testing.T) {
+	seeded := rand.New(rand.NewSource(1))
+	trie := NewTrie(EmptyHash, memorydb.New())
+	live := make([][]byte, 0)
+	for i := 0; i < 1000; i++ {
+		var op string
+		if len(live) > 0 && seeded.Intn(3) == 0 {
+			idx := seeded.Intn(len(live))
+			op = fmt.Sprintf("delete %x", live[idx])
+			trie = trie.Delete(live[idx])
+			live = append(live[:idx], live[idx+1:]...)
+		} else {
+			key := make([]byte, 1+seeded.Intn(4))
+			seeded.Read(key)
+			if len(live) > 0 && seeded.Intn(4) == 0 {
+				// keys which are prefixes of other keys make branch targets
+				other := live[seeded.Intn(len(live))]
+				key = other[:1+seeded.Intn(len(other))]
+			}
+			value := make([]byte, seeded.Intn(40))
+			seeded.Read(value)
+			op = fmt.Sprintf("insert %x", key)
+			trie = trie.Insert(key, value)
+			live = append(live, key)
+		}
+		violations, err := trie.CheckCanonical(trie.StateRoot())
+		assert.Nil(t, err, op)
+		assert.Equal(t, []CanonicalViolation{}, violations, op)
+	}
+}
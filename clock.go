@@ -0,0 +1,39 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import "time"
+
+// Clock is the source of time of background subsystems, e.g. Pruner, tests inject a
+// fake clock to drive them deterministically rather than sleeping
+type Clock interface {
+	Now() time.Time
+	// NewTimer create a timer which send the time on its channel once after d
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a timer created by Clock
+type Timer interface {
+	C() <-chan time.Time
+	// Stop prevent the timer from firing, and report whether it's stopped before
+	// it fired
+	Stop() bool
+}
+
+// SystemClock is the clock of the system, it's the default clock
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time { return t.Timer.C }
@@ -0,0 +1,117 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a clock advanced by tests, every timer created is sent to waits, so
+// tests know when a background goroutine is waiting
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	waits  chan time.Duration
+}
+
+type fakeTimer struct {
+	deadline time.Time
+	ch       chan time.Time
+	fired    bool
+	clock    *fakeClock
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0), waits: make(chan time.Duration, 16)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.lock.Lock()
+	timer := &fakeTimer{deadline: c.now.Add(d), ch: make(chan time.Time, 1), clock: c}
+	c.timers = append(c.timers, timer)
+	c.lock.Unlock()
+	c.waits <- d
+	return timer
+}
+
+// Advance move the clock forward by d and fire the timers due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	timers := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.deadline.After(c.now) {
+			timers = append(timers, timer)
+			continue
+		}
+		timer.fired = true
+		timer.ch <- c.now
+	}
+	c.timers = timers
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.ch }
+
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, timer := range c.timers {
+		if timer == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			break
+		}
+	}
+	return !t.fired
+}
+
+func TestPrunerFakeClock(t *testing.T) {
+	memDB := memorydb.New()
+	clock := newFakeClock()
+	pruner := NewPruner(memDB, PrunerConfig{NodesPerSecond: 2, Clock: clock})
+	scheduleRandomNodes(memDB, pruner, 5)
+	pruner.Start()
+	defer pruner.Stop()
+
+	// the initial burst is pruned, then the pruner wait for a token
+	assert.Equal(t, 500*time.Millisecond, <-clock.waits)
+	assert.Equal(t, 2, pruner.Progress().Pruned)
+	clock.Advance(499 * time.Millisecond)
+	assert.Equal(t, 2, pruner.Progress().Pruned)
+	clock.Advance(time.Millisecond)
+	assert.Equal(t, 500*time.Millisecond, <-clock.waits)
+	assert.Equal(t, 3, pruner.Progress().Pruned)
+	// the tokens refilled while waiting for a second are enough for the rest
+	clock.Advance(time.Second)
+	assert.True(t, waitPruned(pruner, time.Second))
+	assert.Equal(t, 5, pruner.Progress().Pruned)
+	assert.Equal(t, 0, len(clock.waits))
+	assert.Equal(t, 0, memDB.Len())
+}
+
+func TestFaultyStoreFakeClock(t *testing.T) {
+	clock := newFakeClock()
+	store := NewFaultyStore(memorydb.New(), FaultConfig{Latency: time.Second, Clock: clock})
+	done := make(chan struct{})
+	go func() {
+		store.Has([]byte{1})
+		close(done)
+	}()
+	assert.Equal(t, time.Second, <-clock.waits)
+	clock.Advance(time.Second)
+	<-done
+}
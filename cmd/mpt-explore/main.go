@@ -0,0 +1,401 @@
+//go:build !mptcore
+// +build !mptcore
+
+// mpt-explore is an interactive terminal explorer of tries stored in a leveldb
+// database or in pack files, for debugging. It opens the db and the packs, and walks
+// the trie of a root from its root node:
+//
+//	mpt-explore -root 0x1234... -db chaindata
+//	mpt-explore -root 0x1234... state.pack
+//
+// Nodes are addressed by their paths, the key nibbles from root, hash nodes are
+// followed by the node iterator one node at a time. Type help at the prompt for
+// commands.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/leveldb"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/lbqds/mpt"
+)
+
+const usage = `commands:
+  ls                 show the node at current path
+  cd <i>             enter child i of a branch, or the child of an extension if i is omitted
+  cd <nibbles>       enter the node at the hex nibbles relative to current path
+  cd /<nibbles>      enter the node at the hex nibbles from root
+  up                 go back to the parent node
+  get <key>          show the value of hex key
+  find <prefix> [n]  list at most n keys under hex prefix, 20 by default
+  prove <key>        show the proof of hex key, or of its absence
+  help               show this message
+  quit               exit`
+
+// position is a node and its path from root
+type position struct {
+	path []byte
+	node mpt.Node
+}
+
+// explorer keep the current node, parents are the nodes the current node was
+// entered from
+type explorer struct {
+	kvs     db.KeyValueStore
+	trie    *mpt.Trie
+	root    position
+	current position
+	parents []position
+	out     io.Writer
+}
+
+// newExplorer read the root node from kvs, the explorer start at it
+func newExplorer(kvs db.KeyValueStore, root common.Hash, out io.Writer) (*explorer, error) {
+	e := &explorer{kvs: kvs, trie: mpt.NewTrie(root, kvs), out: out}
+	n, err := e.resolve(root)
+	if err != nil {
+		return nil, err
+	}
+	e.root = position{node: n}
+	e.current = e.root
+	return e, nil
+}
+
+// run execute commands read from in until quit or EOF
+func (e *explorer) run(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	e.prompt()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && (fields[0] == "quit" || fields[0] == "exit") {
+			return
+		}
+		if len(fields) > 0 {
+			if err := e.exec(fields[0], fields[1:]); err != nil {
+				fmt.Fprintf(e.out, "error: %v\n", err)
+			}
+		}
+		e.prompt()
+	}
+}
+
+func (e *explorer) prompt() {
+	fmt.Fprintf(e.out, "/%s> ", nibblesString(e.current.path))
+}
+
+func (e *explorer) exec(cmd string, args []string) error {
+	switch cmd {
+	case "ls":
+		return e.show()
+	case "cd":
+		return e.enter(args)
+	case "up":
+		if len(e.parents) == 0 {
+			return errors.New("already at root")
+		}
+		e.current = e.parents[len(e.parents)-1]
+		e.parents = e.parents[:len(e.parents)-1]
+		return e.show()
+	case "get":
+		return e.get(args)
+	case "find":
+		return e.find(args)
+	case "prove":
+		return e.prove(args)
+	case "help":
+		fmt.Fprintln(e.out, usage)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q, type help for commands", cmd)
+	}
+}
+
+// resolve read the node of hash by the node iterator, the iteration stop at the node
+// itself, so none of its descendants are read
+func (e *explorer) resolve(hash common.Hash) (mpt.Node, error) {
+	var encoded []byte
+	err := mpt.NewTrie(hash, e.kvs).IterateNodes(mpt.PreOrder, func(_ []byte, _ common.Hash, node []byte) bool {
+		encoded = append([]byte{}, node...)
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if encoded == nil {
+		return nil, errors.New("empty trie")
+	}
+	return mpt.DecodeNode(encoded)
+}
+
+// descend return the node at nibbles under n, hash nodes on the way are resolved
+func (e *explorer) descend(n mpt.Node, nibbles []byte) (mpt.Node, error) {
+	for len(nibbles) > 0 {
+		switch v := n.(type) {
+		case mpt.Extension:
+			key := v.Key()
+			if !bytes.HasPrefix(nibbles, key) {
+				return nil, mpt.ErrNoNodeAtPath
+			}
+			n, nibbles = v.Child(), nibbles[len(key):]
+		case mpt.Branch:
+			child := v.Child(int(nibbles[0]))
+			if child == nil {
+				return nil, mpt.ErrNoNodeAtPath
+			}
+			n, nibbles = child, nibbles[1:]
+		default:
+			// nibbles go beyond leaf node
+			return nil, mpt.ErrNoNodeAtPath
+		}
+		if n.Kind() == mpt.HashKind {
+			resolved, err := e.resolve(n.Hash())
+			if err != nil {
+				return nil, err
+			}
+			n = resolved
+		}
+	}
+	return n, nil
+}
+
+func (e *explorer) show() error {
+	n := e.current.node
+	fmt.Fprintf(e.out, "%s %x, %d bytes\n", n.Kind(), n.Hash(), len(n.Encoded()))
+	switch n := n.(type) {
+	case mpt.Leaf:
+		fmt.Fprintf(e.out, "  key   %s\n", nibblesString(n.Key()))
+		fmt.Fprintf(e.out, "  value %x\n", n.Value())
+	case mpt.Extension:
+		fmt.Fprintf(e.out, "  key   %s\n", nibblesString(n.Key()))
+		fmt.Fprintf(e.out, "  child %s\n", childString(n.Child()))
+	case mpt.Branch:
+		for i := 0; i < 16; i++ {
+			if child := n.Child(i); child != nil {
+				fmt.Fprintf(e.out, "  %x %s\n", i, childString(child))
+			}
+		}
+		if target, ok := n.Target(); ok {
+			fmt.Fprintf(e.out, "  value %x\n", target)
+		}
+	}
+	return nil
+}
+
+// enter move to the node at the path of args
+func (e *explorer) enter(args []string) error {
+	from := e.current
+	var nibbles []byte
+	if len(args) == 0 {
+		ext, ok := from.node.(mpt.Extension)
+		if !ok {
+			return errors.New("not an extension node, cd to a child of branch by its index")
+		}
+		nibbles = ext.Key()
+	} else {
+		arg := args[0]
+		if strings.HasPrefix(arg, "/") {
+			from, arg = e.root, arg[1:]
+		}
+		var err error
+		if nibbles, err = parseNibbles(arg); err != nil {
+			return err
+		}
+	}
+	n, err := e.descend(from.node, nibbles)
+	if err != nil {
+		return err
+	}
+	e.parents = append(e.parents, e.current)
+	e.current = position{path: append(append([]byte{}, from.path...), nibbles...), node: n}
+	return e.show()
+}
+
+func (e *explorer) get(args []string) error {
+	key, err := parseKey(args)
+	if err != nil {
+		return err
+	}
+	value, err := e.trie.TryGet(key)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		fmt.Fprintln(e.out, "absent")
+		return nil
+	}
+	fmt.Fprintf(e.out, "%x\n", value)
+	return nil
+}
+
+func (e *explorer) find(args []string) error {
+	prefix, err := parseKey(args)
+	if err != nil {
+		return err
+	}
+	limit := 20
+	if len(args) > 1 {
+		if limit, err = strconv.Atoi(args[1]); err != nil || limit <= 0 {
+			return fmt.Errorf("invalid limit %q", args[1])
+		}
+	}
+	found := 0
+	err = e.trie.IteratePrefix(prefix, func(key, value []byte) bool {
+		if found == limit {
+			fmt.Fprintln(e.out, "...")
+			return false
+		}
+		found++
+		fmt.Fprintf(e.out, "%x %x\n", key, value)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if found == 0 {
+		fmt.Fprintln(e.out, "no keys")
+	}
+	return nil
+}
+
+func (e *explorer) prove(args []string) error {
+	key, err := parseKey(args)
+	if err != nil {
+		return err
+	}
+	value, proof, err := e.trie.GetWithProof(key)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		fmt.Fprintln(e.out, "absent, proof of absence:")
+	}
+	size := 0
+	for i, encoded := range proof {
+		n, err := mpt.DecodeNode(encoded)
+		if err != nil {
+			return err
+		}
+		size += len(encoded)
+		fmt.Fprintf(e.out, "%d %s %x, %d bytes\n", i, n.Kind(), n.Hash(), len(encoded))
+	}
+	fmt.Fprintf(e.out, "%d nodes, %d bytes\n", len(proof), size)
+	return nil
+}
+
+func parseKey(args []string) ([]byte, error) {
+	if len(args) == 0 {
+		return nil, errors.New("missing key")
+	}
+	key, err := hex.DecodeString(strings.TrimPrefix(args[0], "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex key %q", args[0])
+	}
+	return key, nil
+}
+
+// parseNibbles parse every hex digit of s as a nibble
+func parseNibbles(s string) ([]byte, error) {
+	nibbles := make([]byte, len(s))
+	for i, c := range s {
+		n, err := strconv.ParseUint(string(c), 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nibbles %q", s)
+		}
+		nibbles[i] = byte(n)
+	}
+	return nibbles, nil
+}
+
+func nibblesString(nibbles []byte) string {
+	var b strings.Builder
+	for _, n := range nibbles {
+		fmt.Fprintf(&b, "%x", n)
+	}
+	return b.String()
+}
+
+func childString(n mpt.Node) string {
+	if n.Kind() == mpt.HashKind {
+		return fmt.Sprintf("-> %x", n.Hash())
+	}
+	return fmt.Sprintf("%s (embedded)", n.Kind())
+}
+
+// openStore open the pack files as a read only store over kvs, nodes are read from
+// the packs first
+func openStore(kvs db.KeyValueStore, paths []string) (*mpt.PackedStore, error) {
+	store := mpt.NewPackedStore(kvs)
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		pack, err := mpt.OpenPack(f, info.Size())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		store.AddPack(pack)
+	}
+	return store, nil
+}
+
+func main() {
+	root := flag.String("root", "", "hex root hash of the trie")
+	dbPath := flag.String("db", "", "path of a leveldb database holding the trie, packs are read first")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s -root <hash> [-db <path>] [<pack>...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	rootBytes, err := hex.DecodeString(strings.TrimPrefix(*root, "0x"))
+	if err != nil || len(rootBytes) != common.HashLength || (*dbPath == "" && flag.NArg() == 0) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := explore(common.BytesToHash(rootBytes), *dbPath, flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// explore open the db and the packs, and run the explorer on stdin until quit
+func explore(root common.Hash, dbPath string, packs []string) error {
+	var kvs db.KeyValueStore = memorydb.New()
+	if dbPath != "" {
+		ldb, err := leveldb.New(dbPath, 0, 0, "")
+		if err != nil {
+			return fmt.Errorf("%s: %v", dbPath, err)
+		}
+		defer ldb.Close()
+		kvs = ldb
+	}
+	store, err := openStore(kvs, packs)
+	if err != nil {
+		return err
+	}
+	e, err := newExplorer(store, root, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if err := e.show(); err != nil {
+		return err
+	}
+	e.run(os.Stdin)
+	return nil
+}
@@ -0,0 +1,120 @@
+//go:build !mptcore
+// +build !mptcore
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/leveldb"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/lbqds/mpt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplorer(t *testing.T) {
+	memDB := memorydb.New()
+	trie := mpt.NewTrie(mpt.EmptyHash, memDB)
+	for i := 0; i < 100; i++ {
+		trie = trie.Insert(mpt.CompositeKey([]byte{0x12}, mpt.Uint64Key(uint64(i))), bytes.Repeat([]byte{0xab}, 40))
+	}
+	trie = trie.Insert([]byte{0x34}, []byte{0xcd})
+	trie.Persist()
+	root := trie.StateRoot()
+
+	dir, err := ioutil.TempDir("", "mpt-explore")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.pack")
+	f, err := os.Create(path)
+	assert.Nil(t, err)
+	_, err = mpt.WritePack(f, memDB, root)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	store, err := openStore(memorydb.New(), []string{path})
+	assert.Nil(t, err)
+
+	run := func(script string) string {
+		var out bytes.Buffer
+		e, err := newExplorer(store, root, &out)
+		assert.Nil(t, err)
+		e.run(strings.NewReader(script))
+		return out.String()
+	}
+	out := run("ls\n")
+	assert.Contains(t, out, "branch")
+	assert.Contains(t, out, "  1 -> ")
+	assert.Contains(t, out, "  3 leaf (embedded)")
+
+	// embedded leaves are entered by path as well
+	out = run("cd 3\nls\nup\n")
+	assert.Contains(t, out, "/3> ")
+	assert.Contains(t, out, "  value cd")
+
+	out = run("cd 1\ncd\n")
+	assert.Contains(t, out, "/1> ")
+	assert.NotContains(t, out, "error")
+	out = run("cd 1\ncd 5\n")
+	assert.Contains(t, out, "error:")
+	out = run("cd /12\nup\nup\n")
+	assert.Contains(t, out, "error: already at root")
+
+	out = run("get 34\nget 35\n")
+	assert.Contains(t, out, "cd\n")
+	assert.Contains(t, out, "absent")
+
+	out = run("find 12 3\nfind 56\n")
+	assert.Equal(t, 1, strings.Count(out, "..."))
+	assert.Contains(t, out, "no keys")
+
+	key := mpt.CompositeKey([]byte{0x12}, mpt.Uint64Key(7))
+	depth, err := trie.PathDepth(key)
+	assert.Nil(t, err)
+	out = run("prove " + hex.EncodeToString(key) + "\n")
+	assert.Contains(t, out, "0 branch")
+	assert.Equal(t, depth, strings.Count(out, " bytes\n")-1)
+	out = run("prove 35\n")
+	assert.Contains(t, out, "absent")
+	assert.Contains(t, out, "0 branch")
+
+	out = run("bogus\nhelp\nquit\nls\n")
+	assert.Contains(t, out, "unknown command")
+	assert.Contains(t, out, "commands:")
+	// commands after quit are not executed
+	assert.NotContains(t, out, "bytes")
+}
+
+func TestExplorerDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mpt-explore")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	ldb, err := leveldb.New(filepath.Join(dir, "chaindata"), 0, 0, "")
+	assert.Nil(t, err)
+	defer ldb.Close()
+
+	trie := mpt.NewTrie(mpt.EmptyHash, ldb)
+	for i := 0; i < 100; i++ {
+		trie = trie.Insert(mpt.Uint64Key(uint64(i)), bytes.Repeat([]byte{0xab}, 40))
+	}
+	trie.Persist()
+	store, err := openStore(ldb, nil)
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	e, err := newExplorer(store, trie.StateRoot(), &out)
+	assert.Nil(t, err)
+	e.run(strings.NewReader("ls\ncd 0000000000000006\nup\ncd /0000000000000006\nget 0000000000000006\nprove 0000000000000006\n"))
+	assert.NotContains(t, out.String(), "error")
+	assert.Equal(t, 4, strings.Count(out.String(), "/0000000000000006> "))
+	assert.Contains(t, out.String(), "  value "+strings.Repeat("ab", 40))
+
+	_, err = newExplorer(store, common.HexToHash("0x01"), &out)
+	assert.NotNil(t, err)
+}
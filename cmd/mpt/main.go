@@ -0,0 +1,200 @@
+//go:build !mptcore
+// +build !mptcore
+
+// mpt is a command line tool for tries stored in pack files. The diff command
+// summarize the changes between the tries of two roots:
+//
+//	mpt diff [-json] [-n 20] 0x1234... 0x5678... state.pack
+//
+// The roots may be in the same or different packs, all packs are opened as one store.
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/lbqds/mpt"
+)
+
+const usage = `usage: %s <command> [arguments]
+
+commands:
+  diff [-json] [-n N] <rootA> <rootB> <pack>...   summarize changes from rootA to rootB
+`
+
+// Change is a key whose value differ between the roots
+type Change struct {
+	Key      string `json:"key"`
+	Kind     string `json:"kind"`
+	Value    string `json:"value,omitempty"`
+	Previous string `json:"previous,omitempty"`
+}
+
+// Report is the summary of the changes from root From to root To, Bytes* count the
+// sizes of keys and values, a modified key count its new value as added and its old
+// value as removed. Changes list at most the limit of changes in key order
+type Report struct {
+	From         common.Hash `json:"from"`
+	To           common.Hash `json:"to"`
+	Added        int         `json:"added"`
+	Removed      int         `json:"removed"`
+	Modified     int         `json:"modified"`
+	BytesAdded   int         `json:"bytesAdded"`
+	BytesRemoved int         `json:"bytesRemoved"`
+	Changes      []Change    `json:"changes"`
+	Truncated    bool        `json:"truncated"`
+}
+
+// diff return the report of the changes from the trie of from to the trie of to,
+// listing at most limit changes
+func diff(store *mpt.PackedStore, from, to common.Hash, limit int) (*Report, error) {
+	report := &Report{From: from, To: to, Changes: make([]Change, 0)}
+	fromTrie, toTrie := mpt.NewTrie(from, store), mpt.NewTrie(to, store)
+	err := fromTrie.Diff(toTrie, func(key, value, prev []byte) {
+		change := Change{Key: hex.EncodeToString(key), Value: hex.EncodeToString(value), Previous: hex.EncodeToString(prev)}
+		switch {
+		case prev == nil:
+			change.Kind = "added"
+			report.Added++
+			report.BytesAdded += len(key) + len(value)
+		case value == nil:
+			change.Kind = "removed"
+			report.Removed++
+			report.BytesRemoved += len(key) + len(prev)
+		default:
+			change.Kind = "modified"
+			report.Modified++
+			report.BytesAdded += len(value)
+			report.BytesRemoved += len(prev)
+		}
+		if len(report.Changes) < limit {
+			report.Changes = append(report.Changes, change)
+		} else {
+			report.Truncated = true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// writeText write the report for humans, changes are prefixed by +, - and ~
+func writeText(w io.Writer, r *Report) {
+	fmt.Fprintf(w, "from %s\nto   %s\n", r.From.Hex(), r.To.Hex())
+	for _, change := range r.Changes {
+		switch change.Kind {
+		case "added":
+			fmt.Fprintf(w, "+ %s = %s\n", change.Key, change.Value)
+		case "removed":
+			fmt.Fprintf(w, "- %s = %s\n", change.Key, change.Previous)
+		default:
+			fmt.Fprintf(w, "~ %s = %s -> %s\n", change.Key, change.Previous, change.Value)
+		}
+	}
+	if r.Truncated {
+		fmt.Fprintf(w, "... %d more\n", r.Added+r.Removed+r.Modified-len(r.Changes))
+	}
+	fmt.Fprintf(w, "%d added, %d removed, %d modified, +%d -%d bytes\n",
+		r.Added, r.Removed, r.Modified, r.BytesAdded, r.BytesRemoved)
+}
+
+// runDiff execute the diff command with its arguments, and return the exit code
+func runDiff(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	asJSON := flags.Bool("json", false, "write the report as JSON")
+	limit := flags.Int("n", 20, "list at most n changes, the counts cover all of them")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: diff [-json] [-n N] <rootA> <rootB> <pack>...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() < 3 {
+		flags.Usage()
+		return 2
+	}
+	from, err := parseRoot(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	to, err := parseRoot(flags.Arg(1))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	store, err := openStore(flags.Args()[2:])
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	report, err := diff(store, from, to, *limit)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		return 0
+	}
+	writeText(stdout, report)
+	return 0
+}
+
+func parseRoot(s string) (common.Hash, error) {
+	root, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil || len(root) != common.HashLength {
+		return common.Hash{}, fmt.Errorf("invalid root %q", s)
+	}
+	return common.BytesToHash(root), nil
+}
+
+// openStore open the pack files as a read only store
+func openStore(paths []string) (*mpt.PackedStore, error) {
+	store := mpt.NewPackedStore(memorydb.New())
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		pack, err := mpt.OpenPack(f, info.Size())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		store.AddPack(pack)
+	}
+	return store, nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "diff":
+		os.Exit(runDiff(os.Args[2:], os.Stdout, os.Stderr))
+	default:
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,65 @@
+//go:build !mptcore
+// +build !mptcore
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/lbqds/mpt"
+	"github.com/stretchr/testify/assert"
+)
+
+// writePack write the trie of kvs to a pack file in dir and return its root
+func writePack(t *testing.T, dir, name string, kvs map[string]string) common.Hash {
+	memDB := memorydb.New()
+	trie := mpt.NewTrie(mpt.EmptyHash, memDB)
+	for k, v := range kvs {
+		trie = trie.Insert([]byte(k), []byte(v))
+	}
+	trie.Persist()
+	f, err := os.Create(filepath.Join(dir, name))
+	assert.Nil(t, err)
+	_, err = mpt.WritePack(f, memDB, trie.StateRoot())
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	return trie.StateRoot()
+}
+
+func TestDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mpt-diff")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	from := writePack(t, dir, "a.pack", map[string]string{"a": "1", "b": "22", "c": "333"})
+	to := writePack(t, dir, "b.pack", map[string]string{"a": "1", "b": "4", "d": "55"})
+	packs := []string{filepath.Join(dir, "a.pack"), filepath.Join(dir, "b.pack")}
+
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, 0, runDiff(append([]string{from.Hex(), to.Hex()}, packs...), &stdout, &stderr))
+	assert.Equal(t, "from "+from.Hex()+"\nto   "+to.Hex()+"\n"+
+		"~ 62 = 3232 -> 34\n"+
+		"- 63 = 333333\n"+
+		"+ 64 = 3535\n"+
+		"1 added, 1 removed, 1 modified, +4 -6 bytes\n", stdout.String())
+
+	stdout.Reset()
+	assert.Equal(t, 0, runDiff(append([]string{"-json", "-n", "1", from.Hex(), to.Hex()}, packs...), &stdout, &stderr))
+	var report Report
+	assert.Nil(t, json.Unmarshal(stdout.Bytes(), &report))
+	assert.Equal(t, Report{
+		From: from, To: to, Added: 1, Removed: 1, Modified: 1, BytesAdded: 4, BytesRemoved: 6,
+		Changes:   []Change{{Key: "62", Kind: "modified", Value: "34", Previous: "3232"}},
+		Truncated: true,
+	}, report)
+
+	// the nodes of rootB are missing without its pack
+	assert.Equal(t, 1, runDiff([]string{from.Hex(), to.Hex(), packs[0]}, &stdout, &stderr))
+	assert.Equal(t, 2, runDiff([]string{"0x12", to.Hex(), packs[0]}, &stdout, &stderr))
+}
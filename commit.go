@@ -0,0 +1,264 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+)
+
+// ErrSyncUnsupported is returned by commits with WithSync if underlying db can't sync
+var ErrSyncUnsupported = errors.New("db doesn't support sync")
+
+// Syncer is implemented by dbs which can flush written data to stable storage, e.g.
+// by fsync of the write ahead log
+type Syncer interface {
+	Sync() error
+}
+
+// CommitOption control the durability of Commit and DeleteQueue.Flush
+type CommitOption func(*commitConfig)
+
+type commitConfig struct {
+	sync     bool
+	deferred *DeleteQueue
+}
+
+// WithSync sync underlying db after the batch of the commit is written, so the
+// commit survive a power loss once it returns, at the cost of the latency of a sync
+func WithSync() CommitOption {
+	return func(c *commitConfig) {
+		c.sync = true
+	}
+}
+
+// WithDeferredDelete queue deleted nodes to q rather than deleting them in the batch
+// of the commit, the commit only write new nodes and the deletes are written by a
+// later q.Flush, e.g. in an idle period
+func WithDeferredDelete(q *DeleteQueue) CommitOption {
+	return func(c *commitConfig) {
+		c.deferred = q
+	}
+}
+
+// Commit persist all logs to underlying db like Persist with durability control of
+// opts, errors of writing and syncing underlying db are returned. WithSync fail
+// with ErrSyncUnsupported before anything is written if underlying db can't sync
+func (t *Trie) Commit(opts ...CommitOption) (report *CommitReport, err error) {
+	t, done := t.measure(OpCommit)
+	defer func() { done(err) }()
+	c := &commitConfig{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	syncer, err := c.syncer(t.db)
+	if err != nil {
+		return nil, err
+	}
+	changes := t.log.flatten()
+	if c.deferred != nil {
+		c.deferred.cancel(changes.inserted)
+	}
+	batch := t.db.NewBatch()
+	report, err = t.commitTo(batch, changes, BatchOptions{}, c.deferred == nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := batch.Write(); err != nil {
+		return nil, err
+	}
+	report.Written()
+	if c.deferred != nil {
+		c.deferred.add(changes.deleted)
+	}
+	if syncer != nil {
+		if err := syncer.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// BatchOptions compose the commit of CommitToBatchOrdered with other writes of the
+// batch, so trie nodes, application data and the root pointer commit atomically
+type BatchOptions struct {
+	// Before is called with the batch before nodes are written, e.g. to write
+	// application data
+	Before func(batch db.Batch) error
+	// After is called with the batch after nodes are written, e.g. to write the
+	// pointer to the new root
+	After func(batch db.Batch) error
+	// Inspect receive every write of the commit, nodes and the schema descriptor of
+	// WithSchema, in the order it's written to the batch, e.g. to mirror the commit
+	// to another db or to check it in tests
+	Inspect db.KeyValueWriter
+}
+
+// CommitToBatchOrdered write all logs to batch like CommitToBatch, surrounded by the
+// writes of hooks: writes of Before, inserted nodes in ascending order of hash,
+// deleted nodes in ascending order of hash, then writes of After. So the same
+// changes always produce the same batch, and a replay of the batch is the same on
+// every node. Errors of the hooks and the batch abort the commit, the batch is
+// never written by it, call Written on the report once the batch is written
+func (t *Trie) CommitToBatchOrdered(batch db.Batch, opts BatchOptions) (*CommitReport, error) {
+	return t.commitTo(batch, t.log.flatten(), opts, true)
+}
+
+// commitTo write changes to batch: writes of opts.Before, inserted nodes in
+// ascending order of hash, deleted nodes in ascending order of hash unless deletes
+// is false, then writes of opts.After. It's the commit shared by Commit,
+// CommitToBatch and CommitToBatchOrdered, errors abort it, and the report is
+// delivered by its Written once the batch is written
+func (t *Trie) commitTo(batch db.Batch, changes *logLayer, opts BatchOptions, deletes bool) (*CommitReport, error) {
+	var w db.KeyValueWriter = batch
+	if opts.Inspect != nil {
+		w = &teeWriter{batch, opts.Inspect}
+	}
+	if opts.Before != nil {
+		if err := opts.Before(batch); err != nil {
+			return nil, err
+		}
+	}
+	existing, err := t.putNodes(w, changes)
+	if err != nil {
+		return nil, err
+	}
+	if deletes {
+		for _, k := range sortedHashes(changes.deleted) {
+			if err := w.Delete(nodeKey(k)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if opts.After != nil {
+		if err := opts.After(batch); err != nil {
+			return nil, err
+		}
+	}
+	return t.commitReport(changes, existing), nil
+}
+
+// teeWriter write to both writers
+type teeWriter struct {
+	db.KeyValueWriter
+	tee db.KeyValueWriter
+}
+
+func (w *teeWriter) Put(key []byte, value []byte) error {
+	if err := w.KeyValueWriter.Put(key, value); err != nil {
+		return err
+	}
+	return w.tee.Put(key, value)
+}
+
+func (w *teeWriter) Delete(key []byte) error {
+	if err := w.KeyValueWriter.Delete(key); err != nil {
+		return err
+	}
+	return w.tee.Delete(key)
+}
+
+// sortedHashes return the keys of m in ascending order
+func sortedHashes(m map[common.Hash][]byte) []common.Hash {
+	hashes := make([]common.Hash, 0, len(m))
+	for k := range m {
+		hashes = append(hashes, k)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+	return hashes
+}
+
+// syncer return underlying db as a Syncer if WithSync is set, nil otherwise.
+// ErrSyncUnsupported is returned if the db can't sync, so commits fail before
+// anything is written rather than after
+func (c *commitConfig) syncer(kvs db.KeyValueStore) (Syncer, error) {
+	if !c.sync {
+		return nil, nil
+	}
+	syncer, ok := kvs.(Syncer)
+	if !ok {
+		return nil, ErrSyncUnsupported
+	}
+	return syncer, nil
+}
+
+// DeleteQueue hold node deletes deferred by commits with WithDeferredDelete until
+// Flush. Nodes inserted by later commits with the queue are removed from it, so a
+// node recreated after being deferred is never deleted, commits of the same db
+// should all use the queue until it's flushed. The queue is in memory, deletes not
+// flushed before a crash are leaked in underlying db, but tries remain intact
+type DeleteQueue struct {
+	db      db.KeyValueStore
+	lock    sync.Mutex
+	pending map[common.Hash]struct{}
+}
+
+// NewDeleteQueue create an empty queue of deletes of kvs
+func NewDeleteQueue(kvs db.KeyValueStore) *DeleteQueue {
+	return &DeleteQueue{
+		db:      kvs,
+		pending: make(map[common.Hash]struct{}),
+	}
+}
+
+func (q *DeleteQueue) add(hashes map[common.Hash][]byte) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for hash := range hashes {
+		q.pending[hash] = struct{}{}
+	}
+}
+
+func (q *DeleteQueue) cancel(hashes map[common.Hash][]byte) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for hash := range hashes {
+		delete(q.pending, hash)
+	}
+}
+
+// Len return the number of pending deletes
+func (q *DeleteQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.pending)
+}
+
+// Flush delete all pending nodes from underlying db in one batch, and return the
+// number of deleted nodes, WithSync is the only option applied. Pending deletes are
+// kept if the batch can't be written
+func (q *DeleteQueue) Flush(opts ...CommitOption) (int, error) {
+	c := &commitConfig{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	syncer, err := c.syncer(q.db)
+	if err != nil {
+		return 0, err
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	batch := q.db.NewBatch()
+	for hash := range q.pending {
+		batch.Delete(nodeKey(hash))
+	}
+	if err := batch.Write(); err != nil {
+		return 0, err
+	}
+	n := len(q.pending)
+	q.pending = make(map[common.Hash]struct{})
+	if syncer != nil {
+		if err := syncer.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
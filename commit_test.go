@@ -0,0 +1,294 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+// syncingDB count syncs, and fail them with err if it isn't nil
+type syncingDB struct {
+	*memorydb.Database
+	syncs int
+	err   error
+}
+
+func (db *syncingDB) Sync() error {
+	db.syncs++
+	return db.err
+}
+
+func TestCommitSync(t *testing.T) {
+	memDB := memorydb.New()
+	trie := NewTrie(EmptyHash, memDB)
+	for _, elem := range uniqueKVs(10) {
+		trie = trie.Insert(elem.k, elem.v)
+	}
+	_, err := trie.Commit(WithSync())
+	assert.Equal(t, ErrSyncUnsupported, err)
+	// nothing is written if the db can't sync
+	assert.Equal(t, 0, memDB.Len())
+	assert.True(t, NewTrie(trie.StateRoot(), memDB).Stale())
+
+	syncing := &syncingDB{Database: memorydb.New()}
+	trie = NewTrie(EmptyHash, syncing)
+	for _, elem := range uniqueKVs(10) {
+		trie = trie.Insert(elem.k, elem.v)
+	}
+	report, err := trie.Commit()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, syncing.syncs)
+	assert.Equal(t, syncing.Len(), report.NodesWritten)
+	_, err = trie.Commit(WithSync())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, syncing.syncs)
+	syncing.err = errors.New("sync failed")
+	_, err = trie.Commit(WithSync())
+	assert.Equal(t, syncing.err, err)
+}
+
+func TestDeferredDelete(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 200)
+	queue := NewDeleteQueue(memDB)
+	lenBefore := memDB.Len()
+	// the same commits without deferring deletes
+	immediateDB := memorydb.New()
+	it := memDB.NewIterator(nil, nil)
+	for it.Next() {
+		assert.Nil(t, immediateDB.Put(it.Key(), it.Value()))
+	}
+	it.Release()
+
+	deleted := trie
+	for _, elem := range kvs[:100] {
+		deleted = deleted.Delete(elem.k)
+	}
+	report, err := deleted.Commit(WithDeferredDelete(queue))
+	assert.Nil(t, err)
+	immediate := NewTrie(deleted.StateRoot(), immediateDB)
+	immediate.log = deleted.log
+	immediate.Persist()
+	assert.True(t, report.NodesDeleted > 0)
+	// deletes of nodes created and deleted before the commit are queued as well
+	assert.True(t, queue.Len() >= report.NodesDeleted)
+	// nodes of the old root are kept until flush
+	assert.Equal(t, lenBefore+report.NodesWritten, memDB.Len())
+	assert.Nil(t, checkSubtree(memDB, trie.StateRoot(), make(map[common.Hash]struct{})))
+
+	// recreated nodes are removed from the queue
+	restored := NewTrie(deleted.StateRoot(), memDB)
+	for _, elem := range kvs[:100] {
+		restored = restored.Insert(elem.k, elem.v)
+	}
+	assert.Equal(t, trie.StateRoot(), restored.StateRoot())
+	_, err = restored.Commit(WithDeferredDelete(queue))
+	assert.Nil(t, err)
+	immediate = NewTrie(restored.StateRoot(), immediateDB)
+	immediate.log = restored.log
+	immediate.Persist()
+
+	pending := queue.Len()
+	n, err := queue.Flush()
+	assert.Nil(t, err)
+	assert.Equal(t, pending, n)
+	assert.Equal(t, 0, queue.Len())
+	assert.Equal(t, immediateDB.Len(), memDB.Len())
+	assert.Nil(t, checkSubtree(memDB, trie.StateRoot(), make(map[common.Hash]struct{})))
+
+	// flush with sync
+	syncing := &syncingDB{Database: memDB}
+	queue = NewDeleteQueue(syncing)
+	n, err = queue.Flush(WithSync())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, 1, syncing.syncs)
+}
+
+// writeRecorder record writes in order, value is nil for deletes
+type writeRecorder struct {
+	writes []kv
+}
+
+func (r *writeRecorder) Put(key []byte, value []byte) error {
+	r.writes = append(r.writes, kv{common.CopyBytes(key), common.CopyBytes(value)})
+	return nil
+}
+
+func (r *writeRecorder) Delete(key []byte) error {
+	r.writes = append(r.writes, kv{common.CopyBytes(key), nil})
+	return nil
+}
+
+func TestCommitToBatchOrdered(t *testing.T) {
+	kvs := uniqueKVs(100)
+	commit := func() (*memorydb.Database, db.Batch, *writeRecorder) {
+		memDB := memorydb.New()
+		trie := NewTrie(EmptyHash, memDB)
+		for _, elem := range kvs {
+			trie = trie.Insert(elem.k, elem.v)
+		}
+		trie.Persist()
+		trie = NewTrie(trie.StateRoot(), memDB)
+		for _, elem := range kvs[:30] {
+			trie = trie.Delete(elem.k)
+		}
+		inspected := &writeRecorder{}
+		batch := memDB.NewBatch()
+		report, err := trie.CommitToBatchOrdered(batch, BatchOptions{
+			Before: func(batch db.Batch) error {
+				return batch.Put([]byte("app"), []byte("data"))
+			},
+			After: func(batch db.Batch) error {
+				return batch.Put([]byte("root"), trie.StateRoot().Bytes())
+			},
+			Inspect: inspected,
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, trie.StateRoot(), report.Root)
+		return memDB, batch, inspected
+	}
+	memDB, batch, inspected := commit()
+	_, otherBatch, otherInspected := commit()
+
+	replayed := &writeRecorder{}
+	assert.Nil(t, batch.Replay(replayed))
+	other := &writeRecorder{}
+	assert.Nil(t, otherBatch.Replay(other))
+	// the same changes produce the same batch
+	assert.Equal(t, replayed.writes, other.writes)
+	assert.Equal(t, inspected.writes, otherInspected.writes)
+	n := len(replayed.writes)
+	assert.Equal(t, []byte("app"), replayed.writes[0].k)
+	assert.Equal(t, []byte("root"), replayed.writes[n-1].k)
+	assert.Equal(t, replayed.writes[1:n-1], inspected.writes)
+	// puts before deletes, both in ascending order
+	for i := 1; i < len(inspected.writes); i++ {
+		prev, cur := inspected.writes[i-1], inspected.writes[i]
+		if (prev.v == nil) == (cur.v == nil) {
+			assert.True(t, bytes.Compare(prev.k, cur.k) < 0)
+		} else {
+			assert.NotNil(t, prev.v)
+		}
+	}
+
+	assert.Nil(t, batch.Write())
+	root, err := memDB.Get([]byte("root"))
+	assert.Nil(t, err)
+	reader := NewTrie(common.BytesToHash(root), memDB)
+	for i, elem := range kvs {
+		if i < 30 {
+			assert.Nil(t, reader.Get(elem.k))
+		} else {
+			assert.Equal(t, elem.v, reader.Get(elem.k))
+		}
+	}
+
+	// errors of hooks abort the commit
+	trie := NewTrie(EmptyHash, memorydb.New()).Insert([]byte{1}, []byte{1})
+	hookErr := errors.New("hook")
+	_, err = trie.CommitToBatchOrdered(memDB.NewBatch(), BatchOptions{
+		After: func(db.Batch) error { return hookErr },
+	})
+	assert.Equal(t, hookErr, err)
+}
+
+func TestCommitToBatchDeterministic(t *testing.T) {
+	kvs := uniqueKVs(200)
+	commit := func() []kv {
+		memDB := memorydb.New()
+		trie := NewTrie(EmptyHash, memDB)
+		for _, elem := range kvs {
+			trie = trie.Insert(elem.k, elem.v)
+		}
+		trie.Persist()
+		trie = NewTrie(trie.StateRoot(), memDB)
+		for _, elem := range kvs[:50] {
+			trie = trie.Delete(elem.k)
+		}
+		for _, elem := range kvs[50:80] {
+			trie = trie.Insert(elem.k, append(common.CopyBytes(elem.v), 1))
+		}
+		batch := memDB.NewBatch()
+		trie.CommitToBatch(batch)
+		recorder := &writeRecorder{}
+		assert.Nil(t, batch.Replay(recorder))
+		return recorder.writes
+	}
+	writes := commit()
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, writes, commit())
+	}
+	for i := 1; i < len(writes); i++ {
+		prev, cur := writes[i-1], writes[i]
+		if (prev.v == nil) == (cur.v == nil) {
+			assert.True(t, bytes.Compare(prev.k, cur.k) < 0)
+		} else {
+			assert.NotNil(t, prev.v)
+		}
+	}
+}
+
+// rejectingDB hand out batches which reject every put after the first puts
+type rejectingDB struct {
+	*memorydb.Database
+	puts int
+}
+
+func (d *rejectingDB) NewBatch() db.Batch {
+	return &rejectingBatch{Batch: d.Database.NewBatch(), puts: d.puts}
+}
+
+// rejectingBatch reject every put once puts is 0
+type rejectingBatch struct {
+	db.Batch
+	puts int
+}
+
+func (b *rejectingBatch) Put(key, value []byte) error {
+	if b.puts == 0 {
+		return errWriteFailed
+	}
+	b.puts--
+	return b.Batch.Put(key, value)
+}
+
+func TestCommitToBatchFailedPut(t *testing.T) {
+	memDB := memorydb.New()
+	rejecting := &rejectingDB{Database: memDB, puts: 2}
+	kvs := uniqueKVs(50)
+	trie := NewTrie(EmptyHash, rejecting)
+	for _, elem := range kvs {
+		trie = trie.Insert(elem.k, elem.v)
+	}
+
+	_, err := trie.CommitToBatchOrdered(rejecting.NewBatch(), BatchOptions{})
+	assert.Equal(t, errWriteFailed, err)
+	assert.PanicsWithValue(t, errWriteFailed, func() { trie.CommitToBatch(rejecting.NewBatch()) })
+	_, err = trie.Commit()
+	assert.Equal(t, errWriteFailed, err)
+	// batches holding the first puts are never written
+	assert.PanicsWithValue(t, errWriteFailed, func() { trie.Persist() })
+	e := NewExpiryTrie(trie, NewTrie(EmptyHash, rejecting))
+	assert.PanicsWithValue(t, errWriteFailed, func() { e.Persist() })
+	assert.Equal(t, 0, memDB.Len())
+	assert.Equal(t, uint64(0), trie.CommitSeq())
+
+	// nothing of the trie is lost, it's committed once puts succeed
+	rejecting.puts = -1
+	report, err := trie.Commit()
+	assert.Nil(t, err)
+	assert.Equal(t, trie.StateRoot(), report.Root)
+	trie = NewTrie(trie.StateRoot(), memDB)
+	for _, elem := range kvs {
+		assert.Equal(t, elem.v, trie.Get(elem.k))
+	}
+}
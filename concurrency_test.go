@@ -0,0 +1,232 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+// tests in this file run goroutines on shared and forked tries, run them with
+// `go test -race -run Concurrent` to check the thread safety
+
+const (
+	concurrentWorkers = 8
+	concurrentKeys    = 200
+)
+
+// uniqueKVs return num random kvs with distinct keys
+func uniqueKVs(num int) []kv {
+	kvs := make([]kv, 0, num)
+	keys := make(map[string]struct{}, num)
+	for len(kvs) < num {
+		elem := newKV()
+		if _, ok := keys[string(elem.k)]; ok {
+			continue
+		}
+		keys[string(elem.k)] = struct{}{}
+		kvs = append(kvs, elem)
+	}
+	return kvs
+}
+
+func persistedTrie(memDB *memorydb.Database, num int) (*Trie, []kv) {
+	trie := NewTrie(EmptyHash, memDB)
+	kvs := uniqueKVs(num)
+	for _, elem := range kvs {
+		trie = trie.Insert(elem.k, elem.v)
+	}
+	trie.Persist()
+	return NewTrie(trie.StateRoot(), memDB), kvs
+}
+
+// runWorkers run fn in workers goroutines, and wait until all of them finished
+func runWorkers(workers int, fn func(worker int)) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			fn(worker)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// checkIterate check trie contains exactly kvs, and keys are in order
+func checkIterate(t *testing.T, trie *Trie, expected map[string][]byte) {
+	count := 0
+	var last []byte
+	err := trie.Iterate(func(key, value []byte) bool {
+		assert.True(t, last == nil || bytes.Compare(last, key) < 0)
+		assert.Equal(t, expected[string(key)], value)
+		last = key
+		count++
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, len(expected), count)
+}
+
+func kvMap(kvs []kv) map[string][]byte {
+	m := make(map[string][]byte, len(kvs))
+	for _, elem := range kvs {
+		m[string(elem.k)] = elem.v
+	}
+	return m
+}
+
+// TestConcurrentGetAndIterate read a trie with cold cache from many goroutines
+func TestConcurrentGetAndIterate(t *testing.T) {
+	trie, kvs := persistedTrie(memorydb.New(), concurrentKeys)
+	expected := kvMap(kvs)
+	runWorkers(concurrentWorkers, func(worker int) {
+		if worker%2 == 0 {
+			checkIterate(t, trie, expected)
+			return
+		}
+		for i := range kvs {
+			elem := kvs[(i+worker*17)%len(kvs)]
+			assert.Equal(t, expected[string(elem.k)], trie.Get(elem.k))
+		}
+	})
+}
+
+// TestConcurrentForks fork a shared trie in many goroutines, every fork insert,
+// delete, iterate and persist, while other goroutines read the shared trie
+func TestConcurrentForks(t *testing.T) {
+	memDB := memorydb.New()
+	base, kvs := persistedTrie(memDB, concurrentKeys)
+	baseRoot := base.StateRoot()
+	expected := kvMap(kvs)
+	// deletes are deferred, otherwise persisting a fork will remove nodes of others
+	pruner := NewPruner(memDB, PrunerConfig{})
+	var recorded bytes.Buffer
+	base = NewTrie(baseRoot, memDB, WithOpRecorder(&recorded))
+
+	forks := make([]*Trie, concurrentWorkers)
+	forkKVs := make([]map[string][]byte, concurrentWorkers)
+	// random source is not thread safe, so generate inserted kvs in advance
+	inserted := make([][]kv, concurrentWorkers)
+	for i := range inserted {
+		for j := 0; j < 50; j++ {
+			inserted[i] = append(inserted[i], newKV())
+		}
+	}
+	runWorkers(concurrentWorkers*2, func(worker int) {
+		if worker >= concurrentWorkers {
+			// reader of the shared trie
+			for _, elem := range kvs {
+				assert.Equal(t, expected[string(elem.k)], base.Get(elem.k))
+			}
+			checkIterate(t, base, expected)
+			return
+		}
+		fork := base
+		own := kvMap(kvs)
+		for _, elem := range inserted[worker] {
+			fork = fork.Insert(elem.k, elem.v)
+			own[string(elem.k)] = elem.v
+		}
+		for _, elem := range kvs[worker*10 : worker*10+10] {
+			fork = fork.Delete(elem.k)
+			delete(own, string(elem.k))
+		}
+		checkIterate(t, fork, own)
+		fork.PersistWithPruner(pruner)
+		forks[worker] = fork
+		forkKVs[worker] = own
+	})
+
+	// the shared trie is unchanged
+	assert.Equal(t, baseRoot, base.StateRoot())
+	checkIterate(t, NewTrie(baseRoot, memDB), expected)
+	for i, fork := range forks {
+		checkIterate(t, NewTrie(fork.StateRoot(), memDB), forkKVs[i])
+	}
+	// every fork recorded 60 operations
+	assert.Equal(t, concurrentWorkers*60, bytes.Count(recorded.Bytes(), []byte("\n")))
+}
+
+// TestConcurrentTrimCache read a trie while another goroutine evict the cache
+func TestConcurrentTrimCache(t *testing.T) {
+	trie, kvs := persistedTrie(memorydb.New(), concurrentKeys)
+	expected := kvMap(kvs)
+	runWorkers(concurrentWorkers, func(worker int) {
+		if worker == 0 {
+			for i := 0; i < 100; i++ {
+				trie.TrimCache(trie.CacheSize() / 2)
+			}
+			trie.EvictClean()
+			return
+		}
+		for _, elem := range kvs {
+			assert.Equal(t, expected[string(elem.k)], trie.Get(elem.k))
+		}
+	})
+}
+
+// TestConcurrentIterateWhileForkCommits iterate a trie while a fork of it insert,
+// delete and commit, with deletes deferred until the iterations are done
+func TestConcurrentIterateWhileForkCommits(t *testing.T) {
+	memDB := memorydb.New()
+	base, kvs := persistedTrie(memDB, concurrentKeys)
+	expected := kvMap(kvs)
+	queue := NewDeleteQueue(memDB)
+	inserted := uniqueKVs(100)
+	runWorkers(concurrentWorkers, func(worker int) {
+		if worker > 0 {
+			for i := 0; i < 5; i++ {
+				checkIterate(t, base, expected)
+			}
+			return
+		}
+		fork := base
+		for i, elem := range inserted {
+			fork = fork.Insert(elem.k, elem.v)
+			fork = fork.Delete(kvs[i].k)
+			if i%10 == 9 {
+				_, err := fork.Commit(WithDeferredDelete(queue))
+				assert.Nil(t, err)
+			}
+		}
+	})
+	checkIterate(t, base, expected)
+	n, err := queue.Flush()
+	assert.Nil(t, err)
+	assert.True(t, n > 0)
+}
+
+// TestConcurrentIterateWhileForkPersists iterate a trie while a fork of it persist,
+// the iteration may fail since nodes are deleted, but never visit wrong key values
+func TestConcurrentIterateWhileForkPersists(t *testing.T) {
+	memDB := memorydb.New()
+	base, kvs := persistedTrie(memDB, concurrentKeys)
+	expected := kvMap(kvs)
+	inserted := uniqueKVs(100)
+	runWorkers(concurrentWorkers, func(worker int) {
+		if worker > 0 {
+			err := base.Iterate(func(key, value []byte) bool {
+				assert.Equal(t, expected[string(key)], value)
+				return true
+			})
+			if err != nil {
+				assert.Equal(t, ErrStaleTrie, err)
+			}
+			return
+		}
+		fork := base
+		for i, elem := range inserted {
+			fork = fork.Insert(elem.k, elem.v)
+			fork = fork.Delete(kvs[i].k)
+			if i%10 == 9 {
+				fork.Persist()
+			}
+		}
+	})
+}
@@ -0,0 +1,45 @@
+//go:build mptcore
+// +build mptcore
+
+package mpt
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Database is the underlying db of tries in the mptcore build, it's the reading part
+// of ethdb.KeyValueStore, tries are never committed to it. It may be nil for tries
+// created from the empty root, whose nodes are all held by their logs
+type Database interface {
+	Has(key []byte) (bool, error)
+	Get(key []byte) ([]byte, error)
+}
+
+// storageConfig is empty, features backed by underlying db are not available in the
+// mptcore build
+type storageConfig struct{}
+
+// TryGet returns the values for key stored in the trie, MissingNodeError is
+// returned if nodes are missing
+func (t *Trie) TryGet(key []byte) ([]byte, error) {
+	return t.getValue(key)
+}
+
+// TryInsert insert key and value to trie, return a new trie, old trie is unchanged.
+// MissingNodeError is returned if nodes are missing, ErrValueTooLarge is returned if
+// value exceed the bound of WithMaxValueSize
+func (t *Trie) TryInsert(key, value []byte) (*Trie, error) {
+	return t.tryInsert(key, value)
+}
+
+// TryDelete delete key and value from trie, return a new trie, old trie is unchanged.
+// MissingNodeError is returned if nodes are missing
+func (t *Trie) TryDelete(key []byte) (*Trie, error) {
+	return t.tryDelete(key)
+}
+
+// resolvePath resolve the node of hash, nodes are never cached by path in the
+// mptcore build
+func (t *Trie) resolvePath(hash common.Hash, path []byte) (node, error) {
+	return t.resolveHash(hash)
+}
@@ -0,0 +1,43 @@
+package mpt
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestInMemoryTrie run in both the default and the mptcore build, tries held in
+// memory must have the same roots in both of them
+func TestInMemoryTrie(t *testing.T) {
+	trie := NewTrie(EmptyHash, nil)
+	for i := 0; i < 64; i++ {
+		trie = trie.Insert([]byte{byte(i), byte(i * 7)}, []byte(fmt.Sprintf("value %d", i)))
+	}
+	expected := common.HexToHash("0x580a171cacc2a8e6fb95c0fa296cf977663c1f50d64df0bd02efc0d9c72aa3e9")
+	assert.Equal(t, expected, trie.StateRoot())
+
+	for i := 0; i < 64; i++ {
+		value, err := trie.TryGet([]byte{byte(i), byte(i * 7)})
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("value %d", i)), value)
+	}
+	value, err := trie.TryGet([]byte{0xff})
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+
+	for i := 0; i < 64; i++ {
+		trie = trie.Delete([]byte{byte(i), byte(i * 7)})
+	}
+	assert.Equal(t, EmptyHash, trie.StateRoot())
+}
+
+func TestInMemoryTrieMissingNode(t *testing.T) {
+	root := common.HexToHash("0x580a171cacc2a8e6fb95c0fa296cf977663c1f50d64df0bd02efc0d9c72aa3e9")
+	trie := NewTrie(root, nil)
+	_, err := trie.TryGet([]byte{0x01, 0x07})
+	assert.IsType(t, &MissingNodeError{}, err)
+	_, err = trie.TryInsert([]byte{0x01}, []byte{0x01})
+	assert.IsType(t, &MissingNodeError{}, err)
+}
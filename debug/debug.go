@@ -0,0 +1,301 @@
+//go:build !mptcore
+// +build !mptcore
+
+// Package debug serve statistics of tries over http, the Handler can be mounted in
+// the mux of host application:
+//
+//	h := debug.NewHandler(100)
+//	h.TrackTrie("state", func() *mpt.Trie { return chain.StateTrie() })
+//	h.TrackPruner("state", pruner)
+//	mux.Handle("/debug/mpt", h)
+//
+// Statistics are served as JSON by default, and as Prometheus text format if the
+// query has format=prometheus.
+package debug
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lbqds/mpt"
+)
+
+// TrieStatus is the statistics of a tracked trie
+type TrieStatus struct {
+	Name          string `json:"name"`
+	Root          string `json:"root"`
+	CacheBytes    int    `json:"cacheBytes"`
+	CacheNodes    int    `json:"cacheNodes"`
+	DirtyNodes    int    `json:"dirtyNodes"`
+	DirtyBytes    int    `json:"dirtyBytes"`
+	InsertedNodes int    `json:"insertedNodes"`
+	DeletedNodes  int    `json:"deletedNodes"`
+	RetainedBytes int    `json:"retainedBytes"`
+}
+
+// PrunerStatus is the progress of a tracked pruner
+type PrunerStatus struct {
+	Name        string `json:"name"`
+	Pruned      int    `json:"pruned"`
+	PrunedBytes int    `json:"prunedBytes"`
+	Pending     int    `json:"pending"`
+	Paused      bool   `json:"paused"`
+	LastError   string `json:"lastError,omitempty"`
+}
+
+// CommitStatus is a recent commit of a trie
+type CommitStatus struct {
+	Name         string        `json:"name"`
+	Root         string        `json:"root"`
+	Time         time.Time     `json:"time"`
+	Duration     time.Duration `json:"duration"`
+	NodesWritten int           `json:"nodesWritten"`
+	BytesWritten int           `json:"bytesWritten"`
+	NodesDeleted int           `json:"nodesDeleted"`
+	BytesDeleted int           `json:"bytesDeleted"`
+}
+
+// Status is all statistics served by Handler, tries and pruners are sorted by
+// name, and commits are in the order of recording
+type Status struct {
+	Tries   []TrieStatus   `json:"tries"`
+	Pruners []PrunerStatus `json:"pruners"`
+	Commits []CommitStatus `json:"commits"`
+}
+
+// Handler is a http handler serving statistics of tracked tries, pruners and the
+// recent commits, it's safe for concurrent use
+type Handler struct {
+	lock       sync.Mutex
+	tries      map[string]func() *mpt.Trie
+	pruners    map[string]*mpt.Pruner
+	commits    []CommitStatus
+	maxCommits int
+}
+
+// NewHandler create a handler which keep at most maxCommits recent commits
+func NewHandler(maxCommits int) *Handler {
+	return &Handler{
+		tries:      make(map[string]func() *mpt.Trie),
+		pruners:    make(map[string]*mpt.Pruner),
+		commits:    make([]CommitStatus, 0),
+		maxCommits: maxCommits,
+	}
+}
+
+// TrackTrie track the trie returned by current under name, tries are immutable,
+// so current is called for every request to get the latest one. current may
+// return nil if there is no trie now
+func (h *Handler) TrackTrie(name string, current func() *mpt.Trie) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.tries[name] = current
+}
+
+// TrackPruner track the pruner under name
+func (h *Handler) TrackPruner(name string, p *mpt.Pruner) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.pruners[name] = p
+}
+
+// Untrack stop tracking the trie and pruner of name
+func (h *Handler) Untrack(name string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.tries, name)
+	delete(h.pruners, name)
+}
+
+// RecordCommit record a commit of the trie of name which took duration
+func (h *Handler) RecordCommit(name string, report *mpt.CommitReport, duration time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.maxCommits <= 0 {
+		return
+	}
+	h.commits = append(h.commits, CommitStatus{
+		Name:         name,
+		Root:         report.Root.Hex(),
+		Time:         time.Now(),
+		Duration:     duration,
+		NodesWritten: report.NodesWritten,
+		BytesWritten: report.BytesWritten,
+		NodesDeleted: report.NodesDeleted,
+		BytesDeleted: report.BytesDeleted,
+	})
+	if len(h.commits) > h.maxCommits {
+		h.commits = append(h.commits[:0], h.commits[len(h.commits)-h.maxCommits:]...)
+	}
+}
+
+// Persist persist the trie and record the commit under name
+func (h *Handler) Persist(name string, t *mpt.Trie) *mpt.CommitReport {
+	start := time.Now()
+	report := t.Persist()
+	h.RecordCommit(name, report, time.Since(start))
+	return report
+}
+
+func sortedNames(names []string) []string {
+	sort.Strings(names)
+	return names
+}
+
+// Status return the current statistics
+func (h *Handler) Status() *Status {
+	h.lock.Lock()
+	tries := make(map[string]func() *mpt.Trie, len(h.tries))
+	for name, current := range h.tries {
+		tries[name] = current
+	}
+	pruners := make(map[string]*mpt.Pruner, len(h.pruners))
+	for name, p := range h.pruners {
+		pruners[name] = p
+	}
+	commits := append([]CommitStatus{}, h.commits...)
+	h.lock.Unlock()
+
+	// tracked tries and pruners are read without lock, they may be slow or
+	// lock themselves
+	status := &Status{
+		Tries:   make([]TrieStatus, 0, len(tries)),
+		Pruners: make([]PrunerStatus, 0, len(pruners)),
+		Commits: commits,
+	}
+	names := make([]string, 0, len(tries))
+	for name := range tries {
+		names = append(names, name)
+	}
+	for _, name := range sortedNames(names) {
+		t := tries[name]()
+		if t == nil {
+			continue
+		}
+		nodes, bytes := t.DirtyCount()
+		stats := t.LogStats()
+		status.Tries = append(status.Tries, TrieStatus{
+			Name:          name,
+			Root:          t.StateRoot().Hex(),
+			CacheBytes:    stats.CachedBytes,
+			CacheNodes:    stats.CachedNodes,
+			DirtyNodes:    nodes,
+			DirtyBytes:    bytes,
+			InsertedNodes: stats.InsertedNodes,
+			DeletedNodes:  stats.DeletedNodes,
+			RetainedBytes: stats.RetainedBytes,
+		})
+	}
+	names = make([]string, 0, len(pruners))
+	for name := range pruners {
+		names = append(names, name)
+	}
+	for _, name := range sortedNames(names) {
+		progress := pruners[name].Progress()
+		prunerStatus := PrunerStatus{
+			Name:        name,
+			Pruned:      progress.Pruned,
+			PrunedBytes: progress.PrunedBytes,
+			Pending:     progress.Pending,
+			Paused:      progress.Paused,
+		}
+		if progress.LastPruneErr != nil {
+			prunerStatus.LastError = progress.LastPruneErr.Error()
+		}
+		status.Pruners = append(status.Pruners, prunerStatus)
+	}
+	return status
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := h.Status()
+	if r.URL.Query().Get("format") == "prometheus" {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writePrometheus(w, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func boolValue(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// writePrometheus write status in Prometheus text format, the last commit of each
+// trie is exported as gauges
+func writePrometheus(w io.Writer, status *Status) {
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	metric("mpt_cache_bytes", "gauge", "Size of cached nodes of the trie.")
+	for _, t := range status.Tries {
+		fmt.Fprintf(w, "mpt_cache_bytes{trie=%q} %d\n", t.Name, t.CacheBytes)
+	}
+	metric("mpt_cache_nodes", "gauge", "Number of cached nodes of the trie.")
+	for _, t := range status.Tries {
+		fmt.Fprintf(w, "mpt_cache_nodes{trie=%q} %d\n", t.Name, t.CacheNodes)
+	}
+	metric("mpt_dirty_nodes", "gauge", "Number of nodes not persisted yet.")
+	for _, t := range status.Tries {
+		fmt.Fprintf(w, "mpt_dirty_nodes{trie=%q} %d\n", t.Name, t.DirtyNodes)
+	}
+	metric("mpt_dirty_bytes", "gauge", "Size of nodes not persisted yet.")
+	for _, t := range status.Tries {
+		fmt.Fprintf(w, "mpt_dirty_bytes{trie=%q} %d\n", t.Name, t.DirtyBytes)
+	}
+	metric("mpt_log_inserted_nodes", "gauge", "Number of inserted entries in all layers of the log.")
+	for _, t := range status.Tries {
+		fmt.Fprintf(w, "mpt_log_inserted_nodes{trie=%q} %d\n", t.Name, t.InsertedNodes)
+	}
+	metric("mpt_log_deleted_nodes", "gauge", "Number of deleted entries in all layers of the log.")
+	for _, t := range status.Tries {
+		fmt.Fprintf(w, "mpt_log_deleted_nodes{trie=%q} %d\n", t.Name, t.DeletedNodes)
+	}
+	metric("mpt_retained_bytes", "gauge", "Estimated memory retained by the cache and the log of the trie.")
+	for _, t := range status.Tries {
+		fmt.Fprintf(w, "mpt_retained_bytes{trie=%q} %d\n", t.Name, t.RetainedBytes)
+	}
+	metric("mpt_pruner_pruned_total", "counter", "Number of nodes pruned.")
+	for _, p := range status.Pruners {
+		fmt.Fprintf(w, "mpt_pruner_pruned_total{pruner=%q} %d\n", p.Name, p.Pruned)
+	}
+	metric("mpt_pruner_pruned_bytes_total", "counter", "Size of nodes pruned.")
+	for _, p := range status.Pruners {
+		fmt.Fprintf(w, "mpt_pruner_pruned_bytes_total{pruner=%q} %d\n", p.Name, p.PrunedBytes)
+	}
+	metric("mpt_pruner_pending", "gauge", "Number of nodes waiting to be pruned.")
+	for _, p := range status.Pruners {
+		fmt.Fprintf(w, "mpt_pruner_pending{pruner=%q} %d\n", p.Name, p.Pending)
+	}
+	metric("mpt_pruner_paused", "gauge", "Whether the pruner is paused.")
+	for _, p := range status.Pruners {
+		fmt.Fprintf(w, "mpt_pruner_paused{pruner=%q} %d\n", p.Name, boolValue(p.Paused))
+	}
+	last := make(map[string]CommitStatus)
+	names := make([]string, 0)
+	for _, c := range status.Commits {
+		if _, ok := last[c.Name]; !ok {
+			names = append(names, c.Name)
+		}
+		last[c.Name] = c
+	}
+	metric("mpt_last_commit_duration_seconds", "gauge", "Duration of the last commit of the trie.")
+	for _, name := range sortedNames(names) {
+		fmt.Fprintf(w, "mpt_last_commit_duration_seconds{trie=%q} %g\n", name, last[name].Duration.Seconds())
+	}
+	metric("mpt_last_commit_bytes_written", "gauge", "Size of nodes written by the last commit of the trie.")
+	for _, name := range names {
+		fmt.Fprintf(w, "mpt_last_commit_bytes_written{trie=%q} %d\n", name, last[name].BytesWritten)
+	}
+}
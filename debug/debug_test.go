@@ -0,0 +1,68 @@
+//go:build !mptcore
+// +build !mptcore
+
+package debug
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/lbqds/mpt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	memDB := memorydb.New()
+	trie := mpt.NewTrie(mpt.EmptyHash, memDB)
+	for i := 0; i < 100; i++ {
+		trie = trie.Insert(mpt.Uint64Key(uint64(i)), []byte{byte(i), 1})
+	}
+	h := NewHandler(2)
+	h.TrackTrie("state", func() *mpt.Trie { return trie })
+	h.TrackTrie("none", func() *mpt.Trie { return nil })
+	pruner := mpt.NewPruner(memDB, mpt.PrunerConfig{})
+	h.TrackPruner("state", pruner)
+
+	status := h.Status()
+	assert.Equal(t, 1, len(status.Tries))
+	assert.Equal(t, trie.StateRoot().Hex(), status.Tries[0].Root)
+	assert.True(t, status.Tries[0].DirtyNodes > 0)
+	assert.True(t, status.Tries[0].InsertedNodes > 0)
+	assert.True(t, status.Tries[0].RetainedBytes > status.Tries[0].DirtyBytes)
+	assert.Equal(t, []PrunerStatus{{Name: "state"}}, status.Pruners)
+
+	for i := 0; i < 3; i++ {
+		h.Persist("state", trie)
+	}
+	h.RecordCommit("storage", &mpt.CommitReport{Root: mpt.EmptyHash}, time.Second)
+	status = h.Status()
+	// only the recent commits are kept
+	assert.Equal(t, 2, len(status.Commits))
+	assert.Equal(t, "state", status.Commits[0].Name)
+	assert.Equal(t, "storage", status.Commits[1].Name)
+
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/mpt", nil))
+	var served Status
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &served))
+	assert.Equal(t, status.Tries, served.Tries)
+	assert.Equal(t, status.Pruners, served.Pruners)
+	assert.Equal(t, 2, len(served.Commits))
+
+	recorder = httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/mpt?format=prometheus", nil))
+	text := recorder.Body.String()
+	assert.True(t, strings.Contains(text, "# TYPE mpt_dirty_nodes gauge\n"))
+	assert.True(t, strings.Contains(text, "# TYPE mpt_retained_bytes gauge\n"))
+	assert.True(t, strings.Contains(text, `mpt_pruner_pending{pruner="state"} 0`))
+	assert.True(t, strings.Contains(text, `mpt_last_commit_duration_seconds{trie="storage"} 1`))
+
+	h.Untrack("state")
+	status = h.Status()
+	assert.Equal(t, 0, len(status.Tries))
+	assert.Equal(t, 0, len(status.Pruners))
+}
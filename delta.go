@@ -0,0 +1,213 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"encoding/binary"
+	"errors"
+
+	db "github.com/ethereum/go-ethereum/ethdb"
+)
+
+// ErrInvalidDelta is returned when a value record of DeltaTrie can't be parsed
+var ErrInvalidDelta = errors.New("invalid delta record")
+
+// value records stored in the data trie of DeltaTrie, a patch keep the first prefix
+// and the last suffix bytes of the base, and replace the bytes between by middle:
+// - base record: {deltaBase} => the value is the base stored in the base trie
+// - patch record: {deltaPatch} ++ uint32(prefix) ++ uint32(suffix) ++ middle
+const (
+	deltaBase  byte = 0x00
+	deltaPatch byte = 0x01
+)
+
+const deltaPatchHeaderLength = 9
+
+// DeltaTrie is a trie storing updates of large values as deltas against a base value,
+// so tweaking a few bytes of a large value only writes the changed bytes. The data
+// trie map keys to value records, the base trie map keys to their base values. An
+// update sharing at least minShared bytes of prefix and suffix with the base is
+// stored as a patch of the base, any other update replace the base by the full
+// value. Get resolve patches transparently. Like Trie, it's immutable, every update
+// return a new DeltaTrie
+type DeltaTrie struct {
+	data      *Trie
+	bases     *Trie
+	minShared int
+}
+
+// NewDeltaTrie create a DeltaTrie from the data trie and its base trie, updates
+// sharing less than minShared bytes with the base are stored in full
+func NewDeltaTrie(data, bases *Trie, minShared int) *DeltaTrie {
+	return &DeltaTrie{
+		data:      data,
+		bases:     bases,
+		minShared: minShared,
+	}
+}
+
+// Data return the data trie
+func (d *DeltaTrie) Data() *Trie {
+	return d.data
+}
+
+// Bases return the base trie
+func (d *DeltaTrie) Bases() *Trie {
+	return d.bases
+}
+
+// Get returns the value for key, nil is returned if the key doesn't exist or nodes
+// can't be resolved, use TryGet to distinguish them
+func (d *DeltaTrie) Get(key []byte) []byte {
+	value, _ := d.TryGet(key)
+	return value
+}
+
+// TryGet returns the value for key, patches are applied to the base value of key
+func (d *DeltaTrie) TryGet(key []byte) ([]byte, error) {
+	record, err := d.data.TryGet(key)
+	if err != nil || record == nil {
+		return nil, err
+	}
+	base, err := d.bases.TryGet(key)
+	if err != nil {
+		return nil, err
+	}
+	if base == nil {
+		return nil, ErrInvalidDelta
+	}
+	return applyDelta(base, record)
+}
+
+// Insert insert key and value, return a new DeltaTrie. It panics if nodes can't
+// be resolved, use TryInsert to get the error instead
+func (d *DeltaTrie) Insert(key, value []byte) *DeltaTrie {
+	newTrie, err := d.TryInsert(key, value)
+	if err != nil {
+		panic(err)
+	}
+	return newTrie
+}
+
+// TryInsert insert key and value, the value is stored as a patch of the base value
+// of key if they share enough bytes, otherwise it become the new base
+func (d *DeltaTrie) TryInsert(key, value []byte) (*DeltaTrie, error) {
+	base, err := d.bases.TryGet(key)
+	if err != nil {
+		return nil, err
+	}
+	bases := d.bases
+	record := []byte{deltaBase}
+	if base != nil && patchable(base, value, d.minShared) {
+		record = diffDelta(base, value)
+	} else if bases, err = d.bases.TryInsert(key, value); err != nil {
+		return nil, err
+	}
+	data, err := d.data.TryInsert(key, record)
+	if err != nil {
+		return nil, err
+	}
+	return NewDeltaTrie(data, bases, d.minShared), nil
+}
+
+// Delete delete key and its base, return a new DeltaTrie. It panics if nodes can't
+// be resolved, use TryDelete to get the error instead
+func (d *DeltaTrie) Delete(key []byte) *DeltaTrie {
+	newTrie, err := d.TryDelete(key)
+	if err != nil {
+		panic(err)
+	}
+	return newTrie
+}
+
+// TryDelete delete key and its base
+func (d *DeltaTrie) TryDelete(key []byte) (*DeltaTrie, error) {
+	data, err := d.data.TryDelete(key)
+	if err != nil {
+		return nil, err
+	}
+	bases, err := d.bases.TryDelete(key)
+	if err != nil {
+		return nil, err
+	}
+	return NewDeltaTrie(data, bases, d.minShared), nil
+}
+
+// CommitToBatch write both the data and base trie to batch, and return their
+// reports, call Written on both once the batch is written. It panics if a commit
+// fails, the batch must not be written then
+func (d *DeltaTrie) CommitToBatch(batch db.Batch) (data, bases *CommitReport) {
+	return d.data.CommitToBatch(batch), d.bases.CommitToBatch(batch)
+}
+
+// Persist write both the data and base trie in one batch, so they are always
+// consistent in db, and return their reports. The base trie must use the same
+// db as the data trie. It panics if the commits or the write of the batch fail
+func (d *DeltaTrie) Persist() (data, bases *CommitReport) {
+	batch := d.data.db.NewBatch()
+	data, bases = d.CommitToBatch(batch)
+	if err := batch.Write(); err != nil {
+		panic(err)
+	}
+	data.Written()
+	bases.Written()
+	return data, bases
+}
+
+// sharedBytes return the length of the common prefix and the common suffix of a
+// and b, they don't overlap in the shorter of a and b
+func sharedBytes(a, b []byte) (prefix, suffix int) {
+	limit := len(a)
+	if len(b) < limit {
+		limit = len(b)
+	}
+	for prefix < limit && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for suffix < limit-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	return prefix, suffix
+}
+
+// patchable return true if value is stored as a patch of base, a value equal to
+// the base is stored as the base itself
+func patchable(base, value []byte, minShared int) bool {
+	if minShared <= 0 || len(base) == len(value) && string(base) == string(value) {
+		return false
+	}
+	prefix, suffix := sharedBytes(base, value)
+	return prefix+suffix >= minShared
+}
+
+// diffDelta return the patch record turning base into value
+func diffDelta(base, value []byte) []byte {
+	prefix, suffix := sharedBytes(base, value)
+	middle := value[prefix : len(value)-suffix]
+	record := make([]byte, deltaPatchHeaderLength, deltaPatchHeaderLength+len(middle))
+	record[0] = deltaPatch
+	binary.BigEndian.PutUint32(record[1:5], uint32(prefix))
+	binary.BigEndian.PutUint32(record[5:9], uint32(suffix))
+	return append(record, middle...)
+}
+
+// applyDelta return the value of record against base
+func applyDelta(base, record []byte) ([]byte, error) {
+	switch {
+	case len(record) == 1 && record[0] == deltaBase:
+		return base, nil
+	case len(record) < deltaPatchHeaderLength || record[0] != deltaPatch:
+		return nil, ErrInvalidDelta
+	}
+	prefix := binary.BigEndian.Uint32(record[1:5])
+	suffix := binary.BigEndian.Uint32(record[5:9])
+	if uint64(prefix)+uint64(suffix) > uint64(len(base)) {
+		return nil, ErrInvalidDelta
+	}
+	middle := record[deltaPatchHeaderLength:]
+	value := make([]byte, 0, int(prefix)+len(middle)+int(suffix))
+	value = append(value, base[:prefix]...)
+	value = append(value, middle...)
+	return append(value, base[len(base)-int(suffix):]...), nil
+}
@@ -0,0 +1,142 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func tweak(value []byte, at int, b byte) []byte {
+	tweaked := append([]byte{}, value...)
+	tweaked[at] = b
+	return tweaked
+}
+
+func TestDeltaTrie(t *testing.T) {
+	memDB := memorydb.New()
+	d := NewDeltaTrie(NewTrie(EmptyHash, memDB), NewTrie(EmptyHash, memDB), 64)
+	key := []byte{0x01, 0x02}
+	base := bytes.Repeat([]byte{0xab}, 1024)
+	d = d.Insert(key, base)
+	d = d.Insert([]byte{0x03}, []byte{0x13})
+	assert.Equal(t, base, d.Get(key))
+	assert.Equal(t, []byte{deltaBase}, d.Data().Get(key))
+
+	// a tweak is stored as a patch of the base
+	tweaked := tweak(base, 512, 0xcd)
+	d = d.Insert(key, tweaked)
+	assert.Equal(t, tweaked, d.Get(key))
+	assert.Equal(t, base, d.Bases().Get(key))
+	assert.Equal(t, deltaPatchHeaderLength+1, len(d.Data().Get(key)))
+
+	// the next tweak is a patch of the same base
+	grown := append(tweak(base, 100, 0xef), 0x01, 0x02)
+	d = d.Insert(key, grown)
+	assert.Equal(t, grown, d.Get(key))
+	assert.Equal(t, base, d.Bases().Get(key))
+
+	// values sharing less than minShared bytes replace the base
+	short := bytes.Repeat([]byte{0xab}, 32)
+	d = d.Insert(key, short)
+	assert.Equal(t, short, d.Get(key))
+	assert.Equal(t, short, d.Bases().Get(key))
+	assert.Equal(t, []byte{deltaBase}, d.Data().Get(key))
+
+	// reload from db
+	d = d.Insert(key, tweaked).Insert(key, tweak(tweaked, 0, 0x00))
+	d.Persist()
+	d = NewDeltaTrie(NewTrie(d.Data().StateRoot(), memDB), NewTrie(d.Bases().StateRoot(), memDB), 64)
+	assert.Equal(t, tweak(tweaked, 0, 0x00), d.Get(key))
+	assert.Equal(t, []byte{0x13}, d.Get([]byte{0x03}))
+
+	d = d.Delete(key)
+	assert.Nil(t, d.Get(key))
+	assert.Nil(t, d.Bases().Get(key))
+	assert.Nil(t, d.Get([]byte{0x04}))
+}
+
+func TestDeltaTrieDisabled(t *testing.T) {
+	memDB := memorydb.New()
+	d := NewDeltaTrie(NewTrie(EmptyHash, memDB), NewTrie(EmptyHash, memDB), 0)
+	base := bytes.Repeat([]byte{0xab}, 1024)
+	tweaked := tweak(base, 1, 0xcd)
+	d = d.Insert([]byte{0x01}, base).Insert([]byte{0x01}, tweaked)
+	assert.Equal(t, tweaked, d.Get([]byte{0x01}))
+	assert.Equal(t, tweaked, d.Bases().Get([]byte{0x01}))
+	assert.Equal(t, []byte{deltaBase}, d.Data().Get([]byte{0x01}))
+}
+
+func TestDeltaTrieWrittenBytes(t *testing.T) {
+	kvs := uniqueKVs(100)
+	// values are distinct, since identical leaves of one trie share one node
+	values := make([][]byte, len(kvs))
+	for i := range kvs {
+		values[i] = append(bytes.Repeat([]byte{0xab}, 4096), Uint64Key(uint64(i))...)
+	}
+	// the plain trie and the base trie have the same nodes, keep them in separate
+	// dbs so pruning one doesn't delete the nodes of the other
+	trieDB, memDB := memorydb.New(), memorydb.New()
+	trie := NewTrie(EmptyHash, trieDB)
+	d := NewDeltaTrie(NewTrie(EmptyHash, memDB), NewTrie(EmptyHash, memDB), 64)
+	for i, elem := range kvs {
+		trie = trie.Insert(elem.k, values[i])
+		d = d.Insert(elem.k, values[i])
+	}
+	trie.Persist()
+	d.Persist()
+	trie = NewTrie(trie.StateRoot(), trieDB)
+	d = NewDeltaTrie(NewTrie(d.Data().StateRoot(), memDB), NewTrie(d.Bases().StateRoot(), memDB), 64)
+
+	for i, elem := range kvs {
+		trie = trie.Insert(elem.k, tweak(values[i], i, 0xcd))
+		d = d.Insert(elem.k, tweak(values[i], i, 0xcd))
+	}
+	full := trie.Persist()
+	data, bases := d.Persist()
+	assert.Equal(t, 0, bases.NodesWritten)
+	assert.Less(t, data.BytesWritten*10, full.BytesWritten)
+	for i, elem := range kvs {
+		assert.Equal(t, tweak(values[i], i, 0xcd), d.Get(elem.k))
+	}
+}
+
+func TestApplyDelta(t *testing.T) {
+	base := []byte("hello world")
+	cases := []struct {
+		value  []byte
+		length int
+	}{
+		{value: []byte("hello world"), length: 9},
+		{value: []byte("hello there world"), length: 15},
+		{value: []byte("hello"), length: 9},
+		{value: []byte("world"), length: 9},
+		{value: []byte("hello world!"), length: 10},
+		{value: []byte("jello world"), length: 10},
+		{value: []byte{}, length: 9},
+	}
+	for _, c := range cases {
+		record := diffDelta(base, c.value)
+		assert.Equal(t, c.length, len(record))
+		value, err := applyDelta(base, record)
+		assert.Nil(t, err)
+		assert.Equal(t, c.value, value)
+	}
+
+	malformed := [][]byte{
+		{},
+		{deltaBase, 0x00},
+		{deltaPatch, 0x00},
+		{0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		{deltaPatch, 0x00, 0x00, 0x00, 0x06, 0x00, 0x00, 0x00, 0x06},
+		{deltaPatch, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+	for _, record := range malformed {
+		_, err := applyDelta(base, record)
+		assert.Equal(t, ErrInvalidDelta, err)
+	}
+}
@@ -0,0 +1,192 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+	"github.com/lbqds/mpt/internal/varint"
+)
+
+// SchemaVersion is the version of the format of nodes and records written by this
+// package, it's bumped by changes which make dbs unreadable by earlier versions
+const SchemaVersion = 1
+
+// SchemaDescriptor describe how the tries of a db are encoded and hashed, tries
+// opened with another schema would compute different roots from the same nodes
+type SchemaDescriptor struct {
+	Version uint64
+	// Codec is the encoding of nodes
+	Codec string
+	// Hasher is the hash function of nodes
+	Hasher string
+	// Radix is the number of children of a branch
+	Radix uint64
+	// EmbedThreshold is the size from which nodes are stored by hash rather than
+	// embedded in their parents
+	EmbedThreshold uint64
+}
+
+// CurrentSchema is the schema of dbs written by this package
+var CurrentSchema = SchemaDescriptor{
+	Version:        SchemaVersion,
+	Codec:          "protobuf",
+	Hasher:         "keccak256",
+	Radix:          16,
+	EmbedThreshold: common.HashLength,
+}
+
+// TaggedSchema is the schema of dbs written by tries with WithTaggedChildRefs, whose
+// nodes tag their child references
+var TaggedSchema = SchemaDescriptor{
+	Version:        SchemaVersion,
+	Codec:          "protobuf-tagged",
+	Hasher:         "keccak256",
+	Radix:          16,
+	EmbedThreshold: common.HashLength,
+}
+
+var errInvalidSchema = errors.New("invalid schema descriptor")
+
+// SchemaMismatchError is returned when a db is written with another schema
+type SchemaMismatchError struct {
+	Stored   SchemaDescriptor
+	Expected SchemaDescriptor
+}
+
+func (e *SchemaMismatchError) Error() string {
+	return fmt.Sprintf("db schema %+v doesn't match %+v", e.Stored, e.Expected)
+}
+
+// encode return the encoding of the descriptor, which is
+// varint version | varint radix | varint threshold | varint size | codec | varint size | hasher
+func (d SchemaDescriptor) encode() []byte {
+	buf := make([]byte, 0, 5*varint.MaxLen+len(d.Codec)+len(d.Hasher))
+	buf = varint.Append(buf, d.Version)
+	buf = varint.Append(buf, d.Radix)
+	buf = varint.Append(buf, d.EmbedThreshold)
+	for _, s := range []string{d.Codec, d.Hasher} {
+		buf = varint.Append(buf, uint64(len(s)))
+		buf = append(buf, s...)
+	}
+	return buf
+}
+
+// decodeSchemaDescriptor is the reverse of SchemaDescriptor.encode
+func decodeSchemaDescriptor(data []byte) (SchemaDescriptor, error) {
+	var fields [3]uint64
+	var ok bool
+	for i := range fields {
+		if fields[i], data, ok = varint.Decode(data); !ok {
+			return SchemaDescriptor{}, errInvalidSchema
+		}
+	}
+	var names [2]string
+	for i := range names {
+		var name []byte
+		if name, data, ok = varint.DecodeBytes(data); !ok {
+			return SchemaDescriptor{}, errInvalidSchema
+		}
+		names[i] = string(name)
+	}
+	if len(data) != 0 {
+		return SchemaDescriptor{}, errInvalidSchema
+	}
+	return SchemaDescriptor{
+		Version:        fields[0],
+		Radix:          fields[1],
+		EmbedThreshold: fields[2],
+		Codec:          names[0],
+		Hasher:         names[1],
+	}, nil
+}
+
+// ReadSchema return the descriptor written to r by the first commit, ok is false if
+// there is none, e.g. the db is empty or written by versions before descriptors
+func ReadSchema(r db.KeyValueReader) (d SchemaDescriptor, ok bool, err error) {
+	has, err := r.Has(schemaKey())
+	if err != nil || !has {
+		return SchemaDescriptor{}, false, err
+	}
+	encoded, err := r.Get(schemaKey())
+	if err != nil {
+		return SchemaDescriptor{}, false, err
+	}
+	d, err = decodeSchemaDescriptor(encoded)
+	if err != nil {
+		return SchemaDescriptor{}, false, err
+	}
+	return d, true, nil
+}
+
+// CheckSchema return SchemaMismatchError if r is written with a schema other than
+// CurrentSchema, dbs without descriptor pass
+func CheckSchema(r db.KeyValueReader) error {
+	return checkSchema(r, CurrentSchema)
+}
+
+// checkSchema return SchemaMismatchError if r is written with a schema other than
+// expected, dbs without descriptor pass
+func checkSchema(r db.KeyValueReader, expected SchemaDescriptor) error {
+	d, ok, err := ReadSchema(r)
+	if err != nil {
+		return err
+	}
+	if ok && d != expected {
+		return &SchemaMismatchError{Stored: d, Expected: expected}
+	}
+	return nil
+}
+
+// schemaDescriptor return the schema of dbs written by tries of the config
+func (c *config) schemaDescriptor() SchemaDescriptor {
+	if c.taggedRefs {
+		return TaggedSchema
+	}
+	return CurrentSchema
+}
+
+// WithSchema write the schema of the trie, CurrentSchema or TaggedSchema, to
+// underlying db with the first commit of the trie if the db has no descriptor yet,
+// so later opens of the db by OpenTrie are checked against it. Without the option
+// only trie nodes are written by commits
+func WithSchema() Option {
+	return func(c *config) {
+		c.schema = true
+	}
+}
+
+// OpenTrie create a trie like NewTrie with WithSchema after checking the schema of
+// kvs like CheckSchema, so a db written by an incompatible version fails here rather
+// than producing wrong roots. Tries with WithTaggedChildRefs are checked against
+// TaggedSchema rather than CurrentSchema
+func OpenTrie(rootHash common.Hash, kvs db.KeyValueStore, opts ...Option) (*Trie, error) {
+	t := NewTrie(rootHash, kvs, append(opts, WithSchema())...)
+	if err := checkSchema(kvs, t.config.schemaDescriptor()); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// putSchema write d to w if r has no descriptor yet
+func putSchema(r db.KeyValueReader, w db.KeyValueWriter, d SchemaDescriptor) error {
+	has, err := r.Has(schemaKey())
+	if err != nil || has {
+		return err
+	}
+	return w.Put(schemaKey(), d.encode())
+}
+
+// writeSchema write the descriptor with commits of tries sharing the config if they
+// are created with WithSchema, until one of the commits is written
+func (t *Trie) writeSchema(w db.KeyValueWriter) error {
+	if !t.config.schema || atomic.LoadUint32(&t.config.schemaWritten) == 1 {
+		return nil
+	}
+	return putSchema(t.db, w, t.config.schemaDescriptor())
+}
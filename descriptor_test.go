@@ -0,0 +1,103 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaDescriptor(t *testing.T) {
+	memDB := memorydb.New()
+	trie, err := OpenTrie(EmptyHash, memDB)
+	assert.Nil(t, err)
+	_, ok, err := ReadSchema(memDB)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	trie = trie.Insert([]byte("key"), []byte("value"))
+	trie.Persist()
+	d, ok, err := ReadSchema(memDB)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, CurrentSchema, d)
+	reopened, err := OpenTrie(trie.StateRoot(), memDB)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), reopened.Get([]byte("key")))
+
+	other := CurrentSchema
+	other.Hasher = "blake2b"
+	assert.Nil(t, memDB.Put(schemaKey(), other.encode()))
+	_, err = OpenTrie(trie.StateRoot(), memDB)
+	assert.Equal(t, &SchemaMismatchError{Stored: other, Expected: CurrentSchema}, err)
+	// an existing descriptor is never overwritten by commits
+	reopened.Insert([]byte("key2"), []byte("value")).Persist()
+	d, _, _ = ReadSchema(memDB)
+	assert.Equal(t, other, d)
+
+	assert.Nil(t, memDB.Put(schemaKey(), []byte{1, 16}))
+	_, err = OpenTrie(trie.StateRoot(), memDB)
+	assert.Equal(t, errInvalidSchema, err)
+}
+
+func TestSchemaDescriptorTagged(t *testing.T) {
+	memDB := memorydb.New()
+	trie, err := OpenTrie(EmptyHash, memDB, WithTaggedChildRefs())
+	assert.Nil(t, err)
+	trie = trie.Insert([]byte("key"), []byte("value"))
+	trie.Persist()
+	d, _, _ := ReadSchema(memDB)
+	assert.Equal(t, TaggedSchema, d)
+	_, err = OpenTrie(trie.StateRoot(), memDB, WithTaggedChildRefs())
+	assert.Nil(t, err)
+	_, err = OpenTrie(trie.StateRoot(), memDB)
+	assert.Equal(t, &SchemaMismatchError{Stored: TaggedSchema, Expected: CurrentSchema}, err)
+	assert.NotNil(t, CheckSchema(memDB))
+}
+
+func TestSchemaDescriptorCommits(t *testing.T) {
+	// tries without WithSchema write nodes only
+	memDB := memorydb.New()
+	NewTrie(EmptyHash, memDB).Insert([]byte("key"), []byte("value")).Persist()
+	_, ok, _ := ReadSchema(memDB)
+	assert.False(t, ok)
+
+	memDB = memorydb.New()
+	batch := memDB.NewBatch()
+	_, err := NewTrie(EmptyHash, memDB, WithSchema()).Insert([]byte("key"), []byte("value")).CommitToBatchOrdered(batch, BatchOptions{})
+	assert.Nil(t, err)
+	assert.Nil(t, batch.Write())
+	_, ok, _ = ReadSchema(memDB)
+	assert.True(t, ok)
+
+	memDB = memorydb.New()
+	group := NewCommitGroup(memDB)
+	_, err = group.Commit(NewTrie(EmptyHash, memDB, WithSchema()).Insert([]byte("key"), []byte("value")))
+	assert.Nil(t, err)
+	_, ok, _ = ReadSchema(memDB)
+	assert.True(t, ok)
+}
+
+func TestSchemaDescriptorFailedCommit(t *testing.T) {
+	// the descriptor is written by later commits until a commit is written
+	memDB := memorydb.New()
+	trie := NewTrie(EmptyHash, memDB, WithSchema()).Insert([]byte("key"), []byte("value"))
+	_, err := trie.CommitToBatchOrdered(memDB.NewBatch(), BatchOptions{})
+	assert.Nil(t, err)
+	trie.Persist()
+	_, ok, _ := ReadSchema(memDB)
+	assert.True(t, ok)
+
+	// errors of reading the descriptor abort commits
+	faulty := NewFaultyStore(memorydb.New(), FaultConfig{ReadFailureRate: 1})
+	trie = NewTrie(EmptyHash, faulty, WithSchema()).Insert([]byte("key"), []byte("value"))
+	_, err = trie.Commit()
+	assert.Equal(t, ErrInjectedFault, err)
+	assert.PanicsWithValue(t, ErrInjectedFault, func() { trie.Persist() })
+	faulty.SetConfig(FaultConfig{})
+	_, ok, _ = ReadSchema(faulty)
+	assert.False(t, ok)
+	assert.True(t, NewTrie(trie.StateRoot(), faulty).Stale())
+}
@@ -0,0 +1,125 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// Format is the output format of DumpTo, it's FormatJSONL or FormatCSV, and can be
+// combined with FormatProof to include the proof of every entry, e.g.
+// FormatCSV|FormatProof
+type Format int
+
+const (
+	// FormatJSONL write one json object per line, with fields key, value and
+	// optionally proof, which is an array of encoded proof nodes
+	FormatJSONL Format = iota
+	// FormatCSV write a header line followed by one record per entry, with columns
+	// key, value and optionally proof, whose proof nodes are separated by ';'
+	FormatCSV
+
+	// FormatProof include the proof of every entry
+	FormatProof Format = 1 << 4
+
+	formatMask Format = FormatProof - 1
+)
+
+type dumpEntry struct {
+	Key   hexutil.Bytes   `json:"key"`
+	Value hexutil.Bytes   `json:"value"`
+	Proof []hexutil.Bytes `json:"proof,omitempty"`
+}
+
+type dumpWriter interface {
+	write(entry *dumpEntry) error
+	flush() error
+}
+
+type jsonlWriter struct {
+	encoder *json.Encoder
+}
+
+func (w *jsonlWriter) write(entry *dumpEntry) error {
+	return w.encoder.Encode(entry)
+}
+
+func (w *jsonlWriter) flush() error {
+	return nil
+}
+
+type csvWriter struct {
+	writer *csv.Writer
+}
+
+func (w *csvWriter) write(entry *dumpEntry) error {
+	record := []string{entry.Key.String(), entry.Value.String()}
+	if entry.Proof != nil {
+		proof := make([]string, len(entry.Proof))
+		for i, encoded := range entry.Proof {
+			proof[i] = encoded.String()
+		}
+		record = append(record, strings.Join(proof, ";"))
+	}
+	return w.writer.Write(record)
+}
+
+func (w *csvWriter) flush() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+// DumpTo write all key values of the trie to w in key order, keys and values
+// are hex encoded with 0x prefix
+func (t *Trie) DumpTo(w io.Writer, format Format) error {
+	withProof := format&FormatProof != 0
+	var writer dumpWriter
+	switch format & formatMask {
+	case FormatJSONL:
+		writer = &jsonlWriter{encoder: json.NewEncoder(w)}
+	case FormatCSV:
+		cw := &csvWriter{writer: csv.NewWriter(w)}
+		header := []string{"key", "value"}
+		if withProof {
+			header = append(header, "proof")
+		}
+		if err := cw.writer.Write(header); err != nil {
+			return err
+		}
+		writer = cw
+	default:
+		return fmt.Errorf("unknown dump format: %d", format)
+	}
+
+	var dumpErr error
+	err := t.Iterate(func(key, value []byte) bool {
+		entry := &dumpEntry{Key: key, Value: value}
+		if withProof {
+			proof, err := t.Prove(key)
+			if err != nil {
+				dumpErr = err
+				return false
+			}
+			entry.Proof = make([]hexutil.Bytes, len(proof))
+			for i, encoded := range proof {
+				entry.Proof[i] = encoded
+			}
+		}
+		dumpErr = writer.write(entry)
+		return dumpErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if dumpErr != nil {
+		return dumpErr
+	}
+	return writer.flush()
+}
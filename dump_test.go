@@ -0,0 +1,75 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumpJSONL(t *testing.T) {
+	trie, kvs := persistedTrie(memorydb.New(), 100)
+	expected := sortedKVs(kvMap(kvs))
+
+	for _, format := range []Format{FormatJSONL, FormatJSONL | FormatProof} {
+		var buf bytes.Buffer
+		assert.Nil(t, trie.DumpTo(&buf, format))
+		scanner := bufio.NewScanner(&buf)
+		i := 0
+		for ; scanner.Scan(); i++ {
+			var entry dumpEntry
+			assert.Nil(t, json.Unmarshal(scanner.Bytes(), &entry))
+			assert.Equal(t, expected[i].k, []byte(entry.Key))
+			assert.Equal(t, expected[i].v, []byte(entry.Value))
+			if format&FormatProof == 0 {
+				assert.Nil(t, entry.Proof)
+				continue
+			}
+			item := ProofItem{Key: entry.Key, Value: entry.Value}
+			for _, encoded := range entry.Proof {
+				item.Proof = append(item.Proof, encoded)
+			}
+			assert.Nil(t, VerifyProofBatch(trie.StateRoot(), []ProofItem{item}))
+		}
+		assert.Equal(t, len(expected), i)
+	}
+}
+
+func TestDumpCSV(t *testing.T) {
+	trie, kvs := persistedTrie(memorydb.New(), 100)
+	expected := sortedKVs(kvMap(kvs))
+
+	var buf bytes.Buffer
+	assert.Nil(t, trie.DumpTo(&buf, FormatCSV|FormatProof))
+	records, err := csv.NewReader(&buf).ReadAll()
+	assert.Nil(t, err)
+	assert.Equal(t, len(expected)+1, len(records))
+	assert.Equal(t, []string{"key", "value", "proof"}, records[0])
+	for i, record := range records[1:] {
+		assert.Equal(t, hexutil.Encode(expected[i].k), record[0])
+		assert.Equal(t, hexutil.Encode(expected[i].v), record[1])
+		item := ProofItem{Key: expected[i].k, Value: expected[i].v}
+		for _, encoded := range strings.Split(record[2], ";") {
+			item.Proof = append(item.Proof, hexutil.MustDecode(encoded))
+		}
+		assert.Nil(t, VerifyProofBatch(trie.StateRoot(), []ProofItem{item}))
+	}
+
+	buf.Reset()
+	assert.Nil(t, NewTrie(EmptyHash, memorydb.New()).DumpTo(&buf, FormatCSV))
+	assert.Equal(t, "key,value\n", buf.String())
+}
+
+func TestDumpUnknownFormat(t *testing.T) {
+	trie := NewTrie(EmptyHash, memorydb.New())
+	assert.NotNil(t, trie.DumpTo(&bytes.Buffer{}, Format(3)))
+}
@@ -0,0 +1,101 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// EIP1186Proof is the proof of an account and its storage slots in the JSON format of
+// eth_getProof (EIP-1186), so tools built around Ethereum proofs can read proofs of
+// tries of this package. Like the snap payloads, only the format is Ethereum's, proof
+// nodes are nodes of this package and must be verified with VerifyProof against
+// roots of this package
+type EIP1186Proof struct {
+	Address      common.Address        `json:"address"`
+	AccountProof []hexutil.Bytes       `json:"accountProof"`
+	Balance      *hexutil.Big          `json:"balance"`
+	CodeHash     common.Hash           `json:"codeHash"`
+	Nonce        hexutil.Uint64        `json:"nonce"`
+	StorageHash  common.Hash           `json:"storageHash"`
+	StorageProof []EIP1186StorageProof `json:"storageProof"`
+}
+
+// EIP1186StorageProof is the proof of a storage slot, Value is zero if the slot is
+// absent and Proof prove its absence
+type EIP1186StorageProof struct {
+	Key   common.Hash     `json:"key"`
+	Value *hexutil.Big    `json:"value"`
+	Proof []hexutil.Bytes `json:"proof"`
+}
+
+// eip1186Account is the RLP of an account in the state trie
+type eip1186Account struct {
+	Nonce    uint64
+	Balance  *big.Int
+	Root     common.Hash
+	CodeHash []byte
+}
+
+// EIP1186Proof return the proof of address and its slots like eth_getProof, the trie
+// is a state trie keyed by the hash of addresses, whose values are RLP accounts,
+// and storage tries are in the same db, keyed by the hash of slots, whose values
+// are RLP encoded integers. An absent account is proved absent and has zero fields,
+// the hash of empty code and the root of empty storage
+func (t *Trie) EIP1186Proof(address common.Address, slots []common.Hash) (*EIP1186Proof, error) {
+	accountKey := keccak256Hash(address[:])
+	value, proof, err := t.GetWithProof(accountKey[:])
+	if err != nil {
+		return nil, err
+	}
+	account := eip1186Account{Balance: new(big.Int), Root: EmptyHash, CodeHash: EmptyHash[:]}
+	if value != nil {
+		if err := rlp.DecodeBytes(value, &account); err != nil {
+			return nil, fmt.Errorf("value of account %x is not an RLP account: %v", address, err)
+		}
+	}
+	result := &EIP1186Proof{
+		Address:      address,
+		AccountProof: hexProof(proof),
+		Balance:      (*hexutil.Big)(account.Balance),
+		CodeHash:     common.BytesToHash(account.CodeHash),
+		Nonce:        hexutil.Uint64(account.Nonce),
+		StorageHash:  account.Root,
+		StorageProof: make([]EIP1186StorageProof, 0, len(slots)),
+	}
+	storage := t.derive(account.Root, t.log.committed())
+	for _, slot := range slots {
+		slotKey := keccak256Hash(slot[:])
+		value, proof, err := storage.GetWithProof(slotKey[:])
+		if err != nil {
+			return nil, err
+		}
+		var content []byte
+		if value != nil {
+			if err := rlp.DecodeBytes(value, &content); err != nil {
+				return nil, fmt.Errorf("value of slot %x is not RLP: %v", slot, err)
+			}
+		}
+		result.StorageProof = append(result.StorageProof, EIP1186StorageProof{
+			Key:   slot,
+			Value: (*hexutil.Big)(new(big.Int).SetBytes(content)),
+			Proof: hexProof(proof),
+		})
+	}
+	return result, nil
+}
+
+// hexProof return the nodes of proof as hex strings of JSON
+func hexProof(proof [][]byte) []hexutil.Bytes {
+	nodes := make([]hexutil.Bytes, len(proof))
+	for i, node := range proof {
+		nodes[i] = node
+	}
+	return nodes
+}
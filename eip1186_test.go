@@ -0,0 +1,93 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/stretchr/testify/assert"
+)
+
+func toNodes(proof []hexutil.Bytes) [][]byte {
+	nodes := make([][]byte, len(proof))
+	for i, node := range proof {
+		nodes[i] = node
+	}
+	return nodes
+}
+
+func TestEIP1186Proof(t *testing.T) {
+	memDB := memorydb.New()
+	storage := NewTrie(EmptyHash, memDB)
+	for i := 1; i <= 20; i++ {
+		slot := common.BigToHash(big.NewInt(int64(i)))
+		value, _ := rlp.EncodeToBytes(big.NewInt(int64(i * 1000)))
+		key := keccak256Hash(slot[:])
+		storage = storage.Insert(key[:], value)
+	}
+	storage.Persist()
+
+	address := common.HexToAddress("0x1234")
+	codeHash := keccak256Hash([]byte("code"))
+	state := NewTrie(EmptyHash, memDB)
+	for i := 0; i < 50; i++ {
+		other, _ := rlp.EncodeToBytes(&eip1186Account{Nonce: uint64(i), Balance: big.NewInt(1), Root: EmptyHash, CodeHash: EmptyHash[:]})
+		key := keccak256Hash(Uint64Key(uint64(i)))
+		state = state.Insert(key[:], other)
+	}
+	account, _ := rlp.EncodeToBytes(&eip1186Account{Nonce: 7, Balance: big.NewInt(1e18), Root: storage.StateRoot(), CodeHash: codeHash[:]})
+	accountKey := keccak256Hash(address[:])
+	state = state.Insert(accountKey[:], account)
+	state.Persist()
+	state = NewTrie(state.StateRoot(), memDB)
+
+	slots := []common.Hash{common.BigToHash(big.NewInt(3)), common.BigToHash(big.NewInt(99))}
+	result, err := state.EIP1186Proof(address, slots)
+	assert.Nil(t, err)
+	assert.Equal(t, hexutil.Uint64(7), result.Nonce)
+	assert.Equal(t, big.NewInt(1e18), result.Balance.ToInt())
+	assert.Equal(t, codeHash, result.CodeHash)
+	assert.Equal(t, storage.StateRoot(), result.StorageHash)
+	value, err := VerifyProof(state.StateRoot(), accountKey[:], toNodes(result.AccountProof))
+	assert.Nil(t, err)
+	assert.Equal(t, account, value)
+	assert.Equal(t, big.NewInt(3000), result.StorageProof[0].Value.ToInt())
+	assert.Equal(t, big.NewInt(0), result.StorageProof[1].Value.ToInt())
+	for _, proof := range result.StorageProof {
+		key := keccak256Hash(proof.Key[:])
+		_, err := VerifyProof(result.StorageHash, key[:], toNodes(proof.Proof))
+		assert.Nil(t, err)
+	}
+
+	encoded, err := json.Marshal(result)
+	assert.Nil(t, err)
+	var fields map[string]interface{}
+	assert.Nil(t, json.Unmarshal(encoded, &fields))
+	for _, name := range []string{"address", "accountProof", "balance", "codeHash", "nonce", "storageHash", "storageProof"} {
+		assert.Contains(t, fields, name)
+	}
+	assert.Equal(t, "0xde0b6b3a7640000", fields["balance"])
+	assert.Equal(t, "0x7", fields["nonce"])
+	storageProof := fields["storageProof"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "0xbb8", storageProof["value"])
+
+	// an absent account is proved absent
+	result, err = state.EIP1186Proof(common.HexToAddress("0x5678"), slots[:1])
+	assert.Nil(t, err)
+	assert.Equal(t, EmptyHash, result.StorageHash)
+	assert.Equal(t, EmptyHash, result.CodeHash)
+	assert.Equal(t, big.NewInt(0), result.Balance.ToInt())
+	absentKey := keccak256Hash(common.HexToAddress("0x5678").Bytes())
+	value, err = VerifyProof(state.StateRoot(), absentKey[:], toNodes(result.AccountProof))
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+	assert.Equal(t, big.NewInt(0), result.StorageProof[0].Value.ToInt())
+	assert.Empty(t, result.StorageProof[0].Proof)
+}
@@ -38,7 +38,7 @@ func decodeKey(flag byte, bytes []byte) ([]byte, byte) {
 	if flag>>4 == 1 {
 		nibbles = nibbles[0 : len(nibbles)-1]
 	}
-	return nibbles, flag & 0x0f
+	return nibbles, flag & typeMask
 }
 
 // matchingLength return common prefix length of two bytes
@@ -0,0 +1,197 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"errors"
+
+	db "github.com/ethereum/go-ethereum/ethdb"
+)
+
+// ErrInvalidExpiryIndex is returned when a key of the expiry index can't be parsed
+var ErrInvalidExpiryIndex = errors.New("invalid key in expiry index")
+
+// key spaces of the index trie of ExpiryTrie:
+// - epoch space: CompositeKey("e", Uint64Key(expiry), key) => empty value
+// - key space: CompositeKey("k", key) => Uint64Key(expiry)
+var (
+	expiryEpochSpace = []byte("e")
+	expiryKeySpace   = []byte("k")
+)
+
+// ExpiryTrie is a trie whose keys have expiry epochs, a secondary index trie map
+// expiry epochs to keys, so expired keys can be found without scanning all leaves
+// of the data trie. The data and index trie must be updated together through the
+// ExpiryTrie, keys inserted to the data trie directly never expire. Like Trie, it's
+// immutable, every update return a new ExpiryTrie
+type ExpiryTrie struct {
+	data  *Trie
+	index *Trie
+}
+
+// NewExpiryTrie create an ExpiryTrie from the data trie and its index trie
+func NewExpiryTrie(data, index *Trie) *ExpiryTrie {
+	return &ExpiryTrie{
+		data:  data,
+		index: index,
+	}
+}
+
+// Data return the data trie
+func (e *ExpiryTrie) Data() *Trie {
+	return e.data
+}
+
+// Index return the index trie
+func (e *ExpiryTrie) Index() *Trie {
+	return e.index
+}
+
+func expiryEpochKey(expiry uint64, key []byte) []byte {
+	return CompositeKey(expiryEpochSpace, Uint64Key(expiry), key)
+}
+
+func expiryKey(key []byte) []byte {
+	return CompositeKey(expiryKeySpace, key)
+}
+
+// Get returns the value for key stored in the data trie, expired keys are returned
+// until they are deleted
+func (e *ExpiryTrie) Get(key []byte) []byte {
+	return e.data.Get(key)
+}
+
+// Expiry return the expiry epoch of key, false is returned if key have no expiry
+func (e *ExpiryTrie) Expiry(key []byte) (uint64, bool, error) {
+	encoded, err := e.index.TryGet(expiryKey(key))
+	if err != nil || encoded == nil {
+		return 0, false, err
+	}
+	expiry, err := ParseUint64Key(encoded)
+	if err != nil {
+		return 0, false, err
+	}
+	return expiry, true, nil
+}
+
+// Insert insert key and value which expire at epoch expiry, return a new ExpiryTrie.
+// It panics if nodes can't be resolved, use TryInsert to get the error instead
+func (e *ExpiryTrie) Insert(key, value []byte, expiry uint64) *ExpiryTrie {
+	newTrie, err := e.TryInsert(key, value, expiry)
+	if err != nil {
+		panic(err)
+	}
+	return newTrie
+}
+
+// TryInsert insert key and value which expire at epoch expiry, the expiry of key
+// is replaced if key already exist
+func (e *ExpiryTrie) TryInsert(key, value []byte, expiry uint64) (*ExpiryTrie, error) {
+	index, err := e.unindex(key)
+	if err != nil {
+		return nil, err
+	}
+	if index, err = index.TryInsert(expiryEpochKey(expiry, key), []byte{}); err != nil {
+		return nil, err
+	}
+	if index, err = index.TryInsert(expiryKey(key), Uint64Key(expiry)); err != nil {
+		return nil, err
+	}
+	data, err := e.data.TryInsert(key, value)
+	if err != nil {
+		return nil, err
+	}
+	return NewExpiryTrie(data, index), nil
+}
+
+// Delete delete key and its expiry, return a new ExpiryTrie. It panics if nodes
+// can't be resolved, use TryDelete to get the error instead
+func (e *ExpiryTrie) Delete(key []byte) *ExpiryTrie {
+	newTrie, err := e.TryDelete(key)
+	if err != nil {
+		panic(err)
+	}
+	return newTrie
+}
+
+// TryDelete delete key and its expiry
+func (e *ExpiryTrie) TryDelete(key []byte) (*ExpiryTrie, error) {
+	index, err := e.unindex(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := e.data.TryDelete(key)
+	if err != nil {
+		return nil, err
+	}
+	return NewExpiryTrie(data, index), nil
+}
+
+// unindex return the index trie with the expiry of key removed
+func (e *ExpiryTrie) unindex(key []byte) (*Trie, error) {
+	expiry, found, err := e.Expiry(key)
+	if err != nil || !found {
+		return e.index, err
+	}
+	index, err := e.index.TryDelete(expiryEpochKey(expiry, key))
+	if err != nil {
+		return nil, err
+	}
+	return index.TryDelete(expiryKey(key))
+}
+
+// ExpiredKeys traverse keys whose expiry is less than or equal to asOf in the order
+// of expiry, keys of the same expiry are in key order. Only the index trie is read,
+// and the traversal stop at the first key not expired yet
+func (e *ExpiryTrie) ExpiredKeys(asOf uint64, fn func(key []byte, expiry uint64) bool) error {
+	prefix := CompositeKey(expiryEpochSpace)
+	var parseErr error
+	err := e.index.IterateFrom(prefix, func(indexKey, _ []byte) bool {
+		if !bytes.HasPrefix(indexKey, prefix) {
+			return false
+		}
+		parts, err := ParseCompositeKey(indexKey)
+		if err == nil && len(parts) != 3 {
+			err = ErrInvalidExpiryIndex
+		}
+		var expiry uint64
+		if err == nil {
+			expiry, err = ParseUint64Key(parts[1])
+		}
+		if err != nil {
+			parseErr = err
+			return false
+		}
+		if expiry > asOf {
+			return false
+		}
+		return fn(parts[2], expiry)
+	})
+	if err != nil {
+		return err
+	}
+	return parseErr
+}
+
+// CommitToBatch write both the data and index trie to batch, and return their
+// reports, call Written on both once the batch is written. It panics if a commit
+// fails, the batch must not be written then
+func (e *ExpiryTrie) CommitToBatch(batch db.Batch) (data, index *CommitReport) {
+	return e.data.CommitToBatch(batch), e.index.CommitToBatch(batch)
+}
+
+// Persist write both the data and index trie in one batch, so they are always
+// consistent in db, and return their reports. The index trie must use the same
+// db as the data trie. It panics if the commits or the write of the batch fail
+func (e *ExpiryTrie) Persist() (data, index *CommitReport) {
+	batch := e.data.db.NewBatch()
+	data, index = e.CommitToBatch(batch)
+	if err := batch.Write(); err != nil {
+		panic(err)
+	}
+	data.Written()
+	index.Written()
+	return data, index
+}
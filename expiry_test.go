@@ -0,0 +1,88 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+type expiredKey struct {
+	key    []byte
+	expiry uint64
+}
+
+func collectExpired(t *testing.T, e *ExpiryTrie, asOf uint64) []expiredKey {
+	expired := make([]expiredKey, 0)
+	err := e.ExpiredKeys(asOf, func(key []byte, expiry uint64) bool {
+		expired = append(expired, expiredKey{key: key, expiry: expiry})
+		return true
+	})
+	assert.Nil(t, err)
+	return expired
+}
+
+func TestExpiryTrie(t *testing.T) {
+	memDB := memorydb.New()
+	e := NewExpiryTrie(NewTrie(EmptyHash, memDB), NewTrie(EmptyHash, memDB))
+	e = e.Insert([]byte{0x01}, []byte{0x11}, 10)
+	e = e.Insert([]byte{0x02, 0x00}, []byte{0x12}, 5)
+	e = e.Insert([]byte{0x03}, []byte{0x13}, 20)
+	e = e.Insert([]byte{0x00}, []byte{0x14}, 10)
+
+	assert.Equal(t, []expiredKey{}, collectExpired(t, e, 4))
+	assert.Equal(t, []expiredKey{
+		{key: []byte{0x02, 0x00}, expiry: 5},
+		{key: []byte{0x00}, expiry: 10},
+		{key: []byte{0x01}, expiry: 10},
+	}, collectExpired(t, e, 10))
+
+	// update the expiry of existing key
+	e = e.Insert([]byte{0x02, 0x00}, []byte{0x15}, 30)
+	expiry, found, err := e.Expiry([]byte{0x02, 0x00})
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, uint64(30), expiry)
+	assert.Equal(t, []byte{0x15}, e.Get([]byte{0x02, 0x00}))
+	assert.Equal(t, []expiredKey{
+		{key: []byte{0x00}, expiry: 10},
+		{key: []byte{0x01}, expiry: 10},
+		{key: []byte{0x03}, expiry: 20},
+	}, collectExpired(t, e, 25))
+
+	// delete expired keys, and reload from db
+	for _, expired := range collectExpired(t, e, 10) {
+		e = e.Delete(expired.key)
+	}
+	e.Persist()
+	e = NewExpiryTrie(NewTrie(e.Data().StateRoot(), memDB), NewTrie(e.Index().StateRoot(), memDB))
+	assert.Nil(t, e.Get([]byte{0x01}))
+	_, found, err = e.Expiry([]byte{0x01})
+	assert.Nil(t, err)
+	assert.False(t, found)
+	assert.Equal(t, []expiredKey{
+		{key: []byte{0x03}, expiry: 20},
+		{key: []byte{0x02, 0x00}, expiry: 30},
+	}, collectExpired(t, e, 100))
+}
+
+func TestExpiryTrieStop(t *testing.T) {
+	memDB := memorydb.New()
+	e := NewExpiryTrie(NewTrie(EmptyHash, memDB), NewTrie(EmptyHash, memDB))
+	kvs := uniqueKVs(100)
+	for i, elem := range kvs {
+		e = e.Insert(elem.k, elem.v, uint64(i))
+	}
+	count := 0
+	err := e.ExpiredKeys(99, func(key []byte, expiry uint64) bool {
+		assert.Equal(t, kvs[count].k, key)
+		assert.Equal(t, uint64(count), expiry)
+		count++
+		return count < 50
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 50, count)
+}
@@ -0,0 +1,132 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+)
+
+// ErrInjectedFault is returned by reads of FaultyStore which are failed on purpose
+var ErrInjectedFault = errors.New("injected fault")
+
+// FaultConfig is the faults injected into reads of FaultyStore
+type FaultConfig struct {
+	// ReadFailureRate is the probability a read fail with ErrInjectedFault
+	ReadFailureRate float64
+	// CorruptionRate is the probability a byte of the value returned by Get is flipped
+	CorruptionRate float64
+	// Latency is added to every read
+	Latency time.Duration
+	// Seed is the seed of the random source, so faults are reproducible across runs
+	Seed int64
+	// Clock is the clock of Latency waits, default is SystemClock
+	Clock Clock
+}
+
+// FaultyStore is a test support db which inject faults into reads of the wrapped
+// db, so error paths of tries, e.g. TryGet and Iterate, can be exercised reliably.
+// Writes are passed through untouched. A resolve is a Get of a node key, resolves
+// are counted so the Nth one can be failed deterministically
+type FaultyStore struct {
+	db.KeyValueStore
+
+	lock     sync.Mutex
+	config   FaultConfig
+	random   *rand.Rand
+	resolves int
+	failAt   map[int]struct{}
+}
+
+// NewFaultyStore wrap kvs with faults of config
+func NewFaultyStore(kvs db.KeyValueStore, config FaultConfig) *FaultyStore {
+	return &FaultyStore{
+		KeyValueStore: kvs,
+		config:        config,
+		random:        rand.New(rand.NewSource(config.Seed)),
+		failAt:        make(map[int]struct{}),
+	}
+}
+
+// SetConfig replace the faults injected into later reads
+func (s *FaultyStore) SetConfig(config FaultConfig) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.config = config
+}
+
+// FailNthResolve fail the nth resolve counted from now with ErrInjectedFault, n
+// starts from 1
+func (s *FaultyStore) FailNthResolve(n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failAt[s.resolves+n] = struct{}{}
+}
+
+// Resolves return the number of resolves so far
+func (s *FaultyStore) Resolves() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.resolves
+}
+
+// inject return the fault of a read of key, and whether the value should be corrupted
+func (s *FaultyStore) inject(key []byte) (bool, error) {
+	s.lock.Lock()
+	config := s.config
+	var err error
+	if len(key) == common.HashLength {
+		s.resolves++
+		if _, ok := s.failAt[s.resolves]; ok {
+			delete(s.failAt, s.resolves)
+			err = ErrInjectedFault
+		}
+	}
+	if err == nil && config.ReadFailureRate > 0 && s.random.Float64() < config.ReadFailureRate {
+		err = ErrInjectedFault
+	}
+	corrupt := config.CorruptionRate > 0 && s.random.Float64() < config.CorruptionRate
+	s.lock.Unlock()
+
+	if config.Latency > 0 {
+		clock := config.Clock
+		if clock == nil {
+			clock = SystemClock
+		}
+		<-clock.NewTimer(config.Latency).C()
+	}
+	return corrupt, err
+}
+
+// Has report whether key is in the wrapped db unless the read is failed
+func (s *FaultyStore) Has(key []byte) (bool, error) {
+	if _, err := s.inject(nil); err != nil {
+		return false, err
+	}
+	return s.KeyValueStore.Has(key)
+}
+
+// Get return the value of key in the wrapped db, which may be failed or corrupted
+func (s *FaultyStore) Get(key []byte) ([]byte, error) {
+	corrupt, err := s.inject(key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := s.KeyValueStore.Get(key)
+	if err != nil || !corrupt || len(value) == 0 {
+		return value, err
+	}
+	// never modify the value owned by the wrapped db
+	value = common.CopyBytes(value)
+	s.lock.Lock()
+	pos := s.random.Intn(len(value))
+	s.lock.Unlock()
+	value[pos] ^= 0xff
+	return value, nil
+}
@@ -0,0 +1,66 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaultyStoreFailNthResolve(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 100)
+	store := NewFaultyStore(memDB, FaultConfig{})
+	trie = NewTrie(trie.StateRoot(), store)
+	// NewTrie read the root by Has rather than resolve
+	assert.Equal(t, 0, store.Resolves())
+
+	store.FailNthResolve(2)
+	_, err := trie.TryGet(kvs[0].k)
+	assert.Equal(t, ErrInjectedFault, err.(*MissingNodeError).Err)
+	assert.Equal(t, 2, store.Resolves())
+	// only the nth resolve is failed
+	for _, elem := range kvs {
+		value, err := trie.TryGet(elem.k)
+		assert.Nil(t, err)
+		assert.Equal(t, elem.v, value)
+	}
+
+	// nodes resolved above are cached
+	trie = NewTrie(trie.StateRoot(), store)
+	store.FailNthResolve(1)
+	assert.NotNil(t, trie.Iterate(func(key, value []byte) bool { return true }))
+	assert.Nil(t, trie.Iterate(func(key, value []byte) bool { return true }))
+}
+
+func TestFaultyStoreRates(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 100)
+	store := NewFaultyStore(memDB, FaultConfig{ReadFailureRate: 1})
+	reader := NewTrie(trie.StateRoot(), store)
+	_, err := reader.TryGet(kvs[0].k)
+	assert.NotNil(t, err)
+	_, err = store.Has(nodeKey(trie.StateRoot()))
+	assert.Equal(t, ErrInjectedFault, err)
+
+	// corruption never modify the value in db
+	store.SetConfig(FaultConfig{CorruptionRate: 1, Seed: 1})
+	encoded, err := memDB.Get(nodeKey(trie.StateRoot()))
+	assert.Nil(t, err)
+	corrupted, err := store.Get(nodeKey(trie.StateRoot()))
+	assert.Nil(t, err)
+	assert.NotEqual(t, encoded, corrupted)
+	stored, _ := memDB.Get(nodeKey(trie.StateRoot()))
+	assert.Equal(t, encoded, stored)
+
+	store.SetConfig(FaultConfig{Latency: 10 * time.Millisecond})
+	start := time.Now()
+	value, err := NewTrie(trie.StateRoot(), store).TryGet(kvs[0].k)
+	assert.Nil(t, err)
+	assert.Equal(t, kvs[0].v, value)
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+}
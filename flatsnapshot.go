@@ -0,0 +1,207 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+	"github.com/lbqds/mpt/internal/varint"
+)
+
+// defaultMarkerInterval is the default number of entries between resume markers
+const defaultMarkerInterval = 10000
+
+// SnapshotMarker is the resume marker of a snapshot generation, entries before Next
+// have been written
+type SnapshotMarker struct {
+	Root common.Hash
+	// Next is the key generation resume from
+	Next []byte
+	// Entries is the number of entries written
+	Entries uint64
+	// Done is true if all entries have been written
+	Done bool
+}
+
+// SnapshotWriter is the output of GenerateSnapshot, entries are written in key order
+type SnapshotWriter interface {
+	// WriteEntry write a key value of the snapshot
+	WriteEntry(key, value []byte) error
+	// WriteMarker persist marker, entries written before it must be durable once
+	// it returns, entries written after the last marker may be lost and are written
+	// again on resume
+	WriteMarker(marker *SnapshotMarker) error
+	// Marker return the last persisted marker, or nil if generation never started
+	Marker() (*SnapshotMarker, error)
+}
+
+// SnapshotProgress is the progress of a snapshot generation
+type SnapshotProgress struct {
+	Entries uint64
+	// Percent is estimated by the position of the next key in the keyspace, which
+	// is accurate if keys are distributed evenly, e.g. hashed keys
+	Percent float64
+	Done    bool
+}
+
+// SnapshotConfig is the config of GenerateSnapshot
+type SnapshotConfig struct {
+	// MarkerInterval is the number of entries between resume markers, default is 10000
+	MarkerInterval int
+	// Progress is called after every marker is persisted if it isn't nil
+	Progress func(progress SnapshotProgress)
+}
+
+// GenerateSnapshot walk the trie of root and write all key values to out as a flat
+// snapshot, a resume marker is persisted every MarkerInterval entries, so if
+// generation is interrupted, e.g. by a restart, the next call resume from the last
+// marker of out rather than the first key. It returns immediately if the snapshot
+// of root is done, and an error if out hold the snapshot of another root
+func GenerateSnapshot(root common.Hash, kvs db.KeyValueStore, out SnapshotWriter, config SnapshotConfig) error {
+	if config.MarkerInterval <= 0 {
+		config.MarkerInterval = defaultMarkerInterval
+	}
+	marker, err := out.Marker()
+	if err != nil {
+		return err
+	}
+	if marker == nil {
+		marker = &SnapshotMarker{Root: root}
+	}
+	if marker.Root != root {
+		return fmt.Errorf("snapshot of root %s is in progress", marker.Root.Hex())
+	}
+	if marker.Done {
+		return nil
+	}
+
+	pending := 0
+	var genErr error
+	err = NewTrie(root, kvs).IterateFrom(marker.Next, func(key, value []byte) bool {
+		if pending == config.MarkerInterval {
+			marker.Next = common.CopyBytes(key)
+			if genErr = writeSnapshotMarker(out, marker, config); genErr != nil {
+				return false
+			}
+			pending = 0
+		}
+		if genErr = out.WriteEntry(key, value); genErr != nil {
+			return false
+		}
+		marker.Entries++
+		pending++
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if genErr != nil {
+		return genErr
+	}
+	marker.Next = nil
+	marker.Done = true
+	return writeSnapshotMarker(out, marker, config)
+}
+
+func writeSnapshotMarker(out SnapshotWriter, marker *SnapshotMarker, config SnapshotConfig) error {
+	if err := out.WriteMarker(marker); err != nil {
+		return err
+	}
+	if config.Progress != nil {
+		progress := SnapshotProgress{Entries: marker.Entries, Done: marker.Done}
+		if marker.Done {
+			progress.Percent = 100
+		} else {
+			progress.Percent = keyPosition(marker.Next) * 100
+		}
+		config.Progress(progress)
+	}
+	return nil
+}
+
+// keyPosition estimate the position of key in the keyspace in [0, 1) by its first
+// 8 bytes, all keys before it are assumed to have been visited
+func keyPosition(key []byte) float64 {
+	var prefix [8]byte
+	copy(prefix[:], key)
+	return float64(binary.BigEndian.Uint64(prefix[:])) / math.Pow(2, 64)
+}
+
+var errInvalidMarker = errors.New("invalid snapshot marker")
+
+// encodeSnapshotMarker encode marker as root | done | varint entries | next
+func encodeSnapshotMarker(marker *SnapshotMarker) []byte {
+	buf := make([]byte, common.HashLength+1, common.HashLength+1+varint.MaxLen+len(marker.Next))
+	copy(buf, marker.Root[:])
+	if marker.Done {
+		buf[common.HashLength] = 1
+	}
+	buf = varint.Append(buf, marker.Entries)
+	return append(buf, marker.Next...)
+}
+
+func decodeSnapshotMarker(data []byte) (*SnapshotMarker, error) {
+	if len(data) < common.HashLength+2 || data[common.HashLength] > 1 {
+		return nil, errInvalidMarker
+	}
+	marker := &SnapshotMarker{
+		Root: common.BytesToHash(data[:common.HashLength]),
+		Done: data[common.HashLength] == 1,
+	}
+	entries, next, ok := varint.Decode(data[common.HashLength+1:])
+	if !ok {
+		return nil, errInvalidMarker
+	}
+	marker.Entries = entries
+	if len(next) > 0 {
+		marker.Next = common.CopyBytes(next)
+	}
+	return marker, nil
+}
+
+// dbSnapshotWriter write entries and marker to a db, entries are buffered in a batch
+// which is written together with the marker
+type dbSnapshotWriter struct {
+	db    db.KeyValueStore
+	batch db.Batch
+}
+
+// NewDBSnapshotWriter return a SnapshotWriter which write the snapshot to kvs, entries
+// are stored in a dedicated keyspace, see schema.go
+func NewDBSnapshotWriter(kvs db.KeyValueStore) SnapshotWriter {
+	return &dbSnapshotWriter{db: kvs, batch: kvs.NewBatch()}
+}
+
+func (w *dbSnapshotWriter) WriteEntry(key, value []byte) error {
+	return w.batch.Put(snapshotEntryKey(key), value)
+}
+
+func (w *dbSnapshotWriter) WriteMarker(marker *SnapshotMarker) error {
+	if err := w.batch.Put(snapshotMarkerKey(), encodeSnapshotMarker(marker)); err != nil {
+		return err
+	}
+	if err := w.batch.Write(); err != nil {
+		return err
+	}
+	w.batch.Reset()
+	return nil
+}
+
+func (w *dbSnapshotWriter) Marker() (*SnapshotMarker, error) {
+	key := snapshotMarkerKey()
+	ok, err := w.db.Has(key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	data, err := w.db.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSnapshotMarker(data)
+}
@@ -0,0 +1,116 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+// crashingWriter fail once limit entries have been written
+type crashingWriter struct {
+	SnapshotWriter
+	written int
+	limit   int
+}
+
+func (w *crashingWriter) WriteEntry(key, value []byte) error {
+	if w.limit > 0 && w.written == w.limit {
+		return errors.New("crashed")
+	}
+	w.written++
+	return w.SnapshotWriter.WriteEntry(key, value)
+}
+
+func snapshotEntries(t *testing.T, memDB *memorydb.Database) map[string][]byte {
+	entries := make(map[string][]byte)
+	it := memDB.NewIterator(snapshotEntryPrefix, nil)
+	defer it.Release()
+	for it.Next() {
+		entries[string(bytes.TrimPrefix(it.Key(), snapshotEntryPrefix))] = it.Value()
+	}
+	assert.Nil(t, it.Error())
+	return entries
+}
+
+func TestGenerateSnapshot(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 1000)
+	outDB := memorydb.New()
+	var progresses []SnapshotProgress
+	config := SnapshotConfig{
+		MarkerInterval: 100,
+		Progress: func(progress SnapshotProgress) {
+			progresses = append(progresses, progress)
+		},
+	}
+	assert.Nil(t, GenerateSnapshot(trie.StateRoot(), memDB, NewDBSnapshotWriter(outDB), config))
+	assert.Equal(t, kvMap(kvs), snapshotEntries(t, outDB))
+
+	assert.Equal(t, 10, len(progresses))
+	for i, progress := range progresses {
+		assert.Equal(t, uint64(100*(i+1)), progress.Entries)
+		if i > 0 {
+			assert.True(t, progress.Percent > progresses[i-1].Percent)
+		}
+	}
+	assert.Equal(t, SnapshotProgress{Entries: 1000, Percent: 100, Done: true}, progresses[9])
+
+	marker, err := NewDBSnapshotWriter(outDB).Marker()
+	assert.Nil(t, err)
+	assert.Equal(t, &SnapshotMarker{Root: trie.StateRoot(), Entries: 1000, Done: true}, marker)
+
+	// done snapshot isn't generated again
+	writer := &crashingWriter{SnapshotWriter: NewDBSnapshotWriter(outDB)}
+	assert.Nil(t, GenerateSnapshot(trie.StateRoot(), memDB, writer, SnapshotConfig{}))
+	assert.Equal(t, 0, writer.written)
+
+	// snapshot of another root
+	other := trie.Insert([]byte{1}, []byte{1})
+	other.Persist()
+	assert.NotNil(t, GenerateSnapshot(other.StateRoot(), memDB, writer, SnapshotConfig{}))
+}
+
+func TestResumeSnapshot(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 1000)
+	outDB := memorydb.New()
+	config := SnapshotConfig{MarkerInterval: 100}
+
+	writer := &crashingWriter{SnapshotWriter: NewDBSnapshotWriter(outDB), limit: 450}
+	assert.NotNil(t, GenerateSnapshot(trie.StateRoot(), memDB, writer, config))
+	// entries after the last marker are lost
+	assert.Equal(t, 400, len(snapshotEntries(t, outDB)))
+	marker, err := writer.Marker()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(400), marker.Entries)
+	assert.False(t, marker.Done)
+
+	writer = &crashingWriter{SnapshotWriter: NewDBSnapshotWriter(outDB)}
+	assert.Nil(t, GenerateSnapshot(trie.StateRoot(), memDB, writer, config))
+	assert.Equal(t, 600, writer.written)
+	assert.Equal(t, kvMap(kvs), snapshotEntries(t, outDB))
+}
+
+func TestSnapshotMarkerEncoding(t *testing.T) {
+	markers := []*SnapshotMarker{
+		{Entries: 0},
+		{Root: EmptyHash, Next: []byte{1, 2, 3}, Entries: 1 << 40},
+		{Root: EmptyHash, Entries: 10, Done: true},
+	}
+	for _, marker := range markers {
+		decoded, err := decodeSnapshotMarker(encodeSnapshotMarker(marker))
+		assert.Nil(t, err)
+		assert.Equal(t, marker, decoded)
+	}
+	_, err := decodeSnapshotMarker(make([]byte, 10))
+	assert.Equal(t, errInvalidMarker, err)
+
+	assert.Equal(t, float64(0), keyPosition(nil))
+	assert.Equal(t, 0.5, keyPosition([]byte{0x80}))
+}
@@ -0,0 +1,316 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+	"github.com/lbqds/mpt/internal/varint"
+)
+
+// ChangeSet is the raw node writes and deletes of a commit, applying it to a db
+// holding the trie of Parent make the db hold the trie of Root
+type ChangeSet struct {
+	// Parent is the committed root the trie derived from
+	Parent common.Hash
+	Root   common.Hash
+	// Inserted is the encoded nodes written by the commit keyed by hash
+	Inserted map[common.Hash][]byte
+	// Deleted is the hashes of nodes deleted by the commit in ascending order
+	Deleted []common.Hash
+}
+
+// WithCommitHook call fn with the changes of every commit of the trie, whether by
+// Persist, CommitToBatch, Commit or PersistWithPruner, so they can be shipped to
+// replicas, see Follower. fn is called once the commit is written to underlying db,
+// commits failed to be written are never seen by it, and it must not modify the
+// change set
+func WithCommitHook(fn func(changes *ChangeSet)) Option {
+	return func(c *config) {
+		c.commitHook = fn
+	}
+}
+
+// prepareCommit find the changes of the commit for the commit hook, the history
+// index and the watcher while nodes replaced by the commit are still in underlying
+// db, and return the func delivering them once the commit is written
+func (t *Trie) prepareCommit(changes *logLayer) func() {
+	var record, notify func()
+	if t.config.history != nil {
+		record = t.config.history.prepare(t)
+	}
+	if t.config.watcher != nil {
+		notify = t.config.watcher.prepare(t)
+	}
+	var cs *ChangeSet
+	if t.config.commitHook != nil {
+		cs = &ChangeSet{
+			Parent:   t.baseRoot,
+			Root:     t.rootHash,
+			Inserted: make(map[common.Hash][]byte, len(changes.inserted)),
+			Deleted:  sortedHashes(changes.deleted),
+		}
+		for k, v := range changes.inserted {
+			cs.Inserted[k] = t.log.value(k, v)
+		}
+	}
+	return func() {
+		atomic.AddUint64(&t.config.commits, 1)
+		if record != nil {
+			record()
+		}
+		if notify != nil {
+			notify()
+		}
+		if cs != nil {
+			t.config.commitHook(cs)
+		}
+	}
+}
+
+var errInvalidChangeSet = errors.New("invalid change set")
+
+// Encode return the encoding of the change set, which is
+// parent | root | varint count | (hash | varint size | node)* | varint count | hash*
+// inserted nodes are in ascending order of hash, so the encoding is deterministic
+func (cs *ChangeSet) Encode() []byte {
+	hashes := sortedHashes(cs.Inserted)
+	size := 2*common.HashLength + 2*varint.MaxLen + len(cs.Deleted)*common.HashLength
+	for _, v := range cs.Inserted {
+		size += common.HashLength + varint.MaxLen + len(v)
+	}
+	buf := make([]byte, 0, size)
+	buf = append(buf, cs.Parent[:]...)
+	buf = append(buf, cs.Root[:]...)
+	buf = varint.Append(buf, uint64(len(hashes)))
+	for _, k := range hashes {
+		buf = append(buf, k[:]...)
+		buf = varint.Append(buf, uint64(len(cs.Inserted[k])))
+		buf = append(buf, cs.Inserted[k]...)
+	}
+	buf = varint.Append(buf, uint64(len(cs.Deleted)))
+	for _, k := range cs.Deleted {
+		buf = append(buf, k[:]...)
+	}
+	return buf
+}
+
+// DecodeChangeSet is the reverse of ChangeSet.Encode
+func DecodeChangeSet(data []byte) (*ChangeSet, error) {
+	hash := func() (common.Hash, error) {
+		if len(data) < common.HashLength {
+			return common.Hash{}, errInvalidChangeSet
+		}
+		h := common.BytesToHash(data[:common.HashLength])
+		data = data[common.HashLength:]
+		return h, nil
+	}
+	uvarint := func() (uint64, error) {
+		v, rest, ok := varint.Decode(data)
+		if !ok {
+			return 0, errInvalidChangeSet
+		}
+		data = rest
+		return v, nil
+	}
+	cs := &ChangeSet{}
+	var err error
+	if cs.Parent, err = hash(); err != nil {
+		return nil, err
+	}
+	if cs.Root, err = hash(); err != nil {
+		return nil, err
+	}
+	count, err := uvarint()
+	if err != nil {
+		return nil, err
+	}
+	// every node take more than a hash, so a huge count is rejected before allocation
+	if count > uint64(len(data)/common.HashLength) {
+		return nil, errInvalidChangeSet
+	}
+	cs.Inserted = make(map[common.Hash][]byte, count)
+	for i := uint64(0); i < count; i++ {
+		k, err := hash()
+		if err != nil {
+			return nil, err
+		}
+		size, err := uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if size > uint64(len(data)) {
+			return nil, errInvalidChangeSet
+		}
+		cs.Inserted[k] = common.CopyBytes(data[:size])
+		data = data[size:]
+	}
+	if count, err = uvarint(); err != nil {
+		return nil, err
+	}
+	if count != uint64(len(data)/common.HashLength) || len(data)%common.HashLength != 0 {
+		return nil, errInvalidChangeSet
+	}
+	cs.Deleted = make([]common.Hash, 0, count)
+	for len(data) > 0 {
+		k, _ := hash()
+		cs.Deleted = append(cs.Deleted, k)
+	}
+	return cs, nil
+}
+
+// changeSetReader read nodes of the db after cs is applied without writing it
+type changeSetReader struct {
+	db      db.KeyValueReader
+	cs      *ChangeSet
+	deleted map[common.Hash]struct{}
+}
+
+func (r *changeSetReader) lookup(key []byte) ([]byte, bool) {
+	if len(key) != common.HashLength {
+		return nil, false
+	}
+	hash := common.BytesToHash(key)
+	if encoded, ok := r.cs.Inserted[hash]; ok {
+		return encoded, true
+	}
+	if _, ok := r.deleted[hash]; ok {
+		return nil, true
+	}
+	return nil, false
+}
+
+func (r *changeSetReader) Has(key []byte) (bool, error) {
+	if encoded, ok := r.lookup(key); ok {
+		return encoded != nil, nil
+	}
+	return r.db.Has(key)
+}
+
+func (r *changeSetReader) Get(key []byte) ([]byte, error) {
+	if encoded, ok := r.lookup(key); ok {
+		if encoded == nil {
+			return nil, fmt.Errorf("node %x is deleted", key)
+		}
+		return encoded, nil
+	}
+	return r.db.Get(key)
+}
+
+// Follower apply change sets of a primary, e.g. received from its commit hook,
+// to a replica db, so the replica is a warm standby holding the same tries. Every
+// change set is verified before it's written: it must derive from the current
+// root of the follower, and its root must resolve fully in the replica after it's
+// applied, otherwise the replica is left unchanged. Nodes verified by previous
+// change sets and not deleted are not verified again, so the cost of a change set
+// is proportional to its size, at the cost of keeping the hashes of the current
+// trie in memory. It's not safe for concurrent use
+type Follower struct {
+	db       db.KeyValueStore
+	root     common.Hash
+	verified map[common.Hash]struct{}
+}
+
+// NewFollower create a follower of the replica kvs, which hold the trie of root
+func NewFollower(kvs db.KeyValueStore, root common.Hash) *Follower {
+	return &Follower{
+		db:       kvs,
+		root:     root,
+		verified: make(map[common.Hash]struct{}),
+	}
+}
+
+// Root return the root the replica hold now
+func (f *Follower) Root() common.Hash {
+	return f.root
+}
+
+// Apply verify cs and write it to the replica
+func (f *Follower) Apply(cs *ChangeSet) error {
+	if cs.Parent != f.root {
+		return fmt.Errorf("change set derive from %s rather than %s", cs.Parent.Hex(), f.root.Hex())
+	}
+	reader := &changeSetReader{
+		db:      f.db,
+		cs:      cs,
+		deleted: make(map[common.Hash]struct{}, len(cs.Deleted)),
+	}
+	for _, k := range cs.Deleted {
+		reader.deleted[k] = struct{}{}
+	}
+	for k, v := range cs.Inserted {
+		if keccak256Hash(v) != k {
+			return fmt.Errorf("inserted node %s doesn't match its hash", k.Hex())
+		}
+	}
+	// deleted nodes are dropped even if the change set is rejected, since they may
+	// be gone after a later one is applied
+	for _, k := range cs.Deleted {
+		delete(f.verified, k)
+	}
+	added, err := f.verify(reader, cs.Root)
+	if err != nil {
+		return err
+	}
+	batch := f.db.NewBatch()
+	for k, v := range cs.Inserted {
+		if err := batch.Put(nodeKey(k), v); err != nil {
+			return err
+		}
+	}
+	for _, k := range cs.Deleted {
+		if _, ok := cs.Inserted[k]; ok {
+			continue
+		}
+		if err := batch.Delete(nodeKey(k)); err != nil {
+			return err
+		}
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	// hashes verified before but no longer reachable stay in the set, they are
+	// dropped once deleted by a later change set
+	for k := range added {
+		f.verified[k] = struct{}{}
+	}
+	f.root = cs.Root
+	return nil
+}
+
+// verify check all nodes reachable from root exist in reader, subtrees verified
+// before are skipped, and return the hashes newly verified
+func (f *Follower) verify(reader db.KeyValueReader, root common.Hash) (map[common.Hash]struct{}, error) {
+	added := make(map[common.Hash]struct{})
+	if isEmptyRoot(root) {
+		return added, nil
+	}
+	stack := []common.Hash{root}
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, ok := f.verified[hash]; ok {
+			continue
+		}
+		if _, ok := added[hash]; ok {
+			continue
+		}
+		encoded, err := reader.Get(nodeKey(hash))
+		if err != nil || len(encoded) == 0 {
+			return nil, &MissingNodeError{Hash: hash, Err: err}
+		}
+		added[hash] = struct{}{}
+		err = childRefs(encoded, func(child common.Hash) {
+			stack = append(stack, child)
+		})
+		if err != nil {
+			return nil, &MissingNodeError{Hash: hash, Err: err}
+		}
+	}
+	return added, nil
+}
@@ -0,0 +1,173 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFollower(t *testing.T) {
+	primary := memorydb.New()
+	changes := make([][]byte, 0)
+	hook := WithCommitHook(func(cs *ChangeSet) {
+		changes = append(changes, cs.Encode())
+	})
+	trie := NewTrie(EmptyHash, primary, hook)
+	kvs := uniqueKVs(300)
+	for i, elem := range kvs {
+		trie = trie.Insert(elem.k, elem.v)
+		if i%100 == 99 {
+			trie.Persist()
+			trie = NewTrie(trie.StateRoot(), primary, hook)
+		}
+	}
+	for _, elem := range kvs[:50] {
+		trie = trie.Delete(elem.k)
+	}
+	_, err := trie.Commit()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(changes))
+
+	replica := memorydb.New()
+	follower := NewFollower(replica, EmptyHash)
+	for i, data := range changes {
+		cs, err := DecodeChangeSet(data)
+		assert.Nil(t, err)
+		assert.Equal(t, data, cs.Encode())
+		if i+1 < len(changes) {
+			// change sets must be applied in order
+			next, _ := DecodeChangeSet(changes[i+1])
+			assert.NotNil(t, follower.Apply(next))
+		}
+		assert.Nil(t, follower.Apply(cs))
+		assert.Equal(t, cs.Root, follower.Root())
+	}
+	assert.Equal(t, trie.StateRoot(), follower.Root())
+	assert.Equal(t, primary.Len(), replica.Len())
+	reader := NewTrie(follower.Root(), replica)
+	for i, elem := range kvs {
+		value, err := reader.TryGet(elem.k)
+		assert.Nil(t, err)
+		if i < 50 {
+			assert.Nil(t, value)
+		} else {
+			assert.Equal(t, elem.v, value)
+		}
+	}
+}
+
+// failingDB fail to write every batch
+type failingDB struct {
+	*memorydb.Database
+}
+
+var errWriteFailed = errors.New("write failed")
+
+func (d *failingDB) NewBatch() db.Batch {
+	return &failingBatch{d.Database.NewBatch()}
+}
+
+type failingBatch struct {
+	db.Batch
+}
+
+func (b *failingBatch) Write() error {
+	return errWriteFailed
+}
+
+func TestCommitHookFailedWrite(t *testing.T) {
+	memDB := memorydb.New()
+	fired := 0
+	history := NewHistoryIndex()
+	watcher := NewWatcher(16)
+	ch := watcher.Watch(nil)
+	opts := []Option{
+		WithCommitHook(func(cs *ChangeSet) { fired++ }),
+		WithHistoryIndex(history),
+		WithWatcher(watcher),
+	}
+	trie := NewTrie(EmptyHash, memDB, opts...).Insert([]byte{1}, []byte{1})
+	trie.Persist()
+	assert.Equal(t, 1, fired)
+	<-ch
+
+	failing := &failingDB{memDB}
+	trie = NewTrie(trie.StateRoot(), failing, opts...).Insert([]byte{2}, []byte{2})
+	assert.PanicsWithValue(t, errWriteFailed, func() { trie.Persist() })
+	_, err := trie.Commit()
+	assert.Equal(t, errWriteFailed, err)
+	_, err = NewCommitGroup(failing).Commit(trie)
+	assert.Equal(t, errWriteFailed, err)
+	subtree, _, err := trie.CommitSubtree([]byte{2})
+	assert.Nil(t, subtree)
+	assert.Equal(t, errWriteFailed, err)
+	batch := failing.NewBatch()
+	report, err := trie.CommitToBatchOrdered(batch, BatchOptions{})
+	assert.Nil(t, err)
+	assert.NotNil(t, batch.Write())
+
+	// nothing is delivered until the commit is written
+	assert.Equal(t, 1, fired)
+	assert.Equal(t, uint64(0), trie.CommitSeq())
+	assert.Equal(t, 0, len(ch))
+	assert.Equal(t, 0, len(history.HistoryOf([]byte{2})))
+	report.Written()
+	assert.Equal(t, 2, fired)
+	assert.Equal(t, uint64(1), trie.CommitSeq())
+	assert.Equal(t, 1, len(ch))
+	assert.Equal(t, 1, len(history.HistoryOf([]byte{2})))
+}
+
+func TestFollowerReject(t *testing.T) {
+	var last *ChangeSet
+	primary := memorydb.New()
+	trie := NewTrie(EmptyHash, primary, WithCommitHook(func(cs *ChangeSet) {
+		last = cs
+	}))
+	for _, elem := range uniqueKVs(100) {
+		trie = trie.Insert(elem.k, elem.v)
+	}
+	trie.Persist()
+
+	replica := memorydb.New()
+	follower := NewFollower(replica, EmptyHash)
+	// a node of the change set is missing
+	incomplete := &ChangeSet{Parent: last.Parent, Root: last.Root, Inserted: make(map[common.Hash][]byte)}
+	for k, v := range last.Inserted {
+		incomplete.Inserted[k] = v
+	}
+	for k := range incomplete.Inserted {
+		if k != last.Root {
+			delete(incomplete.Inserted, k)
+			break
+		}
+	}
+	_, ok := follower.Apply(incomplete).(*MissingNodeError)
+	assert.True(t, ok)
+	assert.Equal(t, 0, replica.Len())
+	assert.Equal(t, EmptyHash, follower.Root())
+
+	// a node doesn't match its hash
+	tampered := &ChangeSet{Parent: last.Parent, Root: last.Root, Inserted: make(map[common.Hash][]byte)}
+	for k, v := range last.Inserted {
+		tampered.Inserted[k] = v
+	}
+	tampered.Inserted[last.Root] = append([]byte{0}, last.Inserted[last.Root]...)
+	assert.NotNil(t, follower.Apply(tampered))
+	assert.Equal(t, 0, replica.Len())
+
+	assert.Nil(t, follower.Apply(last))
+	assert.Equal(t, primary.Len(), replica.Len())
+
+	for _, data := range [][]byte{nil, last.Encode()[:70], append(last.Encode(), 1)} {
+		_, err := DecodeChangeSet(data)
+		assert.NotNil(t, err)
+	}
+}
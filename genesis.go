@@ -0,0 +1,64 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// nodeCollector is a NodeStore which collect distinct nodes in the order of writes
+type nodeCollector struct {
+	nodes []Node
+	seen  map[string]struct{}
+}
+
+func (c *nodeCollector) Put(key []byte, value []byte) error {
+	if _, ok := c.seen[string(key)]; ok {
+		return nil
+	}
+	n, err := decodeNode(value)
+	if err != nil {
+		return err
+	}
+	c.seen[string(key)] = struct{}{}
+	c.nodes = append(c.nodes, n)
+	return nil
+}
+
+func (c *nodeCollector) Delete(key []byte) error {
+	return nil
+}
+
+// GenesisRoot compute the root of the trie holding the key values of alloc and all
+// nodes stored by hash in the trie. Key values are applied in key order, so the
+// root and the nodes, including their order, only depend on the content of alloc,
+// which let genesis tooling reproduce an exact root from an allocation file. Nodes
+// are in post order with the root last, writing the encoding of every node keyed
+// by its hash to a db make the trie readable by NewTrie
+func GenesisRoot(alloc map[string][]byte) (common.Hash, []Node) {
+	keys := make([]string, 0, len(alloc))
+	for key := range alloc {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	collector := &nodeCollector{
+		nodes: make([]Node, 0),
+		seen:  make(map[string]struct{}),
+	}
+	builder := newStackBuilder(collector)
+	for _, key := range keys {
+		// keys are distinct and sorted, and the collector never fail on nodes
+		// encoded by the builder
+		if err := builder.add([]byte(key), alloc[key]); err != nil {
+			panic(err)
+		}
+	}
+	root, err := builder.commit()
+	if err != nil {
+		panic(err)
+	}
+	return root, collector.nodes
+}
@@ -0,0 +1,63 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenesisRoot(t *testing.T) {
+	alloc := kvMap(uniqueKVs(500))
+	alloc[string([]byte{0x01})] = []byte{0x01}
+	alloc[string([]byte{0x01, 0x02})] = []byte{0x02}
+	root, nodes := GenesisRoot(alloc)
+	assert.Equal(t, root, nodes[len(nodes)-1].Hash())
+
+	// same as the trie built by inserts in any order
+	memDB := memorydb.New()
+	trie := NewTrie(EmptyHash, memDB)
+	for k, v := range alloc {
+		trie = trie.Insert([]byte(k), v)
+	}
+	assert.Equal(t, trie.StateRoot(), root)
+	trie.Persist()
+	assert.Equal(t, memDB.Len(), len(nodes))
+	for _, n := range nodes {
+		encoded, err := memDB.Get(nodeKey(n.Hash()))
+		assert.Nil(t, err)
+		assert.Equal(t, encoded, n.Encoded())
+	}
+
+	// nodes are enough to open the trie
+	genesisDB := memorydb.New()
+	for _, n := range nodes {
+		assert.Nil(t, genesisDB.Put(nodeKey(n.Hash()), n.Encoded()))
+	}
+	assert.Nil(t, checkSubtree(genesisDB, root, make(map[common.Hash]struct{})))
+	genesis := NewTrie(root, genesisDB)
+	for k, v := range alloc {
+		assert.Equal(t, v, genesis.Get([]byte(k)))
+	}
+
+	// deterministic
+	again, againNodes := GenesisRoot(alloc)
+	assert.Equal(t, root, again)
+	assert.Equal(t, len(nodes), len(againNodes))
+	for i := range nodes {
+		assert.Equal(t, nodes[i].Encoded(), againNodes[i].Encoded())
+	}
+
+	root, nodes = GenesisRoot(map[string][]byte{})
+	assert.Equal(t, EmptyHash, root)
+	assert.Equal(t, 0, len(nodes))
+
+	// the root is stored even if it's small
+	root, nodes = GenesisRoot(map[string][]byte{"a": {1}})
+	assert.Equal(t, 1, len(nodes))
+	assert.Equal(t, root, nodes[0].Hash())
+}
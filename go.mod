@@ -6,4 +6,6 @@ require (
 	github.com/ethereum/go-ethereum v1.9.21
 	github.com/golang/protobuf v1.4.2
 	github.com/stretchr/testify v1.6.1
+	github.com/syndtr/goleveldb v1.0.1-0.20200815110645-5c35d600f0ca
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 )
@@ -0,0 +1,154 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ErrGraftConflict is returned by Graft when the trie already have keys under the prefix
+var ErrGraftConflict = errors.New("trie already have keys under the graft prefix")
+
+// Graft attach the persisted trie of subRoot under prefix, every key of the sub
+// trie become prefix followed by the key. Nodes of the sub trie are shared rather
+// than copied, so it's O(len(prefix)) no matter how large the sub trie is, and the
+// sub trie must be in the same db. The key space of the sub trie must be free in
+// the trie, ErrGraftConflict is returned if any key of the trie start with prefix
+func (t *Trie) Graft(prefix []byte, subRoot common.Hash) (newTrie *Trie, err error) {
+	defer recoverResolveError(&err)
+	if t.empty(subRoot) {
+		return t, nil
+	}
+	subNode, err := t.resolveHash(subRoot)
+	if err != nil {
+		return nil, err
+	}
+	path := bytesToNibbles(prefix)
+	var result *insertResult
+	if t.empty(t.rootHash) {
+		newRootNode := withKeyPrefix(path, subNode, t.config.taggedRefs)
+		result = newInsertResult(newRootNode)
+		result.insert(newRootNode)
+	} else {
+		rootNode, err := t.resolveHash(t.rootHash)
+		if err != nil {
+			return nil, err
+		}
+		result = t.graft(rootNode, path, subNode)
+		if result == nil {
+			return nil, ErrGraftConflict
+		}
+	}
+	return t.derive(result.newNode.Hash(), t.log.mergeFromInsertResult(t.rootHash, result)), nil
+}
+
+// graft attach subNode at path under startNode, nil is returned if startNode
+// have keys under path
+func (t *Trie) graft(startNode node, path []byte, subNode node) *insertResult {
+	switch n := startNode.(type) {
+	case *leafNode:
+		ml := matchingLength(path, n.key)
+		if ml == len(path) {
+			return nil
+		}
+		var branch *branchNode
+		var maybeLeaf node
+		if ml == len(n.key) {
+			branch = branchWithTarget(n.value, t.config.taggedRefs)
+		} else {
+			maybeLeaf = newLeafNode(n.key[ml+1:], n.value)
+			branch = branchWithChild(int(n.key[ml]), maybeLeaf, nil, t.config.taggedRefs)
+		}
+		result := t.graft(branch, path[ml:], subNode)
+		result.insert(maybeLeaf)
+		result.delete(n)
+		return wrapGraftResult(result, path[:ml], t.config.taggedRefs)
+	case *extNode:
+		ml := matchingLength(path, n.key)
+		if ml == len(path) {
+			return nil
+		}
+		if ml == len(n.key) {
+			result := t.graft(n.child, path[ml:], subNode)
+			if result == nil {
+				return nil
+			}
+			result.delete(n)
+			return wrapGraftResult(result, n.key, n.tagged)
+		}
+		// diverge at ml, the rest of ext become a child of a new branch
+		rest := withKeyPrefix(n.key[ml+1:], n.child, n.tagged)
+		branch := branchWithChild(int(n.key[ml]), rest, nil, n.tagged)
+		result := t.graft(branch, path[ml:], subNode)
+		if len(n.key[ml+1:]) > 0 {
+			result.insert(rest)
+		}
+		result.delete(n)
+		return wrapGraftResult(result, path[:ml], t.config.taggedRefs)
+	case *branchNode:
+		if len(path) == 0 {
+			return nil
+		}
+		pos := int(path[0])
+		if n.children[pos] != nil {
+			result := t.graft(n.children[pos], path[1:], subNode)
+			if result == nil {
+				return nil
+			}
+			newBranch := n.updateChild(pos, result.newNode)
+			result.newNode = newBranch
+			result.insert(newBranch)
+			result.delete(n)
+			return result
+		}
+		child := withKeyPrefix(path[1:], subNode, n.tagged)
+		newBranch := n.updateChild(pos, child)
+		result := newInsertResult(newBranch)
+		result.insert(newBranch)
+		if child != subNode {
+			result.insert(child)
+		}
+		result.delete(n)
+		return result
+	case *hashNode:
+		resolved, err := t.resolveHash(n.Hash())
+		if err != nil {
+			panic(&resolveError{err})
+		}
+		return t.graft(resolved, path, subNode)
+	default:
+		// this should never happen
+		return nil
+	}
+}
+
+// wrapGraftResult wrap the new node of result by an ext node with key prefix, tagged
+// tell whether the child reference of the ext node is tagged
+func wrapGraftResult(result *insertResult, prefix []byte, tagged bool) *insertResult {
+	if result == nil || len(prefix) == 0 {
+		return result
+	}
+	ext := newExtNode(prefix, result.newNode, tagged)
+	result.newNode = ext
+	result.insert(ext)
+	return result
+}
+
+// withKeyPrefix return n with prefix prepended to its key, a branch node is
+// wrapped by an ext node whose child reference is tagged if tagged is true
+func withKeyPrefix(prefix []byte, n node, tagged bool) node {
+	if len(prefix) == 0 {
+		return n
+	}
+	switch n := n.(type) {
+	case *leafNode:
+		return newLeafNode(concat(prefix, n.key), n.value)
+	case *extNode:
+		return newExtNode(concat(prefix, n.key), n.child, n.tagged)
+	default:
+		return newExtNode(common.CopyBytes(prefix), n, tagged)
+	}
+}
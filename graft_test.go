@@ -0,0 +1,91 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func testGraft(t *testing.T, base []kv, prefix []byte, sub []kv) {
+	memDB := memorydb.New()
+	subTrie := NewTrie(EmptyHash, memDB)
+	for _, elem := range sub {
+		subTrie = subTrie.Insert(elem.k, elem.v)
+	}
+	subTrie.Persist()
+
+	trie := NewTrie(EmptyHash, memDB)
+	expected := NewTrie(EmptyHash, memorydb.New())
+	for _, elem := range base {
+		trie = trie.Insert(elem.k, elem.v)
+		expected = expected.Insert(elem.k, elem.v)
+	}
+	trie.Persist()
+	trie = NewTrie(trie.StateRoot(), memDB)
+	for _, elem := range sub {
+		expected = expected.Insert(concat(prefix, elem.k), elem.v)
+	}
+
+	grafted, err := trie.Graft(prefix, subTrie.StateRoot())
+	assert.Nil(t, err)
+	assert.Equal(t, expected.StateRoot(), grafted.StateRoot())
+	grafted.Persist()
+	reloaded := NewTrie(grafted.StateRoot(), memDB)
+	for _, elem := range base {
+		assert.Equal(t, elem.v, reloaded.Get(elem.k))
+	}
+	for _, elem := range sub {
+		assert.Equal(t, elem.v, reloaded.Get(concat(prefix, elem.k)))
+	}
+}
+
+func TestGraft(t *testing.T) {
+	sub := uniqueKVs(50)
+	tiny := []kv{{k: []byte{0x01}, v: []byte{0x01}}}
+	// graft to empty trie
+	testGraft(t, nil, []byte{0xaa}, sub)
+	testGraft(t, nil, nil, sub)
+	testGraft(t, nil, []byte{0xaa}, tiny)
+
+	// prefix diverge from a leaf, and from an ext node
+	leaf := []kv{{k: []byte{0xab, 0xcd}, v: []byte{0x01}}}
+	testGraft(t, leaf, []byte{0xaa}, sub)
+	testGraft(t, leaf, []byte{0xab, 0xce}, tiny)
+	ext := []kv{{k: []byte{0xab, 0xcd, 0x01}, v: bytes.Repeat([]byte{0x01}, 32)}, {k: []byte{0xab, 0xcd, 0x02}, v: []byte{0x02}}}
+	testGraft(t, ext, []byte{0xab, 0xce}, sub)
+	testGraft(t, ext, []byte{0xac}, tiny)
+	testGraft(t, ext, []byte{0xab, 0xcd, 0x03}, sub)
+	// a key of the trie is a prefix of the graft prefix
+	testGraft(t, leaf, []byte{0xab, 0xcd, 0xef}, sub)
+	testGraft(t, ext, []byte{0xab, 0xcd, 0x01, 0x01}, sub)
+
+	var base []kv
+	for _, elem := range uniqueKVs(100) {
+		if elem.k[0] != 0xff {
+			base = append(base, elem)
+		}
+	}
+	testGraft(t, base, []byte{0xff}, sub)
+	testGraft(t, base, []byte{0xff, 0x00}, tiny)
+}
+
+func TestGraftConflict(t *testing.T) {
+	memDB := memorydb.New()
+	sub := NewTrie(EmptyHash, memDB).Insert([]byte{0x01}, []byte{0x01})
+	sub.Persist()
+	trie := NewTrie(EmptyHash, memDB)
+	trie = trie.Insert([]byte{0xab, 0xcd}, []byte{0x01})
+	trie = trie.Insert([]byte{0xab, 0xce}, []byte{0x02})
+	for _, prefix := range [][]byte{nil, {0xab}, {0xab, 0xcd}} {
+		_, err := trie.Graft(prefix, sub.StateRoot())
+		assert.Equal(t, ErrGraftConflict, err)
+	}
+	_, err := trie.Graft([]byte{0xac}, common.BytesToHash(randomBytes()))
+	assert.IsType(t, &MissingNodeError{}, err)
+}
@@ -0,0 +1,172 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+)
+
+// CommitGroup merge concurrent commits of tries sharing one db into write epochs,
+// e.g. the account trie and many storage tries of a block. The first commit of an
+// epoch is its leader, it wait for the previous epoch to be written while later
+// commits join the epoch, then write all of them in one batch followed by one sync
+// with WithSync. So the latency of a commit is at most two batch writes and syncs no
+// matter how many tries commit at the same time. Nodes are content addressed, a node
+// inserted by any commit of an epoch is kept even if another commit delete it. It's
+// safe for concurrent use
+type CommitGroup struct {
+	db     db.KeyValueStore
+	config commitConfig
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	open    *commitEpoch
+	writing bool
+}
+
+// commitEpoch is the merged changes of commits written together
+// - keep: all nodes inserted by the commits, including nodes skipped by dedup
+// - puts: nodes to write
+// - deletes: nodes deleted by the commits, except nodes to keep
+// - commits: the number of merged commits
+type commitEpoch struct {
+	commits int
+	// schema is the descriptor of the first commit of a trie with WithSchema
+	schema  *SchemaDescriptor
+	keep    map[common.Hash][]byte
+	puts    map[common.Hash][]byte
+	deletes map[common.Hash][]byte
+	done    chan struct{}
+	err     error
+}
+
+// NewCommitGroup create a group writing commits to kvs with durability control of
+// opts, e.g. WithSync or WithDeferredDelete
+func NewCommitGroup(kvs db.KeyValueStore, opts ...CommitOption) *CommitGroup {
+	g := &CommitGroup{db: kvs}
+	for _, opt := range opts {
+		opt(&g.config)
+	}
+	g.cond = sync.NewCond(&g.lock)
+	return g
+}
+
+// Commit persist all logs of t in the current epoch of the group, and return once the
+// epoch is written. t must be a trie of the db of the group, errors of writing and
+// syncing the epoch are returned to all commits of it
+func (g *CommitGroup) Commit(t *Trie) (report *CommitReport, err error) {
+	t, done := t.measure(OpCommit)
+	defer func() { done(err) }()
+	changes := t.log.flatten()
+	existing := make(map[common.Hash]struct{})
+	for k := range changes.inserted {
+		if t.nodeExists(changes, k) {
+			existing[k] = struct{}{}
+		}
+	}
+	report = t.commitReport(changes, existing)
+
+	g.lock.Lock()
+	epoch := g.open
+	leader := epoch == nil
+	if leader {
+		epoch = &commitEpoch{
+			keep:    make(map[common.Hash][]byte),
+			puts:    make(map[common.Hash][]byte),
+			deletes: make(map[common.Hash][]byte),
+			done:    make(chan struct{}),
+		}
+		g.open = epoch
+	}
+	epoch.add(t.log, changes, existing)
+	if epoch.schema == nil && t.config.schema {
+		d := t.config.schemaDescriptor()
+		epoch.schema = &d
+	}
+	if !leader {
+		g.lock.Unlock()
+		<-epoch.done
+		if epoch.err == nil {
+			report.Written()
+		}
+		return report, epoch.err
+	}
+	for g.writing {
+		g.cond.Wait()
+	}
+	// no more commits join the epoch from now on
+	g.open = nil
+	g.writing = true
+	g.lock.Unlock()
+
+	epoch.err = g.write(epoch)
+	g.lock.Lock()
+	g.writing = false
+	g.cond.Broadcast()
+	g.lock.Unlock()
+	close(epoch.done)
+	if epoch.err == nil {
+		report.Written()
+	}
+	return report, epoch.err
+}
+
+// add merge the changes of a commit to the epoch, spilled nodes are read from log
+func (e *commitEpoch) add(log *updateLog, changes *logLayer, existing map[common.Hash]struct{}) {
+	e.commits++
+	for k, v := range changes.inserted {
+		v = log.value(k, v)
+		e.keep[k] = v
+		delete(e.deletes, k)
+		if _, ok := existing[k]; !ok {
+			e.puts[k] = v
+		}
+	}
+	for k := range changes.deleted {
+		if _, ok := e.keep[k]; !ok {
+			e.deletes[k] = nil
+		}
+	}
+}
+
+func (g *CommitGroup) write(epoch *commitEpoch) error {
+	syncer, err := g.config.syncer(g.db)
+	if err != nil {
+		return err
+	}
+	if g.config.deferred != nil {
+		g.config.deferred.cancel(epoch.keep)
+	}
+	batch := g.db.NewBatch()
+	if epoch.schema != nil {
+		if err := putSchema(g.db, batch, *epoch.schema); err != nil {
+			return err
+		}
+	}
+	for _, k := range sortedHashes(epoch.puts) {
+		if err := batch.Put(nodeKey(k), epoch.puts[k]); err != nil {
+			return err
+		}
+	}
+	if g.config.deferred == nil {
+		for _, k := range sortedHashes(epoch.deletes) {
+			if err := batch.Delete(nodeKey(k)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	if g.config.deferred != nil {
+		g.config.deferred.add(epoch.deletes)
+	}
+	if syncer != nil {
+		return syncer.Sync()
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+// gatedDB count syncs, and block the first sync until gate is closed
+type gatedDB struct {
+	*memorydb.Database
+	syncs int32
+	gate  chan struct{}
+}
+
+func (db *gatedDB) Sync() error {
+	if atomic.AddInt32(&db.syncs, 1) == 1 {
+		<-db.gate
+	}
+	return nil
+}
+
+// waitEpoch wait until n commits joined the open epoch of g
+func waitEpoch(g *CommitGroup, n int) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		g.lock.Lock()
+		joined := g.open != nil && g.open.commits == n
+		g.lock.Unlock()
+		if joined {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+func TestCommitGroup(t *testing.T) {
+	gated := &gatedDB{Database: memorydb.New(), gate: make(chan struct{})}
+	group := NewCommitGroup(gated, WithSync())
+	tries := make([]*Trie, 20)
+	kvs := make([][]kv, len(tries))
+	for i := range tries {
+		tries[i] = NewTrie(EmptyHash, gated)
+		kvs[i] = uniqueKVs(50)
+		for _, elem := range kvs[i] {
+			tries[i] = tries[i].Insert(elem.k, elem.v)
+		}
+	}
+
+	var wg sync.WaitGroup
+	commit := func(trie *Trie) {
+		defer wg.Done()
+		_, err := group.Commit(trie)
+		assert.Nil(t, err)
+	}
+	// the first commit block in sync, the others join the next epoch meanwhile
+	wg.Add(len(tries))
+	go commit(tries[0])
+	for i := 1; i < len(tries); i++ {
+		go commit(tries[i])
+	}
+	assert.True(t, waitEpoch(group, len(tries)-1))
+	close(gated.gate)
+	wg.Wait()
+	assert.Equal(t, int32(2), gated.syncs)
+	for i, trie := range tries {
+		reader := NewTrie(trie.StateRoot(), gated)
+		for _, elem := range kvs[i] {
+			assert.Equal(t, elem.v, reader.Get(elem.k))
+		}
+	}
+}
+
+func TestCommitGroupKeepInserted(t *testing.T) {
+	gated := &gatedDB{Database: memorydb.New(), gate: make(chan struct{})}
+	base, kvs := persistedTrie(gated.Database, 100)
+	// deleted deletes nodes of base, which are inserted again by rebuilt
+	deleted := base.Delete(kvs[0].k)
+	rebuilt := NewTrie(EmptyHash, gated)
+	for _, elem := range kvs {
+		rebuilt = rebuilt.Insert(elem.k, elem.v)
+	}
+	assert.Equal(t, base.StateRoot(), rebuilt.StateRoot())
+
+	group := NewCommitGroup(gated, WithSync())
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		group.Commit(NewTrie(EmptyHash, gated).Insert([]byte{1}, []byte{1}))
+	}()
+	// wait until the first epoch is being written
+	for {
+		group.lock.Lock()
+		writing := group.writing
+		group.lock.Unlock()
+		if writing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, trie := range []*Trie{rebuilt, deleted} {
+		go func(trie *Trie) {
+			defer wg.Done()
+			_, err := group.Commit(trie)
+			assert.Nil(t, err)
+		}(trie)
+	}
+	assert.True(t, waitEpoch(group, 2))
+	close(gated.gate)
+	wg.Wait()
+
+	for _, root := range []*Trie{base, deleted} {
+		reader := NewTrie(root.StateRoot(), gated)
+		assert.Nil(t, checkSubtree(gated, root.StateRoot(), make(map[common.Hash]struct{})))
+		for _, elem := range kvs[1:] {
+			assert.Equal(t, elem.v, reader.Get(elem.k))
+		}
+	}
+}
@@ -0,0 +1,89 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// NodeGrowthPoint is a point of the cumulative node growth series, Nodes is the net
+// change of stored nodes of each kind from the first recorded commit to Root
+type NodeGrowthPoint struct {
+	Root  common.Hash `json:"root"`
+	Nodes NodeCounts  `json:"nodes"`
+}
+
+// NodeGrowthStats accumulate the node kind deltas of commits into a cumulative
+// series, so state growth dashboards can be built from commit reports without
+// diffing tries. It's safe for concurrent use, and serve the series as JSON over
+// http
+type NodeGrowthStats struct {
+	lock      sync.Mutex
+	total     NodeCounts
+	series    []NodeGrowthPoint
+	maxPoints int
+	meter     func(point NodeGrowthPoint)
+}
+
+// NewNodeGrowthStats create an empty series which keep at most maxPoints recent
+// points, zero means unlimited, meter is called with every new point if it's not nil, which forward the
+// series to a metrics system
+func NewNodeGrowthStats(maxPoints int, meter func(point NodeGrowthPoint)) *NodeGrowthStats {
+	return &NodeGrowthStats{
+		series:    make([]NodeGrowthPoint, 0),
+		maxPoints: maxPoints,
+		meter:     meter,
+	}
+}
+
+// WithNodeGrowthStats record the report of every commit of the trie to stats
+func WithNodeGrowthStats(stats *NodeGrowthStats) Option {
+	return func(c *config) {
+		c.growthStats = stats
+	}
+}
+
+func (s *NodeGrowthStats) record(report *CommitReport) {
+	s.lock.Lock()
+	s.total.Leaves += report.Added.Leaves - report.Removed.Leaves
+	s.total.Extensions += report.Added.Extensions - report.Removed.Extensions
+	s.total.Branches += report.Added.Branches - report.Removed.Branches
+	point := NodeGrowthPoint{Root: report.Root, Nodes: s.total}
+	s.series = append(s.series, point)
+	if s.maxPoints > 0 && len(s.series) > s.maxPoints {
+		s.series = s.series[len(s.series)-s.maxPoints:]
+	}
+	s.lock.Unlock()
+	if s.meter != nil {
+		s.meter(point)
+	}
+}
+
+// Total return the net change of stored nodes of all recorded commits
+func (s *NodeGrowthStats) Total() NodeCounts {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.total
+}
+
+// Series return the recent points in the order of commits
+func (s *NodeGrowthStats) Series() []NodeGrowthPoint {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	series := make([]NodeGrowthPoint, len(s.series))
+	copy(series, s.series)
+	return series
+}
+
+// ServeHTTP write the recent points as JSON
+func (s *NodeGrowthStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.Series()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,64 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeGrowthStats(t *testing.T) {
+	memDB := memorydb.New()
+	metered := make([]NodeGrowthPoint, 0)
+	stats := NewNodeGrowthStats(3, func(point NodeGrowthPoint) {
+		metered = append(metered, point)
+	})
+	pruner := NewPruner(memDB, PrunerConfig{})
+	pruner.Start()
+	defer pruner.Stop()
+	trie := NewTrie(EmptyHash, memDB, WithNodeGrowthStats(stats))
+	kvs := uniqueKVs(500)
+	var expected NodeCounts
+	for i := 0; i < 5; i++ {
+		for _, elem := range kvs[i*100 : (i+1)*100] {
+			trie = trie.Insert(elem.k, elem.v)
+		}
+		for _, elem := range kvs[i*50 : i*50+30] {
+			trie = trie.Delete(elem.k)
+		}
+		var report *CommitReport
+		if i%2 == 0 {
+			report = trie.Persist()
+		} else {
+			var err error
+			report, err = trie.PersistWithPruner(pruner)
+			assert.Nil(t, err)
+			assert.True(t, waitPruned(pruner, time.Second))
+		}
+		assert.Equal(t, report.NodesWritten, report.Added.Total())
+		assert.Equal(t, report.NodesDeleted, report.Removed.Total())
+		expected.Leaves += report.Added.Leaves - report.Removed.Leaves
+		expected.Extensions += report.Added.Extensions - report.Removed.Extensions
+		expected.Branches += report.Added.Branches - report.Removed.Branches
+		assert.Equal(t, expected, stats.Total())
+		trie = NewTrie(trie.StateRoot(), memDB, WithNodeGrowthStats(stats))
+	}
+
+	series := stats.Series()
+	assert.Equal(t, 3, len(series))
+	assert.Equal(t, metered[2:], series)
+	assert.Equal(t, trie.StateRoot(), series[2].Root)
+	assert.Equal(t, stats.Total(), series[2].Nodes)
+
+	recorder := httptest.NewRecorder()
+	stats.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	var served []NodeGrowthPoint
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &served))
+	assert.Equal(t, series, served)
+}
@@ -0,0 +1,29 @@
+package mpt
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"golang.org/x/crypto/sha3"
+)
+
+// EmptyHash is hash of empty trie
+var EmptyHash = keccak256Hash([]byte{})
+
+// EthereumEmptyRoot is the root of empty trie defined by ethereum, the hash of RLP
+// encoded empty string
+var EthereumEmptyRoot = keccak256Hash([]byte{0x80})
+
+// isEmptyRoot report whether root is a well known root of empty trie
+func isEmptyRoot(root common.Hash) bool {
+	return root == EmptyHash || root == EthereumEmptyRoot
+}
+
+// keccak256Hash return the keccak256 hash of data. It's computed by x/crypto rather
+// than go-ethereum/crypto, which pulls in secp256k1 and other heavy dependencies
+// not wanted by the mptcore build
+func keccak256Hash(data []byte) common.Hash {
+	var hash common.Hash
+	hasher := sha3.NewLegacyKeccak256()
+	hasher.Write(data)
+	hasher.Sum(hash[:0])
+	return hash
+}
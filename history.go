@@ -0,0 +1,141 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ErrNotInHistory is returned by ValueAt if the root isn't recorded by the history
+// index, or the value of the key at the root predates the history
+var ErrNotInHistory = errors.New("not in history")
+
+// RootChange is the change of a key by the commit of Root
+type RootChange struct {
+	Root common.Hash
+	// Seq is the sequence of the commit in the history index, starting from 1
+	Seq uint64
+	// Value is the value after the commit, nil if the key is deleted
+	Value []byte
+}
+
+// HistoryIndex record the roots where every key changed, so the value of a key at
+// any recorded root, and the history of a key, can be read without keeping the
+// tries of old roots. Changes are found by diffing the committed trie with the
+// previous commit like Watcher, so commits recorded are expected to follow each
+// other. The history starts from the root the first recorded commit derived from,
+// and is kept in memory. It's safe for concurrent use
+type HistoryIndex struct {
+	lock sync.RWMutex
+	// emptyOrigin report whether the history starts from an empty trie
+	emptyOrigin bool
+	committed   *common.Hash
+	seq         uint64
+	// seqs is the latest sequence of every recorded root
+	seqs    map[common.Hash]uint64
+	changes map[string][]RootChange
+	// err is the error of a failed diff, the history is incomplete after it
+	err error
+}
+
+// NewHistoryIndex create an empty history index
+func NewHistoryIndex() *HistoryIndex {
+	return &HistoryIndex{
+		seqs:    make(map[common.Hash]uint64),
+		changes: make(map[string][]RootChange),
+	}
+}
+
+// WithHistoryIndex record the key changes of every commit of the trie to h
+func WithHistoryIndex(h *HistoryIndex) Option {
+	return func(c *config) {
+		c.history = h
+	}
+}
+
+// prepare find the changes of the commit of t, and return the func adding them to
+// the history once the commit is written
+func (h *HistoryIndex) prepare(t *Trie) func() {
+	h.lock.RLock()
+	from := t.baseRoot
+	first := h.committed == nil
+	if !first {
+		from = *h.committed
+	}
+	failed := h.err != nil
+	h.lock.RUnlock()
+	root := t.rootHash
+	emptyOrigin := first && t.empty(from)
+	keys := make([]string, 0)
+	values := make([][]byte, 0)
+	var err error
+	if from != root && !failed {
+		previous := t.derive(from, newUpdateLog())
+		err = diffPrefix(previous, t, nil, func(key, value, prev []byte) {
+			keys = append(keys, string(key))
+			values = append(values, value)
+		})
+	}
+	return func() {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		if h.committed == nil {
+			h.emptyOrigin = emptyOrigin
+			h.seqs[from] = 0
+		}
+		h.committed = &root
+		if from == root || h.err != nil {
+			return
+		}
+		h.seq++
+		h.seqs[root] = h.seq
+		if err != nil {
+			h.err = err
+			return
+		}
+		for i, key := range keys {
+			h.changes[key] = append(h.changes[key], RootChange{Root: root, Seq: h.seq, Value: values[i]})
+		}
+	}
+}
+
+// HistoryOf return the changes of key in the order of commits
+func (h *HistoryIndex) HistoryOf(key []byte) []RootChange {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	changes := h.changes[string(key)]
+	return append(make([]RootChange, 0, len(changes)), changes...)
+}
+
+// ValueAt return the value of key in the trie of root, nil if it's absent. A root
+// committed more than once has the same key values every time, so any of them is
+// used. ErrNotInHistory is returned if root isn't recorded, or key isn't changed
+// since the origin of the history and the origin isn't empty
+func (h *HistoryIndex) ValueAt(key []byte, root common.Hash) ([]byte, error) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if h.err != nil {
+		return nil, h.err
+	}
+	seq, ok := h.seqs[root]
+	if !ok {
+		return nil, ErrNotInHistory
+	}
+	changes := h.changes[string(key)]
+	// the first change after root
+	i := sort.Search(len(changes), func(i int) bool {
+		return changes[i].Seq > seq
+	})
+	if i > 0 {
+		return changes[i-1].Value, nil
+	}
+	if h.emptyOrigin {
+		return nil, nil
+	}
+	return nil, ErrNotInHistory
+}
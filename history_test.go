@@ -0,0 +1,88 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistoryIndex(t *testing.T) {
+	history := NewHistoryIndex()
+	trie := NewTrie(EmptyHash, memorydb.New(), WithHistoryIndex(history))
+	roots := make([]common.Hash, 0)
+	models := make([]map[string][]byte, 0)
+	model := make(map[string][]byte)
+	sequence := uint64(0)
+	for round := 0; round < 30; round++ {
+		for i := 0; i < 1+random.Intn(8); i++ {
+			key := randomKey()
+			if random.Intn(3) == 0 {
+				trie = trie.Delete(key)
+				delete(model, string(key))
+				continue
+			}
+			sequence++
+			value := append(Uint64Key(sequence), randomBytes()...)
+			trie = trie.Insert(key, value)
+			model[string(key)] = value
+		}
+		trie.Persist()
+		snapshot := make(map[string][]byte, len(model))
+		for k, v := range model {
+			snapshot[k] = v
+		}
+		roots = append(roots, trie.StateRoot())
+		models = append(models, snapshot)
+	}
+
+	for i, root := range roots {
+		for j := 0; j < 50; j++ {
+			key := randomKey()
+			value, err := history.ValueAt(key, root)
+			assert.Nil(t, err)
+			assert.Equal(t, models[i][string(key)], value)
+		}
+	}
+	for k := range model {
+		changes := history.HistoryOf([]byte(k))
+		assert.True(t, len(changes) > 0)
+		for i := 1; i < len(changes); i++ {
+			assert.True(t, changes[i-1].Seq < changes[i].Seq)
+		}
+		last := changes[len(changes)-1]
+		assert.Equal(t, model[k], last.Value)
+		for i, root := range roots {
+			if root == last.Root {
+				assert.Equal(t, last.Value, models[i][k])
+			}
+		}
+	}
+	_, err := history.ValueAt([]byte{1}, common.Hash{1})
+	assert.Equal(t, ErrNotInHistory, err)
+}
+
+func TestHistoryIndexOrigin(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 10)
+	origin := trie.StateRoot()
+	history := NewHistoryIndex()
+	trie = NewTrie(origin, memDB, WithHistoryIndex(history))
+	trie = trie.Insert(kvs[0].k, []byte("changed"))
+	trie.Persist()
+
+	value, err := history.ValueAt(kvs[0].k, trie.StateRoot())
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("changed"), value)
+	_, err = history.ValueAt(kvs[0].k, origin)
+	assert.Equal(t, ErrNotInHistory, err)
+	// values predating the history are unknown
+	_, err = history.ValueAt(kvs[1].k, trie.StateRoot())
+	assert.Equal(t, ErrNotInHistory, err)
+	assert.Equal(t, 1, len(history.HistoryOf(kvs[0].k)))
+	assert.Empty(t, history.HistoryOf(kvs[1].k))
+}
@@ -0,0 +1,57 @@
+// Package varint encode and decode the unsigned varints of the encodings of mpt,
+// e.g. nodes, proofs, packs, wire messages and records in underlying db, so all
+// of them share one implementation
+package varint
+
+import (
+	"encoding/binary"
+)
+
+// MaxLen is the max size of a varint
+const MaxLen = binary.MaxVarintLen64
+
+// Append append the varint of x to buf
+func Append(buf []byte, x uint64) []byte {
+	var varint [MaxLen]byte
+	n := binary.PutUvarint(varint[:], x)
+	return append(buf, varint[:n]...)
+}
+
+// Size return the size of the varint of x
+func Size(x uint64) int {
+	n := 1
+	for ; x >= 0x80; x >>= 7 {
+		n++
+	}
+	return n
+}
+
+// Decode decode a varint from the front of data, and return it with the rest of
+// data, ok is false if data doesn't start with a varint
+func Decode(data []byte) (x uint64, rest []byte, ok bool) {
+	x, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, data, false
+	}
+	return x, data[n:], true
+}
+
+// DecodeMinimal is Decode which reject varints with redundant trailing zero groups
+// as well, so every value has one encoding
+func DecodeMinimal(data []byte) (x uint64, rest []byte, ok bool) {
+	x, n := binary.Uvarint(data)
+	if n <= 0 || (n > 1 && data[n-1] == 0) {
+		return 0, data, false
+	}
+	return x, data[n:], true
+}
+
+// DecodeBytes decode a varint length from the front of data followed by as many
+// bytes, and return the bytes with the rest of data. The bytes are a slice of data
+func DecodeBytes(data []byte) (value []byte, rest []byte, ok bool) {
+	size, rest, ok := Decode(data)
+	if !ok || size > uint64(len(rest)) {
+		return nil, data, false
+	}
+	return rest[:size], rest[size:], true
+}
@@ -0,0 +1,51 @@
+package varint
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVarint(t *testing.T) {
+	for _, x := range []uint64{0, 1, 127, 128, 300, 1 << 32, math.MaxUint64} {
+		encoded := Append([]byte{0xff}, x)[1:]
+		var expected [MaxLen]byte
+		n := binary.PutUvarint(expected[:], x)
+		assert.Equal(t, expected[:n], encoded)
+		assert.Equal(t, n, Size(x))
+
+		for _, decode := range []func([]byte) (uint64, []byte, bool){Decode, DecodeMinimal} {
+			decoded, rest, ok := decode(append(encoded, 0x01))
+			assert.True(t, ok)
+			assert.Equal(t, x, decoded)
+			assert.Equal(t, []byte{0x01}, rest)
+		}
+	}
+	for _, invalid := range [][]byte{nil, {0x80}, {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}} {
+		_, rest, ok := Decode(invalid)
+		assert.False(t, ok)
+		assert.Equal(t, invalid, rest)
+	}
+}
+
+func TestDecodeMinimal(t *testing.T) {
+	// 1 with a redundant zero group
+	x, _, ok := Decode([]byte{0x81, 0x00})
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), x)
+	_, _, ok = DecodeMinimal([]byte{0x81, 0x00})
+	assert.False(t, ok)
+}
+
+func TestDecodeBytes(t *testing.T) {
+	value, rest, ok := DecodeBytes([]byte{0x02, 0xaa, 0xbb, 0xcc})
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0xaa, 0xbb}, value)
+	assert.Equal(t, []byte{0xcc}, rest)
+	_, _, ok = DecodeBytes([]byte{0x03, 0xaa, 0xbb})
+	assert.False(t, ok)
+	_, _, ok = DecodeBytes(nil)
+	assert.False(t, ok)
+}
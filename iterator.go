@@ -0,0 +1,377 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Iterate traverse all key values of the trie in key order, stop traversing if fn
+// return false. Caller must not modify key and value.
+//
+// Key order is the strict lexicographic order of key bytes, which is guaranteed by
+// all iterations of the trie: children of a branch are visited in the order of
+// their nibbles, and the target of a branch is visited before its children, so a
+// key is always visited before the keys it's a prefix of. Diff, range proofs and
+// export depend on this total order.
+//
+// Iterating a trie is safe while tries forked from it insert, delete and commit in
+// other goroutines: iterations decode nodes into fresh nodes for every resolve,
+// which never alias the logs or the cache, layers are never modified once shared,
+// and cached encodings are replaced rather than modified. Decoded nodes shared by
+// a NodePathCache, which only Get and SubtreeHash read, have their hashes and
+// encodings computed before they are shared, so no reader write them. A commit
+// which deletes nodes of the trie, e.g. Persist, may fail the iteration with
+// ErrStaleTrie, but never make it visit wrong key values, commit with a pruner or
+// deferred deletes to keep them until iterations are done
+func (t *Trie) Iterate(fn func(key, value []byte) bool) error {
+	return t.IterateFrom(nil, fn)
+}
+
+// IterateFrom traverse key values whose key is greater than or equal to start in
+// key order, subtrees before start are skipped without resolving
+func (t *Trie) IterateFrom(start []byte, fn func(key, value []byte) bool) error {
+	if t.empty(t.rootHash) {
+		return nil
+	}
+	rootNode, err := t.resolveHash(t.rootHash)
+	if err != nil {
+		t.traceMissing(nil, err)
+		return err
+	}
+	var startNibbles []byte
+	if len(start) > 0 {
+		startNibbles = bytesToNibbles(start)
+	}
+	_, err = t.iterate(rootNode, nil, startNibbles, fn)
+	return err
+}
+
+// IteratePrefix traverse key values whose key start with prefix in key order, it
+// descends directly to the subtree of prefix, so nodes outside the subtree are
+// never resolved, which make prefix scans of namespaced keys cheap
+func (t *Trie) IteratePrefix(prefix []byte, fn func(key, value []byte) bool) error {
+	if t.empty(t.rootHash) {
+		return nil
+	}
+	rootNode, err := t.resolveHash(t.rootHash)
+	if err != nil {
+		t.traceMissing(nil, err)
+		return err
+	}
+	return t.iteratePrefix(rootNode, nil, bytesToNibbles(prefix), fn)
+}
+
+// iteratePrefix find the subtree of prefix below startNode and traverse it, path
+// is the key nibbles from root to startNode, which is always a prefix of prefix
+func (t *Trie) iteratePrefix(startNode node, path, prefix []byte, fn func(key, value []byte) bool) error {
+	switch n := startNode.(type) {
+	case *leafNode:
+		if key := extendPath(path, n.key...); bytes.HasPrefix(key, prefix) {
+			fn(nibblesToBytes(key), n.value)
+		}
+		return nil
+	case *extNode:
+		childPath := extendPath(path, n.key...)
+		if bytes.HasPrefix(childPath, prefix) {
+			_, err := t.iterate(n.child, childPath, nil, fn)
+			return err
+		}
+		if bytes.HasPrefix(prefix, childPath) {
+			return t.iteratePrefix(n.child, childPath, prefix, fn)
+		}
+		return nil
+	case *branchNode:
+		if len(path) == len(prefix) {
+			_, err := t.iterate(n, path, nil, fn)
+			return err
+		}
+		child := n.children[prefix[len(path)]]
+		if child == nil {
+			return nil
+		}
+		return t.iteratePrefix(child, extendPath(path, prefix[len(path)]), prefix, fn)
+	case *hashNode:
+		resolved, err := t.resolveHash(n.Hash())
+		if err != nil {
+			t.traceMissing(path, err)
+			return err
+		}
+		return t.iteratePrefix(resolved, path, prefix, fn)
+	default:
+		// this should never happen
+		return nil
+	}
+}
+
+// iterate traverse the subtree of startNode, path is the key nibbles from root
+// to startNode, start is the nibbles of the first key to visit or nil if all keys
+// of the subtree are visited. Return false if the traversing is stopped by fn
+func (t *Trie) iterate(startNode node, path, start []byte, fn func(key, value []byte) bool) (bool, error) {
+	switch n := startNode.(type) {
+	case *leafNode:
+		key := extendPath(path, n.key...)
+		if start != nil && bytes.Compare(key, start) < 0 {
+			return true, nil
+		}
+		return fn(nibblesToBytes(key), n.value), nil
+	case *extNode:
+		childPath := extendPath(path, n.key...)
+		skip, childStart := boundStart(childPath, start)
+		if skip {
+			return true, nil
+		}
+		return t.iterate(n.child, childPath, childStart, fn)
+	case *branchNode:
+		// the key of target is shorter than the key of children, so visit target first
+		if n.hasTarget() && (start == nil || bytes.Compare(path, start) >= 0) && !fn(nibblesToBytes(path), n.target) {
+			return false, nil
+		}
+		t.prefetchChildren(n, path, start)
+		for i, child := range n.children {
+			if child == nil {
+				continue
+			}
+			childPath := extendPath(path, byte(i))
+			skip, childStart := boundStart(childPath, start)
+			if skip {
+				continue
+			}
+			next, err := t.iterate(child, childPath, childStart, fn)
+			if err != nil || !next {
+				return next, err
+			}
+		}
+		return true, nil
+	case *hashNode:
+		resolved, err := t.resolveHash(n.Hash())
+		if err != nil {
+			t.traceMissing(path, err)
+			return false, err
+		}
+		return t.iterate(resolved, path, start, fn)
+	default:
+		// this should never happen
+		return true, nil
+	}
+}
+
+// boundStart compare the path of a subtree with start, return true if all keys of
+// the subtree are before start, otherwise return the start for the subtree, which
+// is nil if all keys of the subtree are after start
+func boundStart(path, start []byte) (bool, []byte) {
+	if start == nil {
+		return false, nil
+	}
+	n := len(path)
+	if len(start) < n {
+		n = len(start)
+	}
+	switch bytes.Compare(path[:n], start[:n]) {
+	case -1:
+		return true, nil
+	case 1:
+		return false, nil
+	default:
+		return false, start
+	}
+}
+
+// extendPath return a new path which append nibbles to path, the original path
+// is unchanged because it may be shared by siblings
+func extendPath(path []byte, nibbles ...byte) []byte {
+	res := make([]byte, len(path)+len(nibbles))
+	copy(res, path)
+	copy(res[len(path):], nibbles)
+	return res
+}
+
+// ProofStep is the proof of a key yielded by IterateWithProof relative to the proof
+// of the previous key, keys next to each other share most nodes of their paths,
+// so only the nodes after the shared ones are returned
+type ProofStep struct {
+	// Shared is the number of leading nodes of the previous proof which are
+	// also in the proof of the key, it's 0 for the first key
+	Shared int
+	// Nodes is the encoded proof nodes following the shared ones
+	Nodes [][]byte
+}
+
+// Apply return the full proof of the key from the proof of the previous key
+func (s ProofStep) Apply(prev [][]byte) [][]byte {
+	proof := make([][]byte, 0, s.Shared+len(s.Nodes))
+	proof = append(proof, prev[:s.Shared]...)
+	return append(proof, s.Nodes...)
+}
+
+// IterateWithProof traverse key values whose key is greater than or equal to start
+// in key order like IterateFrom, and yield the membership proof of every key as a
+// ProofStep. The full proof is the same as the one returned by Prove
+func (t *Trie) IterateWithProof(start []byte, fn func(key, value []byte, step ProofStep) bool) error {
+	if t.empty(t.rootHash) {
+		return nil
+	}
+	rootNode, err := t.resolveHash(t.rootHash)
+	if err != nil {
+		t.traceMissing(nil, err)
+		return err
+	}
+	var startNibbles []byte
+	if len(start) > 0 {
+		startNibbles = bytesToNibbles(start)
+	}
+	it := &proofIterator{trie: t, stack: [][]byte{rootNode.Encode()}, fn: fn}
+	_, err = it.iterate(rootNode, nil, startNibbles)
+	return err
+}
+
+// proofIterator keep the proof nodes from root to the current node in stack, shared
+// is the number of nodes in stack unchanged since the last yielded key
+type proofIterator struct {
+	trie   *Trie
+	stack  [][]byte
+	shared int
+	fn     func(key, value []byte, step ProofStep) bool
+}
+
+func (it *proofIterator) yield(path, value []byte) bool {
+	step := ProofStep{
+		Shared: it.shared,
+		Nodes:  append([][]byte{}, it.stack[it.shared:]...),
+	}
+	it.shared = len(it.stack)
+	return it.fn(nibblesToBytes(path), value, step)
+}
+
+func (it *proofIterator) iterate(startNode node, path, start []byte) (bool, error) {
+	switch n := startNode.(type) {
+	case *leafNode:
+		key := extendPath(path, n.key...)
+		if start != nil && bytes.Compare(key, start) < 0 {
+			return true, nil
+		}
+		return it.yield(key, n.value), nil
+	case *extNode:
+		childPath := extendPath(path, n.key...)
+		skip, childStart := boundStart(childPath, start)
+		if skip {
+			return true, nil
+		}
+		return it.iterate(n.child, childPath, childStart)
+	case *branchNode:
+		if n.hasTarget() && (start == nil || bytes.Compare(path, start) >= 0) && !it.yield(path, n.target) {
+			return false, nil
+		}
+		it.trie.prefetchChildren(n, path, start)
+		for i, child := range n.children {
+			if child == nil {
+				continue
+			}
+			childPath := extendPath(path, byte(i))
+			skip, childStart := boundStart(childPath, start)
+			if skip {
+				continue
+			}
+			next, err := it.iterate(child, childPath, childStart)
+			if err != nil || !next {
+				return next, err
+			}
+		}
+		return true, nil
+	case *hashNode:
+		resolved, err := it.trie.resolveHash(n.Hash())
+		if err != nil {
+			it.trie.traceMissing(path, err)
+			return false, err
+		}
+		it.stack = append(it.stack, resolved.Encode())
+		next, err := it.iterate(resolved, path, start)
+		it.stack = it.stack[:len(it.stack)-1]
+		if it.shared > len(it.stack) {
+			it.shared = len(it.stack)
+		}
+		return next, err
+	default:
+		// this should never happen
+		return true, nil
+	}
+}
+
+// TraversalOrder is the order of visiting nodes by IterateNodes
+type TraversalOrder int
+
+const (
+	// PreOrder visit a node before its children
+	PreOrder TraversalOrder = iota
+	// PostOrder visit a node after its children, e.g. for pruning
+	PostOrder
+	// LeavesOnly visit leaf nodes only
+	LeavesOnly
+)
+
+// NodeVisitor is called by IterateNodes for every visited node, path is the key
+// nibbles from root to the node, hash is empty if the node is embedded in its
+// parent. Traversing stop if it return false. Caller must not modify path and
+// encoded
+type NodeVisitor func(path []byte, hash common.Hash, encoded []byte) bool
+
+// IterateNodes traverse all nodes of the trie in order, children are visited in
+// the order of their paths
+func (t *Trie) IterateNodes(order TraversalOrder, fn NodeVisitor) error {
+	if order != PreOrder && order != PostOrder && order != LeavesOnly {
+		return fmt.Errorf("unknown traversal order: %d", order)
+	}
+	if t.empty(t.rootHash) {
+		return nil
+	}
+	_, err := t.iterateNodes(&hashNode{t.rootHash[:]}, nil, order, fn)
+	return err
+}
+
+func (t *Trie) iterateNodes(startNode node, path []byte, order TraversalOrder, fn NodeVisitor) (bool, error) {
+	var hash common.Hash
+	if n, ok := startNode.(*hashNode); ok {
+		resolved, err := t.resolveHash(n.Hash())
+		if err != nil {
+			t.traceMissing(path, err)
+			return false, err
+		}
+		hash, startNode = n.Hash(), resolved
+	}
+	visit := func() bool {
+		return fn(path, hash, startNode.Encode())
+	}
+	if order == PreOrder && !visit() {
+		return false, nil
+	}
+	switch n := startNode.(type) {
+	case *leafNode:
+		if order == LeavesOnly && !visit() {
+			return false, nil
+		}
+	case *extNode:
+		next, err := t.iterateNodes(n.child, extendPath(path, n.key...), order, fn)
+		if err != nil || !next {
+			return next, err
+		}
+	case *branchNode:
+		t.prefetchChildren(n, path, nil)
+		for i, child := range n.children {
+			if child == nil {
+				continue
+			}
+			next, err := t.iterateNodes(child, extendPath(path, byte(i)), order, fn)
+			if err != nil || !next {
+				return next, err
+			}
+		}
+	}
+	if order == PostOrder && !visit() {
+		return false, nil
+	}
+	return true, nil
+}
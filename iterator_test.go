@@ -0,0 +1,407 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+// sortedKVs return the key values of m in key order
+func sortedKVs(m map[string][]byte) []kv {
+	kvs := make([]kv, 0, len(m))
+	for k, v := range m {
+		kvs = append(kvs, kv{k: []byte(k), v: v})
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		return bytes.Compare(kvs[i].k, kvs[j].k) < 0
+	})
+	return kvs
+}
+
+func collectKVs(t *testing.T, iterate func(fn func(key, value []byte) bool) error) []kv {
+	kvs := make([]kv, 0)
+	err := iterate(func(key, value []byte) bool {
+		kvs = append(kvs, kv{k: key, v: value})
+		return true
+	})
+	assert.Nil(t, err)
+	return kvs
+}
+
+func TestIterate(t *testing.T) {
+	memDB := memorydb.New()
+	trie := NewTrie(EmptyHash, memDB)
+	assert.Equal(t, []kv{}, collectKVs(t, trie.Iterate))
+	expected := make(map[string][]byte)
+	for i := 0; i < iterateTimes; i++ {
+		elem := newKV()
+		trie = trie.Insert(elem.k, elem.v)
+		expected[string(elem.k)] = elem.v
+	}
+	// key which is prefix of other keys is stored as target of branch node
+	trie = trie.Insert([]byte{0x01}, []byte{0x01})
+	trie = trie.Insert([]byte{0x01, 0x02}, []byte{0x02})
+	expected[string([]byte{0x01})] = []byte{0x01}
+	expected[string([]byte{0x01, 0x02})] = []byte{0x02}
+	assert.Equal(t, sortedKVs(expected), collectKVs(t, trie.Iterate))
+
+	trie.Persist()
+	reloaded := NewTrie(trie.StateRoot(), memDB)
+	assert.Equal(t, sortedKVs(expected), collectKVs(t, reloaded.Iterate))
+}
+
+// orderKeys return keys which are prefixes of each other or differ in the high or
+// low nibble only, together with random keys of various lengths
+func orderKeys() map[string][]byte {
+	keys := [][]byte{
+		{}, {0x00}, {0x00, 0x00}, {0x00, 0x01}, {0x00, 0x10}, {0x01}, {0x01, 0x00, 0xff},
+		{0x0f}, {0x10}, {0x10, 0x00}, {0xf0}, {0xff}, {0xff, 0xff}, {0xff, 0xff, 0x00},
+	}
+	for i := 0; i < 300; i++ {
+		key := make([]byte, 1+random.Intn(8))
+		random.Read(key)
+		keys = append(keys, key)
+	}
+	m := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		m[string(key)] = randomBytes()
+	}
+	return m
+}
+
+// assertStrictOrder check keys are in strict lexicographic byte order
+func assertStrictOrder(t *testing.T, kvs []kv) {
+	for i := 1; i < len(kvs); i++ {
+		assert.True(t, bytes.Compare(kvs[i-1].k, kvs[i].k) < 0, "%x is not before %x", kvs[i-1].k, kvs[i].k)
+	}
+}
+
+func TestIterateOrder(t *testing.T) {
+	expected := orderKeys()
+	sorted := sortedKVs(expected)
+	memDB := memorydb.New()
+	var root common.Hash
+	// the order is independent of the order of inserts
+	for round := 0; round < 3; round++ {
+		kvs := make([]kv, len(sorted))
+		copy(kvs, sorted)
+		random.Shuffle(len(kvs), func(i, j int) { kvs[i], kvs[j] = kvs[j], kvs[i] })
+		trie := NewTrie(EmptyHash, memDB)
+		for _, elem := range kvs {
+			trie = trie.Insert(elem.k, elem.v)
+		}
+		if round > 0 {
+			assert.Equal(t, root, trie.StateRoot())
+		}
+		root = trie.StateRoot()
+		actual := collectKVs(t, trie.Iterate)
+		assertStrictOrder(t, actual)
+		assert.Equal(t, sorted, actual)
+	}
+
+	trie := NewTrie(EmptyHash, memDB)
+	for _, elem := range sorted {
+		trie = trie.Insert(elem.k, elem.v)
+	}
+	trie.Persist()
+	trie = NewTrie(trie.StateRoot(), memDB)
+	assert.Equal(t, sorted, collectKVs(t, trie.Iterate))
+	// the empty key is the target of the root branch, which is visited first
+	assert.Equal(t, []byte{}, sorted[0].k)
+
+	for _, start := range [][]byte{{0x00}, {0x00, 0x00}, {0x0f}, {0x10, 0x00, 0x00}, {0xff, 0xff}} {
+		actual := collectKVs(t, func(fn func(key, value []byte) bool) error {
+			return trie.IterateFrom(start, fn)
+		})
+		assertStrictOrder(t, actual)
+		assert.True(t, len(actual) > 0)
+		assert.True(t, bytes.Compare(actual[0].k, start) >= 0)
+	}
+	withProof := make([]kv, 0)
+	err := trie.IterateWithProof(nil, func(key, value []byte, step ProofStep) bool {
+		withProof = append(withProof, kv{k: key, v: value})
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, sorted, withProof)
+	resp, err := trie.IterateRange(nil, nil, 0)
+	assert.Nil(t, err)
+	ranged := make([]kv, 0, len(resp.Keys))
+	for i, key := range resp.Keys {
+		ranged = append(ranged, kv{k: key, v: resp.Values[i]})
+	}
+	assert.Equal(t, sorted, ranged)
+	viewed := collectKVs(t, trie.View([]byte{0x00}).Iterate)
+	assertStrictOrder(t, viewed)
+	assert.Equal(t, []byte{}, viewed[0].k)
+}
+
+func TestIterateStop(t *testing.T) {
+	trie := NewTrie(EmptyHash, memorydb.New())
+	for i := 0; i < 100; i++ {
+		elem := newKV()
+		trie = trie.Insert(elem.k, elem.v)
+	}
+	count := 0
+	err := trie.Iterate(func(key, value []byte) bool {
+		count++
+		return count < 10
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 10, count)
+}
+
+func TestIterateFrom(t *testing.T) {
+	trie, kvs := persistedTrie(memorydb.New(), 200)
+	expected := sortedKVs(kvMap(kvs))
+	for i := 0; i < 20; i++ {
+		start := randomBytes()
+		if i%2 == 0 {
+			start = expected[random.Intn(len(expected))].k
+		}
+		actual := collectKVs(t, func(fn func(key, value []byte) bool) error {
+			return trie.IterateFrom(start, fn)
+		})
+		first := 0
+		for first < len(expected) && bytes.Compare(expected[first].k, start) < 0 {
+			first++
+		}
+		assert.Equal(t, expected[first:], actual)
+	}
+}
+
+func TestIteratePrefix(t *testing.T) {
+	expected := orderKeys()
+	sorted := sortedKVs(expected)
+	memDB := memorydb.New()
+	trie := NewTrie(EmptyHash, memDB)
+	for _, elem := range sorted {
+		trie = trie.Insert(elem.k, elem.v)
+	}
+	trie.Persist()
+
+	prefixes := [][]byte{nil, {0x00}, {0x01}, {0x01, 0x00}, {0xff, 0xff}, {0x02, 0x03, 0x04, 0x05}}
+	for i := 0; i < 50; i++ {
+		key := sorted[random.Intn(len(sorted))].k
+		prefixes = append(prefixes, key[:random.Intn(len(key)+1)])
+	}
+	for _, prefix := range prefixes {
+		filtered := make([]kv, 0)
+		for _, elem := range sorted {
+			if bytes.HasPrefix(elem.k, prefix) {
+				filtered = append(filtered, elem)
+			}
+		}
+		store := NewFaultyStore(memDB, FaultConfig{})
+		reloaded := NewTrie(trie.StateRoot(), store)
+		actual := collectKVs(t, func(fn func(key, value []byte) bool) error {
+			return reloaded.IteratePrefix(prefix, fn)
+		})
+		assert.Equal(t, filtered, actual, "prefix %x", prefix)
+		// nodes outside the subtree of prefix aren't resolved
+		if len(prefix) > 0 {
+			assert.True(t, store.Resolves() < 2+len(prefix)*2+len(filtered)*2, "prefix %x", prefix)
+		}
+	}
+
+	// stop by fn
+	count := 0
+	assert.Nil(t, trie.IteratePrefix(nil, func(key, value []byte) bool {
+		count++
+		return count < 10
+	}))
+	assert.Equal(t, 10, count)
+}
+
+func TestIterateWithProof(t *testing.T) {
+	trie, kvs := persistedTrie(memorydb.New(), 500)
+	trie = trie.Insert([]byte{0x01}, []byte{0x01})
+	trie = trie.Insert([]byte{0x01, 0x02}, []byte{0x02})
+	trie.Persist()
+	expected := kvMap(kvs)
+	expected[string([]byte{0x01})] = []byte{0x01}
+	expected[string([]byte{0x01, 0x02})] = []byte{0x02}
+
+	check := func(start []byte) []kv {
+		var prev [][]byte
+		items := make([]ProofItem, 0)
+		visited := make([]kv, 0)
+		total, full := 0, 0
+		err := trie.IterateWithProof(start, func(key, value []byte, step ProofStep) bool {
+			if len(items) == 0 {
+				assert.Equal(t, 0, step.Shared)
+			}
+			proof := step.Apply(prev)
+			expectedProof, err := trie.Prove(key)
+			assert.Nil(t, err)
+			assert.Equal(t, expectedProof, proof)
+			items = append(items, ProofItem{Key: key, Value: value, Proof: proof})
+			visited = append(visited, kv{k: key, v: value})
+			total += len(step.Nodes)
+			full += len(proof)
+			prev = proof
+			return true
+		})
+		assert.Nil(t, err)
+		assert.Nil(t, VerifyProofBatch(trie.StateRoot(), items))
+		// path nodes are shared by adjacent keys
+		assert.True(t, len(items) < 2 || total < full)
+		return visited
+	}
+	assert.Equal(t, sortedKVs(expected), check(nil))
+	sorted := sortedKVs(expected)
+	start := sorted[len(sorted)/2].k
+	assert.Equal(t, sorted[len(sorted)/2:], check(start))
+
+	// stop traversing
+	count := 0
+	err := trie.IterateWithProof(nil, func(key, value []byte, step ProofStep) bool {
+		count++
+		return count < 10
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 10, count)
+}
+
+type visitedNode struct {
+	path    []byte
+	hash    common.Hash
+	encoded []byte
+}
+
+func collectNodes(t *testing.T, trie *Trie, order TraversalOrder) []visitedNode {
+	nodes := make([]visitedNode, 0)
+	err := trie.IterateNodes(order, func(path []byte, hash common.Hash, encoded []byte) bool {
+		nodes = append(nodes, visitedNode{path: path, hash: hash, encoded: encoded})
+		return true
+	})
+	assert.Nil(t, err)
+	return nodes
+}
+
+// tinyTrie return a persisted trie of single byte keys and values, most nodes are
+// embedded in their parents, some keys are prefixes of others, and the leaf of
+// {0x13} have empty key and empty value, which is encoded as the flag byte alone
+func tinyTrie(memDB *memorydb.Database) (*Trie, []kv) {
+	kvs := []kv{
+		{k: []byte{0x01}, v: []byte{0x01}},
+		{k: []byte{0x01, 0x02}, v: []byte{0x02}},
+		{k: []byte{0x12}, v: []byte{0x03}},
+		{k: []byte{0x13}, v: []byte{}},
+		{k: []byte{0xf0}, v: []byte{0x05}},
+	}
+	trie := NewTrie(EmptyHash, memDB)
+	for _, elem := range kvs {
+		trie = trie.Insert(elem.k, elem.v)
+	}
+	trie.Persist()
+	return NewTrie(trie.StateRoot(), memDB), kvs
+}
+
+func TestIterateEmbeddedNodes(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := tinyTrie(memDB)
+	assert.Equal(t, kvs, collectKVs(t, trie.Iterate))
+
+	nodes := collectNodes(t, trie, PreOrder)
+	assert.Equal(t, trie.StateRoot(), nodes[0].hash)
+	paths := make(map[string]struct{})
+	embedded := 0
+	for _, n := range nodes {
+		if n.hash == (common.Hash{}) {
+			// embedded nodes have no hash, and are identified by their paths
+			embedded++
+			assert.True(t, len(n.encoded) < common.HashLength)
+		}
+		encoded, err := ReadTrieNodeByPath(memDB, trie.StateRoot(), n.path)
+		assert.Nil(t, err)
+		assert.Equal(t, n.encoded, encoded)
+		paths[string(n.path)] = struct{}{}
+	}
+	assert.Equal(t, len(nodes), len(paths))
+	assert.Equal(t, len(nodes)-embedded, memDB.Len())
+	assert.True(t, embedded > 0)
+
+	// start inside embedded subtrees
+	for i, elem := range kvs {
+		actual := collectKVs(t, func(fn func(key, value []byte) bool) error {
+			return trie.IterateFrom(elem.k, fn)
+		})
+		assert.Equal(t, kvs[i:], actual)
+	}
+
+	var prev [][]byte
+	items := make([]ProofItem, 0)
+	err := trie.IterateWithProof(nil, func(key, value []byte, step ProofStep) bool {
+		prev = step.Apply(prev)
+		expected, err := trie.Prove(key)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, prev)
+		items = append(items, ProofItem{Key: key, Value: value, Proof: prev})
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, len(kvs), len(items))
+	assert.Nil(t, VerifyProofBatch(trie.StateRoot(), items))
+}
+
+func TestIterateNodes(t *testing.T) {
+	trie, kvs := persistedTrie(memorydb.New(), 200)
+	trie = trie.Insert([]byte{0x01}, []byte{0x01})
+
+	pre := collectNodes(t, trie, PreOrder)
+	post := collectNodes(t, trie, PostOrder)
+	assert.Equal(t, len(pre), len(post))
+	assert.Equal(t, trie.StateRoot(), pre[0].hash)
+	assert.Equal(t, trie.StateRoot(), post[len(post)-1].hash)
+	embedded := 0
+	for i, n := range pre {
+		if n.hash == (common.Hash{}) {
+			embedded++
+			assert.True(t, len(n.encoded) < common.HashLength)
+		} else {
+			assert.Equal(t, crypto.Keccak256Hash(n.encoded), n.hash)
+		}
+		// parents are visited before children in pre-order, and after them in post-order
+		for _, later := range pre[i+1:] {
+			assert.False(t, len(later.path) < len(n.path) && bytes.HasPrefix(n.path, later.path))
+		}
+	}
+	assert.True(t, embedded > 0)
+	for i, n := range post {
+		for _, later := range post[i+1:] {
+			assert.False(t, len(later.path) > len(n.path) && bytes.HasPrefix(later.path, n.path))
+		}
+	}
+
+	leaves := collectNodes(t, trie, LeavesOnly)
+	targets := 0
+	for _, n := range pre {
+		decoded, err := decodeNode(n.encoded)
+		assert.Nil(t, err)
+		if branch, ok := decoded.(*branchNode); ok && branch.hasTarget() {
+			targets++
+		}
+	}
+	for _, n := range leaves {
+		assert.Equal(t, leafType, n.encoded[len(n.encoded)-1]&0x0f)
+	}
+	assert.Equal(t, len(kvMap(append(kvs, kv{k: []byte{0x01}}))), len(leaves)+targets)
+
+	count := 0
+	err := trie.IterateNodes(PostOrder, func(path []byte, hash common.Hash, encoded []byte) bool {
+		count++
+		return count < 10
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 10, count)
+	assert.NotNil(t, trie.IterateNodes(TraversalOrder(3), nil))
+}
@@ -0,0 +1,115 @@
+package mpt
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Helpers to build keys from common types. The trie iterate key values in the
+// byte order of keys, the ordering property of each key type is documented, so
+// a trie used as an index can be scanned in the expected order.
+
+// Uint64Key return the 8 bytes big endian encoding of n, the byte order of keys
+// is the same as the numeric order of n
+func Uint64Key(n uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, n)
+	return key
+}
+
+// ParseUint64Key is the reverse of Uint64Key
+func ParseUint64Key(key []byte) (uint64, error) {
+	if len(key) != 8 {
+		return 0, fmt.Errorf("invalid uint64 key length: %d", len(key))
+	}
+	return binary.BigEndian.Uint64(key), nil
+}
+
+// AddressKey return the 20 bytes of addr, the byte order of keys is the same as
+// the order of addresses as big endian numbers
+func AddressKey(addr common.Address) []byte {
+	return common.CopyBytes(addr[:])
+}
+
+// ParseAddressKey is the reverse of AddressKey
+func ParseAddressKey(key []byte) (common.Address, error) {
+	if len(key) != common.AddressLength {
+		return common.Address{}, fmt.Errorf("invalid address key length: %d", len(key))
+	}
+	return common.BytesToAddress(key), nil
+}
+
+// CompositeKey join parts into one key, the byte order of keys is the order of
+// parts compared one by one, the same as comparing tuples, so all keys with the
+// same leading parts are adjacent and can be iterated by View. Every part is
+// escaped and terminated to make parts of any length comparable: 0x00 in parts
+// is encoded as 0x00 0xff, and every part end with 0x00 0x01
+func CompositeKey(parts ...[]byte) []byte {
+	size := 0
+	for _, part := range parts {
+		size += len(part) + 2
+	}
+	key := make([]byte, 0, size)
+	for _, part := range parts {
+		for _, b := range part {
+			if b == 0x00 {
+				key = append(key, 0x00, 0xff)
+			} else {
+				key = append(key, b)
+			}
+		}
+		key = append(key, 0x00, 0x01)
+	}
+	return key
+}
+
+// ParseCompositeKey is the reverse of CompositeKey
+func ParseCompositeKey(key []byte) ([][]byte, error) {
+	parts := make([][]byte, 0)
+	part := make([]byte, 0)
+	for i := 0; i < len(key); i++ {
+		if key[i] != 0x00 {
+			part = append(part, key[i])
+			continue
+		}
+		if i+1 == len(key) {
+			return nil, fmt.Errorf("invalid composite key %x: truncated escape", key)
+		}
+		i++
+		switch key[i] {
+		case 0xff:
+			part = append(part, 0x00)
+		case 0x01:
+			parts = append(parts, part)
+			part = make([]byte, 0)
+		default:
+			return nil, fmt.Errorf("invalid composite key %x: unknown escape %x", key, key[i])
+		}
+	}
+	if len(part) != 0 {
+		return nil, fmt.Errorf("invalid composite key %x: unterminated part", key)
+	}
+	return parts, nil
+}
+
+// ListIndexKey return the key of the item at index of a list, which is the rlp
+// encoding of index as the keys of transaction and receipt tries. The byte order
+// of keys is NOT the order of indexes: index 0 is encoded as 0x80, which sorts
+// after indexes 1 to 127
+func ListIndexKey(index uint64) []byte {
+	switch {
+	case index == 0:
+		return []byte{0x80}
+	case index < 0x80:
+		return []byte{byte(index)}
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], index)
+	size := 8
+	for buf[8-size] == 0 {
+		size--
+	}
+	return append([]byte{0x80 + byte(size)}, buf[8-size:]...)
+}
@@ -0,0 +1,86 @@
+package mpt
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUint64Key(t *testing.T) {
+	numbers := []uint64{0, 1, 255, 256, 1 << 32, math.MaxUint64}
+	for i, n := range numbers {
+		parsed, err := ParseUint64Key(Uint64Key(n))
+		assert.Nil(t, err)
+		assert.Equal(t, n, parsed)
+		if i > 0 {
+			assert.True(t, bytes.Compare(Uint64Key(numbers[i-1]), Uint64Key(n)) < 0)
+		}
+	}
+	_, err := ParseUint64Key([]byte{0x01})
+	assert.NotNil(t, err)
+}
+
+func TestAddressKey(t *testing.T) {
+	addr := common.HexToAddress("0x00000000000000000000000000000000000000ff")
+	parsed, err := ParseAddressKey(AddressKey(addr))
+	assert.Nil(t, err)
+	assert.Equal(t, addr, parsed)
+	other := common.HexToAddress("0x0000000000000000000000000000000000000100")
+	assert.True(t, bytes.Compare(AddressKey(addr), AddressKey(other)) < 0)
+	_, err = ParseAddressKey(addr[1:])
+	assert.NotNil(t, err)
+}
+
+func TestCompositeKey(t *testing.T) {
+	tuples := [][][]byte{
+		{{}},
+		{{}, {0x01}},
+		{{0x00}},
+		{{0x00}, {}},
+		{{0x00, 0x00}},
+		{{0x00, 0x01}},
+		{{0x01}},
+		{{0x01}, {0x00}},
+		{{0x01}, {0x01}},
+		{{0x01, 0x00}},
+		{{0xff}},
+	}
+	keys := make([][]byte, 0, len(tuples))
+	for _, parts := range tuples {
+		key := CompositeKey(parts...)
+		parsed, err := ParseCompositeKey(key)
+		assert.Nil(t, err)
+		assert.Equal(t, parts, parsed)
+		keys = append(keys, key)
+	}
+	// byte order of keys is the order of tuples
+	assert.True(t, sort.SliceIsSorted(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	}))
+
+	for _, invalid := range [][]byte{{0x01}, {0x00}, {0x00, 0x02}} {
+		_, err := ParseCompositeKey(invalid)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestListIndexKey(t *testing.T) {
+	cases := []struct {
+		index uint64
+		key   []byte
+	}{
+		{0, []byte{0x80}},
+		{1, []byte{0x01}},
+		{0x7f, []byte{0x7f}},
+		{0x80, []byte{0x81, 0x80}},
+		{0x0100, []byte{0x82, 0x01, 0x00}},
+		{1<<64 - 1, []byte{0x88, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.key, ListIndexKey(c.index))
+	}
+}
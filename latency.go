@@ -0,0 +1,200 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Op is a trie operation measured by the latency sink
+type Op int
+
+const (
+	OpGet Op = iota
+	OpInsert
+	OpDelete
+	OpCommit
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpGet:
+		return "get"
+	case OpInsert:
+		return "insert"
+	case OpDelete:
+		return "delete"
+	case OpCommit:
+		return "commit"
+	default:
+		return fmt.Sprintf("Op(%d)", int(op))
+	}
+}
+
+// OpSample is the latency of an operation, DBReads is the number of nodes read from
+// underlying db rather than the log or caches of the trie
+type OpSample struct {
+	Op       Op
+	Duration time.Duration
+	DBReads  int
+	Err      error
+}
+
+// Outcome classify the sample by the number of db reads, so slow operations caused
+// by cache misses can be told from a degraded db: "cache-hit" for no reads, "db-1",
+// "db-2-4" and "db-5+", or "error" if the operation failed
+func (s OpSample) Outcome() string {
+	switch {
+	case s.Err != nil:
+		return "error"
+	case s.DBReads == 0:
+		return "cache-hit"
+	case s.DBReads == 1:
+		return "db-1"
+	case s.DBReads <= 4:
+		return "db-2-4"
+	default:
+		return "db-5+"
+	}
+}
+
+// WithLatencySink call sink with the sample of every Get, Insert and Delete of the
+// trie and every commit by Persist, Commit and PersistWithPruner, e.g. the Observe
+// of LatencyHistograms, or a function forwarding samples to a metrics system. Sink
+// is called synchronously, so it must be cheap
+func WithLatencySink(sink func(sample OpSample)) Option {
+	return func(c *config) {
+		c.latencySink = sink
+	}
+}
+
+// measure return a copy of t counting the nodes resolved, and a function sending the
+// sample of the operation to the sink and the cache stats when it's done. If the
+// trie has neither of them, t itself and a no-op function are returned
+func (t *Trie) measure(op Op) (*Trie, func(err error)) {
+	sink, stats := t.config.latencySink, t.config.cacheStats
+	if sink == nil && stats == nil {
+		return t, func(error) {}
+	}
+	measured := *t
+	measured.counts = &opCounts{}
+	start := time.Now()
+	return &measured, func(err error) {
+		counts := *measured.counts
+		// the copy may be returned by the operation, e.g. a delete of an absent key
+		measured.counts = nil
+		if sink != nil {
+			sink(OpSample{Op: op, Duration: time.Since(start), DBReads: counts.dbReads, Err: err})
+		}
+		if stats != nil {
+			stats.record(op, counts)
+		}
+	}
+}
+
+// defaultLatencyBounds is the upper bounds of latency buckets, from 10us to 1s
+var defaultLatencyBounds = []time.Duration{
+	10 * time.Microsecond, 50 * time.Microsecond,
+	100 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 500 * time.Millisecond,
+	time.Second,
+}
+
+// LatencyHistogram is the latency distribution of an operation with an outcome,
+// Counts[i] is the number of samples not greater than Bounds[i] and greater than
+// the previous bound, the last count is samples greater than all bounds
+type LatencyHistogram struct {
+	Op      string          `json:"op"`
+	Outcome string          `json:"outcome"`
+	Bounds  []time.Duration `json:"bounds"`
+	Counts  []uint64        `json:"counts"`
+	Count   uint64          `json:"count"`
+	Sum     time.Duration   `json:"sum"`
+}
+
+type latencyKey struct {
+	op      Op
+	outcome string
+}
+
+// LatencyHistograms keep a latency histogram for every operation and outcome, it's
+// safe for concurrent use, and serve the histograms as JSON over http
+type LatencyHistograms struct {
+	lock       sync.Mutex
+	bounds     []time.Duration
+	histograms map[latencyKey]*LatencyHistogram
+}
+
+// NewLatencyHistograms create empty histograms with the bucket upper bounds, which
+// must be ascending, nil means the default bounds from 10us to 1s
+func NewLatencyHistograms(bounds []time.Duration) *LatencyHistograms {
+	if bounds == nil {
+		bounds = defaultLatencyBounds
+	}
+	return &LatencyHistograms{
+		bounds:     append([]time.Duration{}, bounds...),
+		histograms: make(map[latencyKey]*LatencyHistogram),
+	}
+}
+
+// Observe add sample to the histogram of its operation and outcome
+func (h *LatencyHistograms) Observe(sample OpSample) {
+	key := latencyKey{op: sample.Op, outcome: sample.Outcome()}
+	bucket := sort.Search(len(h.bounds), func(i int) bool {
+		return sample.Duration <= h.bounds[i]
+	})
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	histogram, ok := h.histograms[key]
+	if !ok {
+		histogram = &LatencyHistogram{
+			Op:      key.op.String(),
+			Outcome: key.outcome,
+			Bounds:  h.bounds,
+			Counts:  make([]uint64, len(h.bounds)+1),
+		}
+		h.histograms[key] = histogram
+	}
+	histogram.Counts[bucket]++
+	histogram.Count++
+	histogram.Sum += sample.Duration
+}
+
+// Histograms return a copy of all histograms sorted by operation and outcome
+func (h *LatencyHistograms) Histograms() []LatencyHistogram {
+	h.lock.Lock()
+	keys := make([]latencyKey, 0, len(h.histograms))
+	for key := range h.histograms {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].op != keys[j].op {
+			return keys[i].op < keys[j].op
+		}
+		return keys[i].outcome < keys[j].outcome
+	})
+	histograms := make([]LatencyHistogram, 0, len(keys))
+	for _, key := range keys {
+		histogram := *h.histograms[key]
+		histogram.Counts = append([]uint64{}, histogram.Counts...)
+		histograms = append(histograms, histogram)
+	}
+	h.lock.Unlock()
+	return histograms
+}
+
+// ServeHTTP write the histograms as JSON
+func (h *LatencyHistograms) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.Histograms()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
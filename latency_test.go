@@ -0,0 +1,100 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpSampleOutcome(t *testing.T) {
+	assert.Equal(t, "cache-hit", OpSample{}.Outcome())
+	assert.Equal(t, "db-1", OpSample{DBReads: 1}.Outcome())
+	assert.Equal(t, "db-2-4", OpSample{DBReads: 4}.Outcome())
+	assert.Equal(t, "db-5+", OpSample{DBReads: 5}.Outcome())
+	assert.Equal(t, "error", OpSample{DBReads: 1, Err: ErrStaleTrie}.Outcome())
+}
+
+func TestLatencySink(t *testing.T) {
+	memDB := memorydb.New()
+	base, kvs := persistedTrie(memDB, 100)
+	samples := make([]OpSample, 0)
+	trie := NewTrie(base.StateRoot(), memDB, WithLatencySink(func(sample OpSample) {
+		samples = append(samples, sample)
+	}))
+
+	assert.Equal(t, kvs[0].v, trie.Get(kvs[0].k))
+	assert.Equal(t, 1, len(samples))
+	assert.Equal(t, OpGet, samples[0].Op)
+	assert.True(t, samples[0].DBReads > 0)
+	assert.Nil(t, samples[0].Err)
+	assert.Equal(t, kvs[0].v, trie.Get(kvs[0].k))
+	assert.Equal(t, "cache-hit", samples[1].Outcome())
+
+	updated := trie.Insert(kvs[1].k, kvs[0].v)
+	assert.Equal(t, OpInsert, samples[2].Op)
+	unchanged, err := updated.TryDelete(randomBytes())
+	assert.Nil(t, err)
+	assert.Equal(t, OpDelete, samples[3].Op)
+	// tries returned by measured operations don't count reads anymore
+	assert.Nil(t, unchanged.counts)
+	assert.Nil(t, updated.counts)
+	updated.Persist()
+	assert.Equal(t, OpCommit, samples[4].Op)
+
+	_, err = NewTrie(base.StateRoot(), memorydb.New(), WithLatencySink(func(sample OpSample) {
+		samples = append(samples, sample)
+	})).TryGet(kvs[0].k)
+	assert.NotNil(t, err)
+	assert.Equal(t, "error", samples[5].Outcome())
+}
+
+func TestLatencyHistograms(t *testing.T) {
+	h := NewLatencyHistograms([]time.Duration{time.Millisecond, time.Second})
+	h.Observe(OpSample{Op: OpGet, Duration: time.Microsecond})
+	h.Observe(OpSample{Op: OpGet, Duration: time.Millisecond})
+	h.Observe(OpSample{Op: OpGet, Duration: 2 * time.Second, DBReads: 2})
+	h.Observe(OpSample{Op: OpCommit, Duration: 10 * time.Millisecond, DBReads: 1})
+
+	histograms := h.Histograms()
+	assert.Equal(t, 3, len(histograms))
+	assert.Equal(t, LatencyHistogram{
+		Op:      "get",
+		Outcome: "cache-hit",
+		Bounds:  []time.Duration{time.Millisecond, time.Second},
+		Counts:  []uint64{2, 0, 0},
+		Count:   2,
+		Sum:     time.Millisecond + time.Microsecond,
+	}, histograms[0])
+	assert.Equal(t, "db-2-4", histograms[1].Outcome)
+	assert.Equal(t, []uint64{0, 0, 1}, histograms[1].Counts)
+	assert.Equal(t, "commit", histograms[2].Op)
+	assert.Equal(t, []uint64{0, 1, 0}, histograms[2].Counts)
+
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	var served []LatencyHistogram
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &served))
+	assert.Equal(t, histograms, served)
+
+	// works as the sink of tries
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 10)
+	h = NewLatencyHistograms(nil)
+	trie = NewTrie(trie.StateRoot(), memDB, WithLatencySink(h.Observe))
+	for _, elem := range kvs {
+		trie.Get(elem.k)
+	}
+	var count uint64
+	for _, histogram := range h.Histograms() {
+		assert.Equal(t, "get", histogram.Op)
+		count += histogram.Count
+	}
+	assert.Equal(t, uint64(len(kvs)), count)
+}
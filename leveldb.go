@@ -0,0 +1,161 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	db "github.com/ethereum/go-ethereum/ethdb"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// LevelDB is a goleveldb db used as underlying db of tries, it's a Snapshotter whose
+// snapshots are taken by GetSnapshot of goleveldb, see WithDBSnapshot. The Database
+// of go-ethereum's ethdb/leveldb doesn't expose the goleveldb db it opened, so it
+// can't take snapshots, open the db with goleveldb and wrap it by NewLevelDB instead
+type LevelDB struct {
+	db *leveldb.DB
+}
+
+var (
+	_ db.KeyValueStore = (*LevelDB)(nil)
+	_ Snapshotter      = (*LevelDB)(nil)
+)
+
+// NewLevelDB wrap an open goleveldb db, closing the LevelDB close the wrapped db
+func NewLevelDB(ldb *leveldb.DB) *LevelDB {
+	return &LevelDB{db: ldb}
+}
+
+// Has report whether key is present in the db
+func (l *LevelDB) Has(key []byte) (bool, error) {
+	return l.db.Has(key, nil)
+}
+
+// Get return the value of key in the db
+func (l *LevelDB) Get(key []byte) ([]byte, error) {
+	return l.db.Get(key, nil)
+}
+
+// Put write key and value to the db
+func (l *LevelDB) Put(key []byte, value []byte) error {
+	return l.db.Put(key, value, nil)
+}
+
+// Delete remove key from the db
+func (l *LevelDB) Delete(key []byte) error {
+	return l.db.Delete(key, nil)
+}
+
+// NewBatch create a batch written to the db by Write
+func (l *LevelDB) NewBatch() db.Batch {
+	return &levelDBBatch{db: l.db, batch: new(leveldb.Batch)}
+}
+
+// NewIterator iterate keys with prefix from start in ascending order
+func (l *LevelDB) NewIterator(prefix []byte, start []byte) db.Iterator {
+	r := util.BytesPrefix(prefix)
+	// the range start with prefix itself, copy it before appending
+	r.Start = append(append([]byte{}, prefix...), start...)
+	return l.db.NewIterator(r, nil)
+}
+
+// Stat return the goleveldb property of the db
+func (l *LevelDB) Stat(property string) (string, error) {
+	return l.db.GetProperty(property)
+}
+
+// Compact compact keys in [start, limit), nil start or limit means unbounded
+func (l *LevelDB) Compact(start []byte, limit []byte) error {
+	return l.db.CompactRange(util.Range{Start: start, Limit: limit})
+}
+
+// Close close the wrapped db
+func (l *LevelDB) Close() error {
+	return l.db.Close()
+}
+
+// NewSnapshot take a snapshot of the db by GetSnapshot of goleveldb
+func (l *LevelDB) NewSnapshot() (DBSnapshot, error) {
+	snapshot, err := l.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &levelDBSnapshot{snapshot}, nil
+}
+
+// levelDBSnapshot is a goleveldb snapshot as DBSnapshot
+type levelDBSnapshot struct {
+	snapshot *leveldb.Snapshot
+}
+
+func (s *levelDBSnapshot) Has(key []byte) (bool, error) {
+	return s.snapshot.Has(key, nil)
+}
+
+func (s *levelDBSnapshot) Get(key []byte) ([]byte, error) {
+	return s.snapshot.Get(key, nil)
+}
+
+func (s *levelDBSnapshot) Release() {
+	s.snapshot.Release()
+}
+
+// levelDBBatch buffer writes in a goleveldb batch, its size count deletes as one
+// byte like the batches of go-ethereum
+type levelDBBatch struct {
+	db    *leveldb.DB
+	batch *leveldb.Batch
+	size  int
+}
+
+func (b *levelDBBatch) Put(key, value []byte) error {
+	b.batch.Put(key, value)
+	b.size += len(value)
+	return nil
+}
+
+func (b *levelDBBatch) Delete(key []byte) error {
+	b.batch.Delete(key)
+	b.size++
+	return nil
+}
+
+func (b *levelDBBatch) ValueSize() int {
+	return b.size
+}
+
+func (b *levelDBBatch) Write() error {
+	return b.db.Write(b.batch, nil)
+}
+
+func (b *levelDBBatch) Reset() {
+	b.batch.Reset()
+	b.size = 0
+}
+
+func (b *levelDBBatch) Replay(w db.KeyValueWriter) error {
+	replayer := &levelDBReplayer{writer: w}
+	if err := b.batch.Replay(replayer); err != nil {
+		return err
+	}
+	return replayer.err
+}
+
+// levelDBReplayer replay a goleveldb batch to a writer, and keep the first error
+type levelDBReplayer struct {
+	writer db.KeyValueWriter
+	err    error
+}
+
+func (r *levelDBReplayer) Put(key, value []byte) {
+	if r.err == nil {
+		r.err = r.writer.Put(key, value)
+	}
+}
+
+func (r *levelDBReplayer) Delete(key []byte) {
+	if r.err == nil {
+		r.err = r.writer.Delete(key)
+	}
+}
@@ -0,0 +1,82 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func newMemoryLevelDB(t *testing.T) *LevelDB {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.Nil(t, err)
+	return NewLevelDB(ldb)
+}
+
+func TestLevelDBSnapshot(t *testing.T) {
+	ldb := newMemoryLevelDB(t)
+	defer ldb.Close()
+	trie := NewTrie(EmptyHash, ldb)
+	kvs := uniqueKVs(200)
+	for _, elem := range kvs {
+		trie = trie.Insert(elem.k, elem.v)
+	}
+	trie.Persist()
+	trie = NewTrie(trie.StateRoot(), ldb)
+	snapshotTrie, err := trie.WithDBSnapshot()
+	assert.Nil(t, err)
+	defer snapshotTrie.ReleaseDBSnapshot()
+
+	// a commit prune nodes of the trie after the snapshot is taken
+	updated := trie
+	for _, elem := range kvs[:100] {
+		updated = updated.Delete(elem.k)
+	}
+	updated.Persist()
+	assert.True(t, trie.Stale())
+	assert.False(t, snapshotTrie.Stale())
+	checkIterate(t, snapshotTrie, kvMap(kvs))
+	checkIterate(t, NewTrie(updated.StateRoot(), ldb), kvMap(kvs[100:]))
+}
+
+func TestLevelDBStore(t *testing.T) {
+	ldb := newMemoryLevelDB(t)
+	defer ldb.Close()
+	batch := ldb.NewBatch()
+	assert.Nil(t, batch.Put([]byte("a1"), []byte{0x01}))
+	assert.Nil(t, batch.Put([]byte("a2"), []byte{0x02}))
+	assert.Nil(t, batch.Put([]byte("b1"), []byte{0x03}))
+	assert.Nil(t, batch.Delete([]byte("c")))
+	assert.Equal(t, 4, batch.ValueSize())
+	has, err := ldb.Has([]byte("a1"))
+	assert.Nil(t, err)
+	assert.False(t, has)
+	assert.Nil(t, batch.Write())
+
+	replayed := memorydb.New()
+	assert.Nil(t, batch.Replay(replayed))
+	assert.Equal(t, 3, replayed.Len())
+	batch.Reset()
+	assert.Equal(t, 0, batch.ValueSize())
+
+	value, err := ldb.Get([]byte("a2"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x02}, value)
+	it := ldb.NewIterator([]byte("a"), []byte("2"))
+	keys := make([]string, 0)
+	for it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	it.Release()
+	assert.Equal(t, []string{"a2"}, keys)
+
+	assert.Nil(t, ldb.Delete([]byte("a2")))
+	_, err = ldb.Get([]byte("a2"))
+	assert.NotNil(t, err)
+	assert.Nil(t, ldb.Compact(nil, nil))
+}
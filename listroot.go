@@ -0,0 +1,78 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// discardStore is a NodeStore which drop all nodes
+type discardStore struct{}
+
+func (discardStore) Put(key []byte, value []byte) error {
+	return nil
+}
+
+func (discardStore) Delete(key []byte) error {
+	return nil
+}
+
+// buildList build the trie of items keyed by ListIndexKey, nodes are written to store
+func buildList(items [][]byte, store NodeStore) (common.Hash, error) {
+	keys := make([][]byte, len(items))
+	order := make([]int, len(items))
+	for i := range items {
+		keys[i] = ListIndexKey(uint64(i))
+		order[i] = i
+	}
+	// the builder require keys in byte order, which is not the order of indexes
+	sort.Slice(order, func(i, j int) bool {
+		return bytes.Compare(keys[order[i]], keys[order[j]]) < 0
+	})
+	builder := newStackBuilder(store)
+	for _, i := range order {
+		if err := builder.add(keys[i], items[i]); err != nil {
+			return common.Hash{}, err
+		}
+	}
+	return builder.commit()
+}
+
+// DeriveListRoot return the root of the trie holding items keyed by their index,
+// encoded by ListIndexKey, like transaction and receipt roots of a block. The trie
+// is built in memory by the stack builder and nodes are dropped, so the memory
+// usage is bounded by the depth of the trie
+func DeriveListRoot(items [][]byte) common.Hash {
+	// keys are distinct and the store never fail
+	root, err := buildList(items, discardStore{})
+	if err != nil {
+		panic(err)
+	}
+	return root
+}
+
+// ListProofs return the root of items as DeriveListRoot and the proof of every item,
+// the proof of item i can be verified by VerifyListItem(root, i, items[i], proof)
+func ListProofs(items [][]byte) (common.Hash, [][][]byte) {
+	memDB := memorydb.New()
+	root, err := buildList(items, memDB)
+	if err != nil {
+		panic(err)
+	}
+	trie := NewTrie(root, memDB)
+	proofs := make([][][]byte, len(items))
+	for i := range items {
+		// all nodes are in memDB
+		proof, err := trie.Prove(ListIndexKey(uint64(i)))
+		if err != nil {
+			panic(err)
+		}
+		proofs[i] = proof
+	}
+	return root, proofs
+}
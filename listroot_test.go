@@ -0,0 +1,38 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeriveListRoot(t *testing.T) {
+	assert.Equal(t, EmptyHash, DeriveListRoot(nil))
+
+	// more than 128 items, so index keys are not in byte order
+	items := make([][]byte, 0, 300)
+	for i := 0; i < 300; i++ {
+		items = append(items, randomBytes())
+	}
+	items[5] = []byte{}
+	trie := NewTrie(EmptyHash, memorydb.New())
+	for i, item := range items {
+		trie = trie.Insert(ListIndexKey(uint64(i)), item)
+	}
+	root := DeriveListRoot(items)
+	assert.Equal(t, trie.StateRoot(), root)
+
+	proofRoot, proofs := ListProofs(items)
+	assert.Equal(t, root, proofRoot)
+	assert.Equal(t, len(items), len(proofs))
+	for i, item := range items {
+		assert.Nil(t, VerifyListItem(root, uint64(i), item, proofs[i]))
+	}
+	assert.NotNil(t, VerifyListItem(root, 1, items[0], proofs[0]))
+	assert.NotNil(t, VerifyListItem(root, 0, items[1], proofs[0]))
+	assert.NotNil(t, VerifyListItem(root, uint64(len(items)), items[0], proofs[0]))
+}
@@ -0,0 +1,145 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// MissingNodeStats count the missing nodes met by read paths of tries by depth, the
+// depth is the number of key nibbles from root to the node. While a trie is synced
+// or healed, counts moving to deeper depths show the sync progress breadth-wise, and
+// counts piling up at a few depths point to stuck subtrees. It's safe for concurrent
+// use, and serve the counts as JSON over http
+type MissingNodeStats struct {
+	lock   sync.Mutex
+	depths []uint64
+	meter  func(depth int)
+}
+
+// missingNodeStatus is the JSON status served by MissingNodeStats
+type missingNodeStatus struct {
+	Total  uint64   `json:"total"`
+	Depths []uint64 `json:"depths"`
+}
+
+// NewMissingNodeStats create an empty stats, meter is called with the depth of every
+// missing node if it's not nil, which forward the counts to a metrics system
+func NewMissingNodeStats(meter func(depth int)) *MissingNodeStats {
+	return &MissingNodeStats{
+		depths: make([]uint64, 0),
+		meter:  meter,
+	}
+}
+
+// WithMissingNodeStats record missing nodes met by Get, Iterate and IterateNodes to stats
+func WithMissingNodeStats(stats *MissingNodeStats) Option {
+	return func(c *config) {
+		c.missingStats = stats
+	}
+}
+
+func (s *MissingNodeStats) record(depth int) {
+	s.lock.Lock()
+	for len(s.depths) <= depth {
+		s.depths = append(s.depths, 0)
+	}
+	s.depths[depth]++
+	s.lock.Unlock()
+	if s.meter != nil {
+		s.meter(depth)
+	}
+}
+
+// Counts return the number of missing nodes of each depth, indexed by depth
+func (s *MissingNodeStats) Counts() []uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	counts := make([]uint64, len(s.depths))
+	copy(counts, s.depths)
+	return counts
+}
+
+// Total return the number of missing nodes of all depths
+func (s *MissingNodeStats) Total() uint64 {
+	var total uint64
+	for _, count := range s.Counts() {
+		total += count
+	}
+	return total
+}
+
+// Reset clear all counts
+func (s *MissingNodeStats) Reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.depths = s.depths[:0]
+}
+
+// ServeHTTP write the counts as JSON, e.g. {"total":3,"depths":[0,1,2]}
+func (s *MissingNodeStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	counts := s.Counts()
+	status := missingNodeStatus{Depths: counts}
+	for _, count := range counts {
+		status.Total += count
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// traceMissing record the node at path to stats of trie if err is a MissingNodeError
+func (t *Trie) traceMissing(path []byte, err error) {
+	stats := t.config.missingStats
+	if stats == nil {
+		return
+	}
+	if _, ok := err.(*MissingNodeError); ok {
+		stats.record(len(path))
+	}
+}
+
+// ErrPrunedState is returned by TryGet of tries with WithPrunedStateError when the
+// path of key cross a node pruned from underlying db, so the value of key at Root
+// is unknown rather than absent
+type ErrPrunedState struct {
+	Root common.Hash
+}
+
+func (e *ErrPrunedState) Error() string {
+	return fmt.Sprintf("state not available at root %s, nodes have been pruned", e.Root.Hex())
+}
+
+// WithPrunedStateError make TryGet return ErrPrunedState rather than ErrStaleTrie or
+// MissingNodeError when nodes on the path of key are absent from underlying db, so
+// RPC layers can tell "state not available at this root" from "key not found".
+// Nodes which exist but can't be decoded are still reported as MissingNodeError
+func WithPrunedStateError() Option {
+	return func(c *config) {
+		c.prunedStateError = true
+	}
+}
+
+// prunedState convert err to ErrPrunedState if the trie has WithPrunedStateError and
+// err is caused by nodes absent from underlying db, nodes are content addressed, so
+// nodes referenced by a committed root only disappear by pruning
+func (t *Trie) prunedState(err error) error {
+	if err == nil || !t.config.prunedStateError {
+		return err
+	}
+	if missing, ok := err.(*MissingNodeError); ok {
+		if t.hasNode(missing.Hash) {
+			return err
+		}
+	} else if err != ErrStaleTrie {
+		return err
+	}
+	return &ErrPrunedState{Root: t.rootHash}
+}
@@ -0,0 +1,109 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMissingNodeStats(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, iterateTimes)
+	// remove all nodes below the root
+	rootKey := nodeKey(trie.StateRoot())
+	it := memDB.NewIterator(nil, nil)
+	for it.Next() {
+		if string(it.Key()) != string(rootKey) {
+			assert.Nil(t, memDB.Delete(it.Key()))
+		}
+	}
+	it.Release()
+
+	metered := make(map[int]int)
+	stats := NewMissingNodeStats(func(depth int) {
+		metered[depth]++
+	})
+	trie = NewTrie(trie.StateRoot(), memDB, WithMissingNodeStats(stats))
+	for _, elem := range kvs[:10] {
+		_, err := trie.TryGet(elem.k)
+		assert.NotNil(t, err)
+	}
+	assert.NotNil(t, trie.Iterate(func(key, value []byte) bool { return true }))
+	counts := stats.Counts()
+	assert.Equal(t, uint64(11), stats.Total())
+	// children of the root branch are at depth 1
+	assert.Equal(t, 2, len(counts))
+	assert.Equal(t, uint64(11), counts[1])
+	assert.Equal(t, map[int]int{1: 11}, metered)
+
+	recorder := httptest.NewRecorder()
+	stats.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	var status missingNodeStatus
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &status))
+	assert.Equal(t, uint64(11), status.Total)
+	assert.Equal(t, counts, status.Depths)
+
+	stats.Reset()
+	assert.Equal(t, uint64(0), stats.Total())
+	// missing root is reported as stale trie rather than missing node
+	trie = NewTrie(trie.StateRoot(), memorydb.New(), WithMissingNodeStats(stats))
+	_, err := trie.TryGet(kvs[0].k)
+	assert.Equal(t, ErrStaleTrie, err)
+	assert.Equal(t, uint64(0), stats.Total())
+}
+
+func TestPrunedStateError(t *testing.T) {
+	memDB := memorydb.New()
+	old, kvs := persistedTrie(memDB, 100)
+	oldRoot := old.StateRoot()
+	updated := old
+	for _, elem := range kvs {
+		updated = updated.Insert(elem.k, randomBytes())
+	}
+	updated.Persist()
+
+	_, err := NewTrie(oldRoot, memDB).TryGet(kvs[0].k)
+	assert.Equal(t, ErrStaleTrie, err)
+	_, err = NewTrie(oldRoot, memDB, WithPrunedStateError()).TryGet(kvs[0].k)
+	assert.Equal(t, &ErrPrunedState{Root: oldRoot}, err)
+
+	// absent key of the current root is not an error
+	current := NewTrie(updated.StateRoot(), memDB, WithPrunedStateError())
+	value, err := current.TryGet(randomBytes())
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+
+	// nodes below the root pruned by a deferred pruner
+	var child []byte
+	it := memDB.NewIterator(nil, nil)
+	for it.Next() && child == nil {
+		if string(it.Key()) != string(nodeKey(updated.StateRoot())) {
+			child = common.CopyBytes(it.Key())
+		}
+	}
+	it.Release()
+	encoded, _ := memDB.Get(child)
+	assert.Nil(t, memDB.Delete(child))
+	for _, elem := range kvs {
+		if _, err = current.TryGet(elem.k); err != nil {
+			break
+		}
+	}
+	assert.Equal(t, &ErrPrunedState{Root: updated.StateRoot()}, err)
+
+	// nodes can't be decoded are not pruned
+	assert.Nil(t, memDB.Put(child, append([]byte{0xff}, encoded...)))
+	for _, elem := range kvs {
+		if _, err = current.TryGet(elem.k); err != nil {
+			break
+		}
+	}
+	assert.IsType(t, &MissingNodeError{}, err)
+}
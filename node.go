@@ -1,21 +1,166 @@
 package mpt
 
 import (
+	"errors"
 	"fmt"
 	"io"
 
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/golang/protobuf/proto"
 )
 
+// NodeKind is the type of a trie node
+type NodeKind int
+
+const (
+	// LeafKind is a leaf node which hold the rest of a key and its value
+	LeafKind NodeKind = iota
+	// ExtensionKind is an extension node which hold the shared key nibbles of its child
+	ExtensionKind
+	// BranchKind is a branch node which hold 16 children and an optional target
+	BranchKind
+	// HashKind is a reference to a node by hash, the node isn't resolved
+	HashKind
+)
+
+func (k NodeKind) String() string {
+	switch k {
+	case LeafKind:
+		return "leaf"
+	case ExtensionKind:
+		return "extension"
+	case BranchKind:
+		return "branch"
+	case HashKind:
+		return "hash"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(k))
+	}
+}
+
+// Node is the read-only view of a trie node for external tools, accessors return
+// copies, so nodes can't be changed through the view
+type Node interface {
+	Hash() common.Hash
+	// Encoded return a copy of the encoded node, nil for hash references
+	Encoded() []byte
+	Kind() NodeKind
+}
+
+// Leaf is the read-only view of a leaf node, Key return the key nibbles
+type Leaf interface {
+	Node
+	Key() []byte
+	Value() []byte
+}
+
+// Extension is the read-only view of an extension node, Key return the key nibbles
+type Extension interface {
+	Node
+	Key() []byte
+	Child() Node
+}
+
+// Branch is the read-only view of a branch node, Child return nil if there is no
+// child at i, Target return false if the branch have no target
+type Branch interface {
+	Node
+	Child(i int) Node
+	Target() ([]byte, bool)
+}
+
+// node is the trie node used by tries, encoding and hash are computed lazily and
+// kept in the node
 type node interface {
+	Node
 	Encode() []byte
-	Hash() common.Hash
 	Capped() []byte
+}
+
+// cacheable is a node whose encoding can be set by Cache, hash nodes only reference
+// nodes, so they have nothing to cache
+type cacheable interface {
+	node
 	Cache([]byte)
 }
 
+var (
+	_ Leaf      = (*leafNode)(nil)
+	_ Extension = (*extNode)(nil)
+	_ Branch    = (*branchNode)(nil)
+	_ node      = (*hashNode)(nil)
+	_ cacheable = (*leafNode)(nil)
+	_ cacheable = (*extNode)(nil)
+	_ cacheable = (*branchNode)(nil)
+)
+
+// DecodeNode decode an encoded node for inspection, children embedded in the node
+// are decoded as well, and children referenced by hash are HashKind nodes
+func DecodeNode(encoded []byte) (Node, error) {
+	return decodeNode(encoded)
+}
+
+// ChildRef is the reference of a node to a child, Index is the nibble of the child
+// in a branch, and -1 for the child of an extension. A child stored by hash has its
+// Hash, otherwise Inline is the encoding of the child embedded in its parent
+type ChildRef struct {
+	Index  int
+	Hash   common.Hash
+	Inline []byte
+}
+
+// NodeInfo is the fields of an encoded node as plain data, Key is the key nibbles of
+// leaf and extension, Value is the value of leaf or the target of branch
+type NodeInfo struct {
+	Kind     NodeKind
+	Hash     common.Hash
+	Key      []byte
+	Children []ChildRef
+	Value    []byte
+	HasValue bool
+}
+
+// InspectNode parse an encoded node into NodeInfo, so external tools can read stored
+// nodes without reimplementing the encoding. Inline children can be inspected by
+// InspectNode as well
+func InspectNode(encoded []byte) (NodeInfo, error) {
+	n, err := decodeNode(encoded)
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	info := NodeInfo{Kind: n.Kind(), Hash: keccak256Hash(encoded)}
+	ref := func(i int, child node) ChildRef {
+		if h, ok := child.(*hashNode); ok {
+			return ChildRef{Index: i, Hash: h.Hash()}
+		}
+		return ChildRef{Index: i, Inline: common.CopyBytes(child.Encode())}
+	}
+	switch n := n.(type) {
+	case *leafNode:
+		info.Key = common.CopyBytes(n.key)
+		info.Value, info.HasValue = common.CopyBytes(n.value), true
+	case *extNode:
+		info.Key = common.CopyBytes(n.key)
+		info.Children = []ChildRef{ref(-1, n.child)}
+	case *branchNode:
+		for i, child := range n.children {
+			if child != nil {
+				info.Children = append(info.Children, ref(i, child))
+			}
+		}
+		info.Value, info.HasValue = n.Target()
+	}
+	return info, nil
+}
+
+// inspected convert n to Node, keeping a nil child as nil interface
+func inspected(n node) Node {
+	if n == nil {
+		return nil
+	}
+	return n
+}
+
 // we use proto rather than rlp, so we need to append one flag byte to the
 // encoded node, which indicate that the length of key nibbles is odd/even
 // and the type of node, the low 4 bits represent the type of node, the
@@ -27,20 +172,46 @@ const (
 	extWithPad  byte = 0x11
 	// branch node have no key, so pad is unnecessary
 	branchType byte = 0x02
+	// taggedFlag is set in the type bits of ext and branch nodes whose child
+	// references are tagged, see WithTaggedChildRefs
+	taggedFlag byte = 0x08
+	// typeMask is the bits of the node type without taggedFlag
+	typeMask byte = 0x07
 )
 
+// a tagged child reference start with one tag byte, which tell whether the rest is
+// the hash of the child or the encoding of the embedded child, so an embedded child
+// is never taken for a hash whatever its length
+const (
+	hashRefTag   byte = 0x00
+	inlineRefTag byte = 0x01
+)
+
+// encodedType return the node type in the flag byte of an encoded node without
+// decoding it, 0xff if there is no flag byte
+func encodedType(encoded []byte) byte {
+	if len(encoded) == 0 {
+		return 0xff
+	}
+	return encoded[len(encoded)-1] & typeMask
+}
+
 type (
 	extNode struct {
-		key     []byte
-		child   node
+		key   []byte
+		child node
+		// tagged is true if the child reference is tagged
+		tagged  bool
 		encoded []byte
 		hash    []byte
 	}
 	branchNode struct {
 		children [16]node
 		target   []byte
-		encoded  []byte
-		hash     []byte
+		// tagged is true if the child references are tagged
+		tagged  bool
+		encoded []byte
+		hash    []byte
 	}
 	leafNode struct {
 		key     []byte
@@ -54,23 +225,26 @@ type (
 	}
 )
 
-func branchWithTarget(target []byte) *branchNode {
+func branchWithTarget(target []byte, tagged bool) *branchNode {
 	return &branchNode{
 		target: target,
+		tagged: tagged,
 	}
 }
 
-func branchWithChild(pos int, n node, target []byte) *branchNode {
+func branchWithChild(pos int, n node, target []byte, tagged bool) *branchNode {
 	b := &branchNode{
 		target: target,
+		tagged: tagged,
 	}
 	b.children[pos] = n
 	return b
 }
 
-func branchWithChildren(children [16]node) *branchNode {
+func branchWithChildren(children [16]node, tagged bool) *branchNode {
 	return &branchNode{
 		children: children,
+		tagged:   tagged,
 	}
 }
 
@@ -78,6 +252,7 @@ func (n *branchNode) updateTarget(target []byte) *branchNode {
 	b := &branchNode{
 		children: n.children,
 		target:   target,
+		tagged:   n.tagged,
 	}
 	return b
 }
@@ -86,6 +261,7 @@ func (n *branchNode) updateChild(pos int, child node) *branchNode {
 	b := &branchNode{
 		children: n.children,
 		target:   n.target,
+		tagged:   n.tagged,
 	}
 	b.children[pos] = child
 	return b
@@ -110,17 +286,16 @@ func (n *branchNode) Encode() []byte {
 	if n.encoded != nil {
 		return n.encoded
 	}
-	var rawNode BranchNode
-	for _, n := range n.children {
-		if n == nil {
-			rawNode.Children = append(rawNode.Children, nil)
+	children := make([][]byte, 0, len(n.children))
+	for _, child := range n.children {
+		if child == nil {
+			children = append(children, nil)
 		} else {
-			rawNode.Children = append(rawNode.Children, n.Capped())
+			children = append(children, childRef(child, n.tagged))
 		}
 	}
-	rawNode.Target = n.target
-	encoded, _ := proto.Marshal(&rawNode)
-	encoded = append(encoded, branchType)
+	encoded := marshalBranchNode(children, n.target)
+	encoded = append(encoded, withTagged(branchType, n.tagged))
 	n.encoded = encoded
 	return encoded
 }
@@ -129,7 +304,7 @@ func (n *branchNode) Hash() common.Hash {
 	if n.hash != nil {
 		return common.BytesToHash(n.hash)
 	}
-	hash := crypto.Keccak256Hash(n.Encode())
+	hash := keccak256Hash(n.Encode())
 	n.hash = hash[:]
 	return hash
 }
@@ -148,10 +323,30 @@ func (n *branchNode) Cache(bytes []byte) {
 	n.encoded = bytes
 }
 
-func newExtNode(key []byte, child node) *extNode {
+func (n *branchNode) Encoded() []byte {
+	return common.CopyBytes(n.Encode())
+}
+
+func (n *branchNode) Kind() NodeKind {
+	return BranchKind
+}
+
+func (n *branchNode) Child(i int) Node {
+	if i < 0 || i >= len(n.children) {
+		return nil
+	}
+	return inspected(n.children[i])
+}
+
+func (n *branchNode) Target() ([]byte, bool) {
+	return common.CopyBytes(n.target), n.hasTarget()
+}
+
+func newExtNode(key []byte, child node, tagged bool) *extNode {
 	return &extNode{
-		key:   key,
-		child: child,
+		key:    key,
+		child:  child,
+		tagged: tagged,
 	}
 }
 
@@ -159,13 +354,8 @@ func (n *extNode) Encode() []byte {
 	if n.encoded != nil {
 		return n.encoded
 	}
-	capped := n.child.Capped()
-	keyBytes, flag := encodeKey(n.key, extType)
-	rawNode := &ExtNode{
-		Key:  keyBytes,
-		Node: capped,
-	}
-	encoded, _ := proto.Marshal(rawNode)
+	keyBytes, flag := encodeKey(n.key, withTagged(extType, n.tagged))
+	encoded := marshalExtNode(keyBytes, childRef(n.child, n.tagged))
 	encoded = append(encoded, flag)
 	n.encoded = encoded
 	return encoded
@@ -175,7 +365,7 @@ func (n *extNode) Hash() common.Hash {
 	if n.hash != nil {
 		return common.BytesToHash(n.hash)
 	}
-	hash := crypto.Keccak256Hash(n.Encode())
+	hash := keccak256Hash(n.Encode())
 	n.hash = hash[:]
 	return hash
 }
@@ -184,6 +374,22 @@ func (n *extNode) Cache(bytes []byte) {
 	n.encoded = bytes
 }
 
+func (n *extNode) Encoded() []byte {
+	return common.CopyBytes(n.Encode())
+}
+
+func (n *extNode) Kind() NodeKind {
+	return ExtensionKind
+}
+
+func (n *extNode) Key() []byte {
+	return common.CopyBytes(n.key)
+}
+
+func (n *extNode) Child() Node {
+	return inspected(n.child)
+}
+
 func (n *extNode) Capped() []byte {
 	encoded := n.Encode()
 	if len(encoded) < common.HashLength {
@@ -206,11 +412,7 @@ func (n *leafNode) Encode() []byte {
 		return n.encoded
 	}
 	keyBytes, flag := encodeKey(n.key, leafType)
-	rawNode := &LeafNode{
-		Key:   keyBytes,
-		Value: n.value,
-	}
-	encoded, _ := proto.Marshal(rawNode)
+	encoded := marshalLeafNode(keyBytes, n.value)
 	encoded = append(encoded, flag)
 	n.encoded = encoded
 	return encoded
@@ -220,7 +422,7 @@ func (n *leafNode) Hash() common.Hash {
 	if n.hash != nil {
 		return common.BytesToHash(n.hash)
 	}
-	hash := crypto.Keccak256Hash(n.Encode())
+	hash := keccak256Hash(n.Encode())
 	n.hash = hash[:]
 	return hash
 }
@@ -239,6 +441,22 @@ func (n *leafNode) Cache(bytes []byte) {
 	n.encoded = bytes
 }
 
+func (n *leafNode) Encoded() []byte {
+	return common.CopyBytes(n.Encode())
+}
+
+func (n *leafNode) Kind() NodeKind {
+	return LeafKind
+}
+
+func (n *leafNode) Key() []byte {
+	return common.CopyBytes(n.key)
+}
+
+func (n *leafNode) Value() []byte {
+	return common.CopyBytes(n.value)
+}
+
 func (n *hashNode) Encode() []byte {
 	return n.hash
 }
@@ -251,22 +469,51 @@ func (n *hashNode) Capped() []byte {
 	return n.hash
 }
 
-func (n *hashNode) Cache(bytes []byte) {
+func (n *hashNode) Encoded() []byte {
+	return nil
+}
+
+func (n *hashNode) Kind() NodeKind {
+	return HashKind
 }
 
+// ErrMalformedNode is returned when an encoded node isn't the canonical encoding of
+// a node, e.g. it has trailing bytes, unknown fields, a wrong number of children or
+// an embedded child which should be referenced by hash
+var ErrMalformedNode = errors.New("malformed node encoding")
+
+// decodeNode decode a node, only the canonical encoding of a node is accepted, so a
+// node has exactly one encoding and one hash. The encoding is checked by its
+// structure rather than comparing it with the re-encoded node, see canonicalMessage,
+// so decoding doesn't cost an encoding of the node
 func decodeNode(bytes []byte) (node, error) {
-	if len(bytes) <= 1 {
+	// a leaf with empty key and empty value is encoded as the flag byte alone,
+	// e.g. a key whose last nibble is consumed by its parent branch, other nodes
+	// always have fields
+	if len(bytes) == 0 || (len(bytes) == 1 && bytes[0]&0x0f != leafType) {
 		return nil, io.ErrUnexpectedEOF
 	}
 	flag := bytes[len(bytes)-1]
 	raw := bytes[0 : len(bytes)-1]
-	switch flag & 0x0f {
+	tagged := flag&taggedFlag != 0
+	switch flag & typeMask {
 	case leafType:
+		// leaf nodes have no child, so no tagged bit
+		if tagged || !canonicalMessage(raw, 0, 0) {
+			return nil, ErrMalformedNode
+		}
 		return decodeLeafNode(raw, flag)
 	case extType:
-		return decodeExtNode(raw, flag)
+		if !canonicalMessage(raw, 0, 0) {
+			return nil, ErrMalformedNode
+		}
+		return decodeExtNode(raw, flag, tagged)
 	case branchType:
-		return decodeBranchNode(raw)
+		// branch nodes have no key, so no padding bit
+		if flag>>4 != 0 || !canonicalMessage(raw, branchChildField, branchTargetField) {
+			return nil, ErrMalformedNode
+		}
+		return decodeBranchNode(raw, tagged)
 	default:
 		// this should never happen
 		return nil, fmt.Errorf("unknown node type: %v", flag)
@@ -279,47 +526,156 @@ func decodeLeafNode(bytes []byte, flag byte) (node, error) {
 	if err != nil {
 		return nil, err
 	}
+	if !validKey(flag, rawNode.Key) {
+		return nil, ErrMalformedNode
+	}
 	keyNibbles, _ := decodeKey(flag, rawNode.Key)
 	n := &leafNode{
 		key:   keyNibbles,
 		value: rawNode.Value,
 	}
+	if n.value == nil {
+		// proto decode empty field as nil, but a leaf always have a value, it may
+		// become the target of a branch
+		n.value = []byte{}
+	}
 	return n, nil
 }
 
-func decodeExtNode(bytes []byte, flag byte) (node, error) {
+func decodeExtNode(bytes []byte, flag byte, tagged bool) (node, error) {
 	var rawNode ExtNode
 	err := proto.Unmarshal(bytes, &rawNode)
 	if err != nil {
 		return nil, err
 	}
-	var n extNode
+	if !validKey(flag, rawNode.Key) {
+		return nil, ErrMalformedNode
+	}
+	n := extNode{tagged: tagged}
 	keyNibbles, _ := decodeKey(flag, rawNode.Key)
 	n.key = keyNibbles
-	if len(rawNode.Node) == common.HashLength {
-		n.child = &hashNode{rawNode.Node}
-	} else {
-		n.child, err = decodeNode(rawNode.Node)
+	if len(rawNode.Node) == 0 {
+		return nil, ErrMalformedNode
 	}
+	n.child, err = decodeChildRef(rawNode.Node, tagged)
 	return &n, err
 }
 
-func decodeBranchNode(bytes []byte) (node, error) {
+func decodeBranchNode(bytes []byte, tagged bool) (node, error) {
 	var rawNode BranchNode
 	err := proto.Unmarshal(bytes, &rawNode)
 	if err != nil {
 		return nil, err
 	}
-	var n branchNode
+	if len(rawNode.Children) != 16 {
+		return nil, ErrMalformedNode
+	}
+	n := branchNode{tagged: tagged}
 	n.target = rawNode.Target
+	if n.target == nil && hasBytesField(bytes, branchTargetField) {
+		// proto decode empty field as nil
+		n.target = []byte{}
+	}
 	for i, child := range rawNode.Children {
 		if len(child) == 0 {
-			n.children[i] = nil
-		} else if len(child) == common.HashLength {
-			n.children[i] = &hashNode{child}
-		} else {
-			n.children[i], err = decodeNode(child)
+			continue
+		}
+		if n.children[i], err = decodeChildRef(child, tagged); err != nil {
+			return nil, err
 		}
 	}
-	return &n, err
+	return &n, nil
+}
+
+// decodeChildRef decode the reference to a child, which is the hash of the child if
+// its encoding is at least as long as a hash, otherwise the child is embedded, see
+// Capped. Untagged references are told apart by their length, so a reference of hash
+// length is always a hash, and a longer one is malformed rather than an embedded
+// child. Tagged references start with hashRefTag or inlineRefTag instead, see
+// childRef. The convention is part of the encoding, so nodes of both conventions
+// have different hashes
+func decodeChildRef(ref []byte, tagged bool) (node, error) {
+	if tagged {
+		switch {
+		case len(ref) == 1+common.HashLength && ref[0] == hashRefTag:
+			return &hashNode{ref[1:]}, nil
+		case len(ref) > 1 && len(ref) <= common.HashLength && ref[0] == inlineRefTag:
+			return decodeEmbedded(ref[1:], tagged)
+		default:
+			return nil, ErrMalformedNode
+		}
+	}
+	switch {
+	case len(ref) == common.HashLength:
+		return &hashNode{ref}, nil
+	case len(ref) > common.HashLength:
+		return nil, ErrMalformedNode
+	default:
+		return decodeEmbedded(ref, tagged)
+	}
+}
+
+// decodeEmbedded decode a child embedded in its parent, embedded ext and branch
+// nodes use the same convention of child references as their parent
+func decodeEmbedded(encoded []byte, tagged bool) (node, error) {
+	n, err := decodeNode(encoded)
+	if err == nil {
+		err = checkTagged(n, tagged)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// checkTagged return ErrMalformedNode if n is an ext or branch node whose child
+// references aren't tagged as tagged tell, leaf nodes have no child references
+func checkTagged(n node, tagged bool) error {
+	switch n := n.(type) {
+	case *extNode:
+		if n.tagged != tagged {
+			return ErrMalformedNode
+		}
+	case *branchNode:
+		if n.tagged != tagged {
+			return ErrMalformedNode
+		}
+	}
+	return nil
+}
+
+// childRef return the reference of parent to child, which is the capped child if
+// tagged is false, otherwise the capped child after the tag telling whether it's a
+// hash or an embedded node
+func childRef(child node, tagged bool) []byte {
+	capped := child.Capped()
+	if !tagged {
+		return capped
+	}
+	tag := inlineRefTag
+	if len(capped) == common.HashLength {
+		tag = hashRefTag
+	}
+	return append([]byte{tag}, capped...)
+}
+
+// withTagged return the node type with taggedFlag set if tagged is true
+func withTagged(nodeType byte, tagged bool) byte {
+	if tagged {
+		return nodeType | taggedFlag
+	}
+	return nodeType
+}
+
+// validKey report whether the flag of key is valid, a padded key has at least the
+// padding nibble, which is zero
+func validKey(flag byte, key []byte) bool {
+	switch flag >> 4 {
+	case 0:
+		return true
+	case 1:
+		return len(key) > 0 && key[len(key)-1]&0x0f == 0
+	default:
+		return false
+	}
 }
@@ -290,7 +290,360 @@ func TestBranchChildrenIndex(t *testing.T) {
 		},
 	}
 	for _, c := range cases {
-		branch := branchWithChildren(c.children)
+		branch := branchWithChildren(c.children, false)
 		assert.Equal(t, branch.childrenIndex(), c.index)
 	}
 }
+
+func TestDecodeNode(t *testing.T) {
+	leaf := newLeafNode([]byte{0x01, 0x02, 0x03}, []byte("value"))
+	hash := common.BytesToHash([]byte("child"))
+	branch := branchWithChild(2, leaf, []byte{}, false)
+	branch = branch.updateChild(5, &hashNode{hash[:]})
+	ext := newExtNode([]byte{0x0a, 0x0b}, branch, false)
+
+	decoded, err := DecodeNode(ext.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, ExtensionKind, decoded.Kind())
+	assert.Equal(t, ext.Hash(), decoded.Hash())
+	assert.Equal(t, ext.Encode(), decoded.Encoded())
+	extView := decoded.(Extension)
+	assert.Equal(t, []byte{0x0a, 0x0b}, extView.Key())
+
+	// the branch is too large to be embedded
+	assert.Equal(t, HashKind, extView.Child().Kind())
+	assert.Equal(t, branch.Hash(), extView.Child().Hash())
+
+	decoded, err = DecodeNode(branch.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, BranchKind, decoded.Kind())
+	branchView := decoded.(Branch)
+	target, ok := branchView.Target()
+	assert.True(t, ok)
+	assert.Equal(t, []byte{}, target)
+	assert.Nil(t, branchView.Child(0))
+	assert.Nil(t, branchView.Child(16))
+	ref := branchView.Child(5)
+	assert.Equal(t, HashKind, ref.Kind())
+	assert.Equal(t, hash, ref.Hash())
+	assert.Nil(t, ref.Encoded())
+
+	leafView := branchView.Child(2).(Leaf)
+	assert.Equal(t, LeafKind, leafView.Kind())
+	assert.Equal(t, []byte("value"), leafView.Value())
+	// views return copies, nodes can't be changed through them
+	leafView.Value()[0] = 'x'
+	leafView.Key()[0] = 0x0f
+	leafView.Encoded()[0] ^= 0xff
+	assert.Equal(t, []byte("value"), leafView.Value())
+	assert.Equal(t, []byte{0x01, 0x02, 0x03}, leafView.Key())
+	assert.Equal(t, leaf.Hash(), leafView.Hash())
+
+	assert.Equal(t, "extension", ExtensionKind.String())
+	_, err = DecodeNode([]byte{0x01})
+	assert.NotNil(t, err)
+}
+
+func TestInspectNode(t *testing.T) {
+	leaf := newLeafNode([]byte{0x01, 0x02, 0x03}, []byte("value"))
+	hash := common.BytesToHash([]byte("child"))
+	branch := branchWithChild(2, leaf, []byte{}, false)
+	branch = branch.updateChild(5, &hashNode{hash[:]})
+	ext := newExtNode([]byte{0x0a, 0x0b}, branch, false)
+
+	info, err := InspectNode(ext.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, NodeInfo{
+		Kind:     ExtensionKind,
+		Hash:     ext.Hash(),
+		Key:      []byte{0x0a, 0x0b},
+		Children: []ChildRef{{Index: -1, Hash: branch.Hash()}},
+	}, info)
+
+	info, err = InspectNode(branch.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, NodeInfo{
+		Kind: BranchKind,
+		Hash: branch.Hash(),
+		Children: []ChildRef{
+			{Index: 2, Inline: leaf.Encode()},
+			{Index: 5, Hash: hash},
+		},
+		Value:    []byte{},
+		HasValue: true,
+	}, info)
+
+	info, err = InspectNode(info.Children[0].Inline)
+	assert.Nil(t, err)
+	assert.Equal(t, NodeInfo{
+		Kind:     LeafKind,
+		Hash:     leaf.Hash(),
+		Key:      []byte{0x01, 0x02, 0x03},
+		Value:    []byte("value"),
+		HasValue: true,
+	}, info)
+
+	info, err = InspectNode(branchWithChild(0, leaf, nil, false).Encode())
+	assert.Nil(t, err)
+	assert.False(t, info.HasValue)
+	assert.Nil(t, info.Value)
+
+	for name, encoded := range malformedNodes() {
+		_, err := InspectNode(encoded)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestDecodeEmptyLeaf(t *testing.T) {
+	// a leaf with empty key and empty value is encoded as the flag byte alone
+	leaf := newLeafNode(nil, []byte{})
+	assert.Equal(t, []byte{leafType}, leaf.Encode())
+	decoded, err := decodeNode(leaf.Encode())
+	assert.Nil(t, err)
+	assert.True(t, checkNode(leaf, decoded))
+
+	branch := branchWithChild(3, leaf, []byte{0x01}, false)
+	decoded, err = decodeNode(branch.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, leaf.Encode(), decoded.(*branchNode).children[3].Encode())
+
+	for _, encoded := range [][]byte{{}, {extType}, {branchType}} {
+		_, err = decodeNode(encoded)
+		assert.NotNil(t, err)
+	}
+}
+
+// malformedNodes is a corpus of crafted encodings which must be rejected, the
+// canonical encoding of every node is the only one accepted
+func malformedNodes() map[string][]byte {
+	leafFields := marshalLeafNode([]byte{0x12}, []byte("value"))
+	children := make([][]byte, 16)
+	children[1] = newLeafNode([]byte{0x01}, []byte("value")).Encode()
+	large := newLeafNode([]byte{0x01}, bytes.Repeat([]byte{0xff}, 32)).Encode()
+	withLarge := make([][]byte, 16)
+	withLarge[0] = large
+	empty := make([][]byte, 16)
+	return map[string][]byte{
+		"empty":                 {},
+		"unknown type":          append(leafFields, 0x03),
+		"unknown flag":          append(leafFields, 0x20|leafType),
+		"padded empty key":      {0x12, 0x01, 0x01, 0x10 | leafType},
+		"nonzero padding":       append(marshalLeafNode([]byte{0x1f}, []byte("value")), 0x10|leafType),
+		"trailing garbage":      append(append(leafFields, 0x00), leafType),
+		"unknown field":         append(appendBytesField(leafFields, 3, []byte{0x01}), leafType),
+		"fields out of order":   append(appendBytesField(marshalLeafNode(nil, []byte("value")), leafKeyField, []byte{0x12}), leafType),
+		"explicit empty key":    append(appendBytesField(nil, leafKeyField, nil), leafType),
+		"varint field":          {0x08, 0x01, leafType},
+		"overlong tag":          {0x92, 0x00, 0x01, 0x01, leafType},
+		"overlong length":       {0x12, 0x81, 0x00, 0x01, leafType},
+		"duplicated value":      append(appendBytesField(leafFields, leafValueField, []byte("value")), leafType),
+		"truncated length":      {0x0a, 0x80, leafType},
+		"length overflow":       {0x0a, 0x05, 0x01, leafType},
+		"padded branch":         append(marshalBranchNode(children, nil), 0x10|branchType),
+		"15 children":           append(marshalBranchNode(children[:15], nil), branchType),
+		"17 children":           append(marshalBranchNode(append(children, nil), nil), branchType),
+		"no children":           append(marshalBranchNode(nil, []byte{0x01}), branchType),
+		"large embedded child":  append(marshalBranchNode(withLarge, nil), branchType),
+		"target before child":   append(appendBytesField(marshalBranchNode(nil, []byte{0x01}), branchChildField, nil), branchType),
+		"embedded garbage":      append(marshalBranchNode(append([][]byte{{0x00, leafType}}, empty[1:]...), nil), branchType),
+		"33 bytes child":        append(marshalBranchNode(append([][]byte{make([]byte, 33)}, empty[1:]...), nil), branchType),
+		"extension no child":    append(marshalExtNode([]byte{0x12}, nil), extType),
+		"extension short child": append(marshalExtNode([]byte{0x12}, []byte{0x01}), extType),
+	}
+}
+
+func TestDecodeMalformedNodes(t *testing.T) {
+	for name, encoded := range malformedNodes() {
+		_, err := decodeNode(encoded)
+		assert.NotNil(t, err, name)
+		_, err = DecodeNode(encoded)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestDecodeChildRef(t *testing.T) {
+	// leaves whose encodings are one byte shorter than a hash and as long as a hash
+	value := make([]byte, 0)
+	for len(newLeafNode([]byte{0x01}, value).Encode()) < common.HashLength-1 {
+		value = append(value, 0xff)
+	}
+	embedded := newLeafNode([]byte{0x01}, value)
+	hashed := newLeafNode([]byte{0x01}, append(value, 0xff))
+	assert.Equal(t, common.HashLength, len(hashed.Encode()))
+
+	branch := branchWithChild(0, embedded, nil, false).updateChild(1, hashed)
+	decoded, err := decodeNode(branch.Encode())
+	assert.Nil(t, err)
+	decodedChildren := decoded.(*branchNode).children
+	assert.True(t, checkLeafNode(embedded, decodedChildren[0]))
+	assert.Equal(t, &hashNode{hashed.Capped()}, decodedChildren[1])
+
+	// an encoding as long as a hash is never embedded
+	children := make([][]byte, 16)
+	children[0] = hashed.Encode()
+	decoded, err = decodeNode(append(marshalBranchNode(children, nil), branchType))
+	assert.Nil(t, err)
+	assert.Equal(t, &hashNode{hashed.Encode()}, decoded.(*branchNode).children[0])
+	children[0] = append(hashed.Encode(), 0x00)
+	_, err = decodeNode(append(marshalBranchNode(children, nil), branchType))
+	assert.Equal(t, ErrMalformedNode, err)
+}
+
+func TestTaggedChildRef(t *testing.T) {
+	// leaves whose encodings are one byte shorter than a hash and as long as a hash
+	value := make([]byte, 0)
+	for len(newLeafNode([]byte{0x01}, value).Encode()) < common.HashLength-1 {
+		value = append(value, 0xff)
+	}
+	embedded := newLeafNode([]byte{0x01}, value)
+	hashed := newLeafNode([]byte{0x01}, append(value, 0xff))
+
+	branch := branchWithChild(0, embedded, nil, true).updateChild(1, hashed)
+	ext := newExtNode([]byte{0x0a}, branch, true)
+	encoded := branch.Encode()
+	assert.Equal(t, branchType|taggedFlag, encoded[len(encoded)-1])
+	assert.NotEqual(t, branchWithChild(0, embedded, nil, false).updateChild(1, hashed).Hash(), branch.Hash())
+	for _, n := range []node{branch, ext} {
+		decoded, err := decodeNode(n.Encode())
+		assert.Nil(t, err)
+		assert.Equal(t, n.Hash(), decoded.Hash())
+	}
+	decoded, _ := decodeNode(encoded)
+	decodedChildren := decoded.(*branchNode).children
+	assert.True(t, decoded.(*branchNode).tagged)
+	assert.True(t, checkLeafNode(embedded, decodedChildren[0]))
+	assert.Equal(t, &hashNode{hashed.Capped()}, decodedChildren[1])
+	assert.Equal(t, []byte{hashRefTag}, childRef(hashed, true)[:1])
+	assert.Equal(t, append([]byte{inlineRefTag}, embedded.Encode()...), childRef(embedded, true))
+
+	// ext and branch nodes are too large to be embedded in canonical encodings, but
+	// embedded children still use the convention of their parent
+	leaf := newLeafNode(nil, []byte{0x01})
+	tagged := func(children [][]byte) []byte {
+		return append(marshalBranchNode(children, nil), branchType|taggedFlag)
+	}
+	children := make([][]byte, 16)
+	for name, ref := range map[string][]byte{
+		"unknown tag":        append([]byte{0x02}, hashed.Hash().Bytes()...),
+		"short hash":         append([]byte{hashRefTag}, embedded.Encode()...),
+		"untagged hash":      hashed.Hash().Bytes(),
+		"inline hash length": append([]byte{inlineRefTag}, hashed.Encode()...),
+		"empty inline":       {inlineRefTag},
+		"untagged embedded":  append([]byte{inlineRefTag}, newExtNode([]byte{0x02}, leaf, false).Encode()...),
+	} {
+		children[0] = ref
+		_, err := decodeNode(tagged(children))
+		assert.Equal(t, ErrMalformedNode, err, name)
+	}
+	children[0] = append([]byte{inlineRefTag}, newExtNode([]byte{0x02}, leaf, true).Encode()...)
+	_, err := decodeNode(tagged(children))
+	assert.Nil(t, err)
+	children[0] = newExtNode([]byte{0x02}, leaf, true).Encode()
+	_, err = decodeNode(append(marshalBranchNode(children, nil), branchType))
+	assert.Equal(t, ErrMalformedNode, err)
+	// leaves have no child references
+	_, err = decodeNode(append(embedded.Encode()[:len(embedded.Encode())-1], leafWithPad|taggedFlag))
+	assert.Equal(t, ErrMalformedNode, err)
+}
+
+// TestDecodeMutatedNodes decode random mutations of valid encodings, they must be
+// rejected or decoded to a node whose encoding is the mutation itself
+func TestDecodeMutatedNodes(t *testing.T) {
+	for i := 0; i < 2000; i++ {
+		encoded := append([]byte{}, generateNode(false, maxDepth-1).Encode()...)
+		pos := random.Intn(len(encoded))
+		switch random.Intn(4) {
+		case 0:
+			encoded[pos] ^= byte(1 + random.Intn(255))
+		case 1:
+			encoded = encoded[:pos]
+		case 2:
+			encoded = append(encoded[:pos], append([]byte{byte(random.Intn(256))}, encoded[pos:]...)...)
+		case 3:
+			encoded = append(encoded[:pos], encoded[pos+1:]...)
+		}
+		n, err := decodeNode(encoded)
+		if err == nil {
+			assert.Equal(t, encoded, n.Encode())
+		}
+	}
+}
+
+// benchNodes return a leaf of 32 bytes key and 64 bytes value, an extension and a
+// branch whose children are referenced by hash, the shapes of nodes in state tries
+func benchNodes() []node {
+	hash := make([]byte, common.HashLength)
+	rand.Read(hash)
+	key := make([]byte, common.HashLength)
+	rand.Read(key)
+	value := make([]byte, 64)
+	rand.Read(value)
+	branch := &branchNode{}
+	for i := range branch.children {
+		branch.children[i] = &hashNode{hash}
+	}
+	return []node{
+		newLeafNode(bytesToNibbles(key), value),
+		newExtNode(bytesToNibbles(key[:4]), &hashNode{hash}, false),
+		branch,
+	}
+}
+
+// uncached return a copy of n without the cached encoding and hash
+func uncached(n node) node {
+	switch n := n.(type) {
+	case *leafNode:
+		return &leafNode{key: n.key, value: n.value}
+	case *extNode:
+		return &extNode{key: n.key, child: n.child}
+	case *branchNode:
+		return &branchNode{children: n.children, target: n.target}
+	}
+	return n
+}
+
+func benchmarkNodes(b *testing.B, fn func(n node, encoded []byte)) {
+	for _, n := range benchNodes() {
+		encoded := n.Encode()
+		b.Run(n.Kind().String(), func(b *testing.B) {
+			b.SetBytes(int64(len(encoded)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				fn(n, encoded)
+			}
+		})
+	}
+}
+
+func BenchmarkNodeEncode(b *testing.B) {
+	benchmarkNodes(b, func(n node, encoded []byte) {
+		uncached(n).Encode()
+	})
+}
+
+func BenchmarkNodeDecode(b *testing.B) {
+	benchmarkNodes(b, func(n node, encoded []byte) {
+		if _, err := decodeNode(encoded); err != nil {
+			b.Fatal(err)
+		}
+	})
+}
+
+func BenchmarkNodeHash(b *testing.B) {
+	benchmarkNodes(b, func(n node, encoded []byte) {
+		keccak256Hash(encoded)
+	})
+}
+
+func TestDecodeNodeNoAlias(t *testing.T) {
+	leaf := newLeafNode(bytesToNibbles([]byte("key")), []byte("value"))
+	encoded := common.CopyBytes(leaf.Encode())
+	decoded, err := decodeNode(encoded)
+	assert.Nil(t, err)
+	// modifying the encoding, e.g. a buffer reused by a db, doesn't change the node
+	for i := range encoded {
+		encoded[i] = 0
+	}
+	assert.Equal(t, []byte("value"), decoded.(*leafNode).value)
+	assert.Equal(t, leaf.Encode(), decoded.Encode())
+}
@@ -2,58 +2,368 @@ package mpt
 
 import (
 	"bytes"
+	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
 )
 
 // updateLog record all operations for immutable trie:
-// - cached: cache key value from underlying db
-// - inserted: record all inserted key value
-// - deleted: record all deleted key value
-// all inserted and deleted key value will be flushed to
+// - cache: cache key value from underlying db, shared by all derived tries
+// - layers: record all inserted and deleted key value, a new trie share layers with old trie
+// creating a new trie only append a new layer rather than copy the whole log, so it's
+// O(changes) instead of O(total log size). All inserted and deleted key value will be flushed to
 // underlying db when execute trie.persist
+// - dirtyNodes, dirtyBytes: number and total size of inserted nodes not persisted yet
+// - spill: table inserted nodes are spilled to, shared like cache, nil if disabled.
+// The value of a spilled node in layers is nil, and it's read from the table
+// - spilledBytes: part of dirtyBytes spilled to the table
 type updateLog struct {
-	cached   map[common.Hash][]byte
-	inserted map[common.Hash][]byte
-	deleted  map[common.Hash][]byte
+	cache        *nodeCache
+	layers       []*logLayer
+	dirtyNodes   int
+	dirtyBytes   int
+	spill        *SpillTable
+	spilledBytes int
+}
+
+// logLayer record the changes of some consecutive operations, a layer is never
+// modified after it is shared by more than one trie:
+// - inserted: record all inserted key value
+// - deleted: record all deleted key value
+// - persisted: record size and type of changed nodes which read from underlying db
+// - bytes: total size of inserted values
+type logLayer struct {
+	inserted  map[common.Hash][]byte
+	deleted   map[common.Hash][]byte
+	persisted map[common.Hash]persistedNode
+	bytes     int
+}
+
+// persistedNode is the size and the node type of an encoded node read from
+// underlying db, so commits report it without reading it again
+type persistedNode struct {
+	size     int
+	nodeType byte
+}
+
+func newLogLayer() *logLayer {
+	return &logLayer{
+		inserted:  make(map[common.Hash][]byte, 0),
+		deleted:   make(map[common.Hash][]byte, 0),
+		persisted: make(map[common.Hash]persistedNode, 0),
+	}
+}
+
+func (layer *logLayer) size() int {
+	return len(layer.inserted) + len(layer.deleted)
+}
+
+func (layer *logLayer) insert(key common.Hash, value []byte) {
+	delete(layer.deleted, key)
+	layer.bytes += len(value) - len(layer.inserted[key])
+	layer.inserted[key] = value
+}
+
+func (layer *logLayer) delete(key common.Hash) {
+	layer.bytes -= len(layer.inserted[key])
+	delete(layer.inserted, key)
+	layer.deleted[key] = []byte{}
+}
+
+// apply return a new layer which include changes of current layer and upper layer
+func (layer *logLayer) apply(upper *logLayer) *logLayer {
+	merged := layer.copy()
+	for k, v := range upper.inserted {
+		merged.insert(k, v)
+	}
+	for k := range upper.deleted {
+		merged.delete(k)
+	}
+	for k, v := range upper.persisted {
+		merged.persisted[k] = v
+	}
+	return merged
+}
+
+func (layer *logLayer) copy() *logLayer {
+	newLayer := newLogLayer()
+	for k, v := range layer.inserted {
+		newLayer.inserted[k] = v
+	}
+	for k, _ := range layer.deleted {
+		newLayer.deleted[k] = []byte{}
+	}
+	for k, v := range layer.persisted {
+		newLayer.persisted[k] = v
+	}
+	newLayer.bytes = layer.bytes
+	return newLayer
+}
+
+// nodeCache cache encoded nodes read from underlying db, it's safe for concurrent use.
+// Cached encodings are never modified, put and trim replace entries, so encodings
+// returned by get stay valid while the cache changes
+// - nodes: cached encoded nodes
+// - order: hashes of cached nodes in the order of caching, evicted nodes may remain
+// - size: total bytes of cached nodes
+type nodeCache struct {
+	lock  sync.RWMutex
+	nodes map[common.Hash][]byte
+	order []common.Hash
+	size  int
+}
+
+func newNodeCache() *nodeCache {
+	return &nodeCache{
+		nodes: make(map[common.Hash][]byte, 0),
+		order: make([]common.Hash, 0),
+	}
+}
+
+func (c *nodeCache) get(key common.Hash) ([]byte, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	value, ok := c.nodes[key]
+	return value, ok
+}
+
+func (c *nodeCache) put(key common.Hash, value []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if old, ok := c.nodes[key]; ok {
+		c.size -= len(old)
+	} else {
+		c.order = append(c.order, key)
+	}
+	c.nodes[key] = value
+	c.size += len(value)
+}
+
+// bytes return the total size of cached nodes
+func (c *nodeCache) bytes() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.size
+}
+
+// count return the number of cached nodes
+func (c *nodeCache) count() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return len(c.nodes)
+}
+
+// entries call fn with cached nodes in the order of caching until it return false
+func (c *nodeCache) entries(fn func(key common.Hash, value []byte) bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	seen := make(map[common.Hash]struct{}, len(c.nodes))
+	for _, key := range c.order {
+		value, ok := c.nodes[key]
+		if _, dup := seen[key]; !ok || dup {
+			continue
+		}
+		seen[key] = struct{}{}
+		if !fn(key, value) {
+			return
+		}
+	}
+}
+
+// trim evict the earliest cached nodes until the total size is at most maxBytes
+func (c *nodeCache) trim(maxBytes int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if maxBytes <= 0 {
+		c.nodes = make(map[common.Hash][]byte, 0)
+		c.order = make([]common.Hash, 0)
+		c.size = 0
+		return
+	}
+	i := 0
+	for ; i < len(c.order) && c.size > maxBytes; i++ {
+		if value, ok := c.nodes[c.order[i]]; ok {
+			c.size -= len(value)
+			delete(c.nodes, c.order[i])
+		}
+	}
+	// copy remaining hashes so that the evicted prefix can be released
+	c.order = append(make([]common.Hash, 0, len(c.order)-i), c.order[i:]...)
 }
 
 func newUpdateLog() *updateLog {
 	return &updateLog{
-		cached:   make(map[common.Hash][]byte, 0),
-		inserted: make(map[common.Hash][]byte, 0),
-		deleted:  make(map[common.Hash][]byte, 0),
+		cache:  newNodeCache(),
+		layers: []*logLayer{newLogLayer()},
 	}
 }
 
-func (log *updateLog) cache(key common.Hash, value []byte) {
-	log.cached[key] = value
+func (log *updateLog) top() *logLayer {
+	return log.layers[len(log.layers)-1]
+}
+
+func (log *updateLog) cached(key common.Hash) ([]byte, bool) {
+	return log.cache.get(key)
 }
 
 func (log *updateLog) insert(key common.Hash, value []byte) {
-	delete(log.deleted, key)
-	delete(log.cached, key)
-	log.inserted[key] = value
+	log.remember(key)
+	if old, deleted, found := log.lookup(key); found && !deleted {
+		log.dirtyBytes -= log.size(key, old)
+	} else {
+		log.dirtyNodes++
+	}
+	log.dirtyBytes += len(value)
+	log.top().insert(key, value)
 }
 
 func (log *updateLog) delete(key common.Hash) {
-	delete(log.inserted, key)
-	delete(log.cached, key)
-	log.deleted[key] = []byte{}
+	log.remember(key)
+	if old, deleted, found := log.lookup(key); found && !deleted {
+		log.dirtyNodes--
+		log.dirtyBytes -= log.size(key, old)
+	}
+	log.top().delete(key)
 }
 
-func (log *updateLog) copy() *updateLog {
-	newLog := newUpdateLog()
-	for k, v := range log.cached {
-		newLog.cached[k] = v
+// size return the size of the inserted value of key, and forget it from spilledBytes
+// if it's spilled, as it's about to be replaced
+func (log *updateLog) size(key common.Hash, value []byte) int {
+	if value != nil {
+		return len(value)
 	}
-	for k, v := range log.inserted {
-		newLog.inserted[k] = v
+	n := log.spill.length(key)
+	log.spilledBytes -= n
+	return n
+}
+
+// value return the inserted value of key found in layers, spilled values are read
+// from the spill table. It panics if the table can't be read, since the changes of
+// the trie are lost then
+func (log *updateLog) value(key common.Hash, value []byte) []byte {
+	if value != nil {
+		return value
 	}
-	for k, _ := range log.deleted {
-		newLog.deleted[k] = []byte{}
+	spilled, err := log.spill.get(key)
+	if err != nil {
+		panic(err)
+	}
+	return spilled
+}
+
+// maybeSpill move inserted values of log to the spill table if those held in memory
+// exceed the budget of the table. Layers are flattened to one, whose values are
+// replaced by nil, the log must not be shared yet. Values stay in memory if
+// writing the table fails
+func (log *updateLog) maybeSpill() {
+	if log.spill == nil || log.dirtyBytes-log.spilledBytes <= log.spill.budget {
+		return
+	}
+	layer := log.flatten()
+	if len(log.layers) == 1 {
+		layer = layer.copy()
+	}
+	for k, v := range layer.inserted {
+		if v == nil {
+			continue
+		}
+		if err := log.spill.put(k, v); err != nil {
+			return
+		}
+		layer.inserted[k] = nil
+		layer.bytes -= len(v)
+		log.spilledBytes += len(v)
+	}
+	log.layers = []*logLayer{layer}
+}
+
+// remember record the size and the type of key if it is cached, because cached
+// node must exist in underlying db
+func (log *updateLog) remember(key common.Hash) {
+	if cached, ok := log.cache.get(key); ok {
+		log.top().persisted[key] = persistedNode{size: len(cached), nodeType: encodedType(cached)}
+	}
+}
+
+// lookup return the latest change of key, inserted value or deleted
+func (log *updateLog) lookup(key common.Hash) (value []byte, deleted bool, found bool) {
+	for i := len(log.layers) - 1; i >= 0; i-- {
+		layer := log.layers[i]
+		if _, ok := layer.deleted[key]; ok {
+			return nil, true, true
+		}
+		if inserted, ok := layer.inserted[key]; ok {
+			return inserted, false, true
+		}
+	}
+	return nil, false, false
+}
+
+// flatten return a layer which include changes of all layers
+func (log *updateLog) flatten() *logLayer {
+	if len(log.layers) == 1 {
+		return log.top()
+	}
+	flattened := log.layers[0]
+	for _, layer := range log.layers[1:] {
+		flattened = flattened.apply(layer)
+	}
+	return flattened
+}
+
+// child return a new log which share layers with current log and have a
+// new empty top layer, all changes of the new log are written to top layer
+func (log *updateLog) child() *updateLog {
+	layers := make([]*logLayer, len(log.layers), len(log.layers)+1)
+	copy(layers, log.layers)
+	return &updateLog{
+		cache:        log.cache,
+		layers:       append(layers, newLogLayer()),
+		dirtyNodes:   log.dirtyNodes,
+		dirtyBytes:   log.dirtyBytes,
+		spill:        log.spill,
+		spilledBytes: log.spilledBytes,
+	}
+}
+
+// committed return an empty log which share the cache with current log, it's
+// used by the trie persisted from current log
+func (log *updateLog) committed() *updateLog {
+	return &updateLog{
+		cache:  log.cache,
+		layers: []*logLayer{newLogLayer()},
+		spill:  log.spill,
+	}
+}
+
+// compact merge the top layer to the layer below it while the top layer is
+// at least half the size of the layer below it, so a log have O(log(n)) layers
+// and every change is copied O(log(n)) times
+func (log *updateLog) compact() {
+	for len(log.layers) > 1 {
+		top := log.top()
+		below := log.layers[len(log.layers)-2]
+		if top.size()*2 < below.size() {
+			return
+		}
+		log.layers = append(log.layers[:len(log.layers)-2], below.apply(top))
+	}
+}
+
+// copy return a deep copy of the log except the cache
+func (log *updateLog) copy() *updateLog {
+	layers := make([]*logLayer, 0, len(log.layers))
+	for _, layer := range log.layers {
+		layers = append(layers, layer.copy())
+	}
+	return &updateLog{
+		cache:        log.cache,
+		layers:       layers,
+		dirtyNodes:   log.dirtyNodes,
+		dirtyBytes:   log.dirtyBytes,
+		spill:        log.spill,
+		spilledBytes: log.spilledBytes,
 	}
-	return newLog
 }
 
 // merge return a new log which include current log and new inserted result
@@ -61,8 +371,14 @@ func (log *updateLog) mergeFromInsertResult(oldRootHash common.Hash, result *ins
 	if result == nil {
 		return log
 	}
-	newLog := log.copy()
+	newLog := log.child()
 	newLog.merge(oldRootHash, result.newNode, result.deleted, result.inserted)
+	if newLog.top().size() == 0 {
+		// all changes cancel out, e.g. an existing key value is inserted again
+		return log
+	}
+	newLog.compact()
+	newLog.maybeSpill()
 	return newLog
 }
 
@@ -71,21 +387,33 @@ func (log *updateLog) mergeFromDeleteResult(oldRootHash common.Hash, result *del
 	if result == nil {
 		return log
 	}
-	newLog := log.copy()
+	newLog := log.child()
 	newLog.merge(oldRootHash, result.newNode, result.deleted, result.inserted)
+	if newLog.top().size() == 0 {
+		// no stored node is changed. A delete which changed the trie always replace
+		// its root, so this is only a guard mirroring mergeFromInsertResult
+		return log
+	}
+	newLog.compact()
+	newLog.maybeSpill()
 	return newLog
 }
 
+// merge record deleted and inserted nodes of an operation to log, nodes both deleted
+// and inserted are unchanged, e.g. the path of a key updated to the same value, so
+// they are skipped rather than logged as a delete followed by a rewrite
 func (log *updateLog) merge(oldRootHash common.Hash, newRootNode node, deleted []node, inserted []node) {
+	deletedHashes := make(map[common.Hash]struct{}, len(deleted))
 	for _, n := range deleted {
 		capped := n.Capped()
 		vh := n.Hash()
 		// if encoded old root node less than 32 bytes, we must delete
 		// the old root node from underlying db
 		if len(capped) == common.HashLength || vh == oldRootHash {
-			log.delete(vh)
+			deletedHashes[vh] = struct{}{}
 		}
 	}
+	insertedNodes := make(map[common.Hash][]byte, len(inserted))
 	for _, n := range inserted {
 		capped := n.Capped()
 		var newRootCapped []byte
@@ -97,9 +425,20 @@ func (log *updateLog) merge(oldRootHash common.Hash, newRootNode node, deleted [
 		// if the encoded root node less than 32 bytes, we must persist the root
 		// node to underlying db, and the hash of the root node is state hash
 		if len(capped) == common.HashLength || bytes.Equal(capped, newRootCapped) {
-			log.insert(n.Hash(), n.Encode())
+			vh := n.Hash()
+			if _, ok := deletedHashes[vh]; ok {
+				delete(deletedHashes, vh)
+				continue
+			}
+			insertedNodes[vh] = n.Encode()
 		}
 	}
+	for vh := range deletedHashes {
+		log.delete(vh)
+	}
+	for vh, encoded := range insertedNodes {
+		log.insert(vh, encoded)
+	}
 }
 
 type operationResult struct {
@@ -1,3 +1,6 @@
+//go:build !mptcore
+// +build !mptcore
+
 package mpt
 
 import (
@@ -7,6 +10,7 @@ import (
 	"reflect"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -51,13 +55,14 @@ func TestMergeOperationResult(t *testing.T) {
 		} else {
 			oldLog = newLog
 		}
-		oldInserted := mapCopy(oldLog.inserted)
-		oldDeleted := mapCopy(oldLog.deleted)
+		oldInserted := mapCopy(oldLog.flatten().inserted)
+		oldDeleted := mapCopy(oldLog.flatten().deleted)
 		result := genOperationResult()
-		newLog = oldLog.copy()
+		newLog = oldLog.child()
 		newLog.merge(EmptyHash, nil, result.deleted, result.inserted)
-		assert.Equal(t, reflect.DeepEqual(oldInserted, oldLog.inserted), true)
-		assert.Equal(t, reflect.DeepEqual(oldDeleted, oldLog.deleted), true)
+		newLog.compact()
+		assert.Equal(t, reflect.DeepEqual(oldInserted, oldLog.flatten().inserted), true)
+		assert.Equal(t, reflect.DeepEqual(oldDeleted, oldLog.flatten().deleted), true)
 	}
 }
 
@@ -68,7 +73,7 @@ func TestMergeWithNewNode(t *testing.T) {
 	result := newOperationResult(leaf)
 	result.insert(leaf)
 	log.merge(EmptyHash, leaf, result.deleted, result.inserted)
-	assert.True(t, mapContains(log.inserted, leaf.Hash(), leaf.Encode()))
+	assert.True(t, mapContains(log.flatten().inserted, leaf.Hash(), leaf.Encode()))
 }
 
 func TestMergeWithOldRootHash(t *testing.T) {
@@ -78,5 +83,91 @@ func TestMergeWithOldRootHash(t *testing.T) {
 	result := newOperationResult(nil)
 	result.delete(leaf)
 	log.merge(leaf.Hash(), nil, result.deleted, result.inserted)
-	assert.True(t, mapContains(log.deleted, leaf.Hash(), []byte{}))
+	assert.True(t, mapContains(log.flatten().deleted, leaf.Hash(), []byte{}))
+}
+
+func TestMergeUnchangedNodes(t *testing.T) {
+	// values are long enough so nodes are referenced by hash
+	unchanged := newLeafNode([]byte{0x01}, bytes.Repeat([]byte{0x01}, 32))
+	deleted := newLeafNode([]byte{0x02}, bytes.Repeat([]byte{0x02}, 32))
+	inserted := newLeafNode([]byte{0x03}, bytes.Repeat([]byte{0x03}, 32))
+	log := newUpdateLog()
+	result := newInsertResult(nil)
+	result.delete(unchanged)
+	result.delete(deleted)
+	result.insert(unchanged)
+	result.insert(inserted)
+	log = log.mergeFromInsertResult(EmptyHash, result)
+	changes := log.flatten()
+	assert.Equal(t, map[common.Hash][]byte{inserted.Hash(): inserted.Encode()}, changes.inserted)
+	assert.Equal(t, map[common.Hash][]byte{deleted.Hash(): {}}, changes.deleted)
+
+	// a result whose changes all cancel out don't add a layer
+	result = newInsertResult(nil)
+	result.delete(inserted)
+	result.insert(inserted)
+	assert.True(t, log == log.mergeFromInsertResult(EmptyHash, result))
+}
+
+func TestInsertSameValue(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 100)
+	root := trie.StateRoot()
+	// idempotent updates don't make nodes dirty
+	for i := 0; i < 3; i++ {
+		for _, elem := range kvs {
+			trie = trie.Insert(elem.k, elem.v)
+		}
+	}
+	assert.Equal(t, root, trie.StateRoot())
+	nodes, size := trie.DirtyCount()
+	assert.Equal(t, 0, nodes)
+	assert.Equal(t, 0, size)
+	assert.Equal(t, 0, len(trie.DirtyNodes()))
+
+	// nodes changed by a real update are written once no matter how many times it's
+	// applied again
+	elem := newKV()
+	once := trie.Insert(elem.k, elem.v)
+	repeated := once
+	for i := 0; i < 10; i++ {
+		repeated = repeated.Insert(elem.k, elem.v).Insert(kvs[i].k, kvs[i].v)
+	}
+	assert.Equal(t, once.StateRoot(), repeated.StateRoot())
+	assert.Equal(t, once.DirtyNodes(), repeated.DirtyNodes())
+	assert.Equal(t, len(once.log.layers), len(repeated.log.layers))
+	report := repeated.Persist()
+	assert.Equal(t, len(once.DirtyNodes()), report.NodesWritten)
+	checkIterate(t, NewTrie(repeated.StateRoot(), memDB), kvMap(append(kvs, elem)))
+}
+
+func TestLogLayersCompact(t *testing.T) {
+	log := newUpdateLog()
+	for i := 0; i < 1000; i++ {
+		result := genOperationResult()
+		oldLayers := len(log.layers)
+		oldTop := log.top().copy()
+		newLog := log.mergeFromInsertResult(EmptyHash, &insertResult{result})
+		// old log is unchanged
+		assert.Equal(t, oldLayers, len(log.layers))
+		assert.Equal(t, oldTop, log.top())
+		log = newLog
+	}
+	// the size of layers decrease by half at least from bottom to top
+	for i := 1; i < len(log.layers); i++ {
+		assert.True(t, log.layers[i].size()*2 < log.layers[i-1].size())
+	}
+	assert.True(t, len(log.layers) <= 15, "too many layers: %d", len(log.layers))
+}
+
+func BenchmarkTrieInsert(b *testing.B) {
+	trie := NewTrie(EmptyHash, memorydb.New())
+	kvs := make([]kv, b.N)
+	for i := range kvs {
+		kvs[i] = newKV()
+	}
+	b.ResetTimer()
+	for _, elem := range kvs {
+		trie = trie.Insert(elem.k, elem.v)
+	}
 }
@@ -0,0 +1,43 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+)
+
+// DirtyNodes return all nodes inserted but not persisted yet, keyed by node hash.
+// Together with the underlying db of the parent state, they are enough to resolve
+// every node of the trie, see NewTrieWithOverlay
+func (t *Trie) DirtyNodes() map[common.Hash][]byte {
+	changes := t.log.flatten()
+	dirty := make(map[common.Hash][]byte, len(changes.inserted))
+	for k, v := range changes.inserted {
+		dirty[k] = common.CopyBytes(t.log.value(k, v))
+	}
+	return dirty
+}
+
+// NewTrieWithOverlay create a trie whose nodes are resolved from overlay first and
+// then db, overlay is usually returned by DirtyNodes of a trie not persisted yet.
+// Overlay nodes are treated as inserted nodes, so they will be written to db when
+// the new trie or tries derived from it are persisted
+func NewTrieWithOverlay(rootHash common.Hash, kvs db.KeyValueStore, overlay map[common.Hash][]byte, opts ...Option) (*Trie, error) {
+	t := NewTrie(rootHash, kvs, opts...)
+	// the committed root which overlay based on is unknown
+	t.baseRoot = t.config.emptyRoot
+	for k, v := range overlay {
+		if hash := keccak256Hash(v); hash != k {
+			return nil, fmt.Errorf("overlay node %s mismatch with its hash %s", k.Hex(), hash.Hex())
+		}
+		if _, err := decodeNode(v); err != nil {
+			return nil, fmt.Errorf("invalid overlay node %s: %v", k.Hex(), err)
+		}
+		t.log.insert(k, common.CopyBytes(v))
+	}
+	return t, nil
+}
@@ -0,0 +1,66 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirtyNodesOverlay(t *testing.T) {
+	proverDB := memorydb.New()
+	verifierDB := memorydb.New()
+	base := NewTrie(EmptyHash, proverDB)
+	all := uniqueKVs(121)
+	kvs := all[:100]
+	for _, elem := range kvs {
+		base = base.Insert(elem.k, elem.v)
+	}
+	// both prover and verifier have the committed state
+	base.Persist()
+	batch := verifierDB.NewBatch()
+	base.CommitToBatch(batch)
+	batch.Write()
+
+	pending := NewTrie(base.StateRoot(), proverDB)
+	for _, elem := range all[100:120] {
+		pending = pending.Insert(elem.k, elem.v)
+		kvs = append(kvs, elem)
+	}
+	pending = pending.Delete(kvs[0].k)
+	dirty := pending.DirtyNodes()
+	assert.True(t, len(dirty) > 0)
+
+	trie, err := NewTrieWithOverlay(pending.StateRoot(), verifierDB, dirty)
+	assert.Nil(t, err)
+	assert.Nil(t, trie.Get(kvs[0].k))
+	for _, elem := range kvs[1:] {
+		assert.Equal(t, elem.v, trie.Get(elem.k))
+	}
+
+	// re-execute a transition on top of the pending state, then persist
+	elem := all[120]
+	expected := pending.Insert(elem.k, elem.v)
+	trie = trie.Insert(elem.k, elem.v)
+	assert.Equal(t, expected.StateRoot(), trie.StateRoot())
+	trie.Persist()
+	reloaded := NewTrie(trie.StateRoot(), verifierDB)
+	for _, elem := range kvs[1:] {
+		assert.Equal(t, elem.v, reloaded.Get(elem.k))
+	}
+}
+
+func TestInvalidOverlay(t *testing.T) {
+	trie := NewTrie(EmptyHash, memorydb.New())
+	trie = trie.Insert([]byte{0x01}, []byte{0x02})
+	trie = trie.Insert([]byte{0x02}, []byte{0x03})
+	dirty := trie.DirtyNodes()
+	for k := range dirty {
+		dirty[k] = append(dirty[k], 0x00)
+	}
+	_, err := NewTrieWithOverlay(trie.StateRoot(), memorydb.New(), dirty)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,473 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+	"github.com/lbqds/mpt/internal/varint"
+)
+
+// A pack file is an immutable, compressed and indexed set of trie nodes, used to
+// freeze nodes of old roots out of the live db:
+//
+//	magic | block ... | index | index offset (8 bytes big endian) | magic
+//
+// Nodes are concatenated into blocks of about packBlockSize bytes, and every block
+// is compressed with flate. The index is a list of uvarints:
+//
+//	number of blocks, (offset, compressed size) of every block,
+//	number of nodes, (hash (32 bytes), block, offset in block, size) of every node
+//
+// Nodes are written in the pre-order of tries, so nodes of a subtree are mostly in
+// the same block.
+
+var packMagic = []byte("mptpack1")
+
+const packBlockSize = 64 * 1024
+
+// ErrInvalidPack is returned when a pack file is malformed
+var ErrInvalidPack = errors.New("invalid pack file")
+
+type packBlock struct {
+	offset uint64
+	size   uint64
+}
+
+type packEntry struct {
+	block  uint64
+	offset uint64
+	size   uint64
+}
+
+// countingWriter count bytes written to w
+type countingWriter struct {
+	w       io.Writer
+	written uint64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.written += uint64(n)
+	return n, err
+}
+
+// packWriter write nodes to a pack file
+type packWriter struct {
+	w       *countingWriter
+	block   bytes.Buffer
+	blocks  []packBlock
+	entries map[common.Hash]packEntry
+}
+
+func newPackWriter(w io.Writer) (*packWriter, error) {
+	pw := &packWriter{
+		w:       &countingWriter{w: w},
+		blocks:  make([]packBlock, 0),
+		entries: make(map[common.Hash]packEntry),
+	}
+	if _, err := pw.w.Write(packMagic); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+func (pw *packWriter) add(hash common.Hash, encoded []byte) error {
+	pw.entries[hash] = packEntry{
+		block:  uint64(len(pw.blocks)),
+		offset: uint64(pw.block.Len()),
+		size:   uint64(len(encoded)),
+	}
+	pw.block.Write(encoded)
+	if pw.block.Len() >= packBlockSize {
+		return pw.flush()
+	}
+	return nil
+}
+
+// flush compress and write the current block
+func (pw *packWriter) flush() error {
+	if pw.block.Len() == 0 {
+		return nil
+	}
+	offset := pw.w.written
+	fw, err := flate.NewWriter(pw.w, flate.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := fw.Write(pw.block.Bytes()); err != nil {
+		return err
+	}
+	if err := fw.Close(); err != nil {
+		return err
+	}
+	pw.blocks = append(pw.blocks, packBlock{offset: offset, size: pw.w.written - offset})
+	pw.block.Reset()
+	return nil
+}
+
+// close write the last block, the index and the footer
+func (pw *packWriter) close() error {
+	if err := pw.flush(); err != nil {
+		return err
+	}
+	indexOffset := pw.w.written
+	index := make([]byte, 0)
+	index = varint.Append(index, uint64(len(pw.blocks)))
+	for _, block := range pw.blocks {
+		index = varint.Append(index, block.offset)
+		index = varint.Append(index, block.size)
+	}
+	hashes := make([]common.Hash, 0, len(pw.entries))
+	for hash := range pw.entries {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+	index = varint.Append(index, uint64(len(hashes)))
+	for _, hash := range hashes {
+		entry := pw.entries[hash]
+		index = append(index, hash[:]...)
+		index = varint.Append(index, entry.block)
+		index = varint.Append(index, entry.offset)
+		index = varint.Append(index, entry.size)
+	}
+	footer := make([]byte, 8)
+	binary.BigEndian.PutUint64(footer, indexOffset)
+	for _, data := range [][]byte{index, footer, packMagic} {
+		if _, err := pw.w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkNodes call fn with every node reachable from root in pre-order, subtrees
+// whose root is skipped by skip are not visited
+func walkNodes(reader db.KeyValueReader, root common.Hash, skip func(hash common.Hash) bool, fn func(hash common.Hash, encoded []byte) error) error {
+	if isEmptyRoot(root) || skip(root) {
+		return nil
+	}
+	encoded, err := reader.Get(nodeKey(root))
+	if err != nil || len(encoded) == 0 {
+		return &MissingNodeError{Hash: root, Err: err}
+	}
+	n, err := decodeNode(encoded)
+	if err != nil {
+		return &MissingNodeError{Hash: root, Err: err}
+	}
+	if err := fn(root, encoded); err != nil {
+		return err
+	}
+	return walkChildren(reader, n, skip, fn)
+}
+
+func walkChildren(reader db.KeyValueReader, n node, skip func(hash common.Hash) bool, fn func(hash common.Hash, encoded []byte) error) error {
+	switch n := n.(type) {
+	case *extNode:
+		return walkChildren(reader, n.child, skip, fn)
+	case *branchNode:
+		for _, child := range n.children {
+			if child == nil {
+				continue
+			}
+			if err := walkChildren(reader, child, skip, fn); err != nil {
+				return err
+			}
+		}
+	case *hashNode:
+		return walkNodes(reader, n.Hash(), skip, fn)
+	}
+	return nil
+}
+
+// WritePack write all nodes reachable from roots to w as a pack file, nodes shared
+// by roots are written once. It return the number of nodes written
+func WritePack(w io.Writer, reader db.KeyValueReader, roots ...common.Hash) (int, error) {
+	return writePack(w, reader, func(common.Hash) bool { return false }, roots...)
+}
+
+func writePack(w io.Writer, reader db.KeyValueReader, skip func(hash common.Hash) bool, roots ...common.Hash) (int, error) {
+	pw, err := newPackWriter(w)
+	if err != nil {
+		return 0, err
+	}
+	written := func(hash common.Hash) bool {
+		if _, ok := pw.entries[hash]; ok {
+			return true
+		}
+		return skip(hash)
+	}
+	for _, root := range roots {
+		if err := walkNodes(reader, root, written, pw.add); err != nil {
+			return 0, err
+		}
+	}
+	if err := pw.close(); err != nil {
+		return 0, err
+	}
+	return len(pw.entries), nil
+}
+
+// Pack is an opened pack file, it's safe for concurrent use
+type Pack struct {
+	r       io.ReaderAt
+	blocks  []packBlock
+	entries map[common.Hash]packEntry
+
+	lock      sync.Mutex
+	cached    []byte
+	cachedIdx uint64
+}
+
+// OpenPack open the pack file of size read from r, the index is loaded in memory
+func OpenPack(r io.ReaderAt, size int64) (*Pack, error) {
+	tailSize := int64(8 + len(packMagic))
+	if size < int64(len(packMagic))+tailSize {
+		return nil, ErrInvalidPack
+	}
+	head := make([]byte, len(packMagic))
+	tail := make([]byte, tailSize)
+	if _, err := r.ReadAt(head, 0); err != nil {
+		return nil, err
+	}
+	if _, err := r.ReadAt(tail, size-tailSize); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(head, packMagic) || !bytes.Equal(tail[8:], packMagic) {
+		return nil, ErrInvalidPack
+	}
+	indexOffset := int64(binary.BigEndian.Uint64(tail[:8]))
+	if indexOffset < int64(len(packMagic)) || indexOffset > size-tailSize {
+		return nil, ErrInvalidPack
+	}
+	index := make([]byte, size-tailSize-indexOffset)
+	if _, err := r.ReadAt(index, indexOffset); err != nil {
+		return nil, err
+	}
+	p := &Pack{r: r, entries: make(map[common.Hash]packEntry)}
+	if err := p.parseIndex(bytes.NewReader(index), uint64(indexOffset)); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Pack) parseIndex(r *bytes.Reader, indexOffset uint64) error {
+	numBlocks, err := binary.ReadUvarint(r)
+	if err != nil || numBlocks > uint64(r.Len()) {
+		return ErrInvalidPack
+	}
+	p.blocks = make([]packBlock, numBlocks)
+	for i := range p.blocks {
+		if p.blocks[i].offset, err = binary.ReadUvarint(r); err != nil {
+			return ErrInvalidPack
+		}
+		if p.blocks[i].size, err = binary.ReadUvarint(r); err != nil {
+			return ErrInvalidPack
+		}
+		if p.blocks[i].offset+p.blocks[i].size > indexOffset {
+			return ErrInvalidPack
+		}
+	}
+	numNodes, err := binary.ReadUvarint(r)
+	if err != nil || numNodes > uint64(r.Len()) {
+		return ErrInvalidPack
+	}
+	for i := uint64(0); i < numNodes; i++ {
+		var hash common.Hash
+		if _, err := io.ReadFull(r, hash[:]); err != nil {
+			return ErrInvalidPack
+		}
+		var entry packEntry
+		for _, field := range []*uint64{&entry.block, &entry.offset, &entry.size} {
+			if *field, err = binary.ReadUvarint(r); err != nil {
+				return ErrInvalidPack
+			}
+		}
+		if entry.block >= numBlocks {
+			return ErrInvalidPack
+		}
+		p.entries[hash] = entry
+	}
+	if r.Len() != 0 {
+		return ErrInvalidPack
+	}
+	return nil
+}
+
+// Len return the number of nodes in the pack
+func (p *Pack) Len() int {
+	return len(p.entries)
+}
+
+// Has report whether the node of hash is in the pack
+func (p *Pack) Has(hash common.Hash) bool {
+	_, ok := p.entries[hash]
+	return ok
+}
+
+// Get return the encoded node of hash, false is returned if it's not in the pack
+func (p *Pack) Get(hash common.Hash) ([]byte, bool, error) {
+	entry, ok := p.entries[hash]
+	if !ok {
+		return nil, false, nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	block, err := p.block(entry.block)
+	if err != nil {
+		return nil, false, err
+	}
+	if entry.offset+entry.size > uint64(len(block)) {
+		return nil, false, ErrInvalidPack
+	}
+	encoded := common.CopyBytes(block[entry.offset : entry.offset+entry.size])
+	if keccak256Hash(encoded) != hash {
+		return nil, false, fmt.Errorf("%v: node %s mismatch with its hash", ErrInvalidPack, hash.Hex())
+	}
+	return encoded, true, nil
+}
+
+// block return the decompressed block i, the last block read is cached
+func (p *Pack) block(i uint64) ([]byte, error) {
+	if p.cached != nil && p.cachedIdx == i {
+		return p.cached, nil
+	}
+	compressed := make([]byte, p.blocks[i].size)
+	if _, err := p.r.ReadAt(compressed, int64(p.blocks[i].offset)); err != nil {
+		return nil, err
+	}
+	fr := flate.NewReader(bytes.NewReader(compressed))
+	defer fr.Close()
+	block, err := ioutil.ReadAll(fr)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", ErrInvalidPack, err)
+	}
+	p.cached, p.cachedIdx = block, i
+	return block, nil
+}
+
+// PackedStore is a db whose nodes missing from the live db are read from packs,
+// writes and deletes only go to the live db. Nodes of old roots can be frozen into
+// packs by Freeze and then removed from the live db by EvictPacked, so the live db
+// stay small for archive deployments
+type PackedStore struct {
+	db.KeyValueStore
+	lock  sync.RWMutex
+	packs []*Pack
+}
+
+// NewPackedStore create a store of the live db kvs and packs
+func NewPackedStore(kvs db.KeyValueStore, packs ...*Pack) *PackedStore {
+	return &PackedStore{
+		KeyValueStore: kvs,
+		packs:         append([]*Pack{}, packs...),
+	}
+}
+
+// AddPack add a pack to the store
+func (s *PackedStore) AddPack(p *Pack) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.packs = append(s.packs, p)
+}
+
+// packed return the encoded node of key from packs
+func (s *PackedStore) packed(key []byte) ([]byte, bool, error) {
+	if len(key) != common.HashLength {
+		return nil, false, nil
+	}
+	hash := common.BytesToHash(key)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, p := range s.packs {
+		if encoded, ok, err := p.Get(hash); ok || err != nil {
+			return encoded, ok, err
+		}
+	}
+	return nil, false, nil
+}
+
+// Has report whether key is in the live db or packs
+func (s *PackedStore) Has(key []byte) (bool, error) {
+	if has, err := s.KeyValueStore.Has(key); has || err != nil {
+		return has, err
+	}
+	if len(key) != common.HashLength {
+		return false, nil
+	}
+	hash := common.BytesToHash(key)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, p := range s.packs {
+		if p.Has(hash) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Get return the value of key from the live db, or from packs if it's missing
+func (s *PackedStore) Get(key []byte) ([]byte, error) {
+	value, err := s.KeyValueStore.Get(key)
+	if err == nil && len(value) > 0 {
+		return value, nil
+	}
+	encoded, ok, packErr := s.packed(key)
+	if packErr != nil {
+		return nil, packErr
+	}
+	if ok {
+		return encoded, nil
+	}
+	return value, err
+}
+
+// inPacks report whether the node of hash is in any pack
+func (s *PackedStore) inPacks(hash common.Hash) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, p := range s.packs {
+		if p.Has(hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// Freeze write nodes reachable from roots to w as a pack file, nodes already in
+// packs of the store are skipped with their subtrees, since a pack always hold
+// complete subtrees. It return the number of nodes written
+func (s *PackedStore) Freeze(w io.Writer, roots ...common.Hash) (int, error) {
+	return writePack(w, s, s.inPacks, roots...)
+}
+
+// EvictPacked delete nodes of pack from the live db, they are still readable from
+// the store once the pack is added
+func (s *PackedStore) EvictPacked(p *Pack) error {
+	batch := s.KeyValueStore.NewBatch()
+	for hash := range p.entries {
+		if err := batch.Delete(nodeKey(hash)); err != nil {
+			return err
+		}
+		if batch.ValueSize() >= db.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	return batch.Write()
+}
@@ -0,0 +1,90 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func openPack(t *testing.T, data []byte) *Pack {
+	p, err := OpenPack(bytes.NewReader(data), int64(len(data)))
+	assert.Nil(t, err)
+	return p
+}
+
+func TestWritePack(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 1000)
+	var buf bytes.Buffer
+	n, err := WritePack(&buf, memDB, trie.StateRoot(), trie.StateRoot())
+	assert.Nil(t, err)
+	// only nodes of the trie are in db
+	assert.Equal(t, memDB.Len(), n)
+	p := openPack(t, buf.Bytes())
+	assert.Equal(t, n, p.Len())
+	it := memDB.NewIterator(nil, nil)
+	for it.Next() {
+		encoded, ok, err := p.Get(common.BytesToHash(it.Key()))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, it.Value(), encoded)
+	}
+	it.Release()
+
+	// read nodes evicted from live db from pack
+	store := NewPackedStore(memDB, p)
+	assert.Nil(t, store.EvictPacked(p))
+	assert.Equal(t, 0, memDB.Len())
+	reloaded := NewTrie(trie.StateRoot(), store)
+	assert.False(t, reloaded.Stale())
+	for _, elem := range kvs {
+		assert.Equal(t, elem.v, reloaded.Get(elem.k))
+	}
+
+	// updated nodes are written to live db, and frozen to a new pack without
+	// nodes already packed
+	for _, elem := range uniqueKVs(100) {
+		reloaded = reloaded.Insert(elem.k, elem.v)
+	}
+	reloaded.Persist()
+	var newBuf bytes.Buffer
+	n, err = store.Freeze(&newBuf, reloaded.StateRoot())
+	assert.Nil(t, err)
+	assert.Equal(t, memDB.Len(), n)
+	newPack := openPack(t, newBuf.Bytes())
+	store.AddPack(newPack)
+	assert.Nil(t, store.EvictPacked(newPack))
+	assert.Equal(t, 0, memDB.Len())
+	assert.Nil(t, checkSubtree(store, reloaded.StateRoot(), make(map[common.Hash]struct{})))
+	assert.Nil(t, checkSubtree(store, trie.StateRoot(), make(map[common.Hash]struct{})))
+}
+
+func TestInvalidPack(t *testing.T) {
+	memDB := memorydb.New()
+	trie, _ := persistedTrie(memDB, 100)
+	var buf bytes.Buffer
+	_, err := WritePack(&buf, memDB, trie.StateRoot())
+	assert.Nil(t, err)
+	data := buf.Bytes()
+	_, err = OpenPack(bytes.NewReader(data[:len(data)-1]), int64(len(data)-1))
+	assert.Equal(t, ErrInvalidPack, err)
+	_, err = OpenPack(bytes.NewReader(data[:10]), 10)
+	assert.Equal(t, ErrInvalidPack, err)
+
+	// corrupt the first block
+	corrupted := append([]byte{}, data...)
+	corrupted[len(packMagic)+5] ^= 0xff
+	p := openPack(t, corrupted)
+	_, _, err = p.Get(trie.StateRoot())
+	assert.NotNil(t, err)
+
+	// missing nodes
+	_, err = WritePack(&buf, memorydb.New(), trie.StateRoot())
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,133 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+)
+
+// ErrNoNodeAtPath is returned when no node of the trie is located at the path
+var ErrNoNodeAtPath = errors.New("no trie node at path")
+
+// ReadTrieNodeByPath return the encoded node located at path in the trie of root,
+// path is the key nibbles from root to the node, the root node is at empty path.
+// Nodes embedded in their parents can be read as well. It read nodes from reader
+// directly, so no Trie is needed
+func ReadTrieNodeByPath(reader db.KeyValueReader, root common.Hash, path []byte) ([]byte, error) {
+	n, err := locatePath(reader, root, path)
+	if err != nil {
+		return nil, err
+	}
+	if ref, ok := n.(*hashNode); ok {
+		encoded, _, err := readNode(reader, ref.Hash())
+		return encoded, err
+	}
+	return n.Encode(), nil
+}
+
+// DeleteNodeByPath delete the node located at path in the trie of root and all its
+// descendants from kvs, and return the number of deleted nodes. It's a repair tool
+// for localized corruption: once a subtree is removed, a healer can download it
+// again rather than resync the whole trie. Nodes on the path to the subtree must be
+// intact, while nodes in the subtree may be missing or corrupted, they are skipped
+// or deleted without following their children. The node must be stored by hash, a
+// node embedded in its parent is rejected, delete the path of its parent instead.
+// Nodes in the subtree shared by other subtrees or tries are deleted as well
+func DeleteNodeByPath(kvs db.KeyValueStore, root common.Hash, path []byte) (int, error) {
+	n, err := locatePath(kvs, root, path)
+	if err != nil {
+		return 0, err
+	}
+	ref, ok := n.(*hashNode)
+	if !ok {
+		return 0, fmt.Errorf("node at path %x is embedded in its parent", path)
+	}
+	batch := kvs.NewBatch()
+	deleted := 0
+	seen := map[common.Hash]struct{}{ref.Hash(): {}}
+	stack := []common.Hash{ref.Hash()}
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		encoded, err := kvs.Get(nodeKey(hash))
+		if err != nil || len(encoded) == 0 {
+			continue
+		}
+		// children of a corrupted node are unknown, they are left to the healer
+		childRefs(encoded, func(child common.Hash) {
+			if _, ok := seen[child]; !ok {
+				seen[child] = struct{}{}
+				stack = append(stack, child)
+			}
+		})
+		if err := batch.Delete(nodeKey(hash)); err != nil {
+			return 0, err
+		}
+		deleted++
+	}
+	if err := batch.Write(); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// readNode read the node of hash from reader
+func readNode(reader db.KeyValueReader, hash common.Hash) ([]byte, node, error) {
+	encoded, err := reader.Get(nodeKey(hash))
+	if err != nil || len(encoded) == 0 {
+		return nil, nil, &MissingNodeError{Hash: hash, Err: err}
+	}
+	n, err := decodeNode(encoded)
+	if err != nil {
+		return nil, nil, &MissingNodeError{Hash: hash, Err: err}
+	}
+	return encoded, n, nil
+}
+
+// locatePath return the node located at path in the trie of root without resolving
+// it, which is a hash node if it's stored by hash
+func locatePath(reader db.KeyValueReader, root common.Hash, path []byte) (node, error) {
+	for _, nibble := range path {
+		if nibble > 0x0f {
+			return nil, fmt.Errorf("invalid nibble %x in path", nibble)
+		}
+	}
+	if isEmptyRoot(root) {
+		return nil, ErrNoNodeAtPath
+	}
+	var startNode node = &hashNode{root[:]}
+	for {
+		if len(path) == 0 {
+			return startNode, nil
+		}
+		if ref, ok := startNode.(*hashNode); ok {
+			_, resolved, err := readNode(reader, ref.Hash())
+			if err != nil {
+				return nil, err
+			}
+			startNode = resolved
+		}
+		switch n := startNode.(type) {
+		case *extNode:
+			if len(path) < len(n.key) || matchingLength(path, n.key) != len(n.key) {
+				return nil, ErrNoNodeAtPath
+			}
+			startNode = n.child
+			path = path[len(n.key):]
+		case *branchNode:
+			if n.children[path[0]] == nil {
+				return nil, ErrNoNodeAtPath
+			}
+			startNode = n.children[path[0]]
+			path = path[1:]
+		default:
+			// path go beyond leaf node
+			return nil, ErrNoNodeAtPath
+		}
+	}
+}
@@ -0,0 +1,126 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+// nodesByPath collect encoded nodes of the subtree of n keyed by their paths
+func nodesByPath(t *testing.T, trie *Trie, n node, path []byte, nodes map[string][]byte) {
+	if hash, ok := n.(*hashNode); ok {
+		resolved, err := trie.resolveHash(hash.Hash())
+		assert.Nil(t, err)
+		n = resolved
+	}
+	nodes[string(path)] = n.Encode()
+	switch n := n.(type) {
+	case *extNode:
+		nodesByPath(t, trie, n.child, extendPath(path, n.key...), nodes)
+	case *branchNode:
+		for i, child := range n.children {
+			if child != nil {
+				nodesByPath(t, trie, child, extendPath(path, byte(i)), nodes)
+			}
+		}
+	}
+}
+
+func TestReadTrieNodeByPath(t *testing.T) {
+	memDB := memorydb.New()
+	trie, _ := persistedTrie(memDB, 100)
+	trie = trie.Insert([]byte{0x01}, []byte{0x01})
+	trie = trie.Insert([]byte{0x01, 0x02}, []byte{0x02})
+	trie.Persist()
+	trie = NewTrie(trie.StateRoot(), memDB)
+
+	nodes := make(map[string][]byte)
+	nodesByPath(t, trie, &hashNode{trie.rootHash[:]}, nil, nodes)
+	embedded := 0
+	for path, encoded := range nodes {
+		if len(encoded) < common.HashLength {
+			embedded++
+		}
+		actual, err := ReadTrieNodeByPath(memDB, trie.StateRoot(), []byte(path))
+		assert.Nil(t, err)
+		assert.Equal(t, encoded, actual)
+	}
+	assert.True(t, embedded > 0)
+
+	_, err := ReadTrieNodeByPath(memDB, trie.StateRoot(), []byte{0x10})
+	assert.NotNil(t, err)
+	_, err = ReadTrieNodeByPath(memDB, trie.StateRoot(), []byte{0x00, 0x01, 0x00, 0x02, 0x00})
+	assert.Equal(t, ErrNoNodeAtPath, err)
+	_, err = ReadTrieNodeByPath(memDB, EmptyHash, nil)
+	assert.Equal(t, ErrNoNodeAtPath, err)
+
+	_, err = ReadTrieNodeByPath(memorydb.New(), trie.StateRoot(), nil)
+	_, ok := err.(*MissingNodeError)
+	assert.True(t, ok)
+}
+
+func TestDeleteNodeByPath(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 500)
+	backup := memorydb.New()
+	it := memDB.NewIterator(nil, nil)
+	for it.Next() {
+		backup.Put(it.Key(), it.Value())
+	}
+	it.Release()
+
+	nodes := make(map[string][]byte)
+	nodesByPath(t, trie, &hashNode{trie.rootHash[:]}, nil, nodes)
+	// the subtree under the first nibble of the first key
+	path := bytesToNibbles(kvs[0].k)[:1]
+	subtree, err := decodeNode(nodes[string(path)])
+	assert.Nil(t, err)
+	hash := subtree.Hash()
+	hashes := make([]common.Hash, 0)
+	assert.Nil(t, ReachableHashes(hash, memDB, func(h common.Hash, size int) bool {
+		hashes = append(hashes, h)
+		return true
+	}))
+	assert.True(t, len(hashes) > 1)
+	// corrupt a node of the subtree
+	assert.Nil(t, memDB.Put(nodeKey(hashes[len(hashes)-1]), []byte{0xff, 0xff}))
+
+	size := memDB.Len()
+	deleted, err := DeleteNodeByPath(memDB, trie.StateRoot(), path)
+	assert.Nil(t, err)
+	assert.Equal(t, len(hashes), deleted)
+	assert.Equal(t, size-deleted, memDB.Len())
+	reader := NewTrie(trie.StateRoot(), memDB)
+	for _, elem := range kvs {
+		value, err := reader.TryGet(elem.k)
+		if bytesToNibbles(elem.k)[0] == path[0] {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, elem.v, value)
+		}
+	}
+
+	// heal the subtree
+	for _, h := range hashes {
+		encoded, _ := backup.Get(nodeKey(h))
+		assert.Nil(t, memDB.Put(nodeKey(h), encoded))
+	}
+	checked := make(map[common.Hash]struct{})
+	assert.Nil(t, checkSubtree(memDB, trie.StateRoot(), checked))
+
+	for p, encoded := range nodes {
+		if len(encoded) < common.HashLength {
+			_, err = DeleteNodeByPath(memDB, trie.StateRoot(), []byte(p))
+			assert.NotNil(t, err)
+			break
+		}
+	}
+	_, err = DeleteNodeByPath(memDB, EmptyHash, nil)
+	assert.Equal(t, ErrNoNodeAtPath, err)
+}
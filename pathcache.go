@@ -0,0 +1,136 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// NodePathCache is a LRU cache of decoded nodes keyed by the root and the path of
+// nodes, the path is the key nibbles from root to the node. Decoding a node decode
+// all children embedded in it, which have no hash identity and can't be cached by
+// hash, so caching decoded nodes by path avoid decoding them again and again. It's
+// designed for read only serving of a few hot roots, a cache can be shared by tries
+// of different roots and is safe for concurrent use
+type NodePathCache struct {
+	lock     sync.Mutex
+	maxNodes int
+	entries  map[string]*list.Element
+	lru      *list.List
+}
+
+type pathCacheEntry struct {
+	key  string
+	hash common.Hash
+	node node
+}
+
+// NewNodePathCache create a cache which hold at most maxNodes decoded nodes
+func NewNodePathCache(maxNodes int) *NodePathCache {
+	return &NodePathCache{
+		maxNodes: maxNodes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// WithNodePathCache resolve nodes from cache for Get, tries opened with the same
+// cache share the decoded nodes
+func WithNodePathCache(cache *NodePathCache) Option {
+	return func(c *config) {
+		c.pathCache = cache
+	}
+}
+
+func pathCacheKey(root common.Hash, path []byte) string {
+	return string(root[:]) + string(path)
+}
+
+// get return the node at path under root, hash is the hash of the node expected
+func (c *NodePathCache) get(root common.Hash, path []byte, hash common.Hash) (node, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.entries[pathCacheKey(root, path)]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*pathCacheEntry)
+	if entry.hash != hash {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.node, true
+}
+
+// put cache n, which is sealed first since it's shared by tries from now on
+func (c *NodePathCache) put(root common.Hash, path []byte, hash common.Hash, n node) {
+	if c.maxNodes <= 0 {
+		return
+	}
+	seal(n)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := pathCacheKey(root, path)
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = &pathCacheEntry{key: key, hash: hash, node: n}
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&pathCacheEntry{key: key, hash: hash, node: n})
+	for c.lru.Len() > c.maxNodes {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*pathCacheEntry).key)
+	}
+}
+
+// Len return the number of cached nodes
+func (c *NodePathCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
+
+// seal compute the encodings and hashes of n and its embedded descendants, which
+// are cached in nodes when first computed, so readers sharing n never write it
+func seal(n node) {
+	n.Hash()
+	switch n := n.(type) {
+	case *branchNode:
+		for _, child := range n.children {
+			if child != nil {
+				seal(child)
+			}
+		}
+	case *extNode:
+		seal(n.child)
+	}
+}
+
+// resolvePath resolve the node of hash at path, nodes are cached by path if the
+// trie has a NodePathCache. Cached nodes are shared by tries, they are sealed
+// before caching so reading them is safe for concurrent use
+func (t *Trie) resolvePath(hash common.Hash, path []byte) (node, error) {
+	cache := t.config.pathCache
+	if cache == nil {
+		n, err := t.resolveHash(hash)
+		if err != nil {
+			t.traceMissing(path, err)
+		}
+		return n, err
+	}
+	if n, ok := cache.get(t.rootHash, path, hash); ok {
+		return n, nil
+	}
+	n, err := t.resolveHash(hash)
+	if err != nil {
+		t.traceMissing(path, err)
+		return nil, err
+	}
+	cache.put(t.rootHash, path, hash, n)
+	return n, nil
+}
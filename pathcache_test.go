@@ -0,0 +1,82 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodePathCache(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 200)
+	cache := NewNodePathCache(1 << 20)
+	warm := NewTrie(trie.StateRoot(), memDB, WithNodePathCache(cache))
+	for _, elem := range kvs[:100] {
+		assert.Equal(t, elem.v, warm.Get(elem.k))
+	}
+	assert.True(t, cache.Len() > 0)
+
+	// nodes of warmed keys are resolved from cache without reading db
+	cold := NewTrie(trie.StateRoot(), memorydb.New(), WithNodePathCache(cache))
+	for _, elem := range kvs[:100] {
+		value, err := cold.TryGet(elem.k)
+		assert.Nil(t, err)
+		assert.Equal(t, elem.v, value)
+	}
+
+	// nodes of other roots are not used
+	other := trie.Insert(kvs[0].k, []byte("other value"))
+	other = NewTrie(other.StateRoot(), memorydb.New(), WithNodePathCache(cache))
+	_, err := other.TryGet(kvs[0].k)
+	assert.NotNil(t, err)
+}
+
+func TestNodePathCacheEviction(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 200)
+	cache := NewNodePathCache(10)
+	trie = NewTrie(trie.StateRoot(), memDB, WithNodePathCache(cache))
+	for _, elem := range kvs {
+		assert.Equal(t, elem.v, trie.Get(elem.k))
+		assert.True(t, cache.Len() <= 10)
+	}
+	assert.Equal(t, 10, cache.Len())
+}
+
+func TestNodePathCacheConcurrentTries(t *testing.T) {
+	// tries of two roots share decoded nodes, including embedded leaves of short
+	// values which are hashed by SubtreeHash, run with -race
+	memDB := memorydb.New()
+	trie := NewTrie(EmptyHash, memDB)
+	kvs := uniqueKVs(200)
+	for i := range kvs {
+		kvs[i].v = []byte{byte(i)}
+		trie = trie.Insert(kvs[i].k, kvs[i].v)
+	}
+	trie.Persist()
+	other := trie.Insert(kvs[0].k, []byte("other value"))
+	// keep nodes of both roots
+	_, err := other.Commit(WithDeferredDelete(NewDeleteQueue(memDB)))
+	assert.Nil(t, err)
+	cache := NewNodePathCache(1 << 20)
+	tries := []*Trie{
+		NewTrie(trie.StateRoot(), memDB, WithNodePathCache(cache)),
+		NewTrie(other.StateRoot(), memDB, WithNodePathCache(cache)),
+	}
+	runWorkers(8, func(worker int) {
+		reader := tries[worker%2]
+		for _, elem := range kvs[1:] {
+			value, err := reader.TryGet(elem.k)
+			assert.Nil(t, err)
+			assert.Equal(t, elem.v, value)
+			for i := 0; i <= len(elem.k); i++ {
+				_, err = reader.SubtreeHash(elem.k[:i])
+				assert.Nil(t, err)
+			}
+		}
+	})
+}
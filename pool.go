@@ -0,0 +1,140 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+)
+
+// TriePoolConfig control how many tries and cached nodes a TriePool keep
+type TriePoolConfig struct {
+	// MaxIdle is the max number of idle tries kept for each root, default is 16
+	MaxIdle int
+	// CacheBytes is the max size of cached nodes of each root, caches are trimmed
+	// when tries are returned, zero means unlimited
+	CacheBytes int
+	// WarmDepth is the number of levels of nodes referenced by hash which are read
+	// into the cache when a root is used first time, zero means no warming
+	WarmDepth int
+}
+
+// poolEntry is the shared cache and idle tries of a root
+type poolEntry struct {
+	cache *nodeCache
+	idle  []*Trie
+}
+
+// TriePool hand out tries of roots for request scoped reads, e.g. RPC servers. Tries
+// of the same root share a node cache which is warmed when the root is used first
+// time, and returned tries are reused, so a request doesn't allocate an update log
+// and a cache. It's safe for concurrent use
+type TriePool struct {
+	db     db.KeyValueStore
+	opts   []Option
+	config TriePoolConfig
+
+	lock    sync.Mutex
+	entries map[common.Hash]*poolEntry
+}
+
+// NewTriePool create a pool of tries on kvs, opts are applied to every trie
+func NewTriePool(kvs db.KeyValueStore, config TriePoolConfig, opts ...Option) *TriePool {
+	if config.MaxIdle <= 0 {
+		config.MaxIdle = 16
+	}
+	return &TriePool{
+		db:      kvs,
+		opts:    opts,
+		config:  config,
+		entries: make(map[common.Hash]*poolEntry),
+	}
+}
+
+// Get return a trie of root, an idle trie is reused if there is any. Nodes which
+// can't be resolved when warming are skipped, they're reported by reads of the trie
+func (p *TriePool) Get(root common.Hash) *Trie {
+	p.lock.Lock()
+	entry, ok := p.entries[root]
+	if !ok {
+		entry = &poolEntry{cache: newNodeCache()}
+		p.entries[root] = entry
+	}
+	if n := len(entry.idle); n > 0 {
+		t := entry.idle[n-1]
+		entry.idle = entry.idle[:n-1]
+		p.lock.Unlock()
+		return t
+	}
+	p.lock.Unlock()
+
+	t := NewTrie(root, p.db, p.opts...)
+	t.log.cache = entry.cache
+	if !ok && p.config.WarmDepth > 0 && !t.empty(t.rootHash) {
+		t.warm(&hashNode{t.rootHash[:]}, p.config.WarmDepth)
+	}
+	return t
+}
+
+// Put return a trie got from the pool, tries derived from it by Insert/Delete are
+// not accepted since they have changes
+func (p *TriePool) Put(t *Trie) {
+	if t.rootHash != t.baseRoot || len(t.log.layers) != 1 || t.log.top().size() != 0 {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	entry, ok := p.entries[t.rootHash]
+	if !ok || t.log.cache != entry.cache {
+		return
+	}
+	if p.config.CacheBytes > 0 && entry.cache.bytes() > p.config.CacheBytes {
+		entry.cache.trim(p.config.CacheBytes)
+	}
+	if len(entry.idle) < p.config.MaxIdle {
+		entry.idle = append(entry.idle, t)
+	}
+}
+
+// Release drop the cache and idle tries of root, e.g. once root is pruned. Tries of
+// root still in use can't be returned to the pool anymore
+func (p *TriePool) Release(root common.Hash) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.entries, root)
+}
+
+// Roots return the number of roots which have a cache in the pool
+func (p *TriePool) Roots() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.entries)
+}
+
+// warm resolve nodes of the subtree of n into the cache, depth is the number of
+// levels of nodes referenced by hash to resolve
+func (t *Trie) warm(n node, depth int) {
+	if ref, ok := n.(*hashNode); ok {
+		if depth == 0 {
+			return
+		}
+		resolved, err := t.resolveHash(ref.Hash())
+		if err != nil {
+			return
+		}
+		n, depth = resolved, depth-1
+	}
+	switch n := n.(type) {
+	case *extNode:
+		t.warm(n.child, depth)
+	case *branchNode:
+		for _, child := range n.children {
+			if child != nil {
+				t.warm(child, depth)
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTriePool(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 500)
+	root := trie.StateRoot()
+	pool := NewTriePool(memDB, TriePoolConfig{MaxIdle: 2, WarmDepth: 2})
+
+	// the cache is warmed when the root is used first time
+	first := pool.Get(root)
+	warmed := first.CacheSize()
+	assert.True(t, warmed > 0)
+	checkIterate(t, first, kvMap(kvs))
+	second := pool.Get(root)
+	// tries of the same root share the cache
+	assert.Equal(t, first.CacheSize(), second.CacheSize())
+	assert.True(t, second.CacheSize() > warmed)
+	assert.Equal(t, 1, pool.Roots())
+
+	// returned tries are reused
+	pool.Put(first)
+	pool.Put(second)
+	third := pool.Get(root)
+	assert.True(t, third == first || third == second)
+	extra := pool.Get(root)
+	extra2 := pool.Get(root)
+	pool.Put(third)
+	pool.Put(extra)
+	pool.Put(extra2)
+	assert.Equal(t, 2, len(pool.entries[root].idle))
+
+	// tries with changes are not accepted
+	elem := newKV()
+	changed := pool.Get(root).Insert(elem.k, elem.v)
+	pool.Put(changed)
+	assert.Equal(t, 1, len(pool.entries[root].idle))
+
+	pool.Release(root)
+	assert.Equal(t, 0, pool.Roots())
+	pool.Put(third)
+	assert.Equal(t, 0, pool.Roots())
+	assert.Equal(t, kvs[0].v, third.Get(kvs[0].k))
+}
+
+func TestTriePoolCacheLimit(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 500)
+	pool := NewTriePool(memDB, TriePoolConfig{CacheBytes: 1024})
+	handle := pool.Get(trie.StateRoot())
+	// no warming
+	assert.Equal(t, 0, handle.CacheSize())
+	checkIterate(t, handle, kvMap(kvs))
+	assert.True(t, handle.CacheSize() > 1024)
+	pool.Put(handle)
+	assert.True(t, pool.Get(trie.StateRoot()).CacheSize() <= 1024)
+
+	// empty trie
+	empty := pool.Get(EmptyHash)
+	assert.Nil(t, empty.Get(kvs[0].k))
+	pool.Put(empty)
+}
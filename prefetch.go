@@ -0,0 +1,68 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// MultiGetter is implemented by dbs which can read several keys in one round trip,
+// e.g. remote stores. Full walks of the trie read all children of a branch with it
+// before visiting them, so the latency of the walk is paid per branch rather than
+// per node
+type MultiGetter interface {
+	// MultiGet return the values of keys in order, nil for absent keys
+	MultiGet(keys [][]byte) ([][]byte, error)
+}
+
+// prefetchChildren read the children of n stored by hash and not resolved yet with
+// one MultiGet if underlying db support it, and cache them for the walk of n. path
+// and start are those of the walk, children before start are skipped. Errors are
+// ignored, the children are read one by one again and report them. It's a no-op
+// for tries with WithNoCache, since prefetched nodes are kept in the cache
+func (t *Trie) prefetchChildren(n *branchNode, path, start []byte) {
+	getter, ok := t.db.(MultiGetter)
+	if !ok || t.config.noCache {
+		return
+	}
+	hashes := make([]common.Hash, 0, len(n.children))
+	keys := make([][]byte, 0, len(n.children))
+	for i, child := range n.children {
+		child, ok := child.(*hashNode)
+		if !ok {
+			continue
+		}
+		if skip, _ := boundStart(extendPath(path, byte(i)), start); skip {
+			continue
+		}
+		hash := child.Hash()
+		if _, deleted, found := t.log.lookup(hash); deleted || found {
+			continue
+		}
+		if _, ok := t.log.cached(hash); ok {
+			continue
+		}
+		hashes = append(hashes, hash)
+		keys = append(keys, nodeKey(hash))
+	}
+	// a single child gain nothing from a multi-get
+	if len(keys) < 2 {
+		return
+	}
+	if t.counts != nil {
+		t.counts.dbReads += len(keys)
+	}
+	values, err := getter.MultiGet(keys)
+	if err != nil || len(values) != len(keys) {
+		return
+	}
+	for i, encoded := range values {
+		if len(encoded) == 0 {
+			continue
+		}
+		if _, err := t.decodeFetched(encoded); err == nil {
+			t.log.cache.put(hashes[i], encoded)
+		}
+	}
+}
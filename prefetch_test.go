@@ -0,0 +1,67 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+// multiGetDB count single reads and multi-gets of the wrapped db
+type multiGetDB struct {
+	*memorydb.Database
+	gets      int
+	multiGets int
+}
+
+func (db *multiGetDB) Get(key []byte) ([]byte, error) {
+	db.gets++
+	return db.Database.Get(key)
+}
+
+func (db *multiGetDB) MultiGet(keys [][]byte) ([][]byte, error) {
+	db.multiGets++
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i], _ = db.Database.Get(key)
+	}
+	return values, nil
+}
+
+func TestPrefetchChildren(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 500)
+	db := &multiGetDB{Database: memDB}
+	reader := NewTrie(trie.StateRoot(), db)
+	assert.Equal(t, kvMap(kvs), kvMap(collectKVs(t, reader.Iterate)))
+	assert.True(t, db.multiGets > 0)
+	// most nodes are read by multi-gets
+	assert.True(t, db.gets+db.multiGets < memDB.Len()/2)
+
+	// nodes cached by the walk are not read again
+	gets, multiGets := db.gets, db.multiGets
+	assert.Nil(t, reader.IterateNodes(PreOrder, func([]byte, common.Hash, []byte) bool {
+		return true
+	}))
+	assert.Equal(t, gets, db.gets)
+	assert.Equal(t, multiGets, db.multiGets)
+
+	// subtrees before start are skipped
+	start := sortedKVs(kvMap(kvs))[400].k
+	db.gets, db.multiGets = 0, 0
+	reader = NewTrie(trie.StateRoot(), db)
+	assert.Equal(t, 100, len(collectKVs(t, func(fn func(key, value []byte) bool) error {
+		return reader.IterateFrom(start, fn)
+	})))
+	assert.True(t, db.gets+db.multiGets < memDB.Len()/4)
+
+	db.gets, db.multiGets = 0, 0
+	reader = NewTrie(trie.StateRoot(), db, WithNoCache())
+	assert.Equal(t, kvMap(kvs), kvMap(collectKVs(t, reader.Iterate)))
+	assert.Equal(t, 0, db.multiGets)
+	assert.Equal(t, memDB.Len(), db.gets)
+}
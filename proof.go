@@ -0,0 +1,389 @@
+package mpt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lbqds/mpt/internal/varint"
+)
+
+// A proof of key is the list of encoded nodes on the path from root to the key,
+// in order from root. The boundary of proof nodes follows the encoding of trie:
+//
+// The root node is always the first proof node, it's referenced by the state root
+// even if its encoding is less than 32 bytes.
+//
+// A child whose encoding is less than 32 bytes is embedded in its parent, it's not
+// a proof node and verified as part of its parent.
+//
+// A child whose encoding is 32 bytes or more is referenced by its hash, the 32
+// bytes hash is stored in its parent, and the encoded child is the next proof node.
+//
+// The proof stop at the node where the path end, that is the leaf of key, the branch
+// whose target is the value of key, or the node show that key is absent. The proof of
+// empty trie is empty.
+
+// Sizes of encoded nodes to estimate proofs before generating them, e.g. to bound
+// witnesses. Lengths of fields are assumed to be one byte varints, that is, fields
+// are less than 128 bytes, which holds for all but long keys and values. Child
+// references of WithTaggedChildRefs are one byte longer than the sizes here
+const (
+	// NodeFlagSize is the size of the flag appended to every encoded node
+	NodeFlagSize = 1
+	// FieldOverhead is the size of the tag and length of a field
+	FieldOverhead = 2
+	// HashRefSize is the size of a child referenced by hash in its parent
+	HashRefSize = FieldOverhead + common.HashLength
+	// MaxBranchNodeSize is the max size of a branch without target, embedded children
+	// are shorter than hashes, so it's the size of a branch whose 16 children are all
+	// referenced by hash
+	MaxBranchNodeSize = 16*HashRefSize + NodeFlagSize
+	// MaxExtNodeSize is the max size of an extension node in tries of 32 bytes keys
+	MaxExtNodeSize = FieldOverhead + common.HashLength + HashRefSize + NodeFlagSize
+	// MaxProofNodeSize is the max size of a proof node accepted by verifiers, so a
+	// proof can't make them hash and decode huge nodes. It bounds the values on the
+	// path of proved keys to about 1MB
+	MaxProofNodeSize = 1 << 20
+)
+
+// ErrProofTooLarge is returned when proofs have more nodes than the paths of their
+// keys can have, or a node larger than MaxProofNodeSize
+var ErrProofTooLarge = errors.New("proof exceed the bound of its keys")
+
+// maxProofDepth return the max number of nodes in the proof of key, every node below
+// the root is stored by hash under a branch or an extension, which consume at least
+// a nibble of the key
+func maxProofDepth(key []byte) int {
+	return 2*len(key) + 1
+}
+
+// checkProofBounds check the size of proofs of items before they are hashed and
+// decoded, so the work of verifiers is bounded by the keys rather than by proofs
+func checkProofBounds(items []ProofItem) error {
+	maxNodes, nodes := 0, 0
+	for i, item := range items {
+		maxNodes += maxProofDepth(item.Key)
+		nodes += len(item.Proof)
+		seen := make(map[string]struct{}, len(item.Proof))
+		for _, encoded := range item.Proof {
+			if len(encoded) > MaxProofNodeSize {
+				return fmt.Errorf("item %d: %v, node of %d bytes", i, ErrProofTooLarge, len(encoded))
+			}
+			if _, ok := seen[string(encoded)]; ok {
+				return fmt.Errorf("item %d: duplicate proof node", i)
+			}
+			seen[string(encoded)] = struct{}{}
+		}
+	}
+	if nodes > maxNodes {
+		return fmt.Errorf("%v, %d nodes for at most %d", ErrProofTooLarge, nodes, maxNodes)
+	}
+	return nil
+}
+
+// EstimateProofSize return the max size of a proof of depth nodes, see PathDepth, in
+// tries of keys of at most 32 bytes. Values on the path are not included, add
+// ValueFieldSize of the value of the key, and of targets of branches on the path if
+// keys are prefixes of each other
+func EstimateProofSize(depth int) int {
+	if depth <= 0 {
+		return 0
+	}
+	return depth * MaxBranchNodeSize
+}
+
+// ValueFieldSize return the size of a value of n bytes in its node
+func ValueFieldSize(n int) int {
+	if n == 0 {
+		// empty value of leaf is omitted
+		return 0
+	}
+	return 1 + varint.Size(uint64(n)) + n
+}
+
+// proofNodes is the decoded nodes of proofs keyed by hash
+type proofNodes map[common.Hash]node
+
+// newProofNodes decode nodes of proofs on workers goroutines and check them against
+// the bounds of c, every distinct node is hashed and decoded once
+func newProofNodes(c *config, workers int, proofs ...[][]byte) (proofNodes, error) {
+	distinct := make([][]byte, 0)
+	seen := make(map[string]struct{})
+	for _, proof := range proofs {
+		for _, encoded := range proof {
+			if _, ok := seen[string(encoded)]; ok {
+				continue
+			}
+			seen[string(encoded)] = struct{}{}
+			distinct = append(distinct, encoded)
+		}
+	}
+	decoded := make([]node, len(distinct))
+	hashes := make([]common.Hash, len(distinct))
+	err := runParallel(workers, len(distinct), func(i int) error {
+		n, err := c.decode(distinct[i])
+		if err == ErrValueTooLarge || err == ErrBranchTarget {
+			return err
+		}
+		if err == nil {
+			err = checkEmbedded(n)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid proof node: %v", err)
+		}
+		decoded[i], hashes[i] = n, keccak256Hash(distinct[i])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	nodes := make(proofNodes, len(distinct))
+	for i, n := range decoded {
+		nodes[hashes[i]] = n
+	}
+	return nodes, nil
+}
+
+// runParallel call fn with every index in [0, n) on workers goroutines, the error
+// of the smallest index is returned, so the result doesn't depend on scheduling
+func runParallel(workers, n int, fn func(i int) error) error {
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			if err := fn(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < n; i += workers {
+				errs[i] = fn(i)
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkEmbedded verify children embedded in n are less than 32 bytes, larger
+// children must be referenced by hash
+func checkEmbedded(n node) error {
+	var children []node
+	switch n := n.(type) {
+	case *extNode:
+		children = []node{n.child}
+	case *branchNode:
+		children = n.children[:]
+	}
+	for _, child := range children {
+		if child == nil {
+			continue
+		}
+		if _, ok := child.(*hashNode); ok {
+			continue
+		}
+		if size := len(child.Encode()); size >= common.HashLength {
+			return fmt.Errorf("embedded node of %d bytes should be referenced by hash", size)
+		}
+		if err := checkEmbedded(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// get return the value of key in the trie of root and whether key is present,
+// an error is returned if proof nodes are incomplete. Hashes of proof nodes on the
+// path of key are passed to visit
+func (nodes proofNodes) get(root common.Hash, key []byte, visit func(hash common.Hash)) ([]byte, bool, error) {
+	if isEmptyRoot(root) {
+		return nil, false, nil
+	}
+	searchKey := bytesToNibbles(key)
+	var startNode node = &hashNode{root[:]}
+	// nodes can't form a cycle without a hash collision, the bound keep the walk
+	// finite even if they did
+	resolves := 0
+	for {
+		switch n := startNode.(type) {
+		case *leafNode:
+			if bytes.Equal(searchKey, n.key) {
+				return n.value, true, nil
+			}
+			return nil, false, nil
+		case *extNode:
+			if matchingLength(searchKey, n.key) != len(n.key) {
+				return nil, false, nil
+			}
+			startNode = n.child
+			searchKey = searchKey[len(n.key):]
+		case *branchNode:
+			if len(searchKey) == 0 {
+				// the target is separated from children, so an empty target is
+				// still a value
+				return n.target, n.hasTarget(), nil
+			}
+			startNode = n.children[searchKey[0]]
+			searchKey = searchKey[1:]
+		case *hashNode:
+			resolved, ok := nodes[n.Hash()]
+			if !ok {
+				return nil, false, fmt.Errorf("proof node %s is missing", n.Hash().Hex())
+			}
+			if resolves++; resolves > maxProofDepth(key) {
+				return nil, false, fmt.Errorf("proof nodes form a cycle")
+			}
+			visit(n.Hash())
+			startNode = resolved
+		default:
+			// nil child of branch node
+			return nil, false, nil
+		}
+	}
+}
+
+// ProofItem is a key with its value and proof, nil value means the proof
+// show that key is absent, and an empty but not nil value means key is present
+// with empty value
+type ProofItem struct {
+	Key   []byte
+	Value []byte
+	Proof [][]byte
+}
+
+// VerifyProofBatch verify all items against root. Nodes shared by proofs are
+// deduplicated, so every distinct node is hashed and decoded only once. Nodes
+// are referenced by hash, so an item can be verified by nodes from proofs of
+// other items.
+//
+// Proofs often come from untrusted peers, so the work is bounded by the keys: the
+// number of nodes can't exceed the max depth of the paths of keys, a proof can't
+// have the same node twice, and nodes can't exceed MaxProofNodeSize, all checked
+// before any node is hashed. Every node must be on the path of some key, so
+// proofs can't carry wasted nodes.
+//
+// opts bound the nodes like the options of NewTrie, WithMaxValueSize reject
+// nodes holding larger values with ErrValueTooLarge, and WithoutBranchTargets
+// reject branch targets with ErrBranchTarget. Other options have no effect
+func VerifyProofBatch(root common.Hash, items []ProofItem, opts ...Option) error {
+	return VerifyProofBatchParallel(root, items, 1, opts...)
+}
+
+// VerifyProofBatchParallel is VerifyProofBatch which hash and decode proof nodes,
+// and verify items, on workers goroutines. Nodes are independent of each other
+// until items are verified, so it scale with the number of cores for large batches
+// such as snap sync responses, e.g. workers is runtime.NumCPU()
+func VerifyProofBatchParallel(root common.Hash, items []ProofItem, workers int, opts ...Option) error {
+	if err := checkProofBounds(items); err != nil {
+		return err
+	}
+	proofs := make([][][]byte, 0, len(items))
+	for _, item := range items {
+		proofs = append(proofs, item.Proof)
+	}
+	nodes, err := newProofNodes(newConfig(opts), workers, proofs...)
+	if err != nil {
+		return err
+	}
+	// paths are collected per item, so workers don't share them
+	paths := make([][]common.Hash, len(items))
+	err = runParallel(workers, len(items), func(i int) error {
+		item := items[i]
+		value, found, err := nodes.get(root, item.Key, func(hash common.Hash) {
+			paths[i] = append(paths[i], hash)
+		})
+		if err != nil {
+			return fmt.Errorf("item %d: %v", i, err)
+		}
+		if found != (item.Value != nil) {
+			return fmt.Errorf("item %d: presence mismatch, proved %v, expected %v", i, found, item.Value != nil)
+		}
+		if !bytes.Equal(value, item.Value) {
+			return fmt.Errorf("item %d: value mismatch, proved %x, expected %x", i, value, item.Value)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return checkWasted(items, nodes, paths)
+}
+
+// checkWasted check every node is on one of the paths of items
+func checkWasted(items []ProofItem, nodes proofNodes, paths [][]common.Hash) error {
+	used := make(map[common.Hash]struct{}, len(nodes))
+	for _, path := range paths {
+		for _, hash := range path {
+			used[hash] = struct{}{}
+		}
+	}
+	if len(used) == len(nodes) {
+		return nil
+	}
+	// report the first wasted node in the order of items
+	for i, item := range items {
+		for _, encoded := range item.Proof {
+			if _, ok := used[keccak256Hash(encoded)]; !ok {
+				return fmt.Errorf("item %d: proof node %x is not on the path of any key", i, keccak256Hash(encoded))
+			}
+		}
+	}
+	return nil
+}
+
+// VerifyProof verify the proof of key against root, and return the value of key,
+// which is nil if the proof show that key is absent, and empty but not nil if key
+// is present with empty value. It needs only the root, e.g. for light clients, and
+// is bounded like VerifyProofBatch, including the bounds of opts
+func VerifyProof(root common.Hash, key []byte, proof [][]byte, opts ...Option) ([]byte, error) {
+	items := []ProofItem{{Key: key, Proof: proof}}
+	if err := checkProofBounds(items); err != nil {
+		return nil, err
+	}
+	nodes, err := newProofNodes(newConfig(opts), 1, proof)
+	if err != nil {
+		return nil, err
+	}
+	path := make([]common.Hash, 0, len(proof))
+	value, found, err := nodes.get(root, key, func(hash common.Hash) {
+		path = append(path, hash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := checkWasted(items, nodes, [][]common.Hash{path}); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, nil
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	return value, nil
+}
+
+// VerifyListItem verify that item is at index of the list of root, which is built
+// by DeriveListRoot, and proof is the proof of the item from ListProofs
+func VerifyListItem(root common.Hash, index uint64, item []byte, proof [][]byte) error {
+	if item == nil {
+		item = []byte{}
+	}
+	return VerifyProofBatch(root, []ProofItem{{Key: ListIndexKey(index), Value: item, Proof: proof}})
+}
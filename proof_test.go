@@ -0,0 +1,452 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func proofItems(t testing.TB, trie *Trie, kvs []kv) []ProofItem {
+	items := make([]ProofItem, 0, len(kvs))
+	for _, elem := range kvs {
+		proof, err := trie.Prove(elem.k)
+		assert.Nil(t, err)
+		items = append(items, ProofItem{Key: elem.k, Value: elem.v, Proof: proof})
+	}
+	return items
+}
+
+func TestVerifyProofBatch(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 200)
+	// tiny nodes are embedded in parents
+	trie = trie.Insert([]byte{0x01}, []byte{0x01})
+	trie = trie.Insert([]byte{0x01, 0x02}, []byte{0x02})
+	kvs = append(kvs, kv{k: []byte{0x01}, v: []byte{0x01}}, kv{k: []byte{0x01, 0x02}, v: []byte{0x02}})
+	// random keys may be overwritten by the tiny ones
+	kvs = sortedKVs(kvMap(kvs))
+	// absent keys, random keys are shorter than 32 bytes
+	kvs = append(kvs, kv{k: []byte{0x01, 0x02, 0x03}}, kv{k: bytes.Repeat([]byte{0xee}, 40)})
+
+	items := proofItems(t, trie, kvs)
+	assert.Nil(t, VerifyProofBatch(trie.StateRoot(), items))
+	for _, item := range items {
+		assert.Nil(t, VerifyProofBatch(trie.StateRoot(), []ProofItem{item}))
+	}
+
+	// wrong value
+	tampered := append([]ProofItem{}, items...)
+	tampered[3].Value = []byte("wrong value")
+	assert.NotNil(t, VerifyProofBatch(trie.StateRoot(), tampered))
+
+	// missing proof nodes
+	item := items[0]
+	item.Proof = item.Proof[:len(item.Proof)-1]
+	assert.NotNil(t, VerifyProofBatch(trie.StateRoot(), []ProofItem{item}))
+
+	// wrong root
+	assert.NotNil(t, VerifyProofBatch(common.Hash{}, items))
+}
+
+func TestVerifyProofBatchParallel(t *testing.T) {
+	trie, kvs := persistedTrie(memorydb.New(), 500)
+	kvs = append(kvs, kv{k: bytes.Repeat([]byte{0xee}, 40)})
+	items := proofItems(t, trie, kvs)
+	for _, workers := range []int{0, 1, 2, 8, 1000} {
+		assert.Nil(t, VerifyProofBatchParallel(trie.StateRoot(), items, workers))
+	}
+
+	// errors are the same as verifying sequentially
+	tampered := append([]ProofItem{}, items...)
+	tampered[100].Value = []byte("wrong value")
+	tampered[200].Value = []byte("wrong value")
+	expected := VerifyProofBatch(trie.StateRoot(), tampered)
+	assert.NotNil(t, expected)
+	assert.Equal(t, expected, VerifyProofBatchParallel(trie.StateRoot(), tampered, 8))
+
+	tampered = append([]ProofItem{}, items...)
+	tampered[10].Proof = [][]byte{{0x01, 0x02, 0x03}}
+	expected = VerifyProofBatch(trie.StateRoot(), tampered)
+	assert.NotNil(t, expected)
+	assert.Equal(t, expected, VerifyProofBatchParallel(trie.StateRoot(), tampered, 8))
+}
+
+func TestVerifyProofBatchEmptyTrie(t *testing.T) {
+	trie := NewTrie(EmptyHash, memorydb.New())
+	items := proofItems(t, trie, []kv{{k: []byte{0x01}}})
+	assert.Equal(t, 0, len(items[0].Proof))
+	assert.Nil(t, VerifyProofBatch(EmptyHash, items))
+	items[0].Value = []byte{0x01}
+	assert.NotNil(t, VerifyProofBatch(EmptyHash, items))
+}
+
+func benchmarkProofItems(b *testing.B) (common.Hash, []ProofItem) {
+	trie, kvs := persistedTrie(memorydb.New(), 10000)
+	return trie.StateRoot(), proofItems(b, trie, kvs[:500])
+}
+
+func BenchmarkVerifyProofOneByOne(b *testing.B) {
+	root, items := benchmarkProofItems(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, item := range items {
+			VerifyProofBatch(root, []ProofItem{item})
+		}
+	}
+}
+
+func BenchmarkVerifyProofBatch(b *testing.B) {
+	root, items := benchmarkProofItems(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		VerifyProofBatch(root, items)
+	}
+}
+
+func BenchmarkVerifyProofBatchParallel(b *testing.B) {
+	root, items := benchmarkProofItems(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		VerifyProofBatchParallel(root, items, runtime.NumCPU())
+	}
+}
+
+func TestProofTinyNodes(t *testing.T) {
+	// the encoding of root is less than 32 bytes
+	trie := NewTrie(EmptyHash, memorydb.New()).Insert([]byte{0x01}, []byte{0x01})
+	proof, err := trie.Prove([]byte{0x01})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(proof))
+	assert.True(t, len(proof[0]) < 32)
+	items := proofItems(t, trie, []kv{{k: []byte{0x01}, v: []byte{0x01}}, {k: []byte{0x02}}})
+	assert.Nil(t, VerifyProofBatch(trie.StateRoot(), items))
+
+	// branch with embedded children, the value of {0x01} is the target of an embedded branch
+	trie = trie.Insert([]byte{0x01, 0x02}, []byte{0x02})
+	trie = trie.Insert([]byte{0x11}, []byte{0x03})
+	trie = trie.Insert([]byte{0x21}, bytes.Repeat([]byte{0xff}, 32))
+	kvs := []kv{
+		{k: []byte{0x01}, v: []byte{0x01}},
+		{k: []byte{0x01, 0x02}, v: []byte{0x02}},
+		{k: []byte{0x11}, v: []byte{0x03}},
+		{k: []byte{0x21}, v: bytes.Repeat([]byte{0xff}, 32)},
+		{k: []byte{0x01, 0x03}},
+		{k: []byte{0x31}},
+	}
+	items = proofItems(t, trie, kvs)
+	for _, item := range items {
+		// embedded nodes are not proof nodes
+		for _, encoded := range item.Proof[1:] {
+			assert.True(t, len(encoded) >= 32)
+		}
+		assert.Nil(t, VerifyProofBatch(trie.StateRoot(), []ProofItem{item}))
+	}
+}
+
+func TestProofLargeEmbeddedNode(t *testing.T) {
+	leaf := newLeafNode([]byte{0x01}, bytes.Repeat([]byte{0xff}, 32))
+	assert.True(t, len(leaf.Encode()) > 32)
+	// a large child embedded in parent rather than referenced by hash
+	children := make([][]byte, 16)
+	children[0] = leaf.Encode()
+	branch := append(marshalBranchNode(children, nil), branchType)
+	_, err := decodeNode(branch)
+	assert.Equal(t, ErrMalformedNode, err)
+
+	item := ProofItem{Key: []byte{0x01}, Value: leaf.value, Proof: [][]byte{branch}}
+	assert.NotNil(t, VerifyProofBatch(crypto.Keccak256Hash(branch), []ProofItem{item}))
+}
+
+func TestProofEmptyTarget(t *testing.T) {
+	trie := NewTrie(EmptyHash, memorydb.New())
+	trie = trie.Insert([]byte{0x01}, []byte{})
+	trie = trie.Insert([]byte{0x01, 0x02}, bytes.Repeat([]byte{0xff}, 32))
+	proof, err := trie.Prove([]byte{0x01})
+	assert.Nil(t, err)
+
+	// an empty target is present, which is different from absent
+	item := ProofItem{Key: []byte{0x01}, Value: []byte{}, Proof: proof}
+	assert.Nil(t, VerifyProofBatch(trie.StateRoot(), []ProofItem{item}))
+	item.Value = nil
+	assert.NotNil(t, VerifyProofBatch(trie.StateRoot(), []ProofItem{item}))
+}
+
+func TestProofEmbeddedEdgeCases(t *testing.T) {
+	trie, kvs := tinyTrie(memorydb.New())
+	// keys absent at embedded leaves and branches, and the empty key
+	absent := []kv{{k: []byte{0x01, 0x03}}, {k: []byte{0x14}}, {k: []byte{0x10}}, {k: []byte{0xf1}}, {k: []byte{}}}
+	items := proofItems(t, trie, append(kvs, absent...))
+	assert.Nil(t, VerifyProofBatch(trie.StateRoot(), items))
+	for _, item := range items {
+		assert.Nil(t, VerifyProofBatch(trie.StateRoot(), []ProofItem{item}))
+	}
+
+	// the root is a leaf encoded as the flag byte alone
+	trie = NewTrie(EmptyHash, memorydb.New()).Insert([]byte{}, []byte{})
+	trie.Persist()
+	proof, err := trie.Prove([]byte{})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{{leafType}}, proof)
+	items = proofItems(t, trie, []kv{{k: []byte{}, v: []byte{}}, {k: []byte{0x01}}})
+	assert.Nil(t, VerifyProofBatch(trie.StateRoot(), items))
+}
+
+func TestEstimateProofSize(t *testing.T) {
+	memDB := memorydb.New()
+	trie := NewTrie(EmptyHash, memDB)
+	kvs := make([]kv, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		elem := kv{k: crypto.Keccak256(Uint64Key(uint64(i))), v: randomBytes()}
+		if i%10 == 0 {
+			elem.v = bytes.Repeat(elem.v, 8)
+		}
+		trie = trie.Insert(elem.k, elem.v)
+		kvs = append(kvs, elem)
+	}
+	trie.Persist()
+	trie = NewTrie(trie.StateRoot(), memDB)
+	absent := crypto.Keccak256([]byte("absent"))
+	kvs = append(kvs, kv{k: absent})
+	for _, elem := range kvs {
+		proof, err := trie.Prove(elem.k)
+		assert.Nil(t, err)
+		depth, err := trie.PathDepth(elem.k)
+		assert.Nil(t, err)
+		assert.Equal(t, len(proof), depth)
+		size := 0
+		for _, encoded := range proof {
+			size += len(encoded)
+			assert.True(t, len(encoded) <= MaxBranchNodeSize+ValueFieldSize(len(elem.v)))
+		}
+		assert.True(t, size <= EstimateProofSize(depth)+ValueFieldSize(len(elem.v)))
+	}
+
+	assert.Equal(t, 545, MaxBranchNodeSize)
+	full := branchWithChildren([16]node{}, false)
+	for i := 0; i < 16; i++ {
+		full = full.updateChild(i, &hashNode{absent})
+	}
+	assert.Equal(t, MaxBranchNodeSize, len(full.Encode()))
+	ext := newExtNode(bytesToNibbles(absent), &hashNode{absent}, false)
+	assert.Equal(t, MaxExtNodeSize, len(ext.Encode()))
+	leaf := newLeafNode(nil, bytes.Repeat([]byte{1}, 200))
+	assert.Equal(t, NodeFlagSize+ValueFieldSize(200), len(leaf.Encode()))
+
+	depth, err := NewTrie(EmptyHash, memDB).PathDepth(absent)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, depth)
+	assert.Equal(t, 0, EstimateProofSize(depth))
+}
+
+func TestVerifyProofBatchBounds(t *testing.T) {
+	trie, kvs := persistedTrie(memorydb.New(), 500)
+	items := proofItems(t, trie, kvs[:2])
+	root := trie.StateRoot()
+	assert.Nil(t, VerifyProofBatch(root, items))
+
+	// more nodes than the path of a short key can have
+	item := ProofItem{Key: []byte{}, Proof: items[0].Proof}
+	err := VerifyProofBatch(root, []ProofItem{item})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), ErrProofTooLarge.Error())
+
+	// duplicate node
+	item = items[0]
+	item.Proof = append([][]byte{item.Proof[0]}, item.Proof...)
+	err = VerifyProofBatch(root, []ProofItem{item})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "duplicate")
+
+	// nodes shared by items are not duplicates
+	assert.Nil(t, VerifyProofBatch(root, []ProofItem{items[0], items[1]}))
+
+	// oversized node
+	item = items[0]
+	item.Proof = append([][]byte{make([]byte, MaxProofNodeSize+1)}, item.Proof...)
+	err = VerifyProofBatch(root, []ProofItem{item})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), ErrProofTooLarge.Error())
+
+	// wasted node, a valid node off the path of the key, a path already as long as
+	// the key allow exceed the bound first
+	item = items[0]
+	item.Proof = append(append([][]byte{}, item.Proof...), items[1].Proof[len(items[1].Proof)-1])
+	err = VerifyProofBatch(root, []ProofItem{item})
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "not on the path") ||
+		strings.Contains(err.Error(), ErrProofTooLarge.Error()), err.Error())
+
+	// nodes for an empty trie
+	err = VerifyProofBatch(EmptyHash, []ProofItem{{Key: kvs[0].k, Proof: items[0].Proof[:1]}})
+	assert.NotNil(t, err)
+}
+
+// TestVerifyProofBatchMutated verify random mutations of proofs, the verifier must
+// never panic, and never accept a wrong value
+func TestVerifyProofBatchMutated(t *testing.T) {
+	trie, kvs := persistedTrie(memorydb.New(), 300)
+	kvs = append(kvs, kv{k: bytes.Repeat([]byte{0xee}, 40)})
+	items := proofItems(t, trie, kvs)
+	root := trie.StateRoot()
+	for i := 0; i < 3000; i++ {
+		item := items[random.Intn(len(items))]
+		proof := make([][]byte, 0, len(item.Proof)+1)
+		for _, encoded := range item.Proof {
+			proof = append(proof, append([]byte{}, encoded...))
+		}
+		switch random.Intn(6) {
+		case 0:
+			if j := random.Intn(len(proof)); len(proof[j]) > 0 {
+				proof[j][random.Intn(len(proof[j]))] ^= byte(1 + random.Intn(255))
+			}
+		case 1:
+			j := random.Intn(len(proof))
+			proof[j] = proof[j][:random.Intn(len(proof[j])+1)]
+		case 2:
+			j := random.Intn(len(proof))
+			proof = append(proof[:j], proof[j+1:]...)
+		case 3:
+			proof = append(proof, proof[random.Intn(len(proof))])
+		case 4:
+			other := items[random.Intn(len(items))].Proof
+			proof = append(proof, other[random.Intn(len(other))])
+		case 5:
+			j, k := random.Intn(len(proof)), random.Intn(len(proof))
+			proof[j], proof[k] = proof[k], proof[j]
+		}
+		wrong := ProofItem{Key: item.Key, Value: append([]byte("wrong"), item.Value...), Proof: proof}
+		assert.NotNil(t, VerifyProofBatch(root, []ProofItem{wrong}))
+		if item.Value != nil {
+			absent := ProofItem{Key: item.Key, Proof: proof}
+			assert.NotNil(t, VerifyProofBatch(root, []ProofItem{absent}))
+		}
+		// the item itself may still verify, e.g. swapped or duplicated nodes
+		VerifyProofBatch(root, []ProofItem{{Key: item.Key, Value: item.Value, Proof: proof}})
+	}
+}
+
+func TestVerifyProof(t *testing.T) {
+	trie, kvs := persistedTrie(memorydb.New(), 200)
+	trie = trie.Insert([]byte{0x01}, []byte{})
+	root := trie.StateRoot()
+	for _, elem := range append(kvs, kv{k: []byte{0x01}, v: []byte{}}) {
+		if bytes.Equal(elem.k, []byte{0x01}) && len(elem.v) != 0 {
+			// random key replaced by the empty value above
+			continue
+		}
+		proof, err := trie.Prove(elem.k)
+		assert.Nil(t, err)
+		value, err := VerifyProof(root, elem.k, proof)
+		assert.Nil(t, err)
+		assert.Equal(t, elem.v, value)
+		assert.NotNil(t, value)
+
+		_, err = VerifyProof(crypto.Keccak256Hash(root[:]), elem.k, proof)
+		assert.NotNil(t, err)
+		_, err = VerifyProof(root, elem.k, proof[:len(proof)-1])
+		assert.NotNil(t, err)
+	}
+
+	absent := bytes.Repeat([]byte{0xee}, 40)
+	proof, err := trie.Prove(absent)
+	assert.Nil(t, err)
+	value, err := VerifyProof(root, absent, proof)
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+
+	value, err = VerifyProof(EmptyHash, absent, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+}
+
+func TestVerifyProofTaggedChildRefs(t *testing.T) {
+	trie := NewTrie(EmptyHash, memorydb.New(), WithTaggedChildRefs())
+	kvs := uniqueKVs(200)
+	for _, elem := range kvs {
+		trie = trie.Insert(elem.k, elem.v)
+	}
+	root := trie.StateRoot()
+	for _, elem := range kvs[:20] {
+		proof, err := trie.Prove(elem.k)
+		assert.Nil(t, err)
+		value, err := VerifyProof(root, elem.k, proof, WithTaggedChildRefs())
+		assert.Nil(t, err)
+		assert.Equal(t, elem.v, value)
+		_, err = VerifyProof(root, elem.k, proof)
+		assert.NotNil(t, err)
+	}
+
+	resp, err := trie.ProveRange(nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, len(kvs), len(resp.Keys))
+	more, err := VerifyRangeProof(root, nil, nil, resp.Keys, resp.Values, resp.Proof, WithTaggedChildRefs())
+	assert.Nil(t, err)
+	assert.False(t, more)
+	_, err = VerifyRangeProof(root, nil, nil, resp.Keys, resp.Values, resp.Proof)
+	assert.NotNil(t, err)
+}
+
+func TestGetWithProof(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 300)
+	trie = trie.Insert(kvs[0].k[:1], []byte("target"))
+	trie.Persist()
+	for _, key := range [][]byte{kvs[0].k, kvs[0].k[:1], kvs[1].k, []byte("absent")} {
+		value, proof, err := trie.GetWithProof(key)
+		assert.Nil(t, err)
+		assert.Equal(t, trie.Get(key), value)
+		expected, err := trie.Prove(key)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, proof)
+		verified, err := VerifyProof(trie.StateRoot(), key, proof)
+		assert.Nil(t, err)
+		assert.Equal(t, value, verified)
+	}
+
+	// every node on the path is read once
+	var reads int
+	fresh := NewTrie(trie.StateRoot(), memDB, WithNoCache(), WithLatencySink(func(sample OpSample) {
+		reads = sample.DBReads
+	}))
+	_, proof, err := fresh.GetWithProof(kvs[1].k)
+	assert.Nil(t, err)
+	assert.Equal(t, len(proof), reads)
+
+	_, _, err = NewTrie(common.Hash{1}, memDB).GetWithProof(kvs[1].k)
+	assert.NotNil(t, err)
+}
+
+func TestVerifyProofMaxValueSize(t *testing.T) {
+	trie := NewTrie(EmptyHash, memorydb.New())
+	for _, elem := range uniqueKVs(50) {
+		trie = trie.Insert(elem.k, elem.v)
+	}
+	// large values as a leaf and as a branch target, both on the path of key
+	key := []byte{0x01, 0x02}
+	trie = trie.Insert(key, make([]byte, 100))
+	trie = trie.Insert(key[:1], make([]byte, 100))
+	root := trie.StateRoot()
+	for _, k := range [][]byte{key, key[:1]} {
+		proof, err := trie.Prove(k)
+		assert.Nil(t, err)
+		value, err := VerifyProof(root, k, proof, WithMaxValueSize(100))
+		assert.Nil(t, err)
+		assert.Equal(t, make([]byte, 100), value)
+		_, err = VerifyProof(root, k, proof, WithMaxValueSize(99))
+		assert.Equal(t, ErrValueTooLarge, err)
+
+		item := ProofItem{Key: k, Value: make([]byte, 100), Proof: proof}
+		assert.Nil(t, VerifyProofBatch(root, []ProofItem{item}, WithMaxValueSize(100)))
+		assert.Equal(t, ErrValueTooLarge, VerifyProofBatch(root, []ProofItem{item}, WithMaxValueSize(99)))
+		assert.Equal(t, ErrValueTooLarge, VerifyProofBatchParallel(root, []ProofItem{item}, 4, WithMaxValueSize(99)))
+	}
+}
@@ -0,0 +1,67 @@
+package mpt
+
+import (
+	"errors"
+
+	"github.com/lbqds/mpt/internal/varint"
+)
+
+// ProofVersion is the version byte of proofs marshaled by Proof.Marshal
+const ProofVersion = 1
+
+// ErrInvalidProofEncoding is returned by Proof.Unmarshal when data isn't the
+// canonical encoding of a proof
+var ErrInvalidProofEncoding = errors.New("invalid proof encoding")
+
+// Proof is a list of encoded proof nodes, e.g. returned by Trie.Prove, with a compact
+// binary encoding so it can be stored in dbs or sent over the wire as one blob
+type Proof [][]byte
+
+// Marshal return the encoding of the proof, which is
+// version | varint count | (varint size | node)*
+// Every proof has exactly one encoding, so equal proofs have equal encodings
+func (p Proof) Marshal() []byte {
+	size := 1 + varint.MaxLen
+	for _, node := range p {
+		size += varint.MaxLen + len(node)
+	}
+	buf := make([]byte, 1, size)
+	buf[0] = ProofVersion
+	buf = varint.Append(buf, uint64(len(p)))
+	for _, node := range p {
+		buf = varint.Append(buf, uint64(len(node)))
+		buf = append(buf, node...)
+	}
+	return buf
+}
+
+// Unmarshal decode data encoded by Marshal to p, nodes are copied so data can be
+// reused. It return ErrInvalidProofEncoding if the version is unknown, data is
+// truncated or has trailing bytes, varints aren't minimal or a node is larger than
+// MaxProofNodeSize
+func (p *Proof) Unmarshal(data []byte) error {
+	if len(data) == 0 || data[0] != ProofVersion {
+		return ErrInvalidProofEncoding
+	}
+	count, data, ok := varint.DecodeMinimal(data[1:])
+	// every node take at least the byte of its size, so a huge count is rejected
+	// before allocation
+	if !ok || count > uint64(len(data)) {
+		return ErrInvalidProofEncoding
+	}
+	nodes := make([][]byte, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var size uint64
+		size, data, ok = varint.DecodeMinimal(data)
+		if !ok || size > MaxProofNodeSize || size > uint64(len(data)) {
+			return ErrInvalidProofEncoding
+		}
+		nodes = append(nodes, append([]byte{}, data[:size]...))
+		data = data[size:]
+	}
+	if len(data) != 0 {
+		return ErrInvalidProofEncoding
+	}
+	*p = nodes
+	return nil
+}
@@ -0,0 +1,51 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProofMarshal(t *testing.T) {
+	trie, kvs := persistedTrie(memorydb.New(), 200)
+	for _, elem := range kvs[:20] {
+		nodes, err := trie.Prove(elem.k)
+		assert.Nil(t, err)
+		encoded := Proof(nodes).Marshal()
+		var decoded Proof
+		assert.Nil(t, decoded.Unmarshal(encoded))
+		assert.Equal(t, Proof(nodes), decoded)
+		assert.Equal(t, encoded, decoded.Marshal())
+		value, err := VerifyProof(trie.StateRoot(), elem.k, decoded)
+		assert.Nil(t, err)
+		assert.Equal(t, elem.v, value)
+	}
+
+	var empty Proof
+	assert.Nil(t, empty.Unmarshal(Proof(nil).Marshal()))
+	assert.Equal(t, Proof{}, empty)
+	assert.Equal(t, []byte{ProofVersion, 2, 1, 0xaa, 0}, Proof{{0xaa}, {}}.Marshal())
+
+	nodes, _ := trie.Prove(kvs[0].k)
+	encoded := Proof(nodes).Marshal()
+	var p Proof
+	for _, invalid := range [][]byte{
+		nil,
+		{},
+		append([]byte{ProofVersion + 1}, encoded[1:]...),
+		encoded[:len(encoded)-1],
+		append(append([]byte{}, encoded...), 0),
+		// non-minimal varint of the count
+		{ProofVersion, 0x81, 0x00, 1, 0xaa},
+		// count larger than data
+		{ProofVersion, 0xff, 0xff, 0xff, 0xff, 0x0f},
+	} {
+		assert.Equal(t, ErrInvalidProofEncoding, p.Unmarshal(invalid))
+	}
+	assert.Nil(t, p.Unmarshal([]byte{ProofVersion, 1, 1, 0xaa}))
+	assert.Equal(t, Proof{{0xaa}}, p)
+}
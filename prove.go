@@ -0,0 +1,93 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import "bytes"
+
+// Prove return the proof of key, the encoded nodes stored by hash on the path of key
+// in order from root, key may be absent from the trie, in that case the proof show
+// the absence of key. Proofs are verified against StateRoot by VerifyProofBatch,
+// ErrStaleTrie is returned if the trie is stale, and MissingNodeError if nodes are
+// missing for other reasons
+func (t *Trie) Prove(key []byte) ([][]byte, error) {
+	proof := make([][]byte, 0)
+	_, err := t.walkProof(key, func(n node) {
+		proof = append(proof, n.Encode())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return proof, nil
+}
+
+// GetWithProof return the value of key, nil if it's absent, and its proof like
+// Prove, both from one walk of the path of key, so nodes are resolved once
+func (t *Trie) GetWithProof(key []byte) (value []byte, proof [][]byte, err error) {
+	t, done := t.measure(OpGet)
+	defer func() { done(err) }()
+	proof = make([][]byte, 0)
+	value, err = t.walkProof(key, func(n node) {
+		proof = append(proof, n.Encode())
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return value, proof, nil
+}
+
+// PathDepth return the number of nodes in the proof of key, that is, the nodes on
+// its path stored by hash, without encoding them, see EstimateProofSize
+func (t *Trie) PathDepth(key []byte) (int, error) {
+	depth := 0
+	_, err := t.walkProof(key, func(node) {
+		depth++
+	})
+	return depth, err
+}
+
+// walkProof call fn with every proof node of key in order from root, and return the
+// value of key found at the end of the path
+func (t *Trie) walkProof(key []byte, fn func(n node)) ([]byte, error) {
+	if t.empty(t.rootHash) {
+		return nil, nil
+	}
+	rootNode, err := t.resolveHash(t.rootHash)
+	if err != nil {
+		return nil, err
+	}
+	fn(rootNode)
+	searchKey := bytesToNibbles(key)
+	startNode := rootNode
+	var value []byte
+	for startNode != nil {
+		var next node
+		switch n := startNode.(type) {
+		case *leafNode:
+			if bytes.Equal(searchKey, n.key) {
+				value = n.value
+			}
+		case *extNode:
+			if matchingLength(searchKey, n.key) == len(n.key) {
+				next = n.child
+				searchKey = searchKey[len(n.key):]
+			}
+		case *branchNode:
+			if len(searchKey) > 0 {
+				next = n.children[searchKey[0]]
+				searchKey = searchKey[1:]
+			} else {
+				value = n.target
+			}
+		case *hashNode:
+			resolved, err := t.resolveHash(n.Hash())
+			if err != nil {
+				return nil, err
+			}
+			fn(resolved)
+			next = resolved
+		}
+		startNode = next
+	}
+	return value, nil
+}
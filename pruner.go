@@ -0,0 +1,336 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+)
+
+// PrunerConfig control how fast the pruner delete nodes from underlying db,
+// zero value of a limit means unlimited
+type PrunerConfig struct {
+	// NodesPerSecond is the max number of nodes deleted per second
+	NodesPerSecond int
+	// BytesPerSecond is the max size of nodes deleted per second
+	BytesPerSecond int
+	// Compacting report whether the underlying db is compacting, pruner pause
+	// until it return false, nil means never pause
+	Compacting func() bool
+	// PollInterval is the interval to check state when pruner is paused or
+	// db is compacting, default is 100ms
+	PollInterval time.Duration
+	// Clock is the clock of rate limits and waits, default is SystemClock
+	Clock Clock
+}
+
+type pruneTask struct {
+	hash common.Hash
+	// size of encoded node, negative if unknown
+	size int
+}
+
+// PrunerProgress is the statistics of a pruner
+type PrunerProgress struct {
+	Pruned       int
+	PrunedBytes  int
+	Pending      int
+	Paused       bool
+	LastPruneErr error
+}
+
+// Pruner delete nodes from underlying db in background, deletes are rate limited
+// so that pruning don't spike IO latency of foreground reads
+type Pruner struct {
+	db     db.KeyValueStore
+	config PrunerConfig
+
+	lock     sync.Mutex
+	queue    []pruneTask
+	paused   bool
+	progress PrunerProgress
+	wake     chan struct{}
+	// interrupt wake the pruner waiting for the rate limit on Pause
+	interrupt chan struct{}
+	quit      chan struct{}
+	done      chan struct{}
+
+	nodeLimiter *rateLimiter
+	byteLimiter *rateLimiter
+}
+
+// NewPruner create a pruner, call Start to run it in background
+func NewPruner(kvs db.KeyValueStore, config PrunerConfig) *Pruner {
+	if config.PollInterval <= 0 {
+		config.PollInterval = 100 * time.Millisecond
+	}
+	if config.Clock == nil {
+		config.Clock = SystemClock
+	}
+	return &Pruner{
+		db:          kvs,
+		config:      config,
+		queue:       make([]pruneTask, 0),
+		wake:        make(chan struct{}, 1),
+		interrupt:   make(chan struct{}, 1),
+		nodeLimiter: newRateLimiter(config.NodesPerSecond, config.Clock),
+		byteLimiter: newRateLimiter(config.BytesPerSecond, config.Clock),
+	}
+}
+
+// Schedule append node hashes to the prune queue
+func (p *Pruner) Schedule(hashes ...common.Hash) {
+	for _, hash := range hashes {
+		p.schedule(pruneTask{hash: hash, size: -1})
+	}
+}
+
+func (p *Pruner) schedule(task pruneTask) {
+	p.lock.Lock()
+	p.queue = append(p.queue, task)
+	p.lock.Unlock()
+	p.notify()
+}
+
+func (p *Pruner) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start run the pruner in background, it's no-op if pruner is running
+func (p *Pruner) Start() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.quit != nil {
+		return
+	}
+	p.quit = make(chan struct{})
+	p.done = make(chan struct{})
+	go p.loop(p.quit, p.done)
+}
+
+// Stop terminate the background pruning, pending nodes are kept and will be
+// pruned after Start again
+func (p *Pruner) Stop() {
+	p.lock.Lock()
+	quit, done := p.quit, p.done
+	p.quit, p.done = nil, nil
+	p.lock.Unlock()
+	if quit == nil {
+		return
+	}
+	close(quit)
+	<-done
+}
+
+// Pause stop deleting nodes until Resume is called, nodes can still be scheduled.
+// A pruner waiting for the rate limit stop waiting, no node is deleted once Pause
+// returns
+func (p *Pruner) Pause() {
+	p.lock.Lock()
+	p.paused = true
+	p.lock.Unlock()
+	select {
+	case p.interrupt <- struct{}{}:
+	default:
+	}
+}
+
+// Resume continue pruning after Pause
+func (p *Pruner) Resume() {
+	p.lock.Lock()
+	p.paused = false
+	p.lock.Unlock()
+	p.notify()
+}
+
+// Progress return the statistics of the pruner
+func (p *Pruner) Progress() PrunerProgress {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	progress := p.progress
+	progress.Pending = len(p.queue)
+	progress.Paused = p.paused
+	return progress
+}
+
+func (p *Pruner) loop(quit, done chan struct{}) {
+	defer close(done)
+	for {
+		select {
+		case <-quit:
+			return
+		default:
+		}
+		p.lock.Lock()
+		paused := p.paused
+		pending := len(p.queue)
+		p.lock.Unlock()
+		if paused || (p.config.Compacting != nil && p.config.Compacting()) {
+			if !p.sleep(quit, p.config.PollInterval) {
+				return
+			}
+			continue
+		}
+		if pending == 0 {
+			select {
+			case <-quit:
+				return
+			case <-p.wake:
+			}
+			continue
+		}
+		if !p.pruneOne(quit) {
+			return
+		}
+	}
+}
+
+// pruneOne delete the first node in queue, return false if pruner is stopped
+func (p *Pruner) pruneOne(quit chan struct{}) bool {
+	p.lock.Lock()
+	task := p.queue[0]
+	p.lock.Unlock()
+	if task.size < 0 && p.config.BytesPerSecond > 0 {
+		encoded, _ := p.db.Get(nodeKey(task.hash))
+		task.size = len(encoded)
+	}
+	if !p.sleep(quit, p.nodeLimiter.reserve(1)) {
+		return false
+	}
+	if task.size > 0 && !p.sleep(quit, p.byteLimiter.reserve(task.size)) {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.paused {
+		// the task is kept, it's pruned after Resume
+		return true
+	}
+	if len(p.queue) == 0 || p.queue[0].hash != task.hash {
+		// the task is cancelled while waiting
+		return true
+	}
+	err := p.db.Delete(nodeKey(task.hash))
+	p.queue = p.queue[1:]
+	if err != nil {
+		p.progress.LastPruneErr = err
+		return true
+	}
+	p.progress.Pruned++
+	if task.size > 0 {
+		p.progress.PrunedBytes += task.size
+	}
+	return true
+}
+
+// writeBatch write batch while no node is deleted, and remove scheduled nodes of
+// inserted from queue, nodes are content addressed, so a node scheduled may be
+// inserted again by a later commit and must be kept. Nothing is removed if batch
+// can't be written
+func (p *Pruner) writeBatch(batch db.Batch, inserted map[common.Hash][]byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	queue := p.queue[:0]
+	for _, task := range p.queue {
+		if _, ok := inserted[task.hash]; !ok {
+			queue = append(queue, task)
+		}
+	}
+	p.queue = queue
+	return nil
+}
+
+// sleep wait for d or until Pause, return false if pruner is stopped while waiting
+func (p *Pruner) sleep(quit chan struct{}, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := p.config.Clock.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-quit:
+		return false
+	case <-p.interrupt:
+		return true
+	case <-timer.C():
+		return true
+	}
+}
+
+// PersistWithPruner write inserted nodes of the trie to underlying db, and
+// schedule deleted nodes to pruner rather than delete them directly. Inserted
+// nodes still scheduled by previous commits are removed from the pruner. Nothing
+// is scheduled or removed if the commit fails, and its error is returned
+func (t *Trie) PersistWithPruner(p *Pruner) (report *CommitReport, err error) {
+	t, done := t.measure(OpCommit)
+	defer func() { done(err) }()
+	changes := t.log.flatten()
+	batch := t.db.NewBatch()
+	existing, err := t.putNodes(batch, changes)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.writeBatch(batch, changes.inserted); err != nil {
+		return nil, err
+	}
+	// the pruner may delete nodes right after they are scheduled
+	report = t.commitReport(changes, existing)
+	report.Written()
+	for k := range changes.deleted {
+		size := -1
+		if persisted, ok := changes.persisted[k]; ok {
+			size = persisted.size
+		}
+		p.schedule(pruneTask{hash: k, size: size})
+	}
+	return report, nil
+}
+
+// rateLimiter is a token bucket refilled at rate tokens per second, the bucket
+// hold at most one second of tokens
+type rateLimiter struct {
+	lock   sync.Mutex
+	clock  Clock
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int, clock Clock) *rateLimiter {
+	return &rateLimiter{
+		clock:  clock,
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   clock.Now(),
+	}
+}
+
+// reserve take n tokens and return how long caller should wait before using them
+func (l *rateLimiter) reserve(n int) time.Duration {
+	if l.rate <= 0 {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.clock.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
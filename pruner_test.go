@@ -0,0 +1,214 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func waitPruned(p *Pruner, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if p.Progress().Pending == 0 {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+func TestPersistWithPruner(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 100)
+	for _, elem := range kvs[:50] {
+		trie = trie.Delete(elem.k)
+	}
+
+	pruner := NewPruner(memDB, PrunerConfig{})
+	pruner.Start()
+	defer pruner.Stop()
+	report, err := trie.PersistWithPruner(pruner)
+	assert.Nil(t, err)
+	assert.True(t, waitPruned(pruner, time.Second))
+	progress := pruner.Progress()
+	// nodes which never persisted are scheduled as well
+	assert.Equal(t, len(trie.log.flatten().deleted), progress.Pruned)
+	assert.Equal(t, report.BytesDeleted, progress.PrunedBytes)
+	for k := range trie.log.flatten().deleted {
+		has, _ := memDB.Has(k[:])
+		assert.False(t, has)
+	}
+	reloaded := NewTrie(trie.StateRoot(), memDB)
+	for _, elem := range kvs[50:] {
+		assert.Equal(t, elem.v, reloaded.Get(elem.k))
+	}
+}
+
+func TestPersistWithPrunerFailedWrite(t *testing.T) {
+	memDB := memorydb.New()
+	persisted, kvs := persistedTrie(memDB, 100)
+	trie := NewTrie(persisted.StateRoot(), &failingDB{memDB})
+	for _, elem := range kvs[:50] {
+		trie = trie.Delete(elem.k)
+	}
+
+	pruner := NewPruner(memDB, PrunerConfig{})
+	pruner.Start()
+	defer pruner.Stop()
+	report, err := trie.PersistWithPruner(pruner)
+	assert.Nil(t, report)
+	assert.Equal(t, errWriteFailed, err)
+	// nothing is scheduled, the old root stay intact
+	assert.Equal(t, 0, pruner.Progress().Pending)
+	reloaded := NewTrie(persisted.StateRoot(), memDB)
+	for _, elem := range kvs {
+		value, err := reloaded.TryGet(elem.k)
+		assert.Nil(t, err)
+		assert.Equal(t, elem.v, value)
+	}
+}
+
+func scheduleRandomNodes(memDB *memorydb.Database, p *Pruner, num int) {
+	for i := 0; i < num; i++ {
+		leaf := generateLeafNode(false)
+		hash := leaf.Hash()
+		memDB.Put(hash[:], leaf.Encode())
+		p.Schedule(hash)
+	}
+}
+
+func TestPrunerRateLimit(t *testing.T) {
+	memDB := memorydb.New()
+	clock := newFakeClock()
+	pruner := NewPruner(memDB, PrunerConfig{NodesPerSecond: 20, Clock: clock})
+	scheduleRandomNodes(memDB, pruner, 60)
+	pruner.Start()
+	defer pruner.Stop()
+	// the initial burst is pruned without waiting
+	assert.Equal(t, 50*time.Millisecond, <-clock.waits)
+	assert.Equal(t, 20, pruner.Progress().Pruned)
+	for i := 1; i <= 5; i++ {
+		clock.Advance(50 * time.Millisecond)
+		assert.Equal(t, 50*time.Millisecond, <-clock.waits)
+		assert.Equal(t, 20+i, pruner.Progress().Pruned)
+	}
+}
+
+func TestPrunerPauseResume(t *testing.T) {
+	memDB := memorydb.New()
+	clock := newFakeClock()
+	pruner := NewPruner(memDB, PrunerConfig{PollInterval: time.Millisecond, Clock: clock})
+	pruner.Pause()
+	scheduleRandomNodes(memDB, pruner, 10)
+	pruner.Start()
+	defer pruner.Stop()
+	// the pruner poll while paused
+	assert.Equal(t, time.Millisecond, <-clock.waits)
+	progress := pruner.Progress()
+	assert.True(t, progress.Paused)
+	assert.Equal(t, 0, progress.Pruned)
+	assert.Equal(t, 10, progress.Pending)
+
+	pruner.Resume()
+	clock.Advance(time.Millisecond)
+	assert.True(t, waitPruned(pruner, time.Second))
+	assert.Equal(t, 10, pruner.Progress().Pruned)
+	assert.Equal(t, 0, memDB.Len())
+}
+
+func TestPrunerPauseRateLimited(t *testing.T) {
+	memDB := memorydb.New()
+	clock := newFakeClock()
+	pruner := NewPruner(memDB, PrunerConfig{NodesPerSecond: 1, PollInterval: time.Millisecond, Clock: clock})
+	scheduleRandomNodes(memDB, pruner, 3)
+	pruner.Start()
+	defer pruner.Stop()
+	assert.Equal(t, time.Second, <-clock.waits)
+	assert.Equal(t, 1, pruner.Progress().Pruned)
+
+	// Pause stop the wait for the rate limit, and nothing is pruned after the limit
+	pruner.Pause()
+	assert.Equal(t, time.Millisecond, <-clock.waits)
+	clock.Advance(2 * time.Second)
+	assert.Equal(t, time.Millisecond, <-clock.waits)
+	assert.Equal(t, 1, pruner.Progress().Pruned)
+	assert.Equal(t, 2, memDB.Len())
+
+	// the interrupted wait is refilled by the time passed
+	pruner.Resume()
+	clock.Advance(time.Millisecond)
+	assert.Equal(t, time.Second, <-clock.waits)
+	assert.Equal(t, 2, pruner.Progress().Pruned)
+	clock.Advance(time.Second)
+	assert.True(t, waitPruned(pruner, time.Second))
+	assert.Equal(t, 3, pruner.Progress().Pruned)
+}
+
+func TestPrunerPauseOnCompaction(t *testing.T) {
+	memDB := memorydb.New()
+	clock := newFakeClock()
+	var compacting int32 = 1
+	pruner := NewPruner(memDB, PrunerConfig{
+		PollInterval: time.Millisecond,
+		Compacting: func() bool {
+			return atomic.LoadInt32(&compacting) == 1
+		},
+		Clock: clock,
+	})
+	scheduleRandomNodes(memDB, pruner, 10)
+	pruner.Start()
+	defer pruner.Stop()
+	assert.Equal(t, time.Millisecond, <-clock.waits)
+	assert.Equal(t, 0, pruner.Progress().Pruned)
+
+	atomic.StoreInt32(&compacting, 0)
+	clock.Advance(time.Millisecond)
+	assert.True(t, waitPruned(pruner, time.Second))
+	assert.Equal(t, 10, pruner.Progress().Pruned)
+}
+
+func TestPrunerStopKeepPending(t *testing.T) {
+	memDB := memorydb.New()
+	clock := newFakeClock()
+	pruner := NewPruner(memDB, PrunerConfig{NodesPerSecond: 1, Clock: clock})
+	scheduleRandomNodes(memDB, pruner, 5)
+	pruner.Start()
+	// stop while waiting for the rate limit
+	assert.Equal(t, time.Second, <-clock.waits)
+	pruner.Stop()
+	// only the initial burst is pruned
+	progress := pruner.Progress()
+	assert.Equal(t, 1, progress.Pruned)
+	assert.Equal(t, 4, progress.Pending)
+	assert.Equal(t, 4, memDB.Len())
+}
+
+func TestPrunerKeepReinsertedNodes(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 100)
+	root := trie.StateRoot()
+	pruner := NewPruner(memDB, PrunerConfig{})
+	trie = trie.Delete(kvs[0].k)
+	trie.PersistWithPruner(pruner)
+	assert.True(t, pruner.Progress().Pending > 0)
+	// insert the deleted key back, all nodes scheduled are recreated
+	trie = NewTrie(trie.StateRoot(), memDB).Insert(kvs[0].k, kvs[0].v)
+	assert.Equal(t, root, trie.StateRoot())
+	trie.PersistWithPruner(pruner)
+
+	pruner.Start()
+	defer pruner.Stop()
+	assert.True(t, waitPruned(pruner, time.Second))
+	assert.Nil(t, checkSubtree(memDB, root, make(map[common.Hash]struct{})))
+	reloaded := NewTrie(root, memDB)
+	for _, elem := range kvs {
+		assert.Equal(t, elem.v, reloaded.Get(elem.k))
+	}
+}
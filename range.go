@@ -0,0 +1,97 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// RangeResponse is a chunk of consecutive key values of a trie together with the
+// proofs of its boundaries, which is enough for a client to verify the chunk is
+// complete and consistent with the root:
+// - Keys, Values: key values in [start, limit) in key order
+// - Proof: nodes of the proof of start and the proof of the last key, nodes shared
+// by both proofs are included once. If no key is returned, the proof of limit is
+// used instead of the last key
+// - More: true if there are key values in [start, limit) not returned because of
+// the byte budget
+type RangeResponse struct {
+	Keys   [][]byte
+	Values [][]byte
+	Proof  [][]byte
+	More   bool
+}
+
+// IterateRange collect key values in [start, limit) in key order until the total
+// size of keys and values reach maxBytes, and the boundary proofs of them in one
+// call. At least one key value is returned if there is any in the range, nil limit
+// means no upper bound, and maxBytes less than or equal to 0 means no budget
+func (t *Trie) IterateRange(start, limit []byte, maxBytes int) (*RangeResponse, error) {
+	resp := &RangeResponse{
+		Keys:   make([][]byte, 0),
+		Values: make([][]byte, 0),
+	}
+	size := 0
+	err := t.IterateFrom(start, func(key, value []byte) bool {
+		if limit != nil && bytes.Compare(key, limit) >= 0 {
+			return false
+		}
+		if maxBytes > 0 && size >= maxBytes {
+			resp.More = true
+			return false
+		}
+		resp.Keys = append(resp.Keys, key)
+		resp.Values = append(resp.Values, common.CopyBytes(value))
+		size += len(key) + len(value)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	last := limit
+	if len(resp.Keys) > 0 {
+		last = resp.Keys[len(resp.Keys)-1]
+	}
+	bounds := [][]byte{start}
+	if last != nil {
+		bounds = append(bounds, last)
+	}
+	proof, err := t.boundaryProof(bounds...)
+	if err != nil {
+		return nil, err
+	}
+	resp.Proof = proof
+	return resp, nil
+}
+
+// ProveRange return all key values in [start, limit) with the proofs of its bounds,
+// it's IterateRange without a byte budget, and it's verified by VerifyRangeProof.
+// The range of an inclusive end is limited by append(end, 0), the first key after
+// end
+func (t *Trie) ProveRange(start, limit []byte) (*RangeResponse, error) {
+	return t.IterateRange(start, limit, 0)
+}
+
+// boundaryProof return the proofs of bounds, nodes shared by them are included once
+func (t *Trie) boundaryProof(bounds ...[]byte) ([][]byte, error) {
+	proof := make([][]byte, 0)
+	seen := make(map[string]struct{})
+	for _, bound := range bounds {
+		nodes, err := t.Prove(bound)
+		if err != nil {
+			return nil, err
+		}
+		for _, encoded := range nodes {
+			if _, ok := seen[string(encoded)]; ok {
+				continue
+			}
+			seen[string(encoded)] = struct{}{}
+			proof = append(proof, encoded)
+		}
+	}
+	return proof, nil
+}
@@ -0,0 +1,68 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIterateRange(t *testing.T) {
+	trie, kvs := persistedTrie(memorydb.New(), 200)
+	expected := sortedKVs(kvMap(kvs))
+	root := trie.StateRoot()
+
+	check := func(start, limit []byte, maxBytes int) *RangeResponse {
+		resp, err := trie.IterateRange(start, limit, maxBytes)
+		assert.Nil(t, err)
+		first := 0
+		for first < len(expected) && bytes.Compare(expected[first].k, start) < 0 {
+			first++
+		}
+		size := 0
+		for i, key := range resp.Keys {
+			assert.Equal(t, expected[first+i].k, key)
+			assert.Equal(t, expected[first+i].v, resp.Values[i])
+			if i < len(resp.Keys)-1 {
+				size += len(key) + len(resp.Values[i])
+			}
+		}
+		if maxBytes > 0 {
+			assert.True(t, size < maxBytes)
+		}
+		next := first + len(resp.Keys)
+		inRange := next < len(expected) && (limit == nil || bytes.Compare(expected[next].k, limit) < 0)
+		assert.Equal(t, inRange, resp.More)
+
+		// boundary proofs
+		items := []ProofItem{{Key: start, Value: trie.Get(start), Proof: resp.Proof}}
+		if len(resp.Keys) > 0 {
+			last := len(resp.Keys) - 1
+			items = append(items, ProofItem{Key: resp.Keys[last], Value: resp.Values[last], Proof: resp.Proof})
+		} else if limit != nil {
+			items = append(items, ProofItem{Key: limit, Value: trie.Get(limit), Proof: resp.Proof})
+		}
+		assert.Nil(t, VerifyProofBatch(root, items))
+		return resp
+	}
+
+	resp := check(nil, nil, 0)
+	assert.Equal(t, len(expected), len(resp.Keys))
+	resp = check(expected[10].k, expected[50].k, 0)
+	assert.Equal(t, 40, len(resp.Keys))
+	resp = check(expected[10].k, nil, 200)
+	assert.True(t, resp.More)
+	// budget smaller than one entry
+	resp = check(expected[10].k, nil, 1)
+	assert.Equal(t, 1, len(resp.Keys))
+	// empty range
+	resp = check(expected[10].k, expected[10].k, 0)
+	assert.Equal(t, 0, len(resp.Keys))
+	for i := 0; i < 10; i++ {
+		check(randomBytes(), nil, 300)
+	}
+}
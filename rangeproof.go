@@ -0,0 +1,308 @@
+package mpt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// VerifyRangeProof verify that keys and values are all the key values of the trie of
+// root from start, and report whether the trie have keys after them. It verifies
+// the RangeResponse of IterateRange and ProveRange, limit is the limit of the
+// request, which bound the range if no key is returned, nil means no limit.
+//
+// The proof is the proofs of start and the last key, or of start and limit if no
+// key is returned. Subtrees between the two paths are rebuilt from the key values,
+// and the root is rehashed with the subtrees outside the range taken from the
+// proof, so the range is proved complete: a missing, extra or modified key value
+// change the root.
+//
+// opts bound proof nodes like VerifyProofBatch, and values larger than the bound
+// of WithMaxValueSize are rejected with ErrValueTooLarge before any node is built
+func VerifyRangeProof(root common.Hash, start, limit []byte, keys, values, proof [][]byte, opts ...Option) (bool, error) {
+	return VerifyRangeProofParallel(root, start, limit, keys, values, proof, 1, opts...)
+}
+
+// VerifyRangeProofParallel is VerifyRangeProof which hash and decode proof nodes,
+// and hash the subtrees rebuilt from key values, on workers goroutines. Rebuilt
+// subtrees don't share nodes, so hashing them scale with the number of cores for
+// large ranges such as snap sync responses, e.g. workers is runtime.NumCPU()
+func VerifyRangeProofParallel(root common.Hash, start, limit []byte, keys, values, proof [][]byte, workers int, opts ...Option) (bool, error) {
+	if len(keys) != len(values) {
+		return false, fmt.Errorf("%d values for %d keys", len(values), len(keys))
+	}
+	c := newConfig(opts)
+	for _, value := range values {
+		if c.maxValueSize > 0 && len(value) > c.maxValueSize {
+			return false, ErrValueTooLarge
+		}
+	}
+	for i, key := range keys {
+		if i == 0 && bytes.Compare(key, start) < 0 {
+			return false, errors.New("key before start of range")
+		}
+		if i > 0 && bytes.Compare(keys[i-1], key) >= 0 {
+			return false, errors.New("keys out of order")
+		}
+		if limit != nil && bytes.Compare(key, limit) >= 0 {
+			return false, errors.New("key after limit of range")
+		}
+	}
+	items := []ProofItem{{Key: start, Proof: proof}}
+	v := &rangeVerifier{lower: bytesToNibbles(start), keys: make([][]byte, len(keys)), values: values, tagged: c.taggedRefs}
+	for i, key := range keys {
+		v.keys[i] = bytesToNibbles(key)
+	}
+	switch {
+	case len(keys) > 0:
+		v.upper, v.inclusive = v.keys[len(keys)-1], true
+		items = append(items, ProofItem{Key: keys[len(keys)-1]})
+	case limit != nil:
+		v.upper = bytesToNibbles(limit)
+		items = append(items, ProofItem{Key: limit})
+	default:
+		v.unbounded = true
+	}
+	if err := checkProofBounds(items); err != nil {
+		return false, err
+	}
+	nodes, err := newProofNodes(c, workers, proof)
+	if err != nil {
+		return false, err
+	}
+	// the proof is the paths of the bounds, every node must be on one of them
+	paths := make([][]common.Hash, len(items))
+	for i, item := range items {
+		_, _, err := nodes.get(root, item.Key, func(hash common.Hash) {
+			paths[i] = append(paths[i], hash)
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+	if err := checkWasted(items, nodes, paths); err != nil {
+		return false, err
+	}
+	v.nodes = nodes
+
+	var rebuilt node
+	if !isEmptyRoot(root) {
+		if rebuilt, err = v.verify(&hashNode{root[:]}, nil); err != nil {
+			return false, err
+		}
+	}
+	if v.next != len(v.keys) {
+		return false, fmt.Errorf("key %x is not in the trie", keys[v.next])
+	}
+	// hashes are cached by the nodes, so the root is hashed from the subtrees
+	_ = runParallel(workers, len(v.built), func(i int) error {
+		v.built[i].Capped()
+		return nil
+	})
+	hash := EmptyHash
+	if rebuilt != nil {
+		hash = keccak256Hash(rebuilt.Encode())
+		if h, ok := rebuilt.(*hashNode); ok {
+			hash = h.Hash()
+		}
+	}
+	if !isEmptyRoot(root) || !isEmptyRoot(hash) {
+		if hash != root {
+			return false, errors.New("range doesn't match the root")
+		}
+	}
+	return v.more, nil
+}
+
+// rangeVerifier rebuild the trie of a range from proof nodes and key values, paths
+// and keys are nibbles
+type rangeVerifier struct {
+	nodes proofNodes
+	lower []byte
+	upper []byte
+	// inclusive is true if upper is the last key rather than the limit
+	inclusive bool
+	unbounded bool
+	keys      [][]byte
+	values    [][]byte
+	// next is the first key not rebuilt yet, keys are rebuilt in order
+	next int
+	more bool
+	// built is the subtrees rebuilt from key values
+	built []node
+	// tagged is true if the child references of rebuilt nodes are tagged
+	tagged bool
+}
+
+// comparePath compare the keys under path with bound, the result is 0 if bound is
+// under path or path is under bound
+func comparePath(path, bound []byte) int {
+	n := len(path)
+	if len(bound) < n {
+		n = len(bound)
+	}
+	return bytes.Compare(path[:n], bound[:n])
+}
+
+// before report whether all keys under path are before lower
+func (v *rangeVerifier) before(path []byte) bool {
+	return comparePath(path, v.lower) < 0
+}
+
+// after report whether all keys under path are after the range
+func (v *rangeVerifier) after(path []byte) bool {
+	if v.unbounded {
+		return false
+	}
+	c := comparePath(path, v.upper)
+	if v.inclusive {
+		return c > 0 || (c == 0 && len(path) > len(v.upper))
+	}
+	return c > 0 || (c == 0 && len(path) >= len(v.upper))
+}
+
+// inside report whether all keys under path are in the range
+func (v *rangeVerifier) inside(path []byte) bool {
+	c := comparePath(path, v.lower)
+	if c < 0 || (c == 0 && len(path) < len(v.lower)) {
+		return false
+	}
+	return v.unbounded || comparePath(path, v.upper) < 0
+}
+
+// inRange report whether the key of path is in the range
+func (v *rangeVerifier) inRange(path []byte) bool {
+	if bytes.Compare(path, v.lower) < 0 {
+		return false
+	}
+	if v.unbounded {
+		return true
+	}
+	c := bytes.Compare(path, v.upper)
+	return c < 0 || (c == 0 && v.inclusive)
+}
+
+// verify return the node at path with the subtrees in the range rebuilt from key
+// values, n is the node in the trie of root
+func (v *rangeVerifier) verify(n node, path []byte) (node, error) {
+	if v.before(path) {
+		return n, nil
+	}
+	if v.after(path) {
+		v.more = v.more || n != nil
+		return n, nil
+	}
+	if v.inside(path) {
+		return v.build(path), nil
+	}
+	switch n := n.(type) {
+	case *hashNode:
+		resolved, ok := v.nodes[n.Hash()]
+		if !ok {
+			return nil, fmt.Errorf("proof node %s is missing", n.Hash().Hex())
+		}
+		return v.verify(resolved, path)
+	case *leafNode:
+		key := append(common.CopyBytes(path), n.key...)
+		if v.inRange(key) {
+			return v.build(path), nil
+		}
+		if bytes.Compare(key, v.lower) >= 0 {
+			v.more = true
+		}
+		return n, nil
+	case *extNode:
+		child, err := v.verify(n.child, append(common.CopyBytes(path), n.key...))
+		if err != nil || child == nil {
+			return nil, err
+		}
+		return newExtNode(n.key, child, n.tagged), nil
+	case *branchNode:
+		rebuilt := &branchNode{target: n.target, tagged: n.tagged}
+		if v.inRange(path) {
+			rebuilt.target = v.take(path)
+		} else if n.hasTarget() && bytes.Compare(path, v.lower) >= 0 {
+			v.more = true
+		}
+		for i, child := range n.children {
+			var err error
+			if rebuilt.children[i], err = v.verify(child, append(common.CopyBytes(path), byte(i))); err != nil {
+				return nil, err
+			}
+		}
+		return rebuilt, nil
+	}
+	return nil, nil
+}
+
+// take return the value of the key of path if it's the next key, nil otherwise
+func (v *rangeVerifier) take(path []byte) []byte {
+	if v.next < len(v.keys) && bytes.Equal(v.keys[v.next], path) {
+		v.next++
+		return v.values[v.next-1]
+	}
+	return nil
+}
+
+// build build the subtree at path from the next keys under path
+func (v *rangeVerifier) build(path []byte) node {
+	first := v.next
+	for v.next < len(v.keys) && bytes.HasPrefix(v.keys[v.next], path) {
+		v.next++
+	}
+	suffixes := make([][]byte, 0, v.next-first)
+	for _, key := range v.keys[first:v.next] {
+		suffixes = append(suffixes, key[len(path):])
+	}
+	n := buildNodes(suffixes, v.values[first:v.next], v.tagged)
+	if n != nil {
+		v.built = append(v.built, n)
+	}
+	return n
+}
+
+// buildNodes build the canonical subtree of sorted distinct keys, which are nibbles
+// relative to the subtree, the child references of built nodes are tagged if tagged
+// is true
+func buildNodes(keys, values [][]byte, tagged bool) node {
+	switch len(keys) {
+	case 0:
+		return nil
+	case 1:
+		return newLeafNode(keys[0], values[0])
+	}
+	// the first key is the shortest if one key is a prefix of the others
+	shared := len(keys[0])
+	for _, key := range keys[1:] {
+		if n := matchingLength(keys[0], key); n < shared {
+			shared = n
+		}
+	}
+	if shared > 0 {
+		suffixes := make([][]byte, len(keys))
+		for i, key := range keys {
+			suffixes[i] = key[shared:]
+		}
+		return newExtNode(keys[0][:shared], buildNodes(suffixes, values, tagged), tagged)
+	}
+	branch := &branchNode{tagged: tagged}
+	if len(keys[0]) == 0 {
+		branch.target = values[0]
+		keys, values = keys[1:], values[1:]
+	}
+	for i := 0; i < len(keys); {
+		j := i
+		for j < len(keys) && keys[j][0] == keys[i][0] {
+			j++
+		}
+		suffixes := make([][]byte, 0, j-i)
+		for _, key := range keys[i:j] {
+			suffixes = append(suffixes, key[1:])
+		}
+		branch.children[keys[i][0]] = buildNodes(suffixes, values[i:j], tagged)
+		i = j
+	}
+	return branch
+}
@@ -0,0 +1,163 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+// rangeTrie return a trie of random keys and keys which are prefixes of others
+func rangeTrie() (*Trie, []kv) {
+	trie, kvs := persistedTrie(memorydb.New(), 300)
+	model := kvMap(kvs)
+	for _, elem := range kvs[:20] {
+		prefix := elem.k[:len(elem.k)/2]
+		model[string(prefix)] = []byte{}
+		trie = trie.Insert(prefix, []byte{})
+	}
+	return trie, sortedKVs(model)
+}
+
+func TestVerifyRangeProof(t *testing.T) {
+	trie, kvs := rangeTrie()
+	root := trie.StateRoot()
+	check := func(start, limit []byte, maxBytes int) *RangeResponse {
+		resp, err := trie.IterateRange(start, limit, maxBytes)
+		assert.Nil(t, err)
+		more, err := VerifyRangeProof(root, start, limit, resp.Keys, resp.Values, resp.Proof)
+		assert.Nil(t, err)
+		// keys after the last key, or at or after limit if no key is returned
+		expected := false
+		for _, elem := range kvs {
+			if len(resp.Keys) > 0 && bytes.Compare(elem.k, resp.Keys[len(resp.Keys)-1]) > 0 ||
+				len(resp.Keys) == 0 && limit != nil && bytes.Compare(elem.k, limit) >= 0 {
+				expected = true
+			}
+		}
+		assert.Equal(t, expected, more)
+		return resp
+	}
+	check(nil, nil, 0)
+	check(nil, kvs[0].k, 0)
+	check(kvs[len(kvs)-1].k, nil, 0)
+	check(append(kvs[len(kvs)-1].k, 0), nil, 0)
+	// an empty range whose limit is a key
+	check(kvs[5].k, kvs[5].k, 0)
+	check(kvs[0].k[:len(kvs[0].k)/2], kvs[0].k[:len(kvs[0].k)/2], 0)
+	for i := 0; i < 200; i++ {
+		a, b := random.Intn(len(kvs)), random.Intn(len(kvs))
+		if a > b {
+			a, b = b, a
+		}
+		start, limit := kvs[a].k, kvs[b].k
+		switch random.Intn(3) {
+		case 0:
+			start, limit = randomKey(), nil
+		case 1:
+			limit = append(kvs[b].k, 0)
+		}
+		check(start, limit, random.Intn(2000))
+	}
+
+	// ProveRange prove a whole range
+	resp, err := trie.ProveRange(kvs[10].k, append(kvs[20].k, 0))
+	assert.Nil(t, err)
+	assert.Equal(t, 11, len(resp.Keys))
+	more, err := VerifyRangeProof(root, kvs[10].k, append(kvs[20].k, 0), resp.Keys, resp.Values, resp.Proof)
+	assert.Nil(t, err)
+	assert.True(t, more)
+
+	// empty trie
+	more, err = VerifyRangeProof(EmptyHash, nil, nil, nil, nil, nil)
+	assert.Nil(t, err)
+	assert.False(t, more)
+}
+
+func TestVerifyRangeProofParallel(t *testing.T) {
+	trie, kvs := rangeTrie()
+	root := trie.StateRoot()
+	resp, err := trie.ProveRange(kvs[10].k, append(kvs[200].k, 0))
+	assert.Nil(t, err)
+	for _, workers := range []int{0, 1, 4, 64} {
+		more, err := VerifyRangeProofParallel(root, kvs[10].k, append(kvs[200].k, 0), resp.Keys, resp.Values, resp.Proof, workers)
+		assert.Nil(t, err)
+		assert.True(t, more)
+
+		values := append([][]byte{}, resp.Values...)
+		values[100] = []byte("modified")
+		_, err = VerifyRangeProofParallel(root, kvs[10].k, append(kvs[200].k, 0), resp.Keys, values, resp.Proof, workers)
+		assert.NotNil(t, err)
+		_, err = VerifyRangeProofParallel(root, kvs[10].k, append(kvs[200].k, 0), resp.Keys, resp.Values, resp.Proof[1:], workers)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestVerifyRangeProofTampered(t *testing.T) {
+	trie, kvs := rangeTrie()
+	root := trie.StateRoot()
+	resp, err := trie.ProveRange(kvs[10].k, kvs[60].k)
+	assert.Nil(t, err)
+	verify := func(keys, values, proof [][]byte) error {
+		_, err := VerifyRangeProof(root, kvs[10].k, kvs[60].k, keys, values, proof)
+		return err
+	}
+	assert.Nil(t, verify(resp.Keys, resp.Values, resp.Proof))
+
+	remove := func(s [][]byte, i int) [][]byte {
+		return append(append([][]byte{}, s[:i]...), s[i+1:]...)
+	}
+	// a key is missing
+	for _, i := range []int{0, 25} {
+		assert.NotNil(t, verify(remove(resp.Keys, i), remove(resp.Values, i), resp.Proof))
+	}
+	// without the last key it's a shorter range, which is proved if no proof node
+	// is wasted, but keys after it are reported
+	last := len(resp.Keys) - 1
+	more, err := VerifyRangeProof(root, kvs[10].k, kvs[60].k, resp.Keys[:last], resp.Values[:last], resp.Proof)
+	assert.True(t, err != nil || more)
+	// a value is modified
+	values := append([][]byte{}, resp.Values...)
+	values[25] = []byte("modified")
+	assert.NotNil(t, verify(resp.Keys, values, resp.Proof))
+	// an extra key
+	keys := append([][]byte{}, resp.Keys...)
+	keys[25] = append(keys[25], 0x01)
+	assert.NotNil(t, verify(keys, resp.Values, resp.Proof))
+	// keys out of order
+	keys = append([][]byte{}, resp.Keys...)
+	keys[25], keys[26] = keys[26], keys[25]
+	assert.NotNil(t, verify(keys, resp.Values, resp.Proof))
+	// proof nodes are missing or wasted
+	assert.NotNil(t, verify(resp.Keys, resp.Values, resp.Proof[1:]))
+	other, _ := trie.Prove(kvs[200].k)
+	assert.NotNil(t, verify(resp.Keys, resp.Values, append(append([][]byte{}, resp.Proof...), other[len(other)-1])))
+	// keys outside the range
+	_, err = VerifyRangeProof(root, kvs[11].k, kvs[60].k, resp.Keys, resp.Values, resp.Proof)
+	assert.NotNil(t, err)
+	_, err = VerifyRangeProof(root, kvs[10].k, kvs[59].k, resp.Keys, resp.Values, resp.Proof)
+	assert.NotNil(t, err)
+}
+
+func TestVerifyRangeProofMaxValueSize(t *testing.T) {
+	trie, kvs := rangeTrie()
+	trie = trie.Insert(kvs[20].k, make([]byte, 100))
+	root := trie.StateRoot()
+	// the large value is in the range
+	resp, err := trie.ProveRange(kvs[10].k, kvs[60].k)
+	assert.Nil(t, err)
+	_, err = VerifyRangeProof(root, kvs[10].k, kvs[60].k, resp.Keys, resp.Values, resp.Proof, WithMaxValueSize(100))
+	assert.Nil(t, err)
+	_, err = VerifyRangeProof(root, kvs[10].k, kvs[60].k, resp.Keys, resp.Values, resp.Proof, WithMaxValueSize(99))
+	assert.Equal(t, ErrValueTooLarge, err)
+
+	// the large value is at the start of the range, so it's in a proof node
+	resp, err = trie.ProveRange(kvs[20].k, kvs[60].k)
+	assert.Nil(t, err)
+	_, err = VerifyRangeProof(root, kvs[20].k, kvs[60].k, resp.Keys[1:], resp.Values[1:], resp.Proof, WithMaxValueSize(99))
+	assert.Equal(t, ErrValueTooLarge, err)
+}
@@ -0,0 +1,106 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+	"github.com/lbqds/mpt/internal/varint"
+)
+
+// ReachableHashes call fn with the hash and encoded size of every node stored by
+// hash and reachable from root, each node is visited once even if it's shared by
+// several subtrees. Child references are read from the encoded nodes directly
+// without decoding them, so it's cheap enough for backup tools and the mark phase
+// of garbage collection. It stops when fn return false, and return MissingNodeError
+// if a reachable node is absent from reader
+func ReachableHashes(root common.Hash, reader db.KeyValueReader, fn func(hash common.Hash, size int) bool) error {
+	if isEmptyRoot(root) {
+		return nil
+	}
+	seen := map[common.Hash]struct{}{root: {}}
+	stack := []common.Hash{root}
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		encoded, err := reader.Get(nodeKey(hash))
+		if err != nil || len(encoded) == 0 {
+			return &MissingNodeError{Hash: hash, Err: err}
+		}
+		if !fn(hash, len(encoded)) {
+			return nil
+		}
+		err = childRefs(encoded, func(child common.Hash) {
+			if _, ok := seen[child]; !ok {
+				seen[child] = struct{}{}
+				stack = append(stack, child)
+			}
+		})
+		if err != nil {
+			return &MissingNodeError{Hash: hash, Err: err}
+		}
+	}
+	return nil
+}
+
+// childRefs call fn with the hashes referenced by the encoded node, including the
+// references of its embedded children
+func childRefs(encoded []byte, fn func(hash common.Hash)) error {
+	if len(encoded) == 0 {
+		return io.ErrUnexpectedEOF
+	}
+	flag := encoded[len(encoded)-1]
+	var field int
+	switch flag & typeMask {
+	case leafType:
+		return nil
+	case extType:
+		field = extNodeField
+	case branchType:
+		field = branchChildField
+	default:
+		return fmt.Errorf("unknown node type: %v", flag)
+	}
+	tagged := flag&taggedFlag != 0
+	return forEachBytesField(encoded[:len(encoded)-1], func(f int, value []byte) error {
+		if f != field || len(value) == 0 {
+			return nil
+		}
+		if tagged {
+			// the tag is checked when the node is decoded, see decodeChildRef
+			if value[0] == hashRefTag {
+				fn(common.BytesToHash(value[1:]))
+				return nil
+			}
+			return childRefs(value[1:], fn)
+		}
+		if len(value) == common.HashLength {
+			fn(common.BytesToHash(value))
+			return nil
+		}
+		return childRefs(value, fn)
+	})
+}
+
+// forEachBytesField call fn with every field of the encoded message, all fields of
+// node messages are length-delimited
+func forEachBytesField(encoded []byte, fn func(field int, value []byte) error) error {
+	for len(encoded) > 0 {
+		tag, rest, ok := varint.Decode(encoded)
+		if !ok || tag&0x07 != wireBytes {
+			return io.ErrUnexpectedEOF
+		}
+		var value []byte
+		if value, encoded, ok = varint.DecodeBytes(rest); !ok {
+			return io.ErrUnexpectedEOF
+		}
+		if err := fn(int(tag>>3), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReachableHashes(t *testing.T) {
+	memDB := memorydb.New()
+	assert.Nil(t, ReachableHashes(EmptyHash, memDB, func(common.Hash, int) bool {
+		t.Fatal("empty trie has no node")
+		return false
+	}))
+
+	trie, _ := persistedTrie(memDB, 500)
+	visit := func(root common.Hash) map[common.Hash]int {
+		visited := make(map[common.Hash]int)
+		assert.Nil(t, ReachableHashes(root, memDB, func(hash common.Hash, size int) bool {
+			_, ok := visited[hash]
+			assert.False(t, ok)
+			visited[hash] = size
+			return true
+		}))
+		return visited
+	}
+	visited := visit(trie.StateRoot())
+	checked := make(map[common.Hash]struct{})
+	assert.Nil(t, checkSubtree(memDB, trie.StateRoot(), checked))
+	assert.Equal(t, len(checked), len(visited))
+	for hash, size := range visited {
+		_, ok := checked[hash]
+		assert.True(t, ok)
+		encoded, _ := memDB.Get(nodeKey(hash))
+		assert.Equal(t, len(encoded), size)
+	}
+
+	// the root of a tiny trie is stored even if it's less than 32 bytes
+	small := NewTrie(EmptyHash, memDB).Insert([]byte{1}, []byte{1})
+	small.Persist()
+	assert.Equal(t, 1, len(visit(small.StateRoot())))
+
+	// references of tagged nodes are read as well
+	tagged := memorydb.New()
+	root, err := Rewrite(trie.StateRoot(), memDB, tagged, WithTaggedChildRefs())
+	assert.Nil(t, err)
+	count := 0
+	assert.Nil(t, ReachableHashes(root, tagged, func(common.Hash, int) bool {
+		count++
+		return true
+	}))
+	assert.Equal(t, len(visited), count)
+	assert.Equal(t, tagged.Len(), count)
+
+	// stop early
+	count = 0
+	assert.Nil(t, ReachableHashes(trie.StateRoot(), memDB, func(common.Hash, int) bool {
+		count++
+		return count < 10
+	}))
+	assert.Equal(t, 10, count)
+
+	for hash := range visited {
+		if hash != trie.StateRoot() {
+			assert.Nil(t, memDB.Delete(nodeKey(hash)))
+			break
+		}
+	}
+	err = ReachableHashes(trie.StateRoot(), memDB, func(common.Hash, int) bool { return true })
+	assert.NotNil(t, err)
+	_, ok := err.(*MissingNodeError)
+	assert.True(t, ok)
+}
@@ -0,0 +1,133 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// every Insert/Delete is recorded as a line, `insert <parent root> <key> <value> <new root>`
+// or `delete <parent root> <key> <new root>`, all fields are hex encoded with 0x prefix,
+// the parent root make it possible to replay operations on different tries derived from
+// the same trie
+const (
+	insertOp = "insert"
+	deleteOp = "delete"
+)
+
+type opRecorder struct {
+	lock sync.Mutex
+	w    io.Writer
+	err  error
+}
+
+// WithOpRecorder record every Insert/Delete to w in a replayable format, the
+// recorded operations can be applied again by ReplayOps
+func WithOpRecorder(w io.Writer) Option {
+	return func(c *config) {
+		c.recorder = &opRecorder{w: w}
+	}
+}
+
+func (r *opRecorder) write(fields ...string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	// stop recording after the first error, the remaining operations can't be replayed
+	if r.err != nil {
+		return
+	}
+	_, r.err = io.WriteString(r.w, strings.Join(fields, " ")+"\n")
+}
+
+func (r *opRecorder) recordInsert(parent common.Hash, key, value []byte, root common.Hash) {
+	r.write(insertOp, parent.Hex(), hexutil.Encode(key), hexutil.Encode(value), root.Hex())
+}
+
+func (r *opRecorder) recordDelete(parent common.Hash, key []byte, root common.Hash) {
+	r.write(deleteOp, parent.Hex(), hexutil.Encode(key), root.Hex())
+}
+
+// ReplayMismatchError is returned when the root of a replayed operation is
+// different from the recorded one
+type ReplayMismatchError struct {
+	Line     int
+	Expected common.Hash
+	Actual   common.Hash
+}
+
+func (e *ReplayMismatchError) Error() string {
+	return fmt.Sprintf("line %d: replayed root %s mismatch with recorded root %s",
+		e.Line, e.Actual.Hex(), e.Expected.Hex())
+}
+
+// ReplayOps apply operations recorded by WithOpRecorder to trie, operations are
+// applied to the trie whose root is the recorded parent root, and the trie of
+// the last applied operation is returned. If the root of an operation mismatch
+// with the recorded one, a ReplayMismatchError is returned together with the
+// trie produced by that operation
+func ReplayOps(r io.Reader, trie *Trie) (*Trie, error) {
+	tries := map[common.Hash]*Trie{trie.StateRoot(): trie}
+	scanner := bufio.NewScanner(r)
+	// values can be large, so allow long lines
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<30)
+	last := trie
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		parent, key, value, root, err := parseOp(fields)
+		if err != nil {
+			return last, fmt.Errorf("line %d: %v", line, err)
+		}
+		base, ok := tries[parent]
+		if !ok {
+			return last, fmt.Errorf("line %d: unknown parent root %s", line, parent.Hex())
+		}
+		if fields[0] == insertOp {
+			last = base.Insert(key, value)
+		} else {
+			last = base.Delete(key)
+		}
+		tries[last.StateRoot()] = last
+		if last.StateRoot() != root {
+			return last, &ReplayMismatchError{Line: line, Expected: root, Actual: last.StateRoot()}
+		}
+	}
+	return last, scanner.Err()
+}
+
+func parseOp(fields []string) (parent common.Hash, key, value []byte, root common.Hash, err error) {
+	var values []string
+	switch {
+	case fields[0] == insertOp && len(fields) == 5:
+		values = fields[1:]
+	case fields[0] == deleteOp && len(fields) == 4:
+		values = []string{fields[1], fields[2], "0x", fields[3]}
+	default:
+		err = fmt.Errorf("malformed operation: %s", strings.Join(fields, " "))
+		return
+	}
+	decoded := make([][]byte, len(values))
+	for i, v := range values {
+		if decoded[i], err = hexutil.Decode(v); err != nil {
+			return
+		}
+	}
+	if len(decoded[0]) != common.HashLength || len(decoded[3]) != common.HashLength {
+		err = fmt.Errorf("invalid root length")
+		return
+	}
+	return common.BytesToHash(decoded[0]), decoded[1], decoded[2], common.BytesToHash(decoded[3]), nil
+}
@@ -0,0 +1,67 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordAndReplayOps(t *testing.T) {
+	var buf bytes.Buffer
+	trie := NewTrie(EmptyHash, memorydb.New(), WithOpRecorder(&buf))
+	kvs := uniqueKVs(100)
+	for _, elem := range kvs {
+		trie = trie.Insert(elem.k, elem.v)
+	}
+	// operations on a fork
+	fork := trie.Delete(kvs[0].k)
+	fork = fork.Insert([]byte{}, []byte{0x01})
+	for _, elem := range kvs[50:] {
+		trie = trie.Delete(elem.k)
+	}
+	// deleting absent key is recorded as well
+	trie = trie.Delete([]byte("absent key"))
+	assert.Equal(t, 153, strings.Count(buf.String(), "\n"))
+
+	replayed, err := ReplayOps(bytes.NewReader(buf.Bytes()), NewTrie(EmptyHash, memorydb.New()))
+	assert.Nil(t, err)
+	assert.Equal(t, trie.StateRoot(), replayed.StateRoot())
+	for _, elem := range kvs[:50] {
+		assert.Equal(t, elem.v, replayed.Get(elem.k))
+	}
+
+	// replay only the operations of the fork
+	lines := strings.Split(buf.String(), "\n")
+	forkOps := strings.Join(lines[:102], "\n")
+	replayed, err = ReplayOps(strings.NewReader(forkOps), NewTrie(EmptyHash, memorydb.New()))
+	assert.Nil(t, err)
+	assert.Equal(t, fork.StateRoot(), replayed.StateRoot())
+}
+
+func TestReplayOpsError(t *testing.T) {
+	var buf bytes.Buffer
+	trie := NewTrie(EmptyHash, memorydb.New(), WithOpRecorder(&buf))
+	trie = trie.Insert([]byte{0x01}, []byte{0x02})
+	trie.Insert([]byte{0x02}, []byte{0x03})
+
+	// tamper the recorded root of the second operation
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	fields := strings.Fields(lines[1])
+	fields[4] = fields[1]
+	tampered := lines[0] + "\n" + strings.Join(fields, " ")
+	replayed, err := ReplayOps(strings.NewReader(tampered), NewTrie(EmptyHash, memorydb.New()))
+	assert.Equal(t, &ReplayMismatchError{Line: 2, Expected: trie.StateRoot(), Actual: replayed.StateRoot()}, err)
+
+	// replay without the first operation, parent is unknown
+	_, err = ReplayOps(strings.NewReader(lines[1]), NewTrie(EmptyHash, memorydb.New()))
+	assert.NotNil(t, err)
+
+	_, err = ReplayOps(strings.NewReader("insert 0x01"), NewTrie(EmptyHash, memorydb.New()))
+	assert.NotNil(t, err)
+}
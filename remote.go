@@ -0,0 +1,175 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+)
+
+// ErrRemoteTimeout is returned when a node isn't fetched within the timeout of
+// RemoteStore, including the time waiting for a free request slot
+var ErrRemoteTimeout = errors.New("remote node request timed out")
+
+// NodeFetcher fetch the encoded node of hash from a remote peer or service, e.g. by
+// a wire NodeRequest. It's called from several goroutines, and should return soon
+// after ctx is done, the node is verified against hash by the caller
+type NodeFetcher func(ctx context.Context, hash common.Hash) ([]byte, error)
+
+// RemoteConfig bound the requests of RemoteStore
+type RemoteConfig struct {
+	// MaxInFlight is the max number of concurrent fetches, default is 16
+	MaxInFlight int
+	// Timeout is the max time of a read, from the request to the node, default is
+	// 10 seconds
+	Timeout time.Duration
+	// Clock is the clock of timeouts, default is SystemClock
+	Clock Clock
+}
+
+// remoteCall is a fetch of a node shared by all concurrent reads of it
+type remoteCall struct {
+	done    chan struct{}
+	encoded []byte
+	err     error
+}
+
+// RemoteStore is a db reading nodes absent from a local db from a NodeFetcher, so
+// a light trie can be opened over RPC by NewTrie(root, store). Fetches go through a
+// bounded pipeline: at most MaxInFlight fetches run at once and later reads wait
+// for a free slot, concurrent reads of the same node share one fetch, and every
+// read fail with ErrRemoteTimeout after Timeout, so the load on the remote end and
+// the latency of reads stay bounded when many tries read at once. Fetched nodes are
+// verified but not written to the local db, tries keep them in their cache. Other
+// keys, Has and all writes go to the local db
+type RemoteStore struct {
+	db.KeyValueStore
+
+	fetch   NodeFetcher
+	config  RemoteConfig
+	slots   chan struct{}
+	lock    sync.Mutex
+	pending map[common.Hash]*remoteCall
+}
+
+// NewRemoteStore create a store reading nodes absent from local by fetch
+func NewRemoteStore(local db.KeyValueStore, fetch NodeFetcher, config RemoteConfig) *RemoteStore {
+	if config.MaxInFlight <= 0 {
+		config.MaxInFlight = 16
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.Clock == nil {
+		config.Clock = SystemClock
+	}
+	return &RemoteStore{
+		KeyValueStore: local,
+		fetch:         fetch,
+		config:        config,
+		slots:         make(chan struct{}, config.MaxInFlight),
+		pending:       make(map[common.Hash]*remoteCall),
+	}
+}
+
+// Get return the value of key in the local db, or fetch it if it's a node key
+func (s *RemoteStore) Get(key []byte) ([]byte, error) {
+	value, err := s.KeyValueStore.Get(key)
+	if err == nil || len(key) != common.HashLength {
+		return value, err
+	}
+	return s.fetchNode(common.BytesToHash(key))
+}
+
+// MultiGet fetch keys concurrently through the pipeline, so full walks of light
+// tries fetch the children of a branch at once, nil is returned for absent keys
+func (s *RemoteStore) MultiGet(keys [][]byte) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+	var wg sync.WaitGroup
+	for i := range keys {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			values[i], errs[i] = s.Get(keys[i])
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// InFlight return the number of fetches running
+func (s *RemoteStore) InFlight() int {
+	return len(s.slots)
+}
+
+// fetchNode fetch the node of hash, or wait for the fetch already running
+func (s *RemoteStore) fetchNode(hash common.Hash) ([]byte, error) {
+	s.lock.Lock()
+	call, ok := s.pending[hash]
+	if !ok {
+		call = &remoteCall{done: make(chan struct{})}
+		s.pending[hash] = call
+		go s.run(hash, call)
+	}
+	s.lock.Unlock()
+	<-call.done
+	return call.encoded, call.err
+}
+
+// run fetch the node of hash within the timeout and deliver it to call
+func (s *RemoteStore) run(hash common.Hash, call *remoteCall) {
+	timer := s.config.Clock.NewTimer(s.config.Timeout)
+	defer timer.Stop()
+	call.encoded, call.err = s.fetchWithin(hash, timer)
+	s.lock.Lock()
+	delete(s.pending, hash)
+	s.lock.Unlock()
+	close(call.done)
+}
+
+func (s *RemoteStore) fetchWithin(hash common.Hash, timer Timer) ([]byte, error) {
+	select {
+	case s.slots <- struct{}{}:
+	case <-timer.C():
+		return nil, ErrRemoteTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	type result struct {
+		encoded []byte
+		err     error
+	}
+	results := make(chan result, 1)
+	go func() {
+		// the slot is held until the fetch return, even after a timeout, so slow
+		// fetches never exceed MaxInFlight
+		defer func() { <-s.slots }()
+		encoded, err := s.fetch(ctx, hash)
+		results <- result{encoded, err}
+	}()
+	select {
+	case r := <-results:
+		if r.err != nil {
+			return nil, r.err
+		}
+		if keccak256Hash(r.encoded) != hash {
+			return nil, fmt.Errorf("remote node %s doesn't match its hash", hash.Hex())
+		}
+		return r.encoded, nil
+	case <-timer.C():
+		return nil, ErrRemoteTimeout
+	}
+}
@@ -0,0 +1,117 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingFetcher fetch nodes from source, and count fetches and the max number of
+// concurrent ones
+type countingFetcher struct {
+	source  *memorydb.Database
+	delay   time.Duration
+	fetches int32
+	running int32
+	max     int32
+}
+
+func (f *countingFetcher) fetch(ctx context.Context, hash common.Hash) ([]byte, error) {
+	atomic.AddInt32(&f.fetches, 1)
+	running := atomic.AddInt32(&f.running, 1)
+	defer atomic.AddInt32(&f.running, -1)
+	for {
+		max := atomic.LoadInt32(&f.max)
+		if running <= max || atomic.CompareAndSwapInt32(&f.max, max, running) {
+			break
+		}
+	}
+	time.Sleep(f.delay)
+	return f.source.Get(nodeKey(hash))
+}
+
+func TestRemoteStore(t *testing.T) {
+	source := memorydb.New()
+	trie, kvs := persistedTrie(source, 300)
+	fetcher := &countingFetcher{source: source, delay: time.Millisecond}
+	store := NewRemoteStore(memorydb.New(), fetcher.fetch, RemoteConfig{MaxInFlight: 4})
+	light := NewTrie(trie.StateRoot(), store)
+	checkIterate(t, light, kvMap(kvs))
+	assert.True(t, fetcher.max <= 4)
+	// full walks fetch children of branches concurrently
+	assert.True(t, fetcher.max > 1)
+	assert.Equal(t, 0, store.InFlight())
+
+	// nodes are verified against their hashes
+	bad := NewRemoteStore(memorydb.New(), func(ctx context.Context, hash common.Hash) ([]byte, error) {
+		return []byte{0x01, 0x02}, nil
+	}, RemoteConfig{})
+	_, err := NewTrie(trie.StateRoot(), bad).TryGet(kvs[0].k)
+	assert.NotNil(t, err)
+}
+
+func TestRemoteStoreDedup(t *testing.T) {
+	source := memorydb.New()
+	trie, _ := persistedTrie(source, 10)
+	fetcher := &countingFetcher{source: source, delay: 20 * time.Millisecond}
+	store := NewRemoteStore(memorydb.New(), fetcher.fetch, RemoteConfig{})
+	root := trie.StateRoot()
+	encoded, _ := source.Get(nodeKey(root))
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := store.Get(nodeKey(root))
+			assert.Nil(t, err)
+			assert.Equal(t, encoded, value)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), fetcher.fetches)
+}
+
+func TestRemoteStoreTimeout(t *testing.T) {
+	clock := newFakeClock()
+	release := make(chan struct{})
+	store := NewRemoteStore(memorydb.New(), func(ctx context.Context, hash common.Hash) ([]byte, error) {
+		<-release
+		return nil, ctx.Err()
+	}, RemoteConfig{MaxInFlight: 1, Timeout: time.Second, Clock: clock})
+
+	errs := make(chan error, 2)
+	go func() {
+		_, err := store.Get(nodeKey(common.Hash{1}))
+		errs <- err
+	}()
+	assert.Equal(t, time.Second, <-clock.waits)
+	// the second read wait for the slot held by the first
+	go func() {
+		_, err := store.Get(nodeKey(common.Hash{2}))
+		errs <- err
+	}()
+	assert.Equal(t, time.Second, <-clock.waits)
+	assert.Equal(t, 1, store.InFlight())
+	clock.Advance(time.Second)
+	assert.Equal(t, ErrRemoteTimeout, <-errs)
+	assert.Equal(t, ErrRemoteTimeout, <-errs)
+	// the slot is held until the fetch return
+	assert.Equal(t, 1, store.InFlight())
+	close(release)
+	for store.InFlight() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// other keys are read from the local db only
+	_, err := store.Get([]byte("meta"))
+	assert.NotNil(t, err)
+}
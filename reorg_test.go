@@ -0,0 +1,219 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+// tests in this file simulate chain reorgs: competing branches of blocks are built
+// on a shared parent state, every block is a trie, and the branches are committed
+// and pruned in various orders. Nodes replaced by a branch are scheduled to the
+// pruner of the branch, which only run once the branch become canonical, and all
+// retained roots must stay fully readable
+
+const (
+	reorgParentKeys = 500
+	reorgBlockKeys  = 20
+)
+
+// reorgChain is a branch of blocks, states[i] is the expected key values of heads[i]
+type reorgChain struct {
+	memDB  *memorydb.Database
+	heads  []*Trie
+	states []map[string][]byte
+	pruner *Pruner
+}
+
+func newReorgChain(memDB *memorydb.Database, parent *Trie, state map[string][]byte) *reorgChain {
+	return &reorgChain{
+		memDB:  memDB,
+		heads:  []*Trie{parent},
+		states: []map[string][]byte{state},
+		pruner: NewPruner(memDB, PrunerConfig{}),
+	}
+}
+
+func (c *reorgChain) head() (*Trie, map[string][]byte) {
+	return c.heads[len(c.heads)-1], c.states[len(c.states)-1]
+}
+
+// extend build a block on head, which update and delete some existing keys and
+// insert new keys, the block is persisted with the pruner of chain if persist is
+// true, otherwise it's kept in memory
+func (c *reorgChain) extend(persist bool) {
+	head, state := c.head()
+	newState := make(map[string][]byte, len(state)+reorgBlockKeys)
+	for k, v := range state {
+		newState[k] = v
+	}
+	changed := 0
+	for k := range state {
+		if changed == reorgBlockKeys {
+			break
+		}
+		if changed%4 == 0 {
+			head = head.Delete([]byte(k))
+			delete(newState, k)
+		} else {
+			value := randomBytes()
+			head = head.Insert([]byte(k), value)
+			newState[k] = value
+		}
+		changed++
+	}
+	for _, elem := range uniqueKVs(reorgBlockKeys) {
+		head = head.Insert(elem.k, elem.v)
+		newState[string(elem.k)] = elem.v
+	}
+	if persist {
+		head.PersistWithPruner(c.pruner)
+		head = NewTrie(head.StateRoot(), c.memDB)
+	}
+	c.heads = append(c.heads, head)
+	c.states = append(c.states, newState)
+}
+
+// prune run the pruner of chain until all scheduled nodes are deleted
+func (c *reorgChain) prune(t *testing.T) {
+	c.pruner.Start()
+	defer c.pruner.Stop()
+	assert.True(t, waitPruned(c.pruner, 5*time.Second))
+}
+
+// assertReadable check every node of root is in db, and the trie of root contains
+// exactly state
+func assertReadable(t *testing.T, memDB *memorydb.Database, root common.Hash, state map[string][]byte) {
+	assert.Nil(t, checkSubtree(memDB, root, make(map[common.Hash]struct{})))
+	checkIterate(t, NewTrie(root, memDB), state)
+}
+
+func reorgParent() (*memorydb.Database, *Trie, map[string][]byte) {
+	memDB := memorydb.New()
+	parent, kvs := persistedTrie(memDB, reorgParentKeys)
+	return memDB, parent, kvMap(kvs)
+}
+
+// TestReorgDeferredPruning build two branches of blocks on the same parent, all
+// blocks are persisted, then only the winner is pruned
+func TestReorgDeferredPruning(t *testing.T) {
+	cases := []struct {
+		name        string
+		interleaved bool
+		winnerFirst bool
+	}{
+		{"winner then loser", false, true},
+		{"loser then winner", false, false},
+		{"interleaved winner first", true, true},
+		{"interleaved loser first", true, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			memDB, parent, state := reorgParent()
+			winner := newReorgChain(memDB, parent, state)
+			loser := newReorgChain(memDB, parent, state)
+			first, second := winner, loser
+			if !tc.winnerFirst {
+				first, second = loser, winner
+			}
+			for i := 0; i < 3; i++ {
+				first.extend(true)
+				if tc.interleaved {
+					second.extend(true)
+				}
+			}
+			if !tc.interleaved {
+				for i := 0; i < 3; i++ {
+					second.extend(true)
+				}
+			}
+			// nothing is pruned before the reorg is settled, so every root of
+			// both branches is retained
+			for _, chain := range []*reorgChain{winner, loser} {
+				for i, head := range chain.heads {
+					assertReadable(t, memDB, head.StateRoot(), chain.states[i])
+				}
+			}
+
+			winner.prune(t)
+			head, state := winner.head()
+			assertReadable(t, memDB, head.StateRoot(), state)
+			// the winner keep growing after the reorg
+			winner.extend(true)
+			winner.prune(t)
+			head, state = winner.head()
+			assertReadable(t, memDB, head.StateRoot(), state)
+		})
+	}
+}
+
+// TestReorgCommitLoserAfterPrune build both branches in memory, the winner is
+// persisted and pruned before the loser is persisted, which must not affect the
+// winner
+func TestReorgCommitLoserAfterPrune(t *testing.T) {
+	memDB, parent, state := reorgParent()
+	winner := newReorgChain(memDB, parent, state)
+	loser := newReorgChain(memDB, parent, state)
+	for i := 0; i < 3; i++ {
+		winner.extend(false)
+		loser.extend(false)
+	}
+	winnerHead, winnerState := winner.head()
+	winnerHead.PersistWithPruner(winner.pruner)
+	winner.prune(t)
+	loserHead, _ := loser.head()
+	loserHead.PersistWithPruner(loser.pruner)
+	assertReadable(t, memDB, winnerHead.StateRoot(), winnerState)
+}
+
+// TestReorgSwitchBack switch the canonical branch to the loser and back again,
+// the pruner of a branch is paused when it lose and resumed when it win
+func TestReorgSwitchBack(t *testing.T) {
+	memDB, parent, state := reorgParent()
+	a := newReorgChain(memDB, parent, state)
+	b := newReorgChain(memDB, parent, state)
+	a.pruner.Pause()
+	b.pruner.Pause()
+	a.pruner.Start()
+	b.pruner.Start()
+	defer a.pruner.Stop()
+	defer b.pruner.Stop()
+
+	a.extend(true)
+	b.extend(true)
+	b.extend(true)
+	// b is canonical for a while, then a catch up and win
+	for _, chain := range []*reorgChain{a, b} {
+		for i, head := range chain.heads {
+			assertReadable(t, memDB, head.StateRoot(), chain.states[i])
+		}
+	}
+	a.extend(true)
+	a.extend(true)
+	a.pruner.Resume()
+	assert.True(t, waitPruned(a.pruner, 5*time.Second))
+	head, state := a.head()
+	assertReadable(t, memDB, head.StateRoot(), state)
+}
+
+// TestReorgImmediatePruning show that Persist prune replaced nodes immediately, so
+// a competing branch built on the same parent become stale once the other branch
+// is persisted, deferred pruning is needed to handle reorgs
+func TestReorgImmediatePruning(t *testing.T) {
+	memDB, parent, state := reorgParent()
+	winner := newReorgChain(memDB, parent, state)
+	loser := newReorgChain(memDB, parent, state)
+	winner.extend(false)
+	loser.extend(false)
+	winnerHead, winnerState := winner.head()
+	winnerHead.Persist()
+	assertReadable(t, memDB, winnerHead.StateRoot(), winnerState)
+	loserHead, _ := loser.head()
+	assert.True(t, loserHead.Stale())
+}
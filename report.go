@@ -0,0 +1,175 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+	"github.com/lbqds/mpt/internal/varint"
+)
+
+// CommitReport summarizes the node writes and deletes of a commit, the byte counts
+// are sizes of encoded nodes, keys are not included. Nodes which already exist in
+// underlying db are not counted as written even if they are put again. Added and
+// Removed break the written and deleted nodes down by kind, a branch restructured
+// by the commit is counted as both removed and added
+type CommitReport struct {
+	Root         common.Hash
+	NodesWritten int
+	BytesWritten int
+	NodesDeleted int
+	BytesDeleted int
+	Added        NodeCounts
+	Removed      NodeCounts
+	// written deliver the commit to growth stats, hooks, watchers and the history
+	// index, nil once delivered
+	written func()
+}
+
+// NodeCounts is the number of stored nodes of each kind, nodes embedded in their
+// parents are part of the parents and not counted
+type NodeCounts struct {
+	Leaves     int `json:"leaves"`
+	Extensions int `json:"extensions"`
+	Branches   int `json:"branches"`
+}
+
+func (c *NodeCounts) add(nodeType byte, delta int) {
+	switch nodeType {
+	case leafType:
+		c.Leaves += delta
+	case extType:
+		c.Extensions += delta
+	case branchType:
+		c.Branches += delta
+	}
+}
+
+// Total return the number of nodes of all kinds
+func (c NodeCounts) Total() int {
+	return c.Leaves + c.Extensions + c.Branches
+}
+
+// commitReport summarize changes, existing is the inserted nodes found in underlying
+// db and skipped when commit. Types of deleted nodes are recorded by the log when
+// they are deleted, so nothing is read from underlying db. Every commit path call
+// it once, and call Written on the report once the commit is written
+func (t *Trie) commitReport(changes *logLayer, existing map[common.Hash]struct{}) *CommitReport {
+	report := &CommitReport{Root: t.rootHash}
+	for k, v := range changes.inserted {
+		if _, ok := changes.persisted[k]; ok {
+			continue
+		}
+		if _, ok := existing[k]; ok {
+			continue
+		}
+		v = t.log.value(k, v)
+		report.NodesWritten++
+		report.BytesWritten += len(v)
+		report.Added.add(encodedType(v), 1)
+	}
+	for k := range changes.deleted {
+		if persisted, ok := changes.persisted[k]; ok {
+			report.NodesDeleted++
+			report.BytesDeleted += persisted.size
+			report.Removed.add(persisted.nodeType, 1)
+		}
+	}
+	notify := t.prepareCommit(changes)
+	report.written = func() {
+		if t.config.schema {
+			// commits of tries with WithSchema write the descriptor or fail
+			atomic.StoreUint32(&t.config.schemaWritten, 1)
+		}
+		if stats := t.config.growthStats; stats != nil {
+			stats.record(report)
+		}
+		notify()
+	}
+	return report
+}
+
+// Written deliver the commit to the growth stats, the commit hook, the watcher and
+// the history index of the trie, and advance its CommitSeq. Commits writing their
+// own batch, e.g. Persist and Commit, call it once the batch is written, callers of
+// CommitToBatch and CommitToBatchOrdered must call it after writing the batch
+// successfully, so a commit which never land is never seen. It does nothing after
+// the first call, or for reports loaded from db
+func (r *CommitReport) Written() {
+	if r.written == nil {
+		return
+	}
+	written := r.written
+	r.written = nil
+	written()
+}
+
+// Growth return the estimated growth of underlying db after the commit, it is
+// negative if the commit shrink the db
+func (r *CommitReport) Growth() int {
+	return r.BytesWritten - r.BytesDeleted
+}
+
+func (r *CommitReport) String() string {
+	return fmt.Sprintf("root: %s, written: %d nodes(%d bytes), deleted: %d nodes(%d bytes), growth: %d bytes",
+		r.Root.Hex(), r.NodesWritten, r.BytesWritten, r.NodesDeleted, r.BytesDeleted, r.Growth())
+}
+
+// reportFields is the number of fields of encoded report, reports stored before
+// node kinds were counted have only the first 4 fields
+const reportFields = 10
+
+func (r *CommitReport) encode() []byte {
+	buf := make([]byte, 0, reportFields*varint.MaxLen)
+	for _, v := range []int{
+		r.NodesWritten, r.BytesWritten, r.NodesDeleted, r.BytesDeleted,
+		r.Added.Leaves, r.Added.Extensions, r.Added.Branches,
+		r.Removed.Leaves, r.Removed.Extensions, r.Removed.Branches,
+	} {
+		buf = varint.Append(buf, uint64(v))
+	}
+	return buf
+}
+
+func decodeCommitReport(root common.Hash, bytes []byte) (*CommitReport, error) {
+	var fields [reportFields]int
+	for i := range fields {
+		if i == 4 && len(bytes) == 0 {
+			break
+		}
+		v, rest, ok := varint.Decode(bytes)
+		if !ok {
+			return nil, fmt.Errorf("invalid commit report of root %s", root.Hex())
+		}
+		fields[i] = int(v)
+		bytes = rest
+	}
+	return &CommitReport{
+		Root:         root,
+		NodesWritten: fields[0],
+		BytesWritten: fields[1],
+		NodesDeleted: fields[2],
+		BytesDeleted: fields[3],
+		Added:        NodeCounts{Leaves: fields[4], Extensions: fields[5], Branches: fields[6]},
+		Removed:      NodeCounts{Leaves: fields[7], Extensions: fields[8], Branches: fields[9]},
+	}, nil
+}
+
+// Store write the report to w, keyed by the root of the report, write it to the
+// same batch as the commit if the report need to be atomic with nodes
+func (r *CommitReport) Store(w db.KeyValueWriter) error {
+	return w.Put(commitReportKey(r.Root), r.encode())
+}
+
+// LoadCommitReport read the report of root which written by CommitReport.Store
+func LoadCommitReport(r db.KeyValueReader, root common.Hash) (*CommitReport, error) {
+	encoded, err := r.Get(commitReportKey(root))
+	if err != nil {
+		return nil, err
+	}
+	return decodeCommitReport(root, encoded)
+}
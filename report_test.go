@@ -0,0 +1,100 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommitReport(t *testing.T) {
+	memDB := memorydb.New()
+	trie := NewTrie(EmptyHash, memDB)
+	kvs := make([]kv, 0)
+	for i := 0; i < 100; i++ {
+		elem := newKV()
+		trie = trie.Insert(elem.k, elem.v)
+		kvs = append(kvs, elem)
+	}
+	report := trie.Persist()
+	assert.Equal(t, trie.StateRoot(), report.Root)
+	assert.Equal(t, memDB.Len(), report.NodesWritten)
+	assert.Equal(t, 0, report.NodesDeleted)
+	assert.Equal(t, report.BytesWritten, report.Growth())
+	assert.Equal(t, report.NodesWritten, report.Added.Total())
+	assert.True(t, report.Added.Leaves > 0 && report.Added.Branches > 0)
+	assert.Equal(t, NodeCounts{}, report.Removed)
+
+	// delete half of keys from a reloaded trie, check the report match the db
+	trie = NewTrie(trie.StateRoot(), memDB)
+	for _, elem := range kvs[:len(kvs)/2] {
+		trie = trie.Delete(elem.k)
+	}
+	sizeBefore := dbSize(memDB)
+	lenBefore := memDB.Len()
+	deleteReport := trie.Persist()
+	assert.True(t, deleteReport.NodesDeleted > 0)
+	assert.Equal(t, lenBefore+deleteReport.NodesWritten-deleteReport.NodesDeleted, memDB.Len())
+	assert.Equal(t, sizeBefore+deleteReport.Growth(), dbSize(memDB))
+	assert.Equal(t, deleteReport.NodesWritten, deleteReport.Added.Total())
+	assert.Equal(t, deleteReport.NodesDeleted, deleteReport.Removed.Total())
+	assert.True(t, deleteReport.Removed.Leaves > 0)
+}
+
+func TestCommitReportNoReads(t *testing.T) {
+	// types of deleted nodes are known without reading them again, even if the
+	// cache is trimmed before the commit
+	faulty := NewFaultyStore(memorydb.New(), FaultConfig{})
+	trie := NewTrie(EmptyHash, faulty)
+	kvs := uniqueKVs(100)
+	for _, elem := range kvs {
+		trie = trie.Insert(elem.k, elem.v)
+	}
+	trie.Persist()
+	trie = NewTrie(trie.StateRoot(), faulty)
+	for _, elem := range kvs[:len(kvs)/2] {
+		trie = trie.Delete(elem.k)
+	}
+	trie.EvictClean()
+	faulty.SetConfig(FaultConfig{ReadFailureRate: 1})
+	report := trie.Persist()
+	assert.True(t, report.NodesDeleted > 0)
+	assert.Equal(t, report.NodesDeleted, report.Removed.Total())
+}
+
+func dbSize(memDB *memorydb.Database) int {
+	size := 0
+	iter := memDB.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		size += len(iter.Value())
+	}
+	return size
+}
+
+func TestStoreCommitReport(t *testing.T) {
+	memDB := memorydb.New()
+	trie := NewTrie(EmptyHash, memDB)
+	for i := 0; i < 10; i++ {
+		elem := newKV()
+		trie = trie.Insert(elem.k, elem.v)
+	}
+	report := trie.Persist()
+	assert.Nil(t, report.Store(memDB))
+	loaded, err := LoadCommitReport(memDB, trie.StateRoot())
+	assert.Nil(t, err)
+	assert.Equal(t, report, loaded)
+
+	_, err = LoadCommitReport(memDB, EmptyHash)
+	assert.NotNil(t, err)
+
+	// reports stored before node kinds were counted
+	legacy, err := decodeCommitReport(report.Root, []byte{1, 2, 3, 4})
+	assert.Nil(t, err)
+	assert.Equal(t, &CommitReport{Root: report.Root, NodesWritten: 1, BytesWritten: 2, NodesDeleted: 3, BytesDeleted: 4}, legacy)
+	_, err = decodeCommitReport(report.Root, []byte{1, 2, 3, 4, 5})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,194 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+)
+
+// RootMeta is the metadata of a committed root, roots whose metadata are stored are
+// managed by ApplyRetention
+type RootMeta struct {
+	Root    common.Hash
+	Created time.Time
+}
+
+// Store write the metadata to w, keyed by its root, write it to the same batch as
+// the commit if it need to be atomic with nodes
+func (m *RootMeta) Store(w db.KeyValueWriter) error {
+	var encoded [8]byte
+	binary.BigEndian.PutUint64(encoded[:], uint64(m.Created.UnixNano()))
+	return w.Put(metaKey(m.Root), encoded[:])
+}
+
+// LoadRootMeta read the metadata of root written by RootMeta.Store
+func LoadRootMeta(r db.KeyValueReader, root common.Hash) (*RootMeta, error) {
+	encoded, err := r.Get(metaKey(root))
+	if err != nil {
+		return nil, err
+	}
+	return decodeRootMeta(root, encoded)
+}
+
+func decodeRootMeta(root common.Hash, encoded []byte) (*RootMeta, error) {
+	if len(encoded) != 8 {
+		return nil, fmt.Errorf("invalid metadata of root %s", root.Hex())
+	}
+	created := time.Unix(0, int64(binary.BigEndian.Uint64(encoded)))
+	return &RootMeta{Root: root, Created: created}, nil
+}
+
+// ListRootMetas return the metadata of all roots in kvs, from the oldest to the newest
+func ListRootMetas(kvs db.Iteratee) ([]*RootMeta, error) {
+	metas := make([]*RootMeta, 0)
+	it := kvs.NewIterator(metaPrefix, nil)
+	defer it.Release()
+	for it.Next() {
+		key := it.Key()
+		if len(key) != len(metaPrefix)+common.HashLength {
+			continue
+		}
+		meta, err := decodeRootMeta(common.BytesToHash(key[len(metaPrefix):]), it.Value())
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, meta)
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(metas, func(i, j int) bool {
+		if !metas[i].Created.Equal(metas[j].Created) {
+			return metas[i].Created.Before(metas[j].Created)
+		}
+		return bytes.Compare(metas[i].Root[:], metas[j].Root[:]) < 0
+	})
+	return metas, nil
+}
+
+// RetentionPolicy decide which roots with metadata are kept by ApplyRetention, zero
+// value of a limit means unlimited
+type RetentionPolicy struct {
+	// MaxAge is the max age of a root since it's created
+	MaxAge time.Duration
+	// MaxCount is the max number of roots, the newest ones are kept
+	MaxCount int
+	// Veto is called with every root outside the policy before it's deleted, the
+	// root is kept if it return true, e.g. a root still read by the application
+	Veto func(meta *RootMeta) bool
+	// Clock is the clock of ages, default is SystemClock
+	Clock Clock
+}
+
+// expired return the roots of metas outside the policy, metas are sorted from the
+// oldest
+func (p *RetentionPolicy) expired(metas []*RootMeta) []*RootMeta {
+	clock := p.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+	now := clock.Now()
+	expired := make([]*RootMeta, 0)
+	for i, meta := range metas {
+		tooMany := p.MaxCount > 0 && len(metas)-i > p.MaxCount
+		tooOld := p.MaxAge > 0 && now.Sub(meta.Created) > p.MaxAge
+		if (tooMany || tooOld) && (p.Veto == nil || !p.Veto(meta)) {
+			expired = append(expired, meta)
+		}
+	}
+	return expired
+}
+
+// ApplyRetention delete the roots with metadata in kvs which fall outside the policy,
+// and return the deleted roots. Nodes aren't reference counted, so the nodes of kept
+// roots are marked first, and only the nodes of deleted roots which are not marked
+// are deleted, the cost is proportional to the size of kept tries. Roots without
+// metadata are not known to ApplyRetention, their nodes may be deleted if they are
+// shared with deleted roots. Nodes and metadata of deleted roots are deleted in one
+// batch
+func ApplyRetention(kvs db.KeyValueStore, policy RetentionPolicy) ([]common.Hash, error) {
+	metas, err := ListRootMetas(kvs)
+	if err != nil {
+		return nil, err
+	}
+	expired := policy.expired(metas)
+	if len(expired) == 0 {
+		return nil, nil
+	}
+	deleted := make(map[common.Hash]struct{}, len(expired))
+	for _, meta := range expired {
+		deleted[meta.Root] = struct{}{}
+	}
+	marked := make(map[common.Hash]struct{})
+	for _, meta := range metas {
+		if _, ok := deleted[meta.Root]; ok {
+			continue
+		}
+		err := ReachableHashes(meta.Root, kvs, func(hash common.Hash, size int) bool {
+			marked[hash] = struct{}{}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	batch := kvs.NewBatch()
+	roots := make([]common.Hash, 0, len(expired))
+	for _, meta := range expired {
+		if err := sweepRoot(kvs, batch, meta.Root, marked); err != nil {
+			return nil, err
+		}
+		if err := batch.Delete(metaKey(meta.Root)); err != nil {
+			return nil, err
+		}
+		if err := batch.Delete(commitReportKey(meta.Root)); err != nil {
+			return nil, err
+		}
+		roots = append(roots, meta.Root)
+	}
+	if err := batch.Write(); err != nil {
+		return nil, err
+	}
+	return roots, nil
+}
+
+// sweepRoot delete the nodes reachable from root to batch except marked nodes and
+// their descendants, every node deleted is marked, so nodes shared by several roots
+// are visited once. Missing nodes are skipped
+func sweepRoot(reader db.KeyValueReader, batch db.KeyValueWriter, root common.Hash, marked map[common.Hash]struct{}) error {
+	if isEmptyRoot(root) {
+		return nil
+	}
+	stack := []common.Hash{root}
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, ok := marked[hash]; ok {
+			continue
+		}
+		marked[hash] = struct{}{}
+		encoded, err := reader.Get(nodeKey(hash))
+		if err != nil || len(encoded) == 0 {
+			continue
+		}
+		if err := batch.Delete(nodeKey(hash)); err != nil {
+			return err
+		}
+		err = childRefs(encoded, func(child common.Hash) {
+			stack = append(stack, child)
+		})
+		if err != nil {
+			return &MissingNodeError{Hash: hash, Err: err}
+		}
+	}
+	return nil
+}
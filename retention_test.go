@@ -0,0 +1,107 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+// retainedRoots persist a trie of the first 20*(i+1) kvs for every i < n, tries are
+// persisted to their own db and copied to memDB, so nodes of older roots are not
+// pruned, root i is created i hours after clock
+func retainedRoots(memDB *memorydb.Database, clock *fakeClock, n int) ([]common.Hash, []kv) {
+	kvs := uniqueKVs(20 * n)
+	roots := make([]common.Hash, n)
+	for i := range roots {
+		own := memorydb.New()
+		trie := NewTrie(EmptyHash, own)
+		for _, elem := range kvs[:20*(i+1)] {
+			trie = trie.Insert(elem.k, elem.v)
+		}
+		trie.Persist().Store(own)
+		it := own.NewIterator(nil, nil)
+		for it.Next() {
+			memDB.Put(it.Key(), it.Value())
+		}
+		it.Release()
+		roots[i] = trie.StateRoot()
+		meta := &RootMeta{Root: roots[i], Created: clock.Now().Add(time.Duration(i) * time.Hour)}
+		meta.Store(memDB)
+	}
+	return roots, kvs
+}
+
+// reachableCount return the number of nodes reachable from roots
+func reachableCount(t *testing.T, memDB *memorydb.Database, roots ...common.Hash) int {
+	nodes := make(map[common.Hash]struct{})
+	for _, root := range roots {
+		assert.Nil(t, ReachableHashes(root, memDB, func(hash common.Hash, size int) bool {
+			nodes[hash] = struct{}{}
+			return true
+		}))
+	}
+	return len(nodes)
+}
+
+func TestApplyRetention(t *testing.T) {
+	memDB := memorydb.New()
+	clock := newFakeClock()
+	roots, kvs := retainedRoots(memDB, clock, 5)
+	metas, err := ListRootMetas(memDB)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(metas))
+	for i, meta := range metas {
+		assert.Equal(t, roots[i], meta.Root)
+	}
+
+	deleted, err := ApplyRetention(memDB, RetentionPolicy{MaxCount: 3, Clock: clock})
+	assert.Nil(t, err)
+	assert.Equal(t, roots[:2], deleted)
+	// only nodes, metadata and reports of the kept roots are left
+	assert.Equal(t, reachableCount(t, memDB, roots[2:]...)+3*2, memDB.Len())
+	for i, root := range roots[2:] {
+		reader := NewTrie(root, memDB)
+		for _, elem := range kvs[:20*(i+3)] {
+			assert.Equal(t, elem.v, reader.Get(elem.k))
+		}
+	}
+	_, err = LoadRootMeta(memDB, roots[0])
+	assert.NotNil(t, err)
+	_, err = LoadCommitReport(memDB, roots[1])
+	assert.NotNil(t, err)
+
+	// nothing is outside the policy
+	deleted, err = ApplyRetention(memDB, RetentionPolicy{MaxCount: 3, Clock: clock})
+	assert.Nil(t, err)
+	assert.Empty(t, deleted)
+}
+
+func TestApplyRetentionMaxAgeVeto(t *testing.T) {
+	memDB := memorydb.New()
+	clock := newFakeClock()
+	roots, _ := retainedRoots(memDB, clock, 4)
+	clock.Advance(3*time.Hour + time.Minute)
+	vetoed := make([]common.Hash, 0)
+	deleted, err := ApplyRetention(memDB, RetentionPolicy{
+		MaxAge: 2 * time.Hour,
+		Clock:  clock,
+		Veto: func(meta *RootMeta) bool {
+			vetoed = append(vetoed, meta.Root)
+			return meta.Root == roots[0]
+		},
+	})
+	assert.Nil(t, err)
+	// roots older than 2 hours are 0 and 1, and 0 is vetoed
+	assert.Equal(t, roots[:2], vetoed)
+	assert.Equal(t, []common.Hash{roots[1]}, deleted)
+	metas, err := ListRootMetas(memDB)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(metas))
+	assert.Equal(t, reachableCount(t, memDB, roots[0], roots[2], roots[3])+3*2, memDB.Len())
+}
@@ -0,0 +1,94 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// OperationError is returned by SafeGet/SafeInsert/SafeDelete, it describe the
+// operation failed and the node caused the failure:
+// - Op: the operation, one of get, insert and delete
+// - Key: the key of the operation
+// - Root: the root of the trie operated on
+// - Hash: the hash of the node failed to resolve, it's empty if unknown
+// - Err: the underlying error, or the value of the panic wrapped as an error
+type OperationError struct {
+	Op   string
+	Key  []byte
+	Root common.Hash
+	Hash common.Hash
+	Err  error
+}
+
+func (e *OperationError) Error() string {
+	if e.Hash != (common.Hash{}) {
+		return fmt.Sprintf("trie %s key %x on root %s failed at node %s: %v", e.Op, e.Key, e.Root.Hex(), e.Hash.Hex(), e.Err)
+	}
+	return fmt.Sprintf("trie %s key %x on root %s failed: %v", e.Op, e.Key, e.Root.Hex(), e.Err)
+}
+
+// Unwrap return the underlying error
+func (e *OperationError) Unwrap() error {
+	return e.Err
+}
+
+// opError wrap err of operation op on key as an OperationError
+func (t *Trie) opError(op string, key []byte, err error) *OperationError {
+	opErr := &OperationError{
+		Op:   op,
+		Key:  common.CopyBytes(key),
+		Root: t.rootHash,
+		Err:  err,
+	}
+	if missing, ok := err.(*MissingNodeError); ok {
+		opErr.Hash = missing.Hash
+	}
+	return opErr
+}
+
+// recoverOp recover any panic of operation op on key and set err to an OperationError
+func (t *Trie) recoverOp(op string, key []byte, err *error) {
+	if r := recover(); r != nil {
+		panicErr, ok := r.(error)
+		if !ok {
+			panicErr = fmt.Errorf("panic: %v", r)
+		}
+		*err = t.opError(op, key, panicErr)
+	}
+}
+
+// SafeGet is TryGet which never panic, all errors including panics of the trie are
+// returned as OperationError, so services embedding the trie don't crash on a bad
+// db read
+func (t *Trie) SafeGet(key []byte) (value []byte, err error) {
+	defer t.recoverOp("get", key, &err)
+	value, err = t.TryGet(key)
+	if err != nil {
+		return nil, t.opError("get", key, err)
+	}
+	return value, nil
+}
+
+// SafeInsert is TryInsert which never panic, errors are returned as OperationError
+func (t *Trie) SafeInsert(key, value []byte) (newTrie *Trie, err error) {
+	defer t.recoverOp("insert", key, &err)
+	newTrie, err = t.TryInsert(key, value)
+	if err != nil {
+		return nil, t.opError("insert", key, err)
+	}
+	return newTrie, nil
+}
+
+// SafeDelete is TryDelete which never panic, errors are returned as OperationError
+func (t *Trie) SafeDelete(key []byte) (newTrie *Trie, err error) {
+	defer t.recoverOp("delete", key, &err)
+	newTrie, err = t.TryDelete(key)
+	if err != nil {
+		return nil, t.opError("delete", key, err)
+	}
+	return newTrie, nil
+}
@@ -0,0 +1,75 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+// panicDB panic on every Get
+type panicDB struct {
+	ethdb.KeyValueStore
+}
+
+func (db *panicDB) Get(key []byte) ([]byte, error) {
+	panic("bad db read")
+}
+
+func TestSafeOperationsMissingNode(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 100)
+	// a leaf of 32 bytes value is never embedded, so a node on the path of its key
+	// is always missing
+	trie = trie.Insert(kvs[0].k, bytes.Repeat([]byte{1}, 32))
+	trie.Persist()
+	trie = NewTrie(trie.StateRoot(), memDB)
+	root := trie.StateRoot()
+	iter := memDB.NewIterator(nil, nil)
+	for iter.Next() {
+		if !bytes.Equal(iter.Key(), root[:]) {
+			memDB.Delete(iter.Key())
+		}
+	}
+	iter.Release()
+
+	check := func(op string, err error) {
+		opErr, ok := err.(*OperationError)
+		assert.True(t, ok)
+		assert.Equal(t, op, opErr.Op)
+		assert.Equal(t, kvs[0].k, opErr.Key)
+		assert.Equal(t, root, opErr.Root)
+		assert.NotEqual(t, root, opErr.Hash)
+		assert.IsType(t, &MissingNodeError{}, opErr.Unwrap())
+	}
+	_, err := trie.SafeGet(kvs[0].k)
+	check("get", err)
+	_, err = trie.SafeInsert(kvs[0].k, kvs[1].v)
+	check("insert", err)
+	_, err = trie.SafeDelete(kvs[0].k)
+	check("delete", err)
+}
+
+func TestSafeOperationsPanic(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 100)
+	trie = NewTrie(trie.StateRoot(), &panicDB{memDB})
+	assert.Panics(t, func() { trie.Get(kvs[0].k) })
+
+	_, err := trie.SafeGet(kvs[0].k)
+	assert.IsType(t, &OperationError{}, err)
+	assert.Contains(t, err.Error(), "bad db read")
+	_, err = trie.SafeInsert(kvs[0].k, kvs[1].v)
+	assert.IsType(t, &OperationError{}, err)
+	_, err = trie.SafeDelete(kvs[0].k)
+	assert.IsType(t, &OperationError{}, err)
+
+	value, err := NewTrie(trie.StateRoot(), memDB).SafeGet(kvs[0].k)
+	assert.Nil(t, err)
+	assert.Equal(t, kvs[0].v, value)
+}
@@ -0,0 +1,235 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+)
+
+// SyncRequest is a node requested by SyncScheduler
+type SyncRequest struct {
+	Hash common.Hash
+	// Path is the nibbles of the node from root
+	Path []byte
+	// Depth is the number of nodes stored by hash above the node, the root is 0
+	Depth int
+	// Seq is the order in which the node is discovered
+	Seq uint64
+}
+
+// SyncPolicy report whether a is fetched before b
+type SyncPolicy func(a, b *SyncRequest) bool
+
+// ShallowFirst fetch nodes by ascending depth, the spine of the trie is synced before
+// the leaves, so proofs become servable as early as possible. It's the default policy
+func ShallowFirst(a, b *SyncRequest) bool {
+	if a.Depth != b.Depth {
+		return a.Depth < b.Depth
+	}
+	return a.Seq < b.Seq
+}
+
+// DeepFirst fetch the deepest nodes first, subtrees are completed one by one, so the
+// number of pending requests stay small
+func DeepFirst(a, b *SyncRequest) bool {
+	if a.Depth != b.Depth {
+		return a.Depth > b.Depth
+	}
+	return a.Seq < b.Seq
+}
+
+// DiscoveryOrder fetch nodes in the order they are discovered
+func DiscoveryOrder(a, b *SyncRequest) bool {
+	return a.Seq < b.Seq
+}
+
+// KeysFirst fetch nodes on the paths of keys before others, e.g. popular keys, so
+// their values and proofs are servable before the rest of the trie is synced. Nodes
+// are ordered by ShallowFirst otherwise. Requests are compared with every key, so
+// keys should be few
+func KeysFirst(keys [][]byte) SyncPolicy {
+	paths := make([][]byte, len(keys))
+	for i, key := range keys {
+		paths[i] = bytesToNibbles(key)
+	}
+	onPath := func(r *SyncRequest) bool {
+		for _, path := range paths {
+			if bytes.HasPrefix(path, r.Path) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(a, b *SyncRequest) bool {
+		if hotA, hotB := onPath(a), onPath(b); hotA != hotB {
+			return hotA
+		}
+		return ShallowFirst(a, b)
+	}
+}
+
+// syncQueue is a heap of requests ordered by policy
+type syncQueue struct {
+	requests []*SyncRequest
+	policy   SyncPolicy
+}
+
+func (q *syncQueue) Len() int           { return len(q.requests) }
+func (q *syncQueue) Less(i, j int) bool { return q.policy(q.requests[i], q.requests[j]) }
+func (q *syncQueue) Swap(i, j int)      { q.requests[i], q.requests[j] = q.requests[j], q.requests[i] }
+func (q *syncQueue) Push(x interface{}) { q.requests = append(q.requests, x.(*SyncRequest)) }
+func (q *syncQueue) Pop() interface{} {
+	last := q.requests[len(q.requests)-1]
+	q.requests = q.requests[:len(q.requests)-1]
+	return last
+}
+
+// SyncScheduler schedule the nodes of a trie missing from a db, so they can be
+// fetched from peers, e.g. to sync the state of a new node. Nodes are requested in
+// the order of the policy, fetched nodes are delivered by Process and written by
+// Commit as soon as they arrive, so a partially synced trie serve the keys whose
+// paths are complete. Nodes existing in the db are walked to find their missing
+// children, so a scheduler of the same root resume an interrupted sync. It's not
+// safe for concurrent use
+type SyncScheduler struct {
+	db       db.KeyValueReader
+	queue    *syncQueue
+	known    map[common.Hash]struct{}
+	inflight map[common.Hash]*SyncRequest
+	fetched  map[common.Hash][]byte
+	seq      uint64
+}
+
+// NewSyncScheduler create a scheduler syncing the trie of root to kvs, nil policy
+// means ShallowFirst
+func NewSyncScheduler(root common.Hash, kvs db.KeyValueReader, policy SyncPolicy) (*SyncScheduler, error) {
+	if policy == nil {
+		policy = ShallowFirst
+	}
+	s := &SyncScheduler{
+		db:       kvs,
+		queue:    &syncQueue{policy: policy},
+		known:    make(map[common.Hash]struct{}),
+		inflight: make(map[common.Hash]*SyncRequest),
+		fetched:  make(map[common.Hash][]byte),
+	}
+	if isEmptyRoot(root) {
+		return s, nil
+	}
+	if err := s.schedule(root, nil, 0); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// schedule request the node of hash if it's missing from db, otherwise its children
+// are scheduled
+func (s *SyncScheduler) schedule(hash common.Hash, path []byte, depth int) error {
+	if _, ok := s.known[hash]; ok {
+		return nil
+	}
+	s.known[hash] = struct{}{}
+	encoded, err := s.db.Get(nodeKey(hash))
+	if err != nil || len(encoded) == 0 {
+		s.seq++
+		heap.Push(s.queue, &SyncRequest{Hash: hash, Path: path, Depth: depth, Seq: s.seq})
+		return nil
+	}
+	return s.expand(hash, encoded, path, depth)
+}
+
+// expand schedule the children of the encoded node
+func (s *SyncScheduler) expand(hash common.Hash, encoded, path []byte, depth int) error {
+	n, err := decodeNode(encoded)
+	if err != nil {
+		return &MissingNodeError{Hash: hash, Err: err}
+	}
+	return forEachHashChild(n, path, func(child common.Hash, childPath []byte) error {
+		return s.schedule(child, childPath, depth+1)
+	})
+}
+
+// forEachHashChild call fn with the hash and path of every child of n stored by
+// hash, including children of its embedded children
+func forEachHashChild(n node, path []byte, fn func(hash common.Hash, path []byte) error) error {
+	switch n := n.(type) {
+	case *extNode:
+		return forEachHashChild(n.child, concat(common.CopyBytes(path), n.key), fn)
+	case *branchNode:
+		for i, child := range n.children {
+			if child == nil {
+				continue
+			}
+			if err := forEachHashChild(child, append(common.CopyBytes(path), byte(i)), fn); err != nil {
+				return err
+			}
+		}
+	case *hashNode:
+		return fn(n.Hash(), path)
+	}
+	return nil
+}
+
+// Missing return at most max nodes to fetch in the order of the policy, they are in
+// flight until delivered by Process or returned by Retry
+func (s *SyncScheduler) Missing(max int) []common.Hash {
+	hashes := make([]common.Hash, 0, max)
+	for len(hashes) < max && s.queue.Len() > 0 {
+		request := heap.Pop(s.queue).(*SyncRequest)
+		s.inflight[request.Hash] = request
+		hashes = append(hashes, request.Hash)
+	}
+	return hashes
+}
+
+// Retry return an in flight node to the queue, e.g. when fetching it failed
+func (s *SyncScheduler) Retry(hash common.Hash) {
+	if request, ok := s.inflight[hash]; ok {
+		delete(s.inflight, hash)
+		heap.Push(s.queue, request)
+	}
+}
+
+// Process deliver the encoded node of an in flight hash, it's verified against the
+// hash and its missing children are scheduled
+func (s *SyncScheduler) Process(hash common.Hash, encoded []byte) error {
+	request, ok := s.inflight[hash]
+	if !ok {
+		return fmt.Errorf("node %s is not requested", hash.Hex())
+	}
+	if keccak256Hash(encoded) != hash {
+		return fmt.Errorf("node %s doesn't match its hash", hash.Hex())
+	}
+	if err := s.expand(hash, encoded, request.Path, request.Depth); err != nil {
+		return err
+	}
+	delete(s.inflight, hash)
+	s.fetched[hash] = common.CopyBytes(encoded)
+	return nil
+}
+
+// Commit write the nodes delivered since the last commit to w, and return the number
+// of written nodes
+func (s *SyncScheduler) Commit(w db.KeyValueWriter) (int, error) {
+	n := 0
+	for hash, encoded := range s.fetched {
+		if err := w.Put(nodeKey(hash), encoded); err != nil {
+			return n, err
+		}
+		delete(s.fetched, hash)
+		n++
+	}
+	return n, nil
+}
+
+// Pending return the number of nodes queued or in flight, the sync is done once it's
+// zero and delivered nodes are committed
+func (s *SyncScheduler) Pending() int {
+	return s.queue.Len() + len(s.inflight)
+}
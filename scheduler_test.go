@@ -0,0 +1,114 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+// syncRound fetch at most max missing nodes from source and commit them to db, and
+// return the requests in the order they are fetched
+func syncRound(t *testing.T, s *SyncScheduler, source, db *memorydb.Database, max int) []common.Hash {
+	hashes := s.Missing(max)
+	for _, hash := range hashes {
+		encoded, err := source.Get(nodeKey(hash))
+		assert.Nil(t, err)
+		assert.Nil(t, s.Process(hash, encoded))
+	}
+	_, err := s.Commit(db)
+	assert.Nil(t, err)
+	return hashes
+}
+
+func TestSyncScheduler(t *testing.T) {
+	source := memorydb.New()
+	trie, kvs := persistedTrie(source, 500)
+	root := trie.StateRoot()
+	db := memorydb.New()
+	s, err := NewSyncScheduler(root, db, nil)
+	assert.Nil(t, err)
+
+	depths := make(map[common.Hash]int)
+	depths[root] = 0
+	lastDepth := 0
+	for s.Pending() > 0 {
+		for _, hash := range syncRound(t, s, source, db, 16) {
+			depth, ok := depths[hash]
+			assert.True(t, ok)
+			// shallow nodes are fetched first
+			assert.True(t, depth >= lastDepth)
+			lastDepth = depth
+			encoded, _ := source.Get(nodeKey(hash))
+			assert.Nil(t, childRefs(encoded, func(child common.Hash) {
+				depths[child] = depth + 1
+			}))
+		}
+	}
+	assert.Equal(t, source.Len(), db.Len())
+	reader := NewTrie(root, db)
+	for _, elem := range kvs {
+		assert.Equal(t, elem.v, reader.Get(elem.k))
+	}
+
+	// unrequested and corrupted nodes are rejected
+	s, _ = NewSyncScheduler(root, memorydb.New(), nil)
+	encoded, _ := source.Get(nodeKey(root))
+	assert.NotNil(t, s.Process(root, encoded))
+	assert.Equal(t, []common.Hash{root}, s.Missing(10))
+	assert.NotNil(t, s.Process(root, encoded[1:]))
+	s.Retry(root)
+	assert.Equal(t, []common.Hash{root}, s.Missing(10))
+	assert.Nil(t, s.Process(root, encoded))
+}
+
+func TestSyncSchedulerResume(t *testing.T) {
+	source := memorydb.New()
+	trie, kvs := persistedTrie(source, 300)
+	db := memorydb.New()
+	s, _ := NewSyncScheduler(trie.StateRoot(), db, DeepFirst)
+	for i := 0; i < 10; i++ {
+		syncRound(t, s, source, db, 8)
+	}
+	// nodes in db are walked, so only missing nodes are requested again
+	partial := db.Len()
+	s, err := NewSyncScheduler(trie.StateRoot(), db, DiscoveryOrder)
+	assert.Nil(t, err)
+	fetched := 0
+	for s.Pending() > 0 {
+		fetched += len(syncRound(t, s, source, db, 8))
+	}
+	assert.Equal(t, source.Len()-partial, fetched)
+	reader := NewTrie(trie.StateRoot(), db)
+	for _, elem := range kvs {
+		assert.Equal(t, elem.v, reader.Get(elem.k))
+	}
+}
+
+func TestSyncSchedulerKeysFirst(t *testing.T) {
+	source := memorydb.New()
+	trie, kvs := persistedTrie(source, 500)
+	hot := kvs[100]
+	db := memorydb.New()
+	s, _ := NewSyncScheduler(trie.StateRoot(), db, KeysFirst([][]byte{hot.k}))
+	// the path of the hot key is fetched first, one node per level
+	fetched := 0
+	for {
+		value, err := NewTrie(trie.StateRoot(), db).TryGet(hot.k)
+		if err == nil {
+			assert.Equal(t, hot.v, value)
+			break
+		}
+		fetched += len(syncRound(t, s, source, db, 1))
+	}
+	assert.True(t, fetched < 10)
+	assert.True(t, s.Pending() > 0)
+	for s.Pending() > 0 {
+		syncRound(t, s, source, db, 16)
+	}
+	assert.Equal(t, source.Len(), db.Len())
+}
@@ -0,0 +1,76 @@
+package mpt
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// The layout of the keyspace in underlying db, all keys written by this package
+// must be built by the key builders below. The key of a trie node is the hash of
+// the node without prefix, so that dbs written by earlier versions remain readable.
+// The key of other records is a schema prefix followed by the identifier of the
+// record, all prefixes start with schemaPrefix and none of them is a prefix of
+// another, a prefixed key can't be taken as a node key unless it's a preimage of
+// keccak256
+var (
+	schemaPrefix = []byte("mpt-")
+
+	metaPrefix         = []byte("mpt-meta-")
+	commitReportPrefix = []byte("mpt-commit-report-")
+	cacheStatsPrefix   = []byte("mpt-cache-stats")
+	schemaKeyPrefix    = []byte("mpt-schema")
+
+	snapshotEntryPrefix  = []byte("mpt-snapshot-entry-")
+	snapshotMarkerPrefix = []byte("mpt-snapshot-marker")
+)
+
+// schemaPrefixes is all prefixes of records other than trie nodes
+var schemaPrefixes = [][]byte{
+	metaPrefix,
+	commitReportPrefix,
+	cacheStatsPrefix,
+	schemaKeyPrefix,
+	snapshotEntryPrefix,
+	snapshotMarkerPrefix,
+}
+
+func prefixedKey(prefix []byte, id []byte) []byte {
+	key := make([]byte, len(prefix)+len(id))
+	copy(key, prefix)
+	copy(key[len(prefix):], id)
+	return key
+}
+
+// nodeKey return the key of the encoded trie node whose hash is hash
+func nodeKey(hash common.Hash) []byte {
+	return hash[:]
+}
+
+// metaKey return the key of metadata of root
+func metaKey(root common.Hash) []byte {
+	return prefixedKey(metaPrefix, root[:])
+}
+
+// commitReportKey return the key of the CommitReport of root
+func commitReportKey(root common.Hash) []byte {
+	return prefixedKey(commitReportPrefix, root[:])
+}
+
+// cacheStatsKey return the key of the persisted CacheStats
+func cacheStatsKey() []byte {
+	return prefixedKey(cacheStatsPrefix, nil)
+}
+
+// schemaKey return the key of the SchemaDescriptor of the db
+func schemaKey() []byte {
+	return prefixedKey(schemaKeyPrefix, nil)
+}
+
+// snapshotEntryKey return the key of key in the flat snapshot
+func snapshotEntryKey(key []byte) []byte {
+	return prefixedKey(snapshotEntryPrefix, key)
+}
+
+// snapshotMarkerKey return the key of the resume marker of the flat snapshot
+func snapshotMarkerKey() []byte {
+	return prefixedKey(snapshotMarkerPrefix, nil)
+}
@@ -0,0 +1,40 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaPrefixes(t *testing.T) {
+	for i, a := range schemaPrefixes {
+		assert.True(t, bytes.HasPrefix(a, schemaPrefix))
+		for j, b := range schemaPrefixes {
+			if i != j {
+				assert.False(t, bytes.HasPrefix(a, b), "%s is prefix of %s", b, a)
+			}
+		}
+	}
+}
+
+func TestSchemaKeys(t *testing.T) {
+	hash := common.BytesToHash(randomBytes())
+	assert.Equal(t, hash[:], nodeKey(hash))
+	assert.Equal(t, common.HashLength, len(nodeKey(hash)))
+	keys := [][]byte{metaKey(hash), commitReportKey(hash), cacheStatsKey(), schemaKey(),
+		snapshotEntryKey(hash[:]), snapshotMarkerKey()}
+	for i, key := range keys {
+		assert.True(t, bytes.HasPrefix(key, schemaPrefixes[i]))
+		assert.NotEqual(t, common.HashLength, len(key))
+	}
+	// reports stored before the schema keep their keys
+	assert.Equal(t, append([]byte("mpt-commit-report-"), hash[:]...), commitReportKey(hash))
+	// building a key never change the shared prefix
+	metaKey(hash)
+	assert.Equal(t, []byte("mpt-meta-"), metaPrefix)
+}
@@ -0,0 +1,102 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+)
+
+// ErrNotMember is returned when proving the membership of a key absent from a set
+var ErrNotMember = errors.New("key is not a member of the set")
+
+// ErrMember is returned when proving the absence of a key present in a set
+var ErrMember = errors.New("key is a member of the set")
+
+// Set is an authenticated set of keys backed by a trie, e.g. a validator set or an
+// allowlist, members are keys with empty values, which are encoded as leaves with
+// no value field, so a member cost only its key. Like Trie, a set is immutable,
+// Add and Remove return a new set
+type Set struct {
+	trie *Trie
+}
+
+// NewSet open the set of root in kvs, the options are those of NewTrie
+func NewSet(root common.Hash, kvs db.KeyValueStore, opts ...Option) *Set {
+	return &Set{trie: NewTrie(root, kvs, opts...)}
+}
+
+// Trie return the trie of the set, it's used to commit the set and to serve it as
+// a trie, e.g. by Persist or Commit
+func (s *Set) Trie() *Trie {
+	return s.trie
+}
+
+// Root return the root of the set
+func (s *Set) Root() common.Hash {
+	return s.trie.StateRoot()
+}
+
+// Add return a set with key added, ErrStaleTrie is returned if the set is stale, and
+// MissingNodeError if nodes are missing for other reasons
+func (s *Set) Add(key []byte) (*Set, error) {
+	t, err := s.trie.TryInsert(key, []byte{})
+	if err != nil {
+		return nil, err
+	}
+	return &Set{trie: t}, nil
+}
+
+// Remove return a set with key removed, errors are those of Add
+func (s *Set) Remove(key []byte) (*Set, error) {
+	t, err := s.trie.TryDelete(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Set{trie: t}, nil
+}
+
+// Contains report whether key is a member of the set, errors are those of TryGet
+func (s *Set) Contains(key []byte) (bool, error) {
+	value, err := s.trie.TryGet(key)
+	return value != nil, err
+}
+
+// ProveMember return the proof that key is a member of the set, it's verified by
+// VerifyMember. ErrNotMember is returned if key is absent
+func (s *Set) ProveMember(key []byte) ([][]byte, error) {
+	member, err := s.Contains(key)
+	if err != nil {
+		return nil, err
+	}
+	if !member {
+		return nil, ErrNotMember
+	}
+	return s.trie.Prove(key)
+}
+
+// ProveNonMember return the proof that key is absent from the set, it's verified
+// by VerifyNonMember. ErrMember is returned if key is present
+func (s *Set) ProveNonMember(key []byte) ([][]byte, error) {
+	member, err := s.Contains(key)
+	if err != nil {
+		return nil, err
+	}
+	if member {
+		return nil, ErrMember
+	}
+	return s.trie.Prove(key)
+}
+
+// VerifyMember verify that key is a member of the set of root by proof
+func VerifyMember(root common.Hash, key []byte, proof [][]byte) error {
+	return VerifyProofBatch(root, []ProofItem{{Key: key, Value: []byte{}, Proof: proof}})
+}
+
+// VerifyNonMember verify that key is absent from the set of root by proof
+func VerifyNonMember(root common.Hash, key []byte, proof [][]byte) error {
+	return VerifyProofBatch(root, []ProofItem{{Key: key, Proof: proof}})
+}
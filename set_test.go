@@ -0,0 +1,64 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSet(t *testing.T) {
+	memDB := memorydb.New()
+	set := NewSet(EmptyHash, memDB)
+	members := [][]byte{[]byte("alice"), []byte("al"), []byte("bob"), []byte("carol")}
+	var err error
+	for _, key := range members {
+		set, err = set.Add(key)
+		assert.Nil(t, err)
+	}
+	set.Trie().Persist()
+	set = NewSet(set.Root(), memDB)
+	for _, key := range members {
+		member, err := set.Contains(key)
+		assert.Nil(t, err)
+		assert.True(t, member)
+		proof, err := set.ProveMember(key)
+		assert.Nil(t, err)
+		assert.Nil(t, VerifyMember(set.Root(), key, proof))
+		assert.NotNil(t, VerifyNonMember(set.Root(), key, proof))
+		_, err = set.ProveNonMember(key)
+		assert.Equal(t, ErrMember, err)
+	}
+
+	absent := []byte("a")
+	member, err := set.Contains(absent)
+	assert.Nil(t, err)
+	assert.False(t, member)
+	_, err = set.ProveMember(absent)
+	assert.Equal(t, ErrNotMember, err)
+	proof, err := set.ProveNonMember(absent)
+	assert.Nil(t, err)
+	assert.Nil(t, VerifyNonMember(set.Root(), absent, proof))
+	assert.NotNil(t, VerifyMember(set.Root(), absent, proof))
+
+	// sets are immutable
+	removed, err := set.Remove([]byte("bob"))
+	assert.Nil(t, err)
+	member, _ = removed.Contains([]byte("bob"))
+	assert.False(t, member)
+	member, _ = set.Contains([]byte("bob"))
+	assert.True(t, member)
+}
+
+func TestSetEncoding(t *testing.T) {
+	set := NewSet(EmptyHash, memorydb.New())
+	set, _ = set.Add([]byte("member"))
+	// a member is a leaf without a value field
+	root, err := set.Trie().resolveHash(set.Root())
+	assert.Nil(t, err)
+	keyBytes, _ := encodeKey(bytesToNibbles([]byte("member")), leafType)
+	assert.Equal(t, FieldOverhead+len(keyBytes)+NodeFlagSize, len(root.Encode()))
+}
@@ -0,0 +1,236 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"fmt"
+	"strings"
+
+	db "github.com/ethereum/go-ethereum/ethdb"
+)
+
+// maxColumns is the max number of columns of ShardedStore, keys are sharded by
+// their first byte
+const maxColumns = 256
+
+// ShardedStore is a db which shard keys by their first byte across columns, e.g.
+// column families of the storage backend. Node keys are hashes, so the writes of
+// a large commit are spread evenly across columns rather than hammering a single
+// keyspace region, and each column is compacted independently. Columns own
+// contiguous ranges of the first byte, so iterating columns one by one visit keys
+// in order
+type ShardedStore struct {
+	columns []db.KeyValueStore
+}
+
+// NewShardedStore create a store sharding keys across columns, it panics if the
+// number of columns is 0 or greater than 256
+func NewShardedStore(columns ...db.KeyValueStore) *ShardedStore {
+	if len(columns) == 0 || len(columns) > maxColumns {
+		panic(fmt.Errorf("invalid number of columns: %d", len(columns)))
+	}
+	return &ShardedStore{columns: append([]db.KeyValueStore{}, columns...)}
+}
+
+// Columns return the number of columns
+func (s *ShardedStore) Columns() int {
+	return len(s.columns)
+}
+
+// column return the index of the column key belong to
+func (s *ShardedStore) column(key []byte) int {
+	if len(key) == 0 {
+		return 0
+	}
+	return int(key[0]) * len(s.columns) / maxColumns
+}
+
+// Has report whether key is in its column
+func (s *ShardedStore) Has(key []byte) (bool, error) {
+	return s.columns[s.column(key)].Has(key)
+}
+
+// Get return the value of key from its column
+func (s *ShardedStore) Get(key []byte) ([]byte, error) {
+	return s.columns[s.column(key)].Get(key)
+}
+
+// Put write key and value to its column
+func (s *ShardedStore) Put(key []byte, value []byte) error {
+	return s.columns[s.column(key)].Put(key, value)
+}
+
+// Delete delete key from its column
+func (s *ShardedStore) Delete(key []byte) error {
+	return s.columns[s.column(key)].Delete(key)
+}
+
+// NewBatch create a batch which buffer writes of every column
+func (s *ShardedStore) NewBatch() db.Batch {
+	b := &shardedBatch{
+		store:   s,
+		puts:    make([]db.Batch, len(s.columns)),
+		deletes: make([]db.Batch, len(s.columns)),
+	}
+	for i, column := range s.columns {
+		b.puts[i] = column.NewBatch()
+		b.deletes[i] = column.NewBatch()
+	}
+	return b
+}
+
+// NewIterator iterate keys of all columns in key order
+func (s *ShardedStore) NewIterator(prefix []byte, start []byte) db.Iterator {
+	return &shardedIterator{
+		store:  s,
+		prefix: prefix,
+		start:  start,
+	}
+}
+
+// Stat return the property of every column
+func (s *ShardedStore) Stat(property string) (string, error) {
+	stats := make([]string, 0, len(s.columns))
+	for i, column := range s.columns {
+		stat, err := column.Stat(property)
+		if err != nil {
+			return "", err
+		}
+		stats = append(stats, fmt.Sprintf("column %d:\n%s", i, stat))
+	}
+	return strings.Join(stats, "\n"), nil
+}
+
+// Compact compact the key range of every column
+func (s *ShardedStore) Compact(start []byte, limit []byte) error {
+	for _, column := range s.columns {
+		if err := column.Compact(start, limit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close close all columns, and return the first error
+func (s *ShardedStore) Close() error {
+	var firstErr error
+	for _, column := range s.columns {
+		if err := column.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// shardedBatch keep puts and deletes of every column in separate batches, puts of
+// all columns are written before deletes, writes to different columns aren't
+// atomic, but if Write is interrupted the db hold a superset of nodes of both the
+// old and new roots
+type shardedBatch struct {
+	store   *ShardedStore
+	puts    []db.Batch
+	deletes []db.Batch
+}
+
+func (b *shardedBatch) Put(key []byte, value []byte) error {
+	return b.puts[b.store.column(key)].Put(key, value)
+}
+
+func (b *shardedBatch) Delete(key []byte) error {
+	return b.deletes[b.store.column(key)].Delete(key)
+}
+
+func (b *shardedBatch) ValueSize() int {
+	size := 0
+	for i := range b.puts {
+		size += b.puts[i].ValueSize() + b.deletes[i].ValueSize()
+	}
+	return size
+}
+
+func (b *shardedBatch) Write() error {
+	for _, batches := range [][]db.Batch{b.puts, b.deletes} {
+		for _, batch := range batches {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *shardedBatch) Reset() {
+	for i := range b.puts {
+		b.puts[i].Reset()
+		b.deletes[i].Reset()
+	}
+}
+
+func (b *shardedBatch) Replay(w db.KeyValueWriter) error {
+	for _, batches := range [][]db.Batch{b.puts, b.deletes} {
+		for _, batch := range batches {
+			if err := batch.Replay(w); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// shardedIterator iterate columns one by one, next is the index of the column
+// to iterate after current is exhausted
+type shardedIterator struct {
+	store   *ShardedStore
+	prefix  []byte
+	start   []byte
+	current db.Iterator
+	next    int
+	err     error
+}
+
+func (it *shardedIterator) Next() bool {
+	for it.err == nil {
+		if it.current != nil {
+			if it.current.Next() {
+				return true
+			}
+			it.err = it.current.Error()
+			it.current.Release()
+			it.current = nil
+			continue
+		}
+		if it.next == len(it.store.columns) {
+			return false
+		}
+		it.current = it.store.columns[it.next].NewIterator(it.prefix, it.start)
+		it.next++
+	}
+	return false
+}
+
+func (it *shardedIterator) Error() error {
+	return it.err
+}
+
+func (it *shardedIterator) Key() []byte {
+	if it.current == nil {
+		return nil
+	}
+	return it.current.Key()
+}
+
+func (it *shardedIterator) Value() []byte {
+	if it.current == nil {
+		return nil
+	}
+	return it.current.Value()
+}
+
+func (it *shardedIterator) Release() {
+	if it.current != nil {
+		it.current.Release()
+		it.current = nil
+	}
+	it.next = len(it.store.columns)
+}
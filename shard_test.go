@@ -0,0 +1,103 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func newShardedStore(n int) (*ShardedStore, []*memorydb.Database) {
+	dbs := make([]*memorydb.Database, n)
+	columns := make([]db.KeyValueStore, n)
+	for i := range dbs {
+		dbs[i] = memorydb.New()
+		columns[i] = dbs[i]
+	}
+	return NewShardedStore(columns...), dbs
+}
+
+func TestShardedStore(t *testing.T) {
+	store, columns := newShardedStore(4)
+	plainDB := memorydb.New()
+	plain, kvs := persistedTrie(plainDB, 500)
+	trie := NewTrie(EmptyHash, store)
+	for _, elem := range kvs {
+		trie = trie.Insert(elem.k, elem.v)
+	}
+	trie.Persist()
+	assert.Equal(t, plain.StateRoot(), trie.StateRoot())
+
+	// every column own a quarter of the first byte
+	total := 0
+	for i, column := range columns {
+		assert.True(t, column.Len() > 0)
+		total += column.Len()
+		it := column.NewIterator(nil, nil)
+		for it.Next() {
+			assert.Equal(t, i, int(it.Key()[0])/64)
+		}
+		it.Release()
+	}
+	assert.Equal(t, plainDB.Len(), total)
+
+	// keys of all columns are iterated in order
+	it := store.NewIterator(nil, nil)
+	expected := plainDB.NewIterator(nil, nil)
+	for expected.Next() {
+		assert.True(t, it.Next())
+		assert.Equal(t, expected.Key(), it.Key())
+		assert.Equal(t, expected.Value(), it.Value())
+	}
+	assert.False(t, it.Next())
+	assert.Nil(t, it.Error())
+	it.Release()
+	expected.Release()
+
+	// replaced nodes are deleted from their columns
+	for _, elem := range kvs[:100] {
+		trie = trie.Delete(elem.k)
+		plain = plain.Delete(elem.k)
+	}
+	trie.Persist()
+	plain.Persist()
+	total = 0
+	for _, column := range columns {
+		total += column.Len()
+	}
+	assert.Equal(t, plainDB.Len(), total)
+	reloaded := NewTrie(trie.StateRoot(), store)
+	checkIterate(t, reloaded, kvMap(kvs[100:]))
+	assert.Nil(t, checkSubtree(store, trie.StateRoot(), make(map[common.Hash]struct{})))
+}
+
+func TestShardedBatch(t *testing.T) {
+	store, _ := newShardedStore(3)
+	batch := store.NewBatch()
+	for _, key := range [][]byte{{0x00}, {0x80, 0x01}, {0xff}} {
+		assert.Nil(t, batch.Put(key, key))
+	}
+	assert.Nil(t, batch.Delete([]byte{0x80, 0x01}))
+	replayed := memorydb.New()
+	assert.Nil(t, batch.Replay(replayed))
+	assert.Nil(t, batch.Write())
+	for _, s := range []db.KeyValueReader{store, replayed} {
+		for _, key := range [][]byte{{0x00}, {0xff}} {
+			value, err := s.Get(key)
+			assert.Nil(t, err)
+			assert.Equal(t, key, value)
+		}
+		has, err := s.Has([]byte{0x80, 0x01})
+		assert.Nil(t, err)
+		assert.False(t, has)
+	}
+	batch.Reset()
+	assert.Equal(t, 0, batch.ValueSize())
+
+	assert.Panics(t, func() { NewShardedStore() })
+}
@@ -0,0 +1,159 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Payloads of the account range and storage ranges responses of the snap protocol,
+// fields are in the order of the protocol, so rlp.EncodeToBytes of them is the
+// payload of the messages, and rlp.DecodeBytes decode the payloads of peers.
+//
+// The payloads are only the format, the proofs are nodes of this package, which are
+// not the RLP nodes of go-ethereum, and roots of tries are different from Ethereum
+// state roots for the same contents. Peers must verify ranges against roots of this
+// package with VerifyProofBatch, so they can be served to peers built on it, or to
+// tools reading snap payloads, but not to go-ethereum peers syncing Ethereum state
+
+// maxHash is the last hash, the limit of a whole storage trie
+var maxHash = common.BytesToHash(bytes.Repeat([]byte{0xff}, common.HashLength))
+
+// SnapAccount is an account of an account range, Body is the value of the account
+// as stored in the trie, e.g. the slim RLP of the account
+type SnapAccount struct {
+	Hash common.Hash
+	Body rlp.RawValue
+}
+
+// SnapAccountRange is the payload of the account range response
+type SnapAccountRange struct {
+	ID       uint64
+	Accounts []*SnapAccount
+	Proof    [][]byte
+}
+
+// SnapStorageSlot is a storage slot of a storage range, Body is the value of the slot
+type SnapStorageSlot struct {
+	Hash common.Hash
+	Body []byte
+}
+
+// SnapStorageRanges is the payload of the storage ranges response, Slots[i] is the
+// slots of the i-th requested storage root
+type SnapStorageRanges struct {
+	ID    uint64
+	Slots [][]*SnapStorageSlot
+	Proof [][]byte
+}
+
+// SnapAccountRange return the accounts of the trie from origin in key order, keys of
+// the trie must be 32 bytes hashes, and values must be RLP. Like the snap protocol, accounts are returned
+// until one at or after limit is returned or their size reach maxBytes, so the range
+// is proved up to limit, and at least one account is returned if there is any. The
+// proof is the proofs of origin and the last account
+func (t *Trie) SnapAccountRange(id uint64, origin, limit common.Hash, maxBytes int) (*SnapAccountRange, error) {
+	keys, values, _, err := t.snapRange(origin, limit, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	resp := &SnapAccountRange{ID: id, Accounts: make([]*SnapAccount, 0, len(keys))}
+	for i, key := range keys {
+		// the body is embedded in the payload as is, so it must be a single RLP value
+		if _, _, rest, err := rlp.Split(values[i]); err != nil || len(rest) > 0 {
+			return nil, fmt.Errorf("value of account %x is not RLP", key)
+		}
+		resp.Accounts = append(resp.Accounts, &SnapAccount{Hash: key, Body: values[i]})
+	}
+	if resp.Proof, err = t.snapProof(origin, keys); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// SnapStorageRanges return the slots of the storage tries of roots, which are in the
+// same db as the trie. Like the snap protocol, origin apply to the first trie and
+// limit to the last one, storage tries are returned whole until their size reach
+// maxBytes, and the proof is only returned for the last trie if it's cut by the
+// budget or start from a nonzero origin, complete tries are proved by their roots
+func (t *Trie) SnapStorageRanges(id uint64, roots []common.Hash, origin, limit common.Hash, maxBytes int) (*SnapStorageRanges, error) {
+	resp := &SnapStorageRanges{ID: id, Slots: make([][]*SnapStorageSlot, 0, len(roots))}
+	size := 0
+	for i, root := range roots {
+		start, end := common.Hash{}, maxHash
+		if i == 0 {
+			start = origin
+		}
+		if i == len(roots)-1 {
+			end = limit
+		}
+		budget := 0
+		if maxBytes > 0 {
+			if budget = maxBytes - size; budget <= 0 {
+				break
+			}
+		}
+		storage := t.derive(root, t.log.committed())
+		keys, values, more, err := storage.snapRange(start, end, budget)
+		if err != nil {
+			return nil, err
+		}
+		slots := make([]*SnapStorageSlot, 0, len(keys))
+		for j, key := range keys {
+			slots = append(slots, &SnapStorageSlot{Hash: key, Body: values[j]})
+			size += common.HashLength + len(values[j])
+		}
+		resp.Slots = append(resp.Slots, slots)
+		if more || start != (common.Hash{}) || end != maxHash {
+			if resp.Proof, err = storage.snapProof(start, keys); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	return resp, nil
+}
+
+// snapRange return key values from origin until one at or after limit, or until
+// their size reach maxBytes, more report whether it's stopped by maxBytes
+func (t *Trie) snapRange(origin, limit common.Hash, maxBytes int) (keys []common.Hash, values [][]byte, more bool, err error) {
+	keys = make([]common.Hash, 0)
+	values = make([][]byte, 0)
+	size := 0
+	var invalid []byte
+	err = t.IterateFrom(origin[:], func(key, value []byte) bool {
+		if len(key) != common.HashLength {
+			invalid = common.CopyBytes(key)
+			return false
+		}
+		if maxBytes > 0 && size >= maxBytes {
+			more = true
+			return false
+		}
+		keys = append(keys, common.BytesToHash(key))
+		values = append(values, common.CopyBytes(value))
+		size += len(key) + len(value)
+		return bytes.Compare(key, limit[:]) < 0
+	})
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if invalid != nil {
+		return nil, nil, false, fmt.Errorf("key %x is not a 32 bytes hash", invalid)
+	}
+	return keys, values, more, nil
+}
+
+// snapProof return the proofs of origin and the last key
+func (t *Trie) snapProof(origin common.Hash, keys []common.Hash) ([][]byte, error) {
+	bounds := [][]byte{origin[:]}
+	if len(keys) > 0 {
+		bounds = append(bounds, keys[len(keys)-1][:])
+	}
+	return t.boundaryProof(bounds...)
+}
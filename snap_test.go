@@ -0,0 +1,117 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/stretchr/testify/assert"
+)
+
+// hashedTrie persist a trie of n random RLP values keyed by hashes
+func hashedTrie(memDB *memorydb.Database, n int) (*Trie, []kv) {
+	trie := NewTrie(EmptyHash, memDB)
+	kvs := make(map[string][]byte, n)
+	for i := 0; i < n; i++ {
+		key := crypto.Keccak256(randomBytes())
+		kvs[string(key)], _ = rlp.EncodeToBytes(randomBytes())
+		trie = trie.Insert(key, kvs[string(key)])
+	}
+	trie.Persist()
+	return NewTrie(trie.StateRoot(), memDB), sortedKVs(kvs)
+}
+
+// checkSnapProof verify the proof of a range from origin
+func checkSnapProof(t *testing.T, root, origin common.Hash, model map[string][]byte, keys []common.Hash, proof [][]byte) {
+	items := []ProofItem{{Key: origin[:], Value: model[string(origin[:])], Proof: proof}}
+	if len(keys) > 0 {
+		last := keys[len(keys)-1]
+		items = append(items, ProofItem{Key: last[:], Value: model[string(last[:])]})
+	}
+	assert.Nil(t, VerifyProofBatch(root, items))
+}
+
+func TestSnapAccountRange(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := hashedTrie(memDB, 100)
+	model := kvMap(kvs)
+	origin := common.BytesToHash(kvs[10].k)
+	resp, err := trie.SnapAccountRange(7, origin, maxHash, 500)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7), resp.ID)
+	assert.True(t, len(resp.Accounts) > 0 && len(resp.Accounts) < 90)
+	keys := make([]common.Hash, 0)
+	for i, account := range resp.Accounts {
+		assert.Equal(t, kvs[10+i].k, account.Hash[:])
+		assert.Equal(t, kvs[10+i].v, []byte(account.Body))
+		keys = append(keys, account.Hash)
+	}
+	checkSnapProof(t, trie.StateRoot(), origin, model, keys, resp.Proof)
+
+	// the first account at or after limit end the range
+	limit := common.BytesToHash(kvs[20].k)
+	limit[31]--
+	resp, err = trie.SnapAccountRange(7, common.Hash{}, limit, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 21, len(resp.Accounts))
+
+	// the payload is the RLP of the response
+	encoded, err := rlp.EncodeToBytes(resp)
+	assert.Nil(t, err)
+	var decoded SnapAccountRange
+	assert.Nil(t, rlp.DecodeBytes(encoded, &decoded))
+	assert.Equal(t, resp, &decoded)
+
+	_, err = trie.Insert(kvs[0].k, []byte{0xc2, 0x01}).SnapAccountRange(7, common.Hash{}, maxHash, 0)
+	assert.NotNil(t, err)
+	_, err = trie.Insert([]byte("short"), []byte{0x01}).SnapAccountRange(7, common.Hash{}, maxHash, 0)
+	assert.NotNil(t, err)
+}
+
+func TestSnapStorageRanges(t *testing.T) {
+	memDB := memorydb.New()
+	tries := make([]*Trie, 3)
+	roots := make([]common.Hash, 3)
+	models := make([][]kv, 3)
+	for i := range tries {
+		tries[i], models[i] = hashedTrie(memDB, 30+i*20)
+		roots[i] = tries[i].StateRoot()
+	}
+	// whole storage tries are proved by their roots
+	resp, err := tries[0].SnapStorageRanges(1, roots, common.Hash{}, maxHash, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(resp.Slots))
+	for i, slots := range resp.Slots {
+		assert.Equal(t, len(models[i]), len(slots))
+	}
+	assert.Empty(t, resp.Proof)
+
+	// the budget cut the second trie, which is proved
+	budget := 0
+	for _, elem := range models[0] {
+		budget += common.HashLength + len(elem.v)
+	}
+	budget += len(models[1]) / 2 * common.HashLength
+	resp, err = tries[0].SnapStorageRanges(1, roots, common.Hash{}, maxHash, budget)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(resp.Slots))
+	assert.Equal(t, len(models[0]), len(resp.Slots[0]))
+	partial := resp.Slots[1]
+	assert.True(t, len(partial) > 0 && len(partial) < len(models[1]))
+	keys := make([]common.Hash, 0)
+	for _, slot := range partial {
+		keys = append(keys, slot.Hash)
+	}
+	checkSnapProof(t, roots[1], common.Hash{}, kvMap(models[1]), keys, resp.Proof)
+
+	encoded, err := rlp.EncodeToBytes(resp)
+	assert.Nil(t, err)
+	var decoded SnapStorageRanges
+	assert.Nil(t, rlp.DecodeBytes(encoded, &decoded))
+	assert.Equal(t, resp, &decoded)
+}
@@ -0,0 +1,76 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"errors"
+
+	db "github.com/ethereum/go-ethereum/ethdb"
+)
+
+// ErrSnapshotUnsupported is returned by WithDBSnapshot if underlying db can't take snapshots
+var ErrSnapshotUnsupported = errors.New("db doesn't support snapshots")
+
+// DBSnapshot is a point-in-time read only view of a db, it must be released after use
+type DBSnapshot interface {
+	db.KeyValueReader
+	Release()
+}
+
+// Snapshotter is implemented by dbs which can take snapshots, e.g. LevelDB. The dbs
+// of go-ethereum don't implement it, a db which can take snapshots must be wrapped
+// to be a Snapshotter
+type Snapshotter interface {
+	NewSnapshot() (DBSnapshot, error)
+}
+
+// snapshotStore read from snapshot, writes still go to the db
+type snapshotStore struct {
+	db.KeyValueStore
+	snapshot DBSnapshot
+}
+
+func (s *snapshotStore) Has(key []byte) (bool, error) {
+	return s.snapshot.Has(key)
+}
+
+func (s *snapshotStore) Get(key []byte) ([]byte, error) {
+	return s.snapshot.Get(key)
+}
+
+// WithDBSnapshot return a trie of the same root and changes whose reads come from
+// a point-in-time snapshot of underlying db, so a commit running in another goroutine
+// can't tear the reads of the trie, e.g. prune nodes halfway through an iteration.
+// Tries derived from it share the snapshot, and Persist still write to underlying
+// db. ErrSnapshotUnsupported is returned if underlying db isn't a Snapshotter, e.g.
+// the Database of go-ethereum's ethdb/leveldb, use LevelDB for goleveldb dbs. Call
+// ReleaseDBSnapshot once the trie is no longer used
+func (t *Trie) WithDBSnapshot() (*Trie, error) {
+	kvs := t.db
+	if s, ok := kvs.(*snapshotStore); ok {
+		kvs = s.KeyValueStore
+	}
+	snapshotter, ok := kvs.(Snapshotter)
+	if !ok {
+		return nil, ErrSnapshotUnsupported
+	}
+	snapshot, err := snapshotter.NewSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	newTrie := t.derive(t.rootHash, t.log)
+	newTrie.db = &snapshotStore{
+		KeyValueStore: kvs,
+		snapshot:      snapshot,
+	}
+	return newTrie, nil
+}
+
+// ReleaseDBSnapshot release the snapshot of a trie returned by WithDBSnapshot, tries
+// derived from it must not be used after that. It's no-op for other tries
+func (t *Trie) ReleaseDBSnapshot() {
+	if s, ok := t.db.(*snapshotStore); ok {
+		s.snapshot.Release()
+	}
+}
@@ -0,0 +1,83 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+// snapshotDB is a memory db which take snapshots by copying all key values
+type snapshotDB struct {
+	*memorydb.Database
+	released int
+}
+
+type memorySnapshot struct {
+	*memorydb.Database
+	db *snapshotDB
+}
+
+func (s *memorySnapshot) Release() {
+	s.db.released++
+}
+
+func (d *snapshotDB) NewSnapshot() (DBSnapshot, error) {
+	copied := memorydb.New()
+	it := d.NewIterator(nil, nil)
+	defer it.Release()
+	for it.Next() {
+		copied.Put(it.Key(), it.Value())
+	}
+	return &memorySnapshot{Database: copied, db: d}, nil
+}
+
+func TestWithDBSnapshot(t *testing.T) {
+	memDB := &snapshotDB{Database: memorydb.New()}
+	trie := NewTrie(EmptyHash, memDB)
+	kvs := uniqueKVs(200)
+	for _, elem := range kvs {
+		trie = trie.Insert(elem.k, elem.v)
+	}
+	trie.Persist()
+	trie = NewTrie(trie.StateRoot(), memDB)
+	snapshotTrie, err := trie.WithDBSnapshot()
+	assert.Nil(t, err)
+	assert.Equal(t, trie.StateRoot(), snapshotTrie.StateRoot())
+
+	// a commit prune nodes of the trie after the snapshot is taken
+	updated := trie
+	for _, elem := range kvs[:100] {
+		updated = updated.Delete(elem.k)
+	}
+	updated.Persist()
+	assert.True(t, trie.Stale())
+	assert.False(t, snapshotTrie.Stale())
+	checkIterate(t, snapshotTrie, kvMap(kvs))
+
+	// derived tries share the snapshot, and persist to underlying db
+	elem := newKV()
+	derived := snapshotTrie.Insert(elem.k, elem.v)
+	assert.Equal(t, kvs[0].v, derived.Get(kvs[0].k))
+	derived.PersistWithPruner(NewPruner(memDB, PrunerConfig{}))
+	assert.Equal(t, elem.v, NewTrie(derived.StateRoot(), memDB).Get(elem.k))
+
+	// take a new snapshot from a snapshot trie
+	again, err := NewTrie(updated.StateRoot(), memDB).WithDBSnapshot()
+	assert.Nil(t, err)
+	latest, err := again.WithDBSnapshot()
+	assert.Nil(t, err)
+	checkIterate(t, latest, kvMap(kvs[100:]))
+
+	snapshotTrie.ReleaseDBSnapshot()
+	again.ReleaseDBSnapshot()
+	latest.ReleaseDBSnapshot()
+	trie.ReleaseDBSnapshot()
+	assert.Equal(t, 3, memDB.released)
+
+	_, err = NewTrie(EmptyHash, memorydb.New()).WithDBSnapshot()
+	assert.Equal(t, ErrSnapshotUnsupported, err)
+}
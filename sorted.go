@@ -0,0 +1,219 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// KV is a key value pair
+type KV struct {
+	Key   []byte
+	Value []byte
+}
+
+// nibbleKV is a key value whose key is the nibbles relative to a node
+type nibbleKV struct {
+	key   []byte
+	value []byte
+}
+
+// ApplySorted insert kvs sorted by key to trie, return a new trie, old trie is
+// unchanged. It panics if kvs are not sorted or nodes can't be resolved, use
+// TryApplySorted to get the error instead
+func (t *Trie) ApplySorted(kvs []KV) *Trie {
+	newTrie, err := t.TryApplySorted(kvs)
+	if err != nil {
+		panic(err)
+	}
+	return newTrie
+}
+
+// TryApplySorted insert kvs to trie, keys of kvs must be in strictly ascending order
+// and values must not be nil, ErrValueTooLarge is returned if a value exceed the
+// bound of WithMaxValueSize. The kvs are merged into the trie in a single top-down
+// pass like a merge join, every node on the paths of kvs is resolved and rewritten
+// once, rather than once per key as repeated Insert do. The inserts are not recorded
+// by WithOpRecorder
+func (t *Trie) TryApplySorted(kvs []KV) (newTrie *Trie, err error) {
+	defer recoverResolveError(&err)
+	if len(kvs) == 0 {
+		return t, nil
+	}
+	entries := make([]nibbleKV, len(kvs))
+	for i, elem := range kvs {
+		if i > 0 && bytes.Compare(kvs[i-1].Key, elem.Key) >= 0 {
+			return nil, fmt.Errorf("key %x is not greater than the previous key %x", elem.Key, kvs[i-1].Key)
+		}
+		if elem.Value == nil {
+			return nil, fmt.Errorf("value of key %x is nil", elem.Key)
+		}
+		if t.config.maxValueSize > 0 && len(elem.Value) > t.config.maxValueSize {
+			return nil, ErrValueTooLarge
+		}
+		entries[i] = nibbleKV{key: bytesToNibbles(elem.Key), value: elem.Value}
+	}
+	var rootNode node
+	if !t.empty(t.rootHash) {
+		rootNode, err = t.resolveHash(t.rootHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	result := newInsertResult(nil)
+	result.newNode = t.applySorted(rootNode, entries, result)
+	if err := t.checkTargets(result); err != nil {
+		return nil, err
+	}
+	newTrie = t.derive(result.newNode.Hash(), t.log.mergeFromInsertResult(t.rootHash, result))
+	return newTrie.maybeAutoCommit()
+}
+
+// applySorted merge kvs into the subtree of startNode, and return the new node of
+// the subtree, new nodes and replaced nodes are recorded to result
+func (t *Trie) applySorted(startNode node, kvs []nibbleKV, result *insertResult) node {
+	switch n := startNode.(type) {
+	case nil:
+		return buildSorted(kvs, t.config.taggedRefs, result)
+	case *leafNode:
+		result.delete(n)
+		return buildSorted(mergeLeaf(n, kvs), t.config.taggedRefs, result)
+	case *extNode:
+		ml := len(n.key)
+		for _, elem := range kvs {
+			if l := matchingLength(elem.key, n.key); l < ml {
+				ml = l
+			}
+		}
+		result.delete(n)
+		if ml == len(n.key) {
+			newExt := newExtNode(n.key, t.applySorted(n.child, stripKeys(kvs, ml), result), n.tagged)
+			result.insert(newExt)
+			return newExt
+		}
+		// some keys diverge from the ext at ml, split the ext by a branch
+		var rest node = n.child
+		if len(n.key) > ml+1 {
+			rest = newExtNode(n.key[ml+1:], n.child, n.tagged)
+			result.insert(rest)
+		}
+		newNode := applySortedToBranch(t, branchWithChild(int(n.key[ml]), rest, nil, n.tagged), stripKeys(kvs, ml), result)
+		if ml > 0 {
+			newNode = newExtNode(n.key[:ml], newNode, n.tagged)
+			result.insert(newNode)
+		}
+		return newNode
+	case *branchNode:
+		result.delete(n)
+		return applySortedToBranch(t, n, kvs, result)
+	case *hashNode:
+		resolved, err := t.resolveHash(n.Hash())
+		if err != nil {
+			panic(&resolveError{err})
+		}
+		return t.applySorted(resolved, kvs, result)
+	default:
+		// this should never happen
+		return nil
+	}
+}
+
+// applySortedToBranch merge kvs into branch, the key of branch target is empty,
+// and other keys are grouped by their first nibble and merged into children
+func applySortedToBranch(t *Trie, branch *branchNode, kvs []nibbleKV, result *insertResult) node {
+	newBranch := &branchNode{
+		children: branch.children,
+		target:   branch.target,
+		tagged:   branch.tagged,
+	}
+	i := 0
+	if len(kvs[0].key) == 0 {
+		newBranch.target = kvs[0].value
+		i++
+	}
+	for i < len(kvs) {
+		pos := kvs[i].key[0]
+		j := i + 1
+		for j < len(kvs) && kvs[j].key[0] == pos {
+			j++
+		}
+		newBranch.children[pos] = t.applySorted(branch.children[pos], stripKeys(kvs[i:j], 1), result)
+		i = j
+	}
+	result.insert(newBranch)
+	return newBranch
+}
+
+// buildSorted build a new subtree from kvs, the child references of built nodes are
+// tagged if tagged is true
+func buildSorted(kvs []nibbleKV, tagged bool, result *insertResult) node {
+	if len(kvs) == 1 {
+		leaf := newLeafNode(common.CopyBytes(kvs[0].key), kvs[0].value)
+		result.insert(leaf)
+		return leaf
+	}
+	// keys are sorted, so the common prefix of the first and the last key is
+	// the common prefix of all keys
+	ml := matchingLength(kvs[0].key, kvs[len(kvs)-1].key)
+	if ml > 0 {
+		ext := newExtNode(common.CopyBytes(kvs[0].key[:ml]), buildSorted(stripKeys(kvs, ml), tagged, result), tagged)
+		result.insert(ext)
+		return ext
+	}
+	branch := &branchNode{tagged: tagged}
+	i := 0
+	if len(kvs[0].key) == 0 {
+		branch.target = kvs[0].value
+		i++
+	}
+	for i < len(kvs) {
+		pos := kvs[i].key[0]
+		j := i + 1
+		for j < len(kvs) && kvs[j].key[0] == pos {
+			j++
+		}
+		branch.children[pos] = buildSorted(stripKeys(kvs[i:j], 1), tagged, result)
+		i = j
+	}
+	result.insert(branch)
+	return branch
+}
+
+// mergeLeaf return kvs with the key value of leaf, value in kvs win if the key
+// of leaf is in kvs
+func mergeLeaf(leaf *leafNode, kvs []nibbleKV) []nibbleKV {
+	merged := make([]nibbleKV, 0, len(kvs)+1)
+	inserted := false
+	for _, elem := range kvs {
+		if !inserted {
+			switch bytes.Compare(leaf.key, elem.key) {
+			case -1:
+				merged = append(merged, nibbleKV{key: leaf.key, value: leaf.value})
+				inserted = true
+			case 0:
+				inserted = true
+			}
+		}
+		merged = append(merged, elem)
+	}
+	if !inserted {
+		merged = append(merged, nibbleKV{key: leaf.key, value: leaf.value})
+	}
+	return merged
+}
+
+// stripKeys return kvs with the first n nibbles of keys removed
+func stripKeys(kvs []nibbleKV, n int) []nibbleKV {
+	if n == 0 {
+		return kvs
+	}
+	stripped := make([]nibbleKV, len(kvs))
+	for i, elem := range kvs {
+		stripped[i] = nibbleKV{key: elem.key[n:], value: elem.value}
+	}
+	return stripped
+}
@@ -0,0 +1,113 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func toKVs(kvs []kv) []KV {
+	result := make([]KV, len(kvs))
+	for i, elem := range kvs {
+		result[i] = KV{Key: elem.k, Value: elem.v}
+	}
+	return result
+}
+
+func testApplySorted(t *testing.T, trie *Trie, memDB *memorydb.Database, updates map[string][]byte) {
+	expected := trie
+	for k, v := range updates {
+		expected = expected.Insert([]byte(k), v)
+	}
+	sorted := sortedKVs(updates)
+	applied := trie.ApplySorted(toKVs(sorted))
+	assert.Equal(t, expected.StateRoot(), applied.StateRoot())
+
+	applied.Persist()
+	reloaded := NewTrie(applied.StateRoot(), memDB)
+	expectedKVs := make([]kv, 0)
+	assert.Nil(t, expected.Iterate(func(key, value []byte) bool {
+		expectedKVs = append(expectedKVs, kv{k: key, v: value})
+		return true
+	}))
+	for _, elem := range expectedKVs {
+		assert.Equal(t, elem.v, reloaded.Get(elem.k))
+	}
+}
+
+func TestApplySortedToEmptyTrie(t *testing.T) {
+	memDB := memorydb.New()
+	testApplySorted(t, NewTrie(EmptyHash, memDB), memDB, kvMap(uniqueKVs(iterateTimes)))
+
+	// keys which are prefixes of other keys
+	memDB = memorydb.New()
+	testApplySorted(t, NewTrie(EmptyHash, memDB), memDB, map[string][]byte{
+		"":         {0},
+		"\x12":     {1},
+		"\x12\x30": {2},
+		"\x12\x34": {3},
+		"\x13":     {4},
+		"\xab":     {5},
+	})
+}
+
+func TestApplySortedToPersistedTrie(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, iterateTimes)
+	updates := kvMap(uniqueKVs(iterateTimes))
+	// update existing keys, and insert keys extend existing keys
+	for i, elem := range kvs[:iterateTimes/10] {
+		updates[string(elem.k)] = []byte{byte(i), 1}
+		updates[string(elem.k)+"\x00"] = []byte{byte(i), 2}
+		if len(elem.k) > 1 {
+			updates[string(elem.k[:len(elem.k)-1])] = []byte{byte(i), 3}
+		}
+	}
+	testApplySorted(t, trie, memDB, updates)
+}
+
+func TestApplySortedSplitNodes(t *testing.T) {
+	memDB := memorydb.New()
+	trie := NewTrie(EmptyHash, memDB)
+	trie = trie.Insert([]byte{0x12, 0x34, 0x56}, []byte{1})
+	trie = trie.Insert([]byte{0x12, 0x34, 0x57}, []byte{2})
+	trie.Persist()
+	trie = NewTrie(trie.StateRoot(), memDB)
+	// split the ext node at the start, in the middle and at the last nibble
+	testApplySorted(t, trie, memDB, map[string][]byte{
+		"\x02":         {3},
+		"\x12\x30":     {4},
+		"\x12\x34\x50": {5},
+		"\x12\x34\x56": {6},
+	})
+	// split the leaf node
+	trie = NewTrie(EmptyHash, memDB).Insert([]byte{0x12, 0x34}, []byte{1})
+	testApplySorted(t, trie, memDB, map[string][]byte{
+		"\x12":         {2},
+		"\x12\x34\x56": {3},
+	})
+}
+
+func TestApplySortedInvalidInput(t *testing.T) {
+	trie := NewTrie(EmptyHash, memorydb.New())
+	_, err := trie.TryApplySorted([]KV{{Key: []byte{2}, Value: []byte{1}}, {Key: []byte{1}, Value: []byte{2}}})
+	assert.NotNil(t, err)
+	_, err = trie.TryApplySorted([]KV{{Key: []byte{1}, Value: []byte{1}}, {Key: []byte{1}, Value: []byte{2}}})
+	assert.NotNil(t, err)
+	_, err = trie.TryApplySorted([]KV{{Key: []byte{1}}})
+	assert.NotNil(t, err)
+	newTrie, err := trie.TryApplySorted(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, EmptyHash, newTrie.StateRoot())
+}
+
+func BenchmarkApplySorted(b *testing.B) {
+	kvs := toKVs(sortedKVs(kvMap(uniqueKVs(b.N))))
+	trie := NewTrie(EmptyHash, memorydb.New())
+	b.ResetTimer()
+	trie.ApplySorted(kvs)
+}
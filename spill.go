@@ -0,0 +1,122 @@
+package mpt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// SpillTable is a temporary file holding inserted nodes moved out of the memory of
+// update logs, see WithSpill. Nodes are content addressed, so a spilled node never
+// change and the table is shared by all tries derived from the spilling trie, old
+// or new. Nodes are appended and never removed until Close, it's safe for
+// concurrent use
+type SpillTable struct {
+	lock   sync.RWMutex
+	budget int
+	file   *os.File
+	size   int64
+	index  map[common.Hash]spillEntry
+	err    error
+}
+
+type spillEntry struct {
+	offset int64
+	length int
+}
+
+// NewSpillTable create an empty table in a new temporary file under dir, the default
+// temporary directory if dir is empty. Tries spill when the inserted nodes held in
+// memory by their log exceed budget bytes
+func NewSpillTable(dir string, budget int) (*SpillTable, error) {
+	file, err := ioutil.TempFile(dir, "mpt-spill-")
+	if err != nil {
+		return nil, err
+	}
+	return &SpillTable{
+		budget: budget,
+		file:   file,
+		index:  make(map[common.Hash]spillEntry),
+	}, nil
+}
+
+// put append the node unless it's already spilled
+func (s *SpillTable) put(key common.Hash, value []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if _, ok := s.index[key]; ok {
+		return nil
+	}
+	if _, err := s.file.WriteAt(value, s.size); err != nil {
+		s.err = err
+		return err
+	}
+	s.index[key] = spillEntry{offset: s.size, length: len(value)}
+	s.size += int64(len(value))
+	return nil
+}
+
+// get read the spilled node of key
+func (s *SpillTable) get(key common.Hash) ([]byte, error) {
+	s.lock.RLock()
+	entry, ok := s.index[key]
+	file := s.file
+	s.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("node %s is not spilled", key.Hex())
+	}
+	value := make([]byte, entry.length)
+	if _, err := file.ReadAt(value, entry.offset); err != nil {
+		return nil, fmt.Errorf("read spilled node %s: %v", key.Hex(), err)
+	}
+	return value, nil
+}
+
+// length return the size of the spilled node of key
+func (s *SpillTable) length(key common.Hash) int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.index[key].length
+}
+
+// Nodes return the number of spilled nodes
+func (s *SpillTable) Nodes() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.index)
+}
+
+// Bytes return the size of the file
+func (s *SpillTable) Bytes() int64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.size
+}
+
+// Err return the first error of writing the file, nodes are kept in memory once
+// spilling failed
+func (s *SpillTable) Err() error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.err
+}
+
+// Close close and remove the file, tries which spilled to the table can't be read
+// or committed afterwards
+func (s *SpillTable) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err == nil {
+		s.err = os.ErrClosed
+	}
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(s.file.Name())
+}
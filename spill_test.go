@@ -0,0 +1,80 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpill(t *testing.T) {
+	table, err := NewSpillTable("", 4096)
+	assert.Nil(t, err)
+	path := table.file.Name()
+	spillDB, memDB := memorydb.New(), memorydb.New()
+	spilled := NewTrie(EmptyHash, spillDB, WithSpill(table))
+	expected := NewTrie(EmptyHash, memDB)
+	kvs := uniqueKVs(1000)
+	// distinct values of fixed size, so the nodes spilled don't depend on random sizes
+	for i := range kvs {
+		kvs[i].v = append(bytes.Repeat([]byte{0xab}, 24), Uint64Key(uint64(i))...)
+	}
+	var half *Trie
+	for i, elem := range kvs {
+		spilled = spilled.Insert(elem.k, elem.v)
+		expected = expected.Insert(elem.k, elem.v)
+		if i == len(kvs)/2 {
+			half = spilled
+		}
+	}
+	for _, elem := range kvs[:100] {
+		spilled = spilled.Delete(elem.k)
+		expected = expected.Delete(elem.k)
+	}
+	assert.True(t, table.Nodes() > 0)
+	assert.Nil(t, table.Err())
+	assert.Equal(t, expected.StateRoot(), spilled.StateRoot())
+	// only the inserted nodes since the last spill are held in memory
+	resident := func(trie *Trie) int {
+		stats := trie.LogStats()
+		return stats.RetainedBytes - (stats.InsertedNodes+stats.DeletedNodes)*common.HashLength
+	}
+	assert.True(t, spilled.log.dirtyBytes-spilled.log.spilledBytes <= 4096)
+	assert.True(t, resident(spilled) < resident(expected)/2)
+	nodes, bytes := spilled.DirtyCount()
+	expectedNodes, expectedBytes := expected.DirtyCount()
+	assert.Equal(t, expectedNodes, nodes)
+	assert.Equal(t, expectedBytes, bytes)
+	assert.Equal(t, expected.DirtyNodes(), spilled.DirtyNodes())
+
+	// spilled nodes are resolved by the trie and tries derived before the spill
+	for i, elem := range kvs {
+		if i < 100 {
+			assert.Nil(t, spilled.Get(elem.k))
+		} else {
+			assert.Equal(t, elem.v, spilled.Get(elem.k))
+		}
+		if i <= len(kvs)/2 {
+			assert.Equal(t, elem.v, half.Get(elem.k))
+		}
+	}
+
+	assert.Equal(t, expected.Persist(), spilled.Persist())
+	assert.Equal(t, memDB.Len(), spillDB.Len())
+	reader := NewTrie(spilled.StateRoot(), spillDB)
+	for _, elem := range kvs[100:] {
+		assert.Equal(t, elem.v, reader.Get(elem.k))
+	}
+
+	assert.Nil(t, table.Close())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+	_, err = half.TryGet(kvs[0].k)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,144 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
+)
+
+// Database is the underlying db of tries
+type Database = db.KeyValueStore
+
+// storageConfig is the options of features backed by underlying db, they are not
+// available in the mptcore build
+type storageConfig struct {
+	// commits is the number of commits of tries sharing the config, it's the first
+	// field so it's 64-bit aligned for atomic access
+	commits      uint64
+	recorder     *opRecorder
+	dedupWrites  bool
+	autoCommit   *autoCommit
+	onAutoCommit func(report *CommitReport)
+	pathCache    *NodePathCache
+	missingStats *MissingNodeStats
+	// prunedStateError report absent nodes met by TryGet as ErrPrunedState
+	prunedStateError bool
+	growthStats      *NodeGrowthStats
+	commitHook       func(changes *ChangeSet)
+	latencySink      func(sample OpSample)
+	watcher          *Watcher
+	history          *HistoryIndex
+	cacheStats       *CacheStats
+	schema           bool
+	// schemaWritten is set once the schema descriptor is known to be in db
+	schemaWritten uint32
+}
+
+// WithWriteDedup skip writing nodes already exist in underlying db when commit, nodes
+// are content addressed and never change, so rewriting them is wasted work. It saves
+// a lot of writes when inserts recreate subtrees seen before, e.g. replaying a reorg,
+// at the cost of a Has per inserted node
+func WithWriteDedup() Option {
+	return func(c *config) {
+		c.dedupWrites = true
+	}
+}
+
+// TryGet returns the values for key stored in the trie, ErrStaleTrie is returned
+// if the trie is stale, and MissingNodeError if nodes are missing for other reasons.
+// Tries with WithPrunedStateError return ErrPrunedState for absent nodes instead
+func (t *Trie) TryGet(key []byte) (value []byte, err error) {
+	t, done := t.measure(OpGet)
+	defer func() { done(err) }()
+	value, err = t.getValue(key)
+	return value, t.prunedState(err)
+}
+
+// TryInsert insert key and value to trie, return a new trie, old trie is unchanged.
+// ErrStaleTrie is returned if the trie is stale, and MissingNodeError if nodes are
+// missing for other reasons, ErrValueTooLarge is returned if value exceed the bound
+// of WithMaxValueSize
+func (t *Trie) TryInsert(key, value []byte) (newTrie *Trie, err error) {
+	t, done := t.measure(OpInsert)
+	defer func() { done(err) }()
+	newTrie, err = t.tryInsert(key, value)
+	if err != nil {
+		return nil, err
+	}
+	t.config.recorder.recordInsert(t.rootHash, key, value, newTrie.rootHash)
+	return newTrie.maybeAutoCommit()
+}
+
+// TryDelete delete key and value from trie, return a new trie, old trie is unchanged.
+// ErrStaleTrie is returned if the trie is stale, and MissingNodeError if nodes are
+// missing for other reasons
+func (t *Trie) TryDelete(key []byte) (newTrie *Trie, err error) {
+	t, done := t.measure(OpDelete)
+	defer func() { done(err) }()
+	newTrie, err = t.tryDelete(key)
+	if err != nil {
+		return nil, err
+	}
+	t.config.recorder.recordDelete(t.rootHash, key, newTrie.rootHash)
+	return newTrie.maybeAutoCommit()
+}
+
+// CommitToBatch write all logs to batch, and return the report of the commit. Nodes
+// are written in ascending order of hash, inserted nodes before deleted nodes, so
+// the same changes always produce the same sequence of writes, and replicas
+// applying the same operations have byte identical dbs. Call Written on the report
+// once the batch is written. It panics if the commit fails, e.g. the batch reject
+// a write, the batch must not be written then, use CommitToBatchOrdered to get the
+// error instead
+func (t *Trie) CommitToBatch(batch db.Batch) *CommitReport {
+	report, err := t.CommitToBatchOrdered(batch, BatchOptions{})
+	if err != nil {
+		panic(err)
+	}
+	return report
+}
+
+// putNodes write the schema descriptor if needed and inserted nodes to w in
+// ascending order of hash, and return nodes skipped since they already exist in
+// underlying db, nothing is skipped unless WithWriteDedup is set
+func (t *Trie) putNodes(w db.KeyValueWriter, changes *logLayer) (map[common.Hash]struct{}, error) {
+	if err := t.writeSchema(w); err != nil {
+		return nil, err
+	}
+	existing := make(map[common.Hash]struct{})
+	for _, k := range sortedHashes(changes.inserted) {
+		if t.nodeExists(changes, k) {
+			existing[k] = struct{}{}
+			continue
+		}
+		if err := w.Put(nodeKey(k), t.log.value(k, changes.inserted[k])); err != nil {
+			return nil, err
+		}
+	}
+	return existing, nil
+}
+
+// nodeExists report whether the inserted node k is skipped by WithWriteDedup since
+// it exists in underlying db
+func (t *Trie) nodeExists(changes *logLayer, k common.Hash) bool {
+	if !t.config.dedupWrites {
+		return false
+	}
+	// nodes read from db are known to exist
+	_, ok := changes.persisted[k]
+	return ok || t.hasNode(k)
+}
+
+// Persist all logs to underlying db, and return the report of the commit. It panics
+// if the commit or the write of its batch fails, use Commit to get the error instead
+// TODO: it's prune mode currently, what we need is archive mode
+// refer to https://blog.ethereum.org/2015/06/26/state-tree-pruning/
+func (t *Trie) Persist() *CommitReport {
+	report, err := t.Commit()
+	if err != nil {
+		panic(err)
+	}
+	return report
+}
@@ -0,0 +1,159 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// CommitSubtree persist the changes of key values under prefix only, together with
+// the updated path from the root to them, changes of other key values stay in
+// memory. It's useful when modules own different namespaces of a trie and commit
+// at different cadences. The committed root is the root the trie derived from with
+// the changes under prefix applied, it's the Root of the returned report. The
+// returned trie has the same key values as the trie, and its pending changes are
+// relative to the committed root, so it should be used instead of the trie
+// afterwards. Like Persist, nodes replaced by the commit are deleted from
+// underlying db
+func (t *Trie) CommitSubtree(prefix []byte) (*Trie, *CommitReport, error) {
+	base := t.derive(t.baseRoot, t.log.committed())
+	// changes replayed on base are internal, they are neither recorded nor auto committed
+	config := *t.config
+	config.recorder = nil
+	config.autoCommit = nil
+	base.config = &config
+	committed, err := base.applyPrefix(t, prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	changes := t.log.flatten()
+	committedChanges := committed.log.flatten()
+	// nodes on the path to prefix which mix new nodes under prefix with old nodes
+	// elsewhere, they are neither in the trie nor in underlying db before commit
+	spine := make([]common.Hash, 0)
+	for k := range committedChanges.inserted {
+		if _, ok := changes.inserted[k]; !ok && !t.hasNode(k) {
+			spine = append(spine, k)
+		}
+	}
+	batch := t.db.NewBatch()
+	report, err := committed.CommitToBatchOrdered(batch, BatchOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := batch.Write(); err != nil {
+		return nil, nil, err
+	}
+	report.Written()
+
+	log := t.log.committed()
+	for k, v := range changes.inserted {
+		if _, ok := committedChanges.inserted[k]; !ok {
+			log.insert(k, t.log.value(k, v))
+		}
+	}
+	for k := range changes.deleted {
+		if _, ok := committedChanges.deleted[k]; !ok {
+			log.delete(k)
+		}
+	}
+	for _, k := range spine {
+		log.delete(k)
+	}
+	newTrie := t.derive(t.rootHash, log)
+	newTrie.baseRoot = committed.rootHash
+	return newTrie, report, nil
+}
+
+// applyPrefix return the trie with key values under prefix replaced by those of
+// other, key values elsewhere are unchanged
+func (t *Trie) applyPrefix(other *Trie, prefix []byte) (*Trie, error) {
+	values := make(map[string][]byte)
+	err := other.IteratePrefix(prefix, func(key, value []byte) bool {
+		values[string(key)] = value
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	removed := make([][]byte, 0)
+	err = t.IteratePrefix(prefix, func(key, value []byte) bool {
+		if newValue, ok := values[string(key)]; !ok {
+			removed = append(removed, key)
+		} else if bytes.Equal(newValue, value) {
+			delete(values, string(key))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	newTrie := t
+	for _, key := range removed {
+		if newTrie, err = newTrie.TryDelete(key); err != nil {
+			return nil, err
+		}
+	}
+	for key, value := range values {
+		if newTrie, err = newTrie.TryInsert([]byte(key), value); err != nil {
+			return nil, err
+		}
+	}
+	return newTrie, nil
+}
+
+// SubtreeHash return the hash of the node holding exactly the key values under
+// prefix, so modules owning namespaces of a trie can track the commitment of their
+// namespace from the global trie. Only nodes on the path to prefix are resolved,
+// the hash of the node at prefix is read from its parent if it's stored by hash.
+// If prefix end inside the key of a leaf or an extension, the node holds the same
+// key values and its hash is returned. A node embedded in its parent has a hash as
+// well, though its parent commit to its encoding. The root of empty trie is
+// returned if no key is under prefix
+func (t *Trie) SubtreeHash(prefix []byte) (common.Hash, error) {
+	if t.empty(t.rootHash) {
+		return t.config.emptyRoot, nil
+	}
+	target := bytesToNibbles(prefix)
+	var path []byte
+	var current node = &hashNode{t.rootHash.Bytes()}
+	for {
+		if len(path) == len(target) {
+			return current.Hash(), nil
+		}
+		switch n := current.(type) {
+		case *hashNode:
+			resolved, err := t.resolvePath(n.Hash(), path)
+			if err != nil {
+				return common.Hash{}, err
+			}
+			current = resolved
+		case *leafNode:
+			if !bytes.HasPrefix(extendPath(path, n.key...), target) {
+				return t.config.emptyRoot, nil
+			}
+			return n.Hash(), nil
+		case *extNode:
+			childPath := extendPath(path, n.key...)
+			// the child is at prefix if the key of the extension end there
+			if len(childPath) > len(target) && bytes.HasPrefix(childPath, target) {
+				return n.Hash(), nil
+			}
+			if !bytes.HasPrefix(target, childPath) {
+				return t.config.emptyRoot, nil
+			}
+			current, path = n.child, childPath
+		case *branchNode:
+			nibble := target[len(path)]
+			if n.children[nibble] == nil {
+				return t.config.emptyRoot, nil
+			}
+			current, path = n.children[nibble], extendPath(path, nibble)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommitSubtree(t *testing.T) {
+	memDB := memorydb.New()
+	trie := NewTrie(EmptyHash, memDB)
+	namespaces := [][]byte{[]byte("acct"), []byte("code"), []byte("misc")}
+	kvs := uniqueKVs(300)
+	for i, elem := range kvs {
+		elem.k = append(append([]byte{}, namespaces[i%3]...), elem.k...)
+		kvs[i] = elem
+		trie = trie.Insert(elem.k, elem.v)
+	}
+	trie.Persist()
+	trie = NewTrie(trie.StateRoot(), memDB)
+	base := kvMap(kvs)
+
+	// update, insert and delete in every namespace
+	expected := kvMap(kvs)
+	committed := kvMap(kvs)
+	for i, elem := range kvs[:90] {
+		switch i % 9 / 3 {
+		case 0:
+			elem.v = randomBytes()
+			trie = trie.Insert(elem.k, elem.v)
+			expected[string(elem.k)] = elem.v
+		case 1:
+			trie = trie.Delete(elem.k)
+			delete(expected, string(elem.k))
+		case 2:
+			elem.k = append(elem.k, 1)
+			trie = trie.Insert(elem.k, elem.v)
+			expected[string(elem.k)] = elem.v
+		}
+		if i%3 == 0 {
+			if _, ok := expected[string(elem.k)]; ok {
+				committed[string(elem.k)] = expected[string(elem.k)]
+			} else {
+				delete(committed, string(elem.k))
+			}
+		}
+	}
+	nodes, _ := trie.DirtyCount()
+
+	newTrie, report, err := trie.CommitSubtree(namespaces[0])
+	assert.Nil(t, err)
+	assert.Equal(t, trie.StateRoot(), newTrie.StateRoot())
+	newNodes, _ := newTrie.DirtyCount()
+	assert.True(t, newNodes < nodes)
+	assert.Equal(t, sortedKVs(expected), collectKVs(t, newTrie.Iterate))
+
+	// the committed root only include changes under prefix
+	assert.NotEqual(t, kvMap(kvs), committed)
+	assert.NotEqual(t, base, committed)
+	reloaded := NewTrie(report.Root, memDB)
+	assert.Equal(t, sortedKVs(committed), collectKVs(t, reloaded.Iterate))
+	checked := make(map[common.Hash]struct{})
+	assert.Nil(t, checkSubtree(memDB, report.Root, checked))
+	assert.Equal(t, len(checked), memDB.Len())
+
+	// the rest are committed later, and nothing is leaked
+	newTrie, _, err = newTrie.CommitSubtree(namespaces[1])
+	assert.Nil(t, err)
+	newTrie.Persist()
+	reloaded = NewTrie(newTrie.StateRoot(), memDB)
+	assert.Equal(t, sortedKVs(expected), collectKVs(t, reloaded.Iterate))
+	checked = make(map[common.Hash]struct{})
+	assert.Nil(t, checkSubtree(memDB, newTrie.StateRoot(), checked))
+	assert.Equal(t, len(checked), memDB.Len())
+}
+
+func TestSubtreeHash(t *testing.T) {
+	memDB := memorydb.New()
+	trie := NewTrie(EmptyHash, memDB)
+	for _, module := range []string{"bank", "gov", "staking"} {
+		for i := 0; i < 50; i++ {
+			trie = trie.Insert(append([]byte(module+"/"), Uint64Key(uint64(i))...), randomBytes())
+		}
+	}
+	trie = trie.Insert([]byte("single/key"), []byte("value"))
+	bank, err := trie.SubtreeHash([]byte("bank/"))
+	assert.Nil(t, err)
+	gov, err := trie.SubtreeHash([]byte("gov/"))
+	assert.Nil(t, err)
+
+	// the hash of the node at the path of the prefix
+	trie.Persist()
+	trie = NewTrie(trie.StateRoot(), memDB)
+	// keys of bank share 7 zero bytes after the prefix, so the branch of their last
+	// byte is at the path of the longer prefix
+	branchPrefix := append([]byte("bank/"), make([]byte, 7)...)
+	encoded, err := ReadTrieNodeByPath(memDB, trie.StateRoot(), bytesToNibbles(branchPrefix))
+	assert.Nil(t, err)
+	hash, err := trie.SubtreeHash(branchPrefix)
+	assert.Nil(t, err)
+	assert.Equal(t, keccak256Hash(encoded), hash)
+	// bank/ end inside the extension below b, which hold the same key values
+	encoded, err = ReadTrieNodeByPath(memDB, trie.StateRoot(), bytesToNibbles([]byte("b")))
+	assert.Nil(t, err)
+	assert.Equal(t, keccak256Hash(encoded), bank)
+	root, err := trie.SubtreeHash(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, trie.StateRoot(), root)
+
+	// changes of other namespaces don't change the hash
+	updated := trie.Insert([]byte("gov/new"), []byte("value"))
+	hash, err = updated.SubtreeHash([]byte("bank/"))
+	assert.Nil(t, err)
+	assert.Equal(t, bank, hash)
+	hash, err = updated.SubtreeHash([]byte("gov/"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, gov, hash)
+
+	// prefixes inside the key of a leaf or an extension
+	leaf, err := trie.SubtreeHash([]byte("single/"))
+	assert.Nil(t, err)
+	hash, err = trie.SubtreeHash([]byte("sin"))
+	assert.Nil(t, err)
+	assert.Equal(t, leaf, hash)
+	hash, err = trie.SubtreeHash([]byte("bank"))
+	assert.Nil(t, err)
+	assert.Equal(t, bank, hash)
+
+	for _, absent := range []string{"x", "single/other", "bank/x", "single/key/longer"} {
+		hash, err = trie.SubtreeHash([]byte(absent))
+		assert.Nil(t, err)
+		assert.Equal(t, EmptyHash, hash)
+	}
+}
@@ -0,0 +1,258 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+
+	db "github.com/ethereum/go-ethereum/ethdb"
+)
+
+// StoreTransform transform values between their plain form and the form stored in
+// underlying db, e.g. encryption or compression. Nodes are hashed over their plain
+// encoding, so roots don't depend on the transform
+type StoreTransform interface {
+	// Forward return the stored form of plain
+	Forward(plain []byte) ([]byte, error)
+	// Inverse return the plain form of stored
+	Inverse(stored []byte) ([]byte, error)
+}
+
+// TransformStore is a db which apply a StoreTransform to values before they are
+// written to the wrapped db, and the inverse after they are read. Every stored value
+// starts with a byte identifying the transform, so keys can be rotated: after Rotate
+// new values are written with the new transform, values written before are still
+// readable as long as their transform is registered, and Rewrap rewrite them with
+// the current one
+type TransformStore struct {
+	db.KeyValueStore
+
+	lock       sync.RWMutex
+	transforms map[byte]StoreTransform
+	current    byte
+}
+
+// NewTransformStore wrap kvs, values are written with transform identified by id
+func NewTransformStore(kvs db.KeyValueStore, id byte, transform StoreTransform) *TransformStore {
+	return &TransformStore{
+		KeyValueStore: kvs,
+		transforms:    map[byte]StoreTransform{id: transform},
+		current:       id,
+	}
+}
+
+// Register add a transform used to read values written with id
+func (s *TransformStore) Register(id byte, transform StoreTransform) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.transforms[id] = transform
+}
+
+// Rotate register transform and write new values with it, e.g. when the encryption
+// key is rotated, the old transforms are kept for reading
+func (s *TransformStore) Rotate(id byte, transform StoreTransform) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.transforms[id] = transform
+	s.current = id
+}
+
+// Unregister remove the transform of id, values written with it become unreadable,
+// call it after Rewrap to retire an old key
+func (s *TransformStore) Unregister(id byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if id != s.current {
+		delete(s.transforms, id)
+	}
+}
+
+func (s *TransformStore) forward(value []byte) ([]byte, error) {
+	s.lock.RLock()
+	id, transform := s.current, s.transforms[s.current]
+	s.lock.RUnlock()
+	stored, err := transform.Forward(value)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{id}, stored...), nil
+}
+
+func (s *TransformStore) inverse(stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, errors.New("stored value without transform id")
+	}
+	s.lock.RLock()
+	transform, ok := s.transforms[stored[0]]
+	s.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown transform id %d", stored[0])
+	}
+	return transform.Inverse(stored[1:])
+}
+
+// Get return the plain value of key
+func (s *TransformStore) Get(key []byte) ([]byte, error) {
+	stored, err := s.KeyValueStore.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.inverse(stored)
+}
+
+// Put write the stored form of value
+func (s *TransformStore) Put(key []byte, value []byte) error {
+	stored, err := s.forward(value)
+	if err != nil {
+		return err
+	}
+	return s.KeyValueStore.Put(key, stored)
+}
+
+// NewBatch create a batch which write the stored form of values
+func (s *TransformStore) NewBatch() db.Batch {
+	return &transformBatch{Batch: s.KeyValueStore.NewBatch(), store: s}
+}
+
+// NewIterator iterate keys with plain values, it stops with an error at the first
+// value which can't be transformed
+func (s *TransformStore) NewIterator(prefix []byte, start []byte) db.Iterator {
+	return &transformIterator{Iterator: s.KeyValueStore.NewIterator(prefix, start), store: s}
+}
+
+// Rewrap rewrite all values not written with the current transform, and return the
+// number of rewritten values
+func (s *TransformStore) Rewrap() (int, error) {
+	s.lock.RLock()
+	current := s.current
+	s.lock.RUnlock()
+	it := s.KeyValueStore.NewIterator(nil, nil)
+	defer it.Release()
+	batch := s.NewBatch()
+	n := 0
+	for it.Next() {
+		stored := it.Value()
+		if len(stored) > 0 && stored[0] == current {
+			continue
+		}
+		plain, err := s.inverse(stored)
+		if err != nil {
+			return 0, err
+		}
+		if err := batch.Put(it.Key(), plain); err != nil {
+			return 0, err
+		}
+		n++
+		if batch.ValueSize() >= db.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return 0, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return 0, err
+	}
+	return n, batch.Write()
+}
+
+type transformBatch struct {
+	db.Batch
+	store *TransformStore
+}
+
+func (b *transformBatch) Put(key []byte, value []byte) error {
+	stored, err := b.store.forward(value)
+	if err != nil {
+		return err
+	}
+	return b.Batch.Put(key, stored)
+}
+
+// Replay replay plain values to w
+func (b *transformBatch) Replay(w db.KeyValueWriter) error {
+	return b.Batch.Replay(&inverseWriter{KeyValueWriter: w, store: b.store})
+}
+
+// inverseWriter write plain values of stored values to the wrapped writer
+type inverseWriter struct {
+	db.KeyValueWriter
+	store *TransformStore
+}
+
+func (w *inverseWriter) Put(key []byte, value []byte) error {
+	plain, err := w.store.inverse(value)
+	if err != nil {
+		return err
+	}
+	return w.KeyValueWriter.Put(key, plain)
+}
+
+type transformIterator struct {
+	db.Iterator
+	store *TransformStore
+	value []byte
+	err   error
+}
+
+func (it *transformIterator) Next() bool {
+	it.value = nil
+	if it.err != nil || !it.Iterator.Next() {
+		return false
+	}
+	it.value, it.err = it.store.inverse(it.Iterator.Value())
+	return it.err == nil
+}
+
+func (it *transformIterator) Value() []byte {
+	return it.value
+}
+
+func (it *transformIterator) Error() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.Iterator.Error()
+}
+
+// aesTransform encrypt values by AES-GCM, a random nonce is prepended to every
+// encrypted value
+type aesTransform struct {
+	aead cipher.AEAD
+}
+
+// NewAESTransform return a StoreTransform encrypting values by AES-GCM with key,
+// which must be 16, 24 or 32 bytes
+func NewAESTransform(key []byte) (StoreTransform, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &aesTransform{aead: aead}, nil
+}
+
+func (t *aesTransform) Forward(plain []byte) ([]byte, error) {
+	nonce := make([]byte, t.aead.NonceSize(), t.aead.NonceSize()+len(plain)+t.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return t.aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+func (t *aesTransform) Inverse(stored []byte) ([]byte, error) {
+	if len(stored) < t.aead.NonceSize() {
+		return nil, errors.New("encrypted value too short")
+	}
+	nonce := stored[:t.aead.NonceSize()]
+	return t.aead.Open(nil, nonce, stored[t.aead.NonceSize():], nil)
+}
@@ -0,0 +1,161 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func newAESTransform(t *testing.T, seed byte) StoreTransform {
+	transform, err := NewAESTransform(bytes.Repeat([]byte{seed}, 32))
+	assert.Nil(t, err)
+	return transform
+}
+
+func TestTransformStore(t *testing.T) {
+	plainDB := memorydb.New()
+	plain, kvs := persistedTrie(plainDB, 200)
+
+	memDB := memorydb.New()
+	store := NewTransformStore(memDB, 1, newAESTransform(t, 1))
+	trie := NewTrie(EmptyHash, store)
+	for _, elem := range kvs {
+		trie = trie.Insert(elem.k, elem.v)
+	}
+	trie.Persist()
+	// hash is computed over the plain encoding
+	assert.Equal(t, plain.StateRoot(), trie.StateRoot())
+	assert.Equal(t, plainDB.Len(), memDB.Len())
+
+	it := memDB.NewIterator(nil, nil)
+	for it.Next() {
+		assert.Equal(t, byte(1), it.Value()[0])
+		value, err := plainDB.Get(it.Key())
+		assert.Nil(t, err)
+		assert.False(t, bytes.Contains(it.Value(), value))
+	}
+	it.Release()
+
+	reader := NewTrie(trie.StateRoot(), store)
+	for _, elem := range kvs {
+		value, err := reader.TryGet(elem.k)
+		assert.Nil(t, err)
+		assert.Equal(t, elem.v, value)
+	}
+	checked := make(map[common.Hash]struct{})
+	assert.Nil(t, checkSubtree(store, trie.StateRoot(), checked))
+	assert.Equal(t, memDB.Len(), len(checked))
+
+	// plain iterator
+	it = store.NewIterator(nil, nil)
+	for it.Next() {
+		value, err := plainDB.Get(it.Key())
+		assert.Nil(t, err)
+		assert.Equal(t, value, it.Value())
+	}
+	assert.Nil(t, it.Error())
+	it.Release()
+}
+
+func TestTransformStoreRotate(t *testing.T) {
+	memDB := memorydb.New()
+	store := NewTransformStore(memDB, 1, newAESTransform(t, 1))
+	kvs := uniqueKVs(100)
+	// tries are built from the empty root, so nodes of the first are kept
+	build := func(kvs []kv) *Trie {
+		trie := NewTrie(EmptyHash, store)
+		for _, elem := range kvs {
+			trie = trie.Insert(elem.k, elem.v)
+		}
+		trie.Persist()
+		return trie
+	}
+	first := build(kvs[:50])
+	store.Rotate(2, newAESTransform(t, 2))
+	second := build(kvs[50:])
+
+	check := func() {
+		for i, trie := range []*Trie{first, second} {
+			reader := NewTrie(trie.StateRoot(), store)
+			for _, elem := range kvs[i*50 : (i+1)*50] {
+				value, err := reader.TryGet(elem.k)
+				assert.Nil(t, err)
+				assert.Equal(t, elem.v, value)
+			}
+		}
+	}
+	// values of both keys are readable
+	check()
+
+	n, err := store.Rewrap()
+	assert.Nil(t, err)
+	assert.True(t, n > 0)
+	it := memDB.NewIterator(nil, nil)
+	for it.Next() {
+		assert.Equal(t, byte(2), it.Value()[0])
+	}
+	it.Release()
+	n, err = store.Rewrap()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	// the old key is retired
+	store.Unregister(1)
+	check()
+}
+
+func TestTransformStoreUnknownID(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 10)
+	store := NewTransformStore(memDB, 1, newAESTransform(t, 1))
+	// values written without the store have no transform id
+	_, err := NewTrie(trie.StateRoot(), store).TryGet(kvs[0].k)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, memDB.Put([]byte("key"), []byte{3, 1, 2}))
+	_, err = store.Get([]byte("key"))
+	assert.NotNil(t, err)
+	it := store.NewIterator([]byte("key"), nil)
+	assert.False(t, it.Next())
+	assert.NotNil(t, it.Error())
+	it.Release()
+
+	// wrong key
+	store.Rotate(2, newAESTransform(t, 2))
+	assert.Nil(t, store.Put([]byte("key"), []byte("value")))
+	store.Rotate(2, newAESTransform(t, 3))
+	_, err = store.Get([]byte("key"))
+	assert.NotNil(t, err)
+}
+
+func TestTransformStoreBatch(t *testing.T) {
+	memDB := memorydb.New()
+	store := NewTransformStore(memDB, 1, newAESTransform(t, 1))
+	batch := store.NewBatch()
+	assert.Nil(t, batch.Put([]byte("a"), []byte("va")))
+	assert.Nil(t, batch.Put([]byte("b"), []byte("vb")))
+	assert.Nil(t, batch.Delete([]byte("c")))
+
+	replayed := memorydb.New()
+	assert.Nil(t, replayed.Put([]byte("c"), []byte("vc")))
+	assert.Nil(t, batch.Replay(replayed))
+	value, err := replayed.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("va"), value)
+	ok, _ := replayed.Has([]byte("c"))
+	assert.False(t, ok)
+
+	assert.Nil(t, batch.Write())
+	raw, err := memDB.Get([]byte("b"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, []byte("vb"), raw)
+	value, err = store.Get([]byte("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("vb"), value)
+}
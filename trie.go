@@ -2,99 +2,334 @@ package mpt
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/crypto"
-	db "github.com/ethereum/go-ethereum/ethdb"
 )
 
-// EmptyHash is hash of empty trie
-var EmptyHash = crypto.Keccak256Hash([]byte{})
+// ErrStaleTrie is returned when nodes of the trie have been pruned from underlying db
+var ErrStaleTrie = errors.New("trie is stale, nodes have been pruned")
+
+// ErrValueTooLarge is returned when a value exceed the bound of WithMaxValueSize
+var ErrValueTooLarge = errors.New("value exceed the max value size")
+
+// ErrBranchTarget is returned when a key is a prefix of another key in a trie with
+// WithoutBranchTargets
+var ErrBranchTarget = errors.New("branch target is disabled")
+
+// MissingNodeError is returned when a node referenced by the trie is absent
+// from underlying db or can't be decoded
+type MissingNodeError struct {
+	Hash common.Hash
+	Err  error
+}
+
+func (e *MissingNodeError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("missing trie node %s: %v", e.Hash.Hex(), e.Err)
+	}
+	return fmt.Sprintf("missing trie node %s", e.Hash.Hex())
+}
 
 // Trie is a immutable merkle patricia tree, every change(delete or insert) will return a new trie
 // with a different root and a different hash as well, the new trie maybe have pointers to subtrees
 // from old trie. Field logs of Trie used to log all changes before persist to underlying db.
+// A trie is safe for concurrent use, and tries derived from the same trie can be used
+// concurrently as well, but persisting a trie delete nodes of its ancestors from underlying
+// db, use PersistWithPruner if other tries still need them.
+//
+// The lifecycle of tries: NewTrie load a committed root, Insert/Delete fork new tries from
+// it, all of them share the nodes of the committed root. Once any of them is persisted, the
+// committed root and nodes replaced by the persisted trie are deleted from underlying db, the
+// persisted trie become the new committed root and all other tries become stale. Operations
+// on a stale trie return ErrStaleTrie when they need a pruned node, use Stale to check it.
 type Trie struct {
-	db       db.KeyValueStore
+	db       Database
 	rootHash common.Hash
+	// baseRoot is the committed root which the trie derived from
+	baseRoot common.Hash
 	log      *updateLog
+	config   *config
+	// counts count node resolves of a measured operation
+	counts *opCounts
+}
+
+// Option configure a trie, tries derived from it by Insert/Delete share the same options
+type Option func(*config)
+
+type config struct {
+	// storageConfig is the first field, so its commit counter is 64-bit aligned for
+	// atomic access
+	storageConfig
+	emptyRoot common.Hash
+	// maxValueSize is the max size of values, zero means unlimited
+	maxValueSize int
+	noCache      bool
+	noTargets    bool
+	taggedRefs   bool
+	spill        *SpillTable
 }
 
-func NewTrie(rootHash common.Hash, db db.KeyValueStore) *Trie {
+// WithEmptyRoot use root as the root hash of empty trie rather than EmptyHash, e.g.
+// EthereumEmptyRoot for compatibility with ethereum. Tries opened with EmptyHash or
+// EthereumEmptyRoot are empty tries whose root is root
+func WithEmptyRoot(root common.Hash) Option {
+	return func(c *config) {
+		c.emptyRoot = root
+	}
+}
+
+// WithMaxValueSize bound the size of values to n bytes, TryInsert return ErrValueTooLarge
+// for larger values, and nodes read from underlying db holding larger values are
+// rejected as MissingNodeError, so a malicious payload can't make the trie hold
+// arbitrarily large values in memory. Proof verifiers given the option reject
+// proof nodes and range values holding larger values with ErrValueTooLarge
+func WithMaxValueSize(n int) Option {
+	return func(c *config) {
+		c.maxValueSize = n
+	}
+}
+
+// WithNoCache never cache nodes read from underlying db, every read of a node not
+// changed by the trie goes to underlying db, so the memory of the trie is bounded
+// by its changes, e.g. on memory constrained devices. Deleted nodes are still
+// removed from underlying db when commit, but since their sizes are unknown they
+// are not counted in CommitReport
+func WithNoCache() Option {
+	return func(c *config) {
+		c.noCache = true
+	}
+}
+
+// WithoutBranchTargets forbid values at branches, that is, keys which are a prefix of
+// another key, e.g. deployments whose keys are all the same length never need them.
+// TryInsert return ErrBranchTarget rather than store a value at a branch, and nodes
+// read from underlying db carrying branch targets are rejected as malformed with
+// MissingNodeError. The encoding of nodes is unchanged, so roots and proofs are the
+// same as tries allowing targets
+func WithoutBranchTargets() Option {
+	return func(c *config) {
+		c.noTargets = true
+	}
+}
+
+// WithTaggedChildRefs tag every child reference of ext and branch nodes by a leading
+// byte telling whether it's a hash or an embedded child, rather than telling them
+// apart by their length. It change the encoding, so roots and proofs differ from
+// tries without the option, and nodes read from underlying db or proofs using the
+// other convention are rejected as malformed. Use Rewrite to convert a trie from
+// one convention to the other
+func WithTaggedChildRefs() Option {
+	return func(c *config) {
+		c.taggedRefs = true
+	}
+}
+
+// WithSpill move inserted nodes to table once those held in memory by the log of a
+// trie exceed the budget of the table, so a huge import doesn't run out of memory
+// before it's committed. Spilled nodes are read from the table when resolved, and
+// streamed from it to the batch when commit, the batch of underlying db may still
+// buffer them. The table is shared by tries derived from the trie, it must not be
+// closed while any of them is used
+func WithSpill(table *SpillTable) Option {
+	return func(c *config) {
+		c.spill = table
+	}
+}
+
+// NewTrie create a trie of rootHash in db. It neither check nor write the schema
+// descriptor of db, use OpenTrie to check it, or WithSchema to write it with the
+// first commit
+func NewTrie(rootHash common.Hash, db Database, opts ...Option) *Trie {
+	c := newConfig(opts)
+	if isEmptyRoot(rootHash) {
+		rootHash = c.emptyRoot
+	}
+	log := newUpdateLog()
+	log.spill = c.spill
 	return &Trie{
 		db:       db,
 		rootHash: rootHash,
-		log:      newUpdateLog(),
+		baseRoot: rootHash,
+		log:      log,
+		config:   c,
+	}
+}
+
+// newConfig return the config of opts
+func newConfig(opts []Option) *config {
+	c := &config{emptyRoot: EmptyHash}
+	for _, opt := range opts {
+		opt(c)
 	}
+	return c
 }
 
-// Get returns the values for key stored in the trie.
+// derive return a new trie with the same db and options
+func (t *Trie) derive(rootHash common.Hash, log *updateLog) *Trie {
+	return &Trie{
+		db:       t.db,
+		rootHash: rootHash,
+		baseRoot: t.baseRoot,
+		log:      log,
+		config:   t.config,
+	}
+}
+
+// empty report whether root is the root of empty trie
+func (t *Trie) empty(root common.Hash) bool {
+	return root == t.config.emptyRoot || isEmptyRoot(root)
+}
+
+// Stale report whether nodes of the trie may have been pruned from underlying db,
+// that is, neither the root nor the committed root it derived from exist in db
+func (t *Trie) Stale() bool {
+	if t.empty(t.rootHash) || t.hasNode(t.rootHash) {
+		return false
+	}
+	if _, _, dirty := t.log.lookup(t.rootHash); dirty {
+		return !t.empty(t.baseRoot) && !t.hasNode(t.baseRoot)
+	}
+	return true
+}
+
+func (t *Trie) hasNode(hash common.Hash) bool {
+	if t.db == nil {
+		return false
+	}
+	has, err := t.db.Has(nodeKey(hash))
+	return err == nil && has
+}
+
+// Get returns the values for key stored in the trie, nil is returned if the key
+// doesn't exist or nodes can't be resolved, use TryGet to distinguish them.
 // Caller must not modify the result directly, if need, use Insert/Delete
 func (t *Trie) Get(key []byte) []byte {
-	if t.rootHash == EmptyHash {
-		return nil
+	value, _ := t.TryGet(key)
+	return value
+}
+
+// getValue search key from the root of the trie
+func (t *Trie) getValue(key []byte) ([]byte, error) {
+	if t.empty(t.rootHash) {
+		return nil, nil
 	}
-	rootNode, err := t.resolveHash(t.rootHash)
+	rootNode, err := t.resolvePath(t.rootHash, nil)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	searchKey := bytesToNibbles(key)
-	return t.tryGet(rootNode, searchKey)
+	return t.tryGet(rootNode, searchKey, searchKey)
 }
 
-func (t *Trie) tryGet(startNode node, searchKey []byte) []byte {
+// tryGet search searchKey from startNode, fullKey is the nibbles of the key
+// searched from root
+func (t *Trie) tryGet(startNode node, searchKey, fullKey []byte) ([]byte, error) {
 	switch n := startNode.(type) {
 	case *leafNode:
 		if bytes.Equal(searchKey, n.key) {
-			return n.value
+			return n.value, nil
 		}
-		return nil
+		return nil, nil
 	case *extNode:
 		if len(searchKey) < len(n.key) {
-			return nil
+			return nil, nil
 		}
 		if bytes.Equal(searchKey[0:len(n.key)], n.key) {
-			return t.tryGet(n.child, searchKey[len(n.key):])
+			return t.tryGet(n.child, searchKey[len(n.key):], fullKey)
 		}
-		return nil
+		return nil, nil
 	case *branchNode:
 		if len(searchKey) == 0 {
-			return n.target
+			return n.target, nil
 		}
-		return t.tryGet(n.children[searchKey[0]], searchKey[1:])
+		return t.tryGet(n.children[searchKey[0]], searchKey[1:], fullKey)
 	case *hashNode:
-		resolved, err := t.resolveHash(n.Hash())
+		resolved, err := t.resolvePath(n.Hash(), fullKey[:len(fullKey)-len(searchKey)])
 		if err != nil {
-			return nil
+			return nil, err
 		}
-		return t.tryGet(resolved, searchKey)
+		return t.tryGet(resolved, searchKey, fullKey)
 	default:
 		// this should never happen
-		return nil
+		return nil, nil
 	}
 }
 
-// Insert insert key and value to trie, return a new trie, old trie is unchanged
+// HasTarget report whether key is present and its value is the target of a branch
+// node, which happen when key is a prefix of other keys. The target is separated
+// from the children of branch, so an empty value is still a target
+func (t *Trie) HasTarget(key []byte) (bool, error) {
+	if t.empty(t.rootHash) {
+		return false, nil
+	}
+	searchKey := bytesToNibbles(key)
+	var startNode node = &hashNode{t.rootHash[:]}
+	for {
+		switch n := startNode.(type) {
+		case *extNode:
+			if matchingLength(searchKey, n.key) != len(n.key) {
+				return false, nil
+			}
+			startNode = n.child
+			searchKey = searchKey[len(n.key):]
+		case *branchNode:
+			if len(searchKey) == 0 {
+				return n.hasTarget(), nil
+			}
+			startNode = n.children[searchKey[0]]
+			searchKey = searchKey[1:]
+		case *hashNode:
+			resolved, err := t.resolveHash(n.Hash())
+			if err != nil {
+				return false, err
+			}
+			startNode = resolved
+		default:
+			// leaf node or nil child of branch node
+			return false, nil
+		}
+	}
+}
+
+// Insert insert key and value to trie, return a new trie, old trie is unchanged.
+// It panics if nodes can't be resolved or value is too large, use TryInsert to get
+// the error instead
 func (t *Trie) Insert(key, value []byte) *Trie {
+	newTrie, err := t.TryInsert(key, value)
+	if err != nil {
+		panic(err)
+	}
+	return newTrie
+}
+
+// tryInsert insert key and value to the trie, errors of resolving nodes are
+// returned rather than panic
+func (t *Trie) tryInsert(key, value []byte) (newTrie *Trie, err error) {
+	if t.config.maxValueSize > 0 && len(value) > t.config.maxValueSize {
+		return nil, ErrValueTooLarge
+	}
+	defer recoverResolveError(&err)
 	searchKey := bytesToNibbles(key)
 	var newRootNode node
 	var result *insertResult
-	if t.rootHash == EmptyHash {
+	if t.empty(t.rootHash) {
 		newRootNode = newLeafNode(searchKey, value)
 		result = newInsertResult(newRootNode)
 		result.insert(newRootNode)
 	} else {
 		rootNode, err := t.resolveHash(t.rootHash)
 		if err != nil {
-			panic("Insert: can't resolve rootHash")
+			return nil, err
 		}
 		result = t.insert(rootNode, searchKey, value)
 		newRootNode = result.newNode
 	}
-	newTrie := NewTrie(newRootNode.Hash(), t.db)
-	newTrie.log = t.log.mergeFromInsertResult(t.rootHash, result)
-	return newTrie
+	if err := t.checkTargets(result); err != nil {
+		return nil, err
+	}
+	return t.derive(newRootNode.Hash(), t.log.mergeFromInsertResult(t.rootHash, result)), nil
 }
 
 func (t *Trie) insert(startNode node, searchKey, value []byte) *insertResult {
@@ -108,7 +343,7 @@ func (t *Trie) insert(startNode node, searchKey, value []byte) *insertResult {
 	case *hashNode:
 		newNode, err := t.resolveHash(n.Hash())
 		if err != nil {
-			panic("insert: can't resolve hashNode")
+			panic(&resolveError{err})
 		}
 		return t.insert(newNode, searchKey, value)
 	default:
@@ -132,10 +367,10 @@ func (t *Trie) insertToLeaf(leaf *leafNode, searchKey, value []byte) *insertResu
 		var tempBranch *branchNode
 		var maybeLeaf node
 		if len(leaf.key) == 0 {
-			tempBranch = branchWithTarget(leaf.value)
+			tempBranch = branchWithTarget(leaf.value, t.config.taggedRefs)
 		} else {
 			maybeLeaf = newLeafNode(leaf.key[1:], leaf.value)
-			tempBranch = branchWithChild(int(leaf.key[0]), maybeLeaf, nil)
+			tempBranch = branchWithChild(int(leaf.key[0]), maybeLeaf, nil, t.config.taggedRefs)
 		}
 		result := t.insert(tempBranch, searchKey, value)
 		result.delete(leaf)
@@ -145,12 +380,12 @@ func (t *Trie) insertToLeaf(leaf *leafNode, searchKey, value []byte) *insertResu
 	// have common prefix, create a new branch node which embedded in a new ext node
 	var tempNode node
 	if ml == len(leaf.key) {
-		tempNode = branchWithTarget(leaf.value)
+		tempNode = branchWithTarget(leaf.value, t.config.taggedRefs)
 	} else {
 		tempNode = newLeafNode(leaf.key[ml:], leaf.value)
 	}
 	result := t.insert(tempNode, searchKey[ml:], value)
-	tempExtNode := newExtNode(leaf.key[:ml], result.newNode)
+	tempExtNode := newExtNode(leaf.key[:ml], result.newNode, t.config.taggedRefs)
 	result.newNode = tempExtNode
 	result.delete(leaf)
 	result.insert(tempExtNode)
@@ -165,11 +400,11 @@ func (t *Trie) insertToExt(ext *extNode, searchKey, value []byte) *insertResult
 		var maybeChild node
 		if len(ext.key) == 1 {
 			// change this node to branch directly
-			tempBranch = branchWithChild(int(ext.key[0]), ext.child, nil)
+			tempBranch = branchWithChild(int(ext.key[0]), ext.child, nil, ext.tagged)
 		} else {
-			newExt := newExtNode(ext.key[1:], ext.child)
+			newExt := newExtNode(ext.key[1:], ext.child, ext.tagged)
 			maybeChild = newExt
-			tempBranch = branchWithChild(int(ext.key[0]), newExt, nil)
+			tempBranch = branchWithChild(int(ext.key[0]), newExt, nil, ext.tagged)
 		}
 		result := t.insert(tempBranch, searchKey, value)
 		result.insert(maybeChild)
@@ -179,15 +414,15 @@ func (t *Trie) insertToExt(ext *extNode, searchKey, value []byte) *insertResult
 	if ml == len(ext.key) {
 		// matched completely, insert kv to the extNode's child
 		result := t.insert(ext.child, searchKey[ml:], value)
-		newExt := newExtNode(ext.key, result.newNode)
+		newExt := newExtNode(ext.key, result.newNode, ext.tagged)
 		result.newNode = newExt
 		result.insert(newExt)
 		result.delete(ext)
 		return result
 	}
-	tempExt := newExtNode(ext.key[ml:], ext.child)
+	tempExt := newExtNode(ext.key[ml:], ext.child, ext.tagged)
 	result := t.insert(tempExt, searchKey[ml:], value)
-	newExt := newExtNode(ext.key[:ml], result.newNode)
+	newExt := newExtNode(ext.key[:ml], result.newNode, ext.tagged)
 	result.newNode = newExt
 	result.insert(newExt)
 	result.delete(ext)
@@ -222,29 +457,39 @@ func (t *Trie) insertToBranch(branch *branchNode, searchKey, value []byte) *inse
 	return result
 }
 
-// Delete delete key and value from trie, return a new trie, old trie is unchanged
+// Delete delete key and value from trie, return a new trie, old trie is unchanged.
+// It panics if nodes can't be resolved, use TryDelete to get the error instead
 func (t *Trie) Delete(key []byte) *Trie {
-	if t.rootHash == EmptyHash {
-		return t
+	newTrie, err := t.TryDelete(key)
+	if err != nil {
+		panic(err)
+	}
+	return newTrie
+}
+
+// tryDelete delete key from the trie, errors of resolving nodes are returned
+// rather than panic
+func (t *Trie) tryDelete(key []byte) (newTrie *Trie, err error) {
+	defer recoverResolveError(&err)
+	if t.empty(t.rootHash) {
+		return t, nil
 	}
 	searchKey := bytesToNibbles(key)
 	rootNode, err := t.resolveHash(t.rootHash)
 	if err != nil {
-		panic("Delete: can't resolve rootHash")
+		return nil, err
 	}
 	result := t.delete(rootNode, searchKey)
 	if !result.hasChanged {
-		return t
+		return t, nil
 	}
 	var newRootHash common.Hash
 	if result.newNode == nil {
-		newRootHash = EmptyHash
+		newRootHash = t.config.emptyRoot
 	} else {
 		newRootHash = result.newNode.Hash()
 	}
-	newTrie := NewTrie(newRootHash, t.db)
-	newTrie.log = t.log.mergeFromDeleteResult(t.rootHash, result)
-	return newTrie
+	return t.derive(newRootHash, t.log.mergeFromDeleteResult(t.rootHash, result)), nil
 }
 
 func (t *Trie) delete(startNode node, searchKey []byte) *deleteResult {
@@ -258,7 +503,7 @@ func (t *Trie) delete(startNode node, searchKey []byte) *deleteResult {
 	case *hashNode:
 		newNode, err := t.resolveHash(n.Hash())
 		if err != nil {
-			panic("delete: can't resolve hashNode")
+			panic(&resolveError{err})
 		}
 		return t.delete(newNode, searchKey)
 	default:
@@ -288,8 +533,8 @@ func (t *Trie) deleteFromExt(ext *extNode, searchKey []byte) *deleteResult {
 	if !result.hasChanged {
 		return result
 	}
-	toFixed := newExtNode(ext.key, result.newNode)
-	fixedNode := t.tryFix(toFixed, result.inserted)
+	toFixed := newExtNode(ext.key, result.newNode, ext.tagged)
+	fixedNode := t.tryFix(toFixed, result)
 	result.newNode = fixedNode
 	result.insert(fixedNode)
 	result.delete(ext)
@@ -299,8 +544,9 @@ func (t *Trie) deleteFromExt(ext *extNode, searchKey []byte) *deleteResult {
 func (t *Trie) deleteFromBranch(branch *branchNode, searchKey []byte) *deleteResult {
 	if len(searchKey) == 0 && branch.hasTarget() {
 		// delete target value of current branch node, and try to fix that
-		fixedNode := t.tryFix(branchWithChildren(branch.children), nil)
-		result := newDeleteResult(fixedNode, true)
+		result := newDeleteResult(nil, true)
+		fixedNode := t.tryFix(branchWithChildren(branch.children, branch.tagged), result)
+		result.newNode = fixedNode
 		result.insert(fixedNode)
 		result.delete(branch)
 		return result
@@ -321,7 +567,7 @@ func (t *Trie) deleteFromBranch(branch *branchNode, searchKey []byte) *deleteRes
 		return result
 	}
 	tempBranch := branch.updateChild(childIndex, result.newNode)
-	fixedNode := t.tryFix(tempBranch, result.inserted)
+	fixedNode := t.tryFix(tempBranch, result)
 	result.newNode = fixedNode
 	result.insert(fixedNode)
 	result.delete(branch)
@@ -331,19 +577,21 @@ func (t *Trie) deleteFromBranch(branch *branchNode, searchKey []byte) *deleteRes
 // tryFix try to fix invalid state of a trie, invalid state means:
 // - branchNode have only one entry(only have single child or only have target value)
 // - extNode have a child which is anything other than a branchNode
-func (t *Trie) tryFix(startNode node, updates []node) node {
+// nodes inserted by result are looked up before resolving, and nodes absorbed by
+// the fix are recorded as deleted to result
+func (t *Trie) tryFix(startNode node, result *deleteResult) node {
 	switch n := startNode.(type) {
 	case *branchNode:
-		return t.tryFixBranch(n, updates)
+		return t.tryFixBranch(n, result)
 	case *extNode:
-		return t.tryFixExt(n, updates)
+		return t.tryFixExt(n, result)
 	default:
 		return n
 	}
 }
 
 // tryFixBranch try to fix a branch node which have only one entry
-func (t *Trie) tryFixBranch(branch *branchNode, updates []node) node {
+func (t *Trie) tryFixBranch(branch *branchNode, result *deleteResult) node {
 	index := branch.childrenIndex()
 	// now we only have target value
 	if len(index) == 0 && branch.hasTarget() {
@@ -352,8 +600,8 @@ func (t *Trie) tryFixBranch(branch *branchNode, updates []node) node {
 	// now we only have one child
 	if len(index) == 1 && !branch.hasTarget() {
 		idx := index[0]
-		tempExtNode := newExtNode([]byte{byte(idx)}, branch.children[idx])
-		return t.tryFix(tempExtNode, updates)
+		tempExtNode := newExtNode([]byte{byte(idx)}, branch.children[idx], branch.tagged)
+		return t.tryFix(tempExtNode, result)
 	}
 	if len(index) == 0 && !branch.hasTarget() {
 		panic("tryFixBranch: invalid branch state, no children and no target")
@@ -363,28 +611,32 @@ func (t *Trie) tryFixBranch(branch *branchNode, updates []node) node {
 }
 
 // tryFixExt try to fix a ext node which child is not a branch node
-func (t *Trie) tryFixExt(ext *extNode, updates []node) node {
+func (t *Trie) tryFixExt(ext *extNode, result *deleteResult) node {
 	var child node
 	switch n := ext.child.(type) {
 	case *hashNode:
 		// first, try to find child from updates
-		child = getNodeFrom(updates, n.Hash())
+		child = getNodeFrom(result.inserted, n.Hash())
 		if child == nil {
 			var err error
 			child, err = t.resolveHash(n.Hash())
 			if err != nil {
-				panic("tryFixExt: can't resolve child, maybe because of can't get node from updates")
+				panic(&resolveError{err})
 			}
 		}
 	default:
 		child = n
 	}
+	// the child is absorbed by the compacted node, delete it whether it's stored in
+	// underlying db or just inserted by the operation, otherwise it's leaked
 	switch n := child.(type) {
 	case *extNode:
 		// the child of current ext node is a ext node, compact to a new extNode
-		return newExtNode(concat(ext.key, n.key), n.child)
+		result.delete(n)
+		return newExtNode(concat(ext.key, n.key), n.child, ext.tagged)
 	case *leafNode:
 		// the child of current ext node is a leaf node, compact to a new leafNode
+		result.delete(n)
 		return newLeafNode(concat(ext.key, n.key), n.value)
 	default:
 		return ext
@@ -392,13 +644,28 @@ func (t *Trie) tryFixExt(ext *extNode, updates []node) node {
 }
 
 func (t *Trie) resolveHash(hash common.Hash) (node, error) {
-	if _, ok := t.log.deleted[hash]; ok {
+	if t.counts != nil {
+		t.counts.resolves++
+	}
+	inserted, deleted, found := t.log.lookup(hash)
+	if deleted {
 		return nil, fmt.Errorf("trie is inconsistent, node has been deleted")
 	}
-	if inserted, ok := t.log.inserted[hash]; ok {
+	if found && inserted == nil {
+		// spilled to disk, see WithSpill
+		spilled, err := t.log.spill.get(hash)
+		if err != nil {
+			return nil, &MissingNodeError{Hash: hash, Err: err}
+		}
+		return decodeNode(spilled)
+	}
+	if found {
 		return decodeNode(inserted)
 	}
-	if cached, ok := t.log.cached[hash]; ok {
+	if cached, ok := t.log.cached(hash); ok {
+		if t.counts != nil {
+			t.counts.cacheHits++
+		}
 		return decodeNode(cached)
 	}
 	return t.fetchFromDB(hash)
@@ -406,34 +673,113 @@ func (t *Trie) resolveHash(hash common.Hash) (node, error) {
 
 // fetch node from underlying db, and cache raw data
 func (t *Trie) fetchFromDB(hash common.Hash) (node, error) {
-	encoded, err := t.db.Get(hash[:])
+	if t.counts != nil {
+		t.counts.dbReads++
+	}
+	if t.db == nil {
+		// a trie held in memory, see Database of the mptcore build
+		return nil, &MissingNodeError{Hash: hash}
+	}
+	encoded, err := t.db.Get(nodeKey(hash))
 	if err != nil || len(encoded) == 0 {
-		panic("fetchFromDB: get from db failed")
+		if t.Stale() {
+			return nil, ErrStaleTrie
+		}
+		return nil, &MissingNodeError{Hash: hash, Err: err}
 	}
-	n, err := decodeNode(encoded)
+	n, err := t.decodeFetched(encoded)
 	if err != nil {
-		panic("fetchFromDB: decodeNode failed")
+		return nil, &MissingNodeError{Hash: hash, Err: err}
+	}
+	if !t.config.noCache {
+		t.log.cache.put(hash, encoded)
 	}
-	t.log.cache(hash, encoded)
 	return n, nil
 }
 
-func (t *Trie) CommitToBatch(batch db.Batch) {
-	for k, v := range t.log.inserted {
-		batch.Put(k[:], v)
+// decodeFetched decode a node read from underlying db, and check it against the
+// bounds of the trie
+func (t *Trie) decodeFetched(encoded []byte) (node, error) {
+	return t.config.decode(encoded)
+}
+
+// decode decode a node from untrusted input, e.g. underlying db or proofs, and check
+// it against the bounds of WithMaxValueSize and WithoutBranchTargets, and the child
+// references of WithTaggedChildRefs
+func (c *config) decode(encoded []byte) (node, error) {
+	n, err := decodeNode(encoded)
+	if err == nil {
+		err = checkTagged(n, c.taggedRefs)
+	}
+	if err == nil && c.maxValueSize > 0 {
+		err = checkValueSize(n, c.maxValueSize)
 	}
-	for k, _ := range t.log.deleted {
-		batch.Delete(k[:])
+	if err == nil && c.noTargets {
+		err = checkNoTargets(n)
 	}
+	return n, err
 }
 
-// Persist all logs to underlying db
-// TODO: it's prune mode currently, what we need is archive mode
-// refer to https://blog.ethereum.org/2015/06/26/state-tree-pruning/
-func (t *Trie) Persist() {
-	batch := t.db.NewBatch()
-	t.CommitToBatch(batch)
-	batch.Write()
+// checkValueSize return ErrValueTooLarge if any value of n and its embedded children
+// is larger than max
+func checkValueSize(n node, max int) error {
+	switch n := n.(type) {
+	case *leafNode:
+		if len(n.value) > max {
+			return ErrValueTooLarge
+		}
+	case *extNode:
+		return checkValueSize(n.child, max)
+	case *branchNode:
+		if len(n.target) > max {
+			return ErrValueTooLarge
+		}
+		for _, child := range n.children {
+			if child == nil {
+				continue
+			}
+			if err := checkValueSize(child, max); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkTargets return ErrBranchTarget if the trie forbid branch targets and any node
+// inserted by result carry a target
+func (t *Trie) checkTargets(result *insertResult) error {
+	if !t.config.noTargets {
+		return nil
+	}
+	for _, n := range result.inserted {
+		if err := checkNoTargets(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkNoTargets return ErrBranchTarget if n or its embedded children is a branch
+// with target
+func checkNoTargets(n node) error {
+	switch n := n.(type) {
+	case *extNode:
+		return checkNoTargets(n.child)
+	case *branchNode:
+		if n.hasTarget() {
+			return ErrBranchTarget
+		}
+		for _, child := range n.children {
+			if child == nil {
+				continue
+			}
+			if err := checkNoTargets(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 // StateRoot return the rootHash of the trie
@@ -441,6 +787,85 @@ func (t *Trie) StateRoot() common.Hash {
 	return t.rootHash
 }
 
+// EvictClean release all cached nodes read from underlying db, the cache is
+// shared by all tries derived from the same trie. Changes not persisted are kept
+func (t *Trie) EvictClean() {
+	t.log.cache.trim(0)
+}
+
+// TrimCache evict the earliest cached nodes until the cache hold at most
+// maxBytes of encoded nodes, changes not persisted are kept. Nodes evicted
+// will be read from underlying db again when needed, and are not counted
+// as deleted in CommitReport if they are deleted later
+func (t *Trie) TrimCache(maxBytes int) {
+	t.log.cache.trim(maxBytes)
+}
+
+// CacheSize return the total size of cached nodes read from underlying db
+func (t *Trie) CacheSize() int {
+	return t.log.cache.bytes()
+}
+
+// LogStats is the memory held by the log of a trie. Layers shared with other tries
+// are counted by all of them, and a node changed in more than one layer is counted
+// once per layer, as it's retained by each of them
+type LogStats struct {
+	// CachedNodes and CachedBytes are nodes read from underlying db, the cache is
+	// shared by all tries derived from the same trie
+	CachedNodes int
+	CachedBytes int
+	// InsertedNodes and DeletedNodes are the entries of all layers
+	InsertedNodes int
+	DeletedNodes  int
+	Layers        int
+	// RetainedBytes is the total size of cached nodes, inserted nodes and hashes
+	// of all entries
+	RetainedBytes int
+}
+
+// LogStats return the stats of the log of the trie, it's O(number of layers), which
+// is logarithmic in the number of changes, so it can be sampled as gauges, e.g. to
+// watch the growth of the cache. It's safe to call concurrently with operations on
+// the trie and its derived tries
+func (t *Trie) LogStats() LogStats {
+	stats := LogStats{
+		CachedNodes: t.log.cache.count(),
+		CachedBytes: t.log.cache.bytes(),
+		Layers:      len(t.log.layers),
+	}
+	stats.RetainedBytes = stats.CachedBytes + stats.CachedNodes*common.HashLength
+	for _, layer := range t.log.layers {
+		stats.InsertedNodes += len(layer.inserted)
+		stats.DeletedNodes += len(layer.deleted)
+		stats.RetainedBytes += layer.bytes + layer.size()*common.HashLength
+	}
+	return stats
+}
+
+// opCounts count the nodes resolved by hash by an operation, and where they are
+// read from, nodes changed by the trie are neither cache hits nor db reads
+type opCounts struct {
+	resolves  int
+	cacheHits int
+	dbReads   int
+}
+
+// resolveError wrap the error of resolving a node, it's used to abort the recursive
+// insert/delete and recovered by TryInsert/TryDelete
+type resolveError struct {
+	err error
+}
+
+func recoverResolveError(err *error) {
+	if r := recover(); r != nil {
+		resolveErr, ok := r.(*resolveError)
+		if !ok {
+			panic(r)
+		}
+		*err = resolveErr.err
+	}
+}
+
 func getNodeFrom(nodes []node, hash common.Hash) node {
 	for _, n := range nodes {
 		if n.Hash() == hash {
@@ -462,4 +887,4 @@ func concat(a []byte, b []byte) []byte {
 	copy(res, a)
 	copy(res[len(a):], b)
 	return res
-}
\ No newline at end of file
+}
@@ -1,3 +1,6 @@
+//go:build !mptcore
+// +build !mptcore
+
 package mpt
 
 import (
@@ -5,6 +8,8 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/ethereum/go-ethereum/common"
+	db "github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/ethdb/memorydb"
 	"github.com/stretchr/testify/assert"
 )
@@ -185,3 +190,465 @@ func TestDeleteThenInsert(t *testing.T) {
 	value := trie.Get(kvs[2].k)
 	assert.Equal(t, value, kvs[2].v)
 }
+
+func TestTrimCache(t *testing.T) {
+	memDB := memorydb.New()
+	trie := NewTrie(EmptyHash, memDB)
+	kvs := uniqueKVs(100)
+	for _, elem := range kvs {
+		trie = trie.Insert(elem.k, elem.v)
+	}
+	trie.Persist()
+	trie = NewTrie(trie.StateRoot(), memDB)
+	assert.Equal(t, 0, trie.CacheSize())
+	for _, elem := range kvs {
+		assert.Equal(t, elem.v, trie.Get(elem.k))
+	}
+	size := trie.CacheSize()
+	assert.True(t, size > 0)
+
+	// cache is shared by derived tries
+	newTrie := trie.Insert(kvs[0].k, kvs[1].v)
+	newTrie.TrimCache(size / 2)
+	assert.True(t, trie.CacheSize() <= size/2)
+	trie.EvictClean()
+	assert.Equal(t, 0, newTrie.CacheSize())
+
+	// evicted nodes are read from underlying db again
+	for _, elem := range kvs[1:] {
+		assert.Equal(t, elem.v, newTrie.Get(elem.k))
+	}
+	assert.Equal(t, kvs[1].v, newTrie.Get(kvs[0].k))
+	assert.Equal(t, kvs[0].v, trie.Get(kvs[0].k))
+}
+
+func TestNoCache(t *testing.T) {
+	memDB := memorydb.New()
+	base, kvs := persistedTrie(memDB, 100)
+	store := NewFaultyStore(memDB, FaultConfig{})
+	trie := NewTrie(base.StateRoot(), store, WithNoCache())
+	for _, elem := range kvs {
+		assert.Equal(t, elem.v, trie.Get(elem.k))
+	}
+	assert.Equal(t, 0, trie.CacheSize())
+	resolves := store.Resolves()
+	assert.True(t, resolves > 0)
+	// every read go to underlying db
+	assert.Equal(t, kvs[0].v, trie.Get(kvs[0].k))
+	assert.True(t, store.Resolves() > resolves)
+
+	for _, elem := range kvs[:50] {
+		trie = trie.Delete(elem.k)
+	}
+	assert.Equal(t, 0, trie.CacheSize())
+	report := trie.Persist()
+	assert.Equal(t, 0, report.NodesDeleted)
+	// deleted nodes are removed even if they are not cached
+	checked := make(map[common.Hash]struct{})
+	assert.Nil(t, checkSubtree(memDB, trie.StateRoot(), checked))
+	assert.Equal(t, memDB.Len(), len(checked))
+	trie = NewTrie(trie.StateRoot(), memDB)
+	for i, elem := range kvs {
+		if i < 50 {
+			assert.Nil(t, trie.Get(elem.k))
+		} else {
+			assert.Equal(t, elem.v, trie.Get(elem.k))
+		}
+	}
+}
+
+func TestLogStats(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 100)
+	assert.Equal(t, LogStats{Layers: 1}, trie.LogStats())
+	for _, elem := range kvs {
+		assert.Equal(t, elem.v, trie.Get(elem.k))
+	}
+	stats := trie.LogStats()
+	assert.Equal(t, memDB.Len(), stats.CachedNodes)
+	assert.Equal(t, trie.CacheSize(), stats.CachedBytes)
+	assert.Equal(t, 0, stats.InsertedNodes)
+
+	updated := trie
+	for _, elem := range kvs[:50] {
+		updated = updated.Insert(elem.k, randomBytes())
+	}
+	nodes, bytes := updated.DirtyCount()
+	stats = updated.LogStats()
+	flattened := updated.log.flatten()
+	assert.True(t, stats.InsertedNodes >= nodes)
+	assert.True(t, stats.DeletedNodes >= len(flattened.deleted))
+	assert.True(t, stats.RetainedBytes > stats.CachedBytes+bytes)
+	assert.Equal(t, bytes, flattened.bytes)
+	// the base trie is not changed
+	assert.Equal(t, 0, trie.LogStats().InsertedNodes)
+
+	updated.Persist()
+	assert.Equal(t, stats, updated.LogStats())
+	updated.EvictClean()
+	stats = updated.LogStats()
+	assert.Equal(t, 0, stats.CachedNodes)
+	assert.Equal(t, 0, stats.CachedBytes)
+}
+
+// TestStaleTrie fork two tries from a committed trie, persist one of them,
+// then the committed trie and the other fork become stale
+func TestStaleTrie(t *testing.T) {
+	memDB := memorydb.New()
+	base, kvs := persistedTrie(memDB, 100)
+	assert.False(t, base.Stale())
+	forkA := base.Insert([]byte{0x01}, []byte{0x01})
+	forkB := base.Insert([]byte{0x02}, []byte{0x02})
+	assert.False(t, forkA.Stale())
+	forkB.Persist()
+	assert.False(t, forkB.Stale())
+	assert.True(t, forkA.Stale())
+	assert.True(t, base.Stale())
+
+	stale := NewTrie(base.StateRoot(), memDB)
+	assert.True(t, stale.Stale())
+	_, err := stale.TryGet(kvs[0].k)
+	assert.Equal(t, ErrStaleTrie, err)
+	_, err = stale.TryInsert(kvs[0].k, kvs[0].v)
+	assert.Equal(t, ErrStaleTrie, err)
+	_, err = stale.TryDelete(kvs[0].k)
+	assert.Equal(t, ErrStaleTrie, err)
+	assert.Nil(t, stale.Get(kvs[0].k))
+	assert.PanicsWithValue(t, ErrStaleTrie, func() { stale.Insert(kvs[0].k, kvs[0].v) })
+
+	// reload the persisted trie, it's not stale
+	reloaded := NewTrie(forkB.StateRoot(), memDB)
+	value, err := reloaded.TryGet([]byte{0x02})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x02}, value)
+}
+
+func TestMissingNode(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 100)
+	// remove all nodes except the root node
+	root := trie.StateRoot()
+	iter := memDB.NewIterator(nil, nil)
+	for iter.Next() {
+		if !bytes.Equal(iter.Key(), root[:]) {
+			memDB.Delete(iter.Key())
+		}
+	}
+	iter.Release()
+	assert.False(t, trie.Stale())
+	_, err := trie.TryGet(kvs[0].k)
+	assert.IsType(t, &MissingNodeError{}, err)
+	_, err = trie.TryInsert(kvs[0].k, kvs[1].v)
+	assert.IsType(t, &MissingNodeError{}, err)
+	_, err = trie.TryDelete(kvs[0].k)
+	assert.IsType(t, &MissingNodeError{}, err)
+}
+
+// countingBatch count puts to the batch
+type countingBatch struct {
+	db.Batch
+	puts int
+}
+
+func (b *countingBatch) Put(key, value []byte) error {
+	b.puts++
+	return b.Batch.Put(key, value)
+}
+
+func TestWriteDedup(t *testing.T) {
+	memDB := memorydb.New()
+	committed, kvs := persistedTrie(memDB, 100)
+
+	// replay the same inserts on an empty trie, all nodes exist already
+	replay := func(opts ...Option) (*CommitReport, int) {
+		trie := NewTrie(EmptyHash, memDB, opts...)
+		for _, elem := range kvs {
+			trie = trie.Insert(elem.k, elem.v)
+		}
+		assert.Equal(t, committed.StateRoot(), trie.StateRoot())
+		batch := &countingBatch{Batch: memDB.NewBatch()}
+		report := trie.CommitToBatch(batch)
+		assert.Nil(t, batch.Write())
+		return report, batch.puts
+	}
+
+	report, puts := replay()
+	assert.True(t, puts > 0)
+	assert.Equal(t, puts, report.NodesWritten)
+
+	report, puts = replay(WithWriteDedup())
+	assert.Equal(t, 0, puts)
+	assert.Equal(t, 0, report.NodesWritten)
+
+	// new nodes are still written
+	trie := NewTrie(committed.StateRoot(), memDB, WithWriteDedup())
+	trie = trie.Insert(randomBytes(), randomBytes())
+	batch := &countingBatch{Batch: memDB.NewBatch()}
+	report = trie.CommitToBatch(batch)
+	assert.True(t, batch.puts > 0)
+	assert.Equal(t, batch.puts, report.NodesWritten)
+}
+
+func TestHasTarget(t *testing.T) {
+	memDB := memorydb.New()
+	trie := NewTrie(EmptyHash, memDB)
+	trie = trie.Insert([]byte{0x01}, []byte{})
+	trie = trie.Insert([]byte{0x01, 0x02}, []byte{0x02})
+	trie = trie.Insert([]byte{0x02}, []byte{0x03})
+	trie.Persist()
+	trie = NewTrie(trie.StateRoot(), memDB)
+
+	cases := []struct {
+		key       []byte
+		hasTarget bool
+	}{
+		{key: []byte{0x01}, hasTarget: true},
+		{key: []byte{0x01, 0x02}, hasTarget: false},
+		{key: []byte{0x02}, hasTarget: false},
+		{key: []byte{0x03}, hasTarget: false},
+	}
+	for _, c := range cases {
+		hasTarget, err := trie.HasTarget(c.key)
+		assert.Nil(t, err)
+		assert.Equal(t, c.hasTarget, hasTarget)
+	}
+	// the empty target survive encoding
+	value := trie.Get([]byte{0x01})
+	assert.NotNil(t, value)
+	assert.Equal(t, 0, len(value))
+
+	trie = trie.Delete([]byte{0x01})
+	hasTarget, err := trie.HasTarget([]byte{0x01})
+	assert.Nil(t, err)
+	assert.False(t, hasTarget)
+	assert.Nil(t, trie.Get([]byte{0x01}))
+}
+
+func TestEmptyRoot(t *testing.T) {
+	assert.Equal(t, common.HexToHash("0x56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421"), EthereumEmptyRoot)
+	memDB := memorydb.New()
+	trie := NewTrie(EmptyHash, memDB, WithEmptyRoot(EthereumEmptyRoot))
+	assert.Equal(t, EthereumEmptyRoot, trie.StateRoot())
+	assert.False(t, trie.Stale())
+
+	kvs := uniqueKVs(100)
+	for _, elem := range kvs {
+		trie = trie.Insert(elem.k, elem.v)
+	}
+	trie.Persist()
+	trie = NewTrie(trie.StateRoot(), memDB, WithEmptyRoot(EthereumEmptyRoot))
+	for _, elem := range kvs {
+		trie = trie.Delete(elem.k)
+	}
+	assert.Equal(t, EthereumEmptyRoot, trie.StateRoot())
+	trie.Persist()
+
+	reloaded := NewTrie(EthereumEmptyRoot, memDB, WithEmptyRoot(EthereumEmptyRoot))
+	assert.False(t, reloaded.Stale())
+	assert.Nil(t, reloaded.Get(kvs[0].k))
+	assert.Nil(t, reloaded.Iterate(func(key, value []byte) bool {
+		t.Fatalf("unexpected key %x in empty trie", key)
+		return false
+	}))
+	assert.Nil(t, VerifyProofBatch(EthereumEmptyRoot, []ProofItem{{Key: kvs[0].k}}))
+	reloaded = reloaded.Insert(kvs[0].k, kvs[0].v)
+	assert.Equal(t, kvs[0].v, reloaded.Get(kvs[0].k))
+}
+
+func TestMaxValueSize(t *testing.T) {
+	memDB := memorydb.New()
+	trie := NewTrie(EmptyHash, memDB, WithMaxValueSize(64))
+	_, err := trie.TryInsert([]byte{1}, make([]byte, 65))
+	assert.Equal(t, ErrValueTooLarge, err)
+	assert.Panics(t, func() { trie.Insert([]byte{1}, make([]byte, 65)) })
+	_, err = trie.TryApplySorted([]KV{{Key: []byte{0}, Value: []byte{}}, {Key: []byte{1}, Value: make([]byte, 65)}})
+	assert.Equal(t, ErrValueTooLarge, err)
+	trie, err = trie.TryInsert([]byte{1}, make([]byte, 64))
+	assert.Nil(t, err)
+	assert.Equal(t, make([]byte, 64), trie.Get([]byte{1}))
+	trie, err = trie.TryApplySorted([]KV{{Key: []byte{2}, Value: make([]byte, 64)}})
+	assert.Nil(t, err)
+	assert.Equal(t, make([]byte, 64), trie.Get([]byte{2}))
+
+	// a trie without the bound hold large values, both as leaves and branch targets
+	unbounded := NewTrie(EmptyHash, memDB)
+	large := []kv{{[]byte{1, 2}, make([]byte, 100)}, {[]byte{1}, make([]byte, 100)}}
+	for _, elem := range uniqueKVs(50) {
+		unbounded = unbounded.Insert(elem.k, elem.v[:1])
+	}
+	for _, elem := range large {
+		unbounded = unbounded.Insert(elem.k, elem.v)
+	}
+	unbounded.Persist()
+	bounded := NewTrie(unbounded.StateRoot(), memDB, WithMaxValueSize(64))
+	for _, elem := range large {
+		_, err := bounded.TryGet(elem.k)
+		assert.Equal(t, ErrValueTooLarge, err.(*MissingNodeError).Err)
+	}
+
+	// embedded leaves are checked as well
+	n := branchWithChild(1, newLeafNode([]byte{1}, make([]byte, 10)), nil, false)
+	assert.Nil(t, checkValueSize(n, 10))
+	assert.Equal(t, ErrValueTooLarge, checkValueSize(n, 9))
+	assert.Equal(t, ErrValueTooLarge, checkValueSize(branchWithTarget(make([]byte, 10), false), 9))
+}
+
+func TestWithoutBranchTargets(t *testing.T) {
+	memDB := memorydb.New()
+	trie := NewTrie(EmptyHash, memDB, WithoutBranchTargets())
+	kvs := make([]kv, 0, 100)
+	for i := 0; i < 100; i++ {
+		kvs = append(kvs, kv{Uint64Key(uint64(i)), randomBytes()})
+	}
+	for _, elem := range kvs {
+		trie = trie.Insert(elem.k, elem.v)
+	}
+	// keys which are a prefix of another key are rejected in both orders
+	_, err := trie.TryInsert(kvs[0].k[:4], []byte{1})
+	assert.Equal(t, ErrBranchTarget, err)
+	_, err = trie.TryInsert(append(kvs[0].k, 1), []byte{1})
+	assert.Equal(t, ErrBranchTarget, err)
+	_, err = trie.TryApplySorted([]KV{{Key: kvs[0].k[:4], Value: []byte{1}}})
+	assert.Equal(t, ErrBranchTarget, err)
+	trie.Persist()
+	reader := NewTrie(trie.StateRoot(), memDB, WithoutBranchTargets())
+	for _, elem := range kvs {
+		assert.Equal(t, elem.v, reader.Get(elem.k))
+	}
+
+	// nodes carrying targets are malformed
+	withTargets := NewTrie(EmptyHash, memDB)
+	withTargets = withTargets.Insert([]byte{1, 2}, randomBytes())
+	withTargets = withTargets.Insert([]byte{1}, randomBytes())
+	withTargets.Persist()
+	_, err = NewTrie(withTargets.StateRoot(), memDB, WithoutBranchTargets()).TryGet([]byte{1, 2})
+	assert.Equal(t, ErrBranchTarget, err.(*MissingNodeError).Err)
+
+	n := newExtNode([]byte{1}, branchWithChild(2, newLeafNode([]byte{3}, []byte{4}), nil, false), false)
+	assert.Nil(t, checkNoTargets(n))
+	assert.Equal(t, ErrBranchTarget, checkNoTargets(newExtNode([]byte{1}, branchWithTarget([]byte{1}, false), false)))
+}
+
+// TestTaggedChildRefs check tries with tagged child references hold the same key
+// values as plain tries under other roots, and nodes of one convention are rejected
+// by tries of the other
+func TestTaggedChildRefs(t *testing.T) {
+	plainDB, taggedDB := memorydb.New(), memorydb.New()
+	plain := NewTrie(EmptyHash, plainDB)
+	tagged := NewTrie(EmptyHash, taggedDB, WithTaggedChildRefs())
+	model := make(map[string][]byte)
+	for i, elem := range uniqueKVs(200) {
+		// values are unique, and short ones are embedded in their parents
+		value := append(Uint64Key(uint64(i))[6:], elem.v...)
+		plain = plain.Insert(elem.k, value)
+		tagged = tagged.Insert(elem.k, value)
+		model[string(elem.k)] = value
+	}
+	expected := sortedKVs(model)
+	assert.NotEqual(t, plain.StateRoot(), tagged.StateRoot())
+	assert.Equal(t, expected, collectKVs(t, tagged.Iterate))
+	sorted := make([]KV, len(expected))
+	for i, elem := range expected {
+		sorted[i] = KV{Key: elem.k, Value: elem.v}
+	}
+	applied, err := NewTrie(EmptyHash, memorydb.New(), WithTaggedChildRefs()).TryApplySorted(sorted)
+	assert.Nil(t, err)
+	assert.Equal(t, tagged.StateRoot(), applied.StateRoot())
+
+	for _, elem := range expected[:100] {
+		plain = plain.Delete(elem.k)
+		tagged = tagged.Delete(elem.k)
+	}
+	applied, err = NewTrie(EmptyHash, memorydb.New(), WithTaggedChildRefs()).TryApplySorted(sorted[100:])
+	assert.Nil(t, err)
+	assert.Equal(t, applied.StateRoot(), tagged.StateRoot())
+	plain.Persist()
+	tagged.Persist()
+	reader := NewTrie(tagged.StateRoot(), taggedDB, WithTaggedChildRefs())
+	assert.Equal(t, expected[100:], collectKVs(t, reader.Iterate))
+
+	// nodes of the other convention are malformed
+	_, err = NewTrie(tagged.StateRoot(), taggedDB).TryGet(expected[150].k)
+	assert.Equal(t, ErrMalformedNode, err.(*MissingNodeError).Err)
+	_, err = NewTrie(plain.StateRoot(), plainDB, WithTaggedChildRefs()).TryGet(expected[150].k)
+	assert.Equal(t, ErrMalformedNode, err.(*MissingNodeError).Err)
+}
+
+// TestDeleteNoGarbage check nodes absorbed when a branch collapse are deleted, so
+// only nodes of the latest trie remain in db
+func TestDeleteNoGarbage(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		memDB := memorydb.New()
+		trie, kvs := persistedTrie(memDB, 50)
+		for _, elem := range kvs[:40] {
+			trie = trie.Delete(elem.k)
+			if random.Intn(4) == 0 {
+				trie.Persist()
+				trie = NewTrie(trie.StateRoot(), memDB)
+			}
+		}
+		trie.Persist()
+		checked := make(map[common.Hash]struct{})
+		assert.Nil(t, checkSubtree(memDB, trie.StateRoot(), checked))
+		assert.Equal(t, len(checked), memDB.Len())
+	}
+}
+
+// randomKey return a short key from a small keyspace, so keys often share prefixes
+// or are prefixes of each other
+func randomKey() []byte {
+	key := make([]byte, 1+random.Intn(4))
+	for i := range key {
+		key[i] = byte(random.Intn(4)) * 0x11
+	}
+	return key
+}
+
+// TestReloadedTwin apply random batches of operations, after every batch the trie
+// is committed and reloaded from underlying db, the reloaded twin must hold the
+// same key values as the trie in memory and the model. Every value is unique, since
+// nodes are not reference counted, identical subtrees under different paths are
+// deleted together once one of them changes
+func TestReloadedTwin(t *testing.T) {
+	memDB := memorydb.New()
+	trie := NewTrie(EmptyHash, memDB)
+	model := make(map[string][]byte)
+	sequence := uint64(0)
+	for round := 0; round < 100; round++ {
+		for i := 0; i < 1+random.Intn(20); i++ {
+			key := randomKey()
+			if random.Intn(3) == 0 {
+				trie = trie.Delete(key)
+				delete(model, string(key))
+				continue
+			}
+			sequence++
+			// short values are embedded in their parents, long ones are hashed
+			value := Uint64Key(sequence)[random.Intn(6):]
+			if random.Intn(2) == 0 {
+				value = append(Uint64Key(sequence), randomBytes()...)
+			}
+			trie = trie.Insert(key, value)
+			model[string(key)] = value
+		}
+		expected := sortedKVs(model)
+		assert.Equal(t, expected, collectKVs(t, trie.Iterate))
+
+		trie.Persist()
+		twin := NewTrie(trie.StateRoot(), memDB)
+		assert.Equal(t, expected, collectKVs(t, twin.Iterate))
+		assert.Equal(t, collectKVs(t, trie.Iterate), collectKVs(t, twin.Iterate))
+		for i := 0; i < 20; i++ {
+			key := randomKey()
+			value, err := twin.TryGet(key)
+			assert.Nil(t, err)
+			assert.Equal(t, trie.Get(key), value)
+			assert.Equal(t, model[string(key)], value)
+		}
+		// every node in underlying db is reachable from the root
+		checked := make(map[common.Hash]struct{})
+		assert.Nil(t, checkSubtree(memDB, trie.StateRoot(), checked))
+		assert.Equal(t, memDB.Len(), len(checked), "round %d", round)
+		trie = twin
+	}
+}
@@ -0,0 +1,61 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Uint64Keys iterate key values of a trie whose keys under a prefix are Uint64Key
+// encodings, e.g. block numbers, by number rather than by bytes. A key under the
+// prefix of another length fails the iteration, since numeric order only holds for
+// keys of the same width
+type Uint64Keys struct {
+	trie   *Trie
+	prefix []byte
+}
+
+// Uint64Keys return the iterator of numeric keys under prefix, nil prefix means the
+// keys of the whole trie
+func (t *Trie) Uint64Keys(prefix []byte) *Uint64Keys {
+	return &Uint64Keys{trie: t, prefix: append([]byte{}, prefix...)}
+}
+
+// IterateFrom traverse key values whose number is greater than or equal to n in
+// numeric order, stop traversing if fn return false
+func (u *Uint64Keys) IterateFrom(n uint64, fn func(n uint64, value []byte) bool) error {
+	return u.iterate(n, nil, fn)
+}
+
+// IterateRangeUint64 traverse key values whose number is in [a, b) in numeric order,
+// stop traversing if fn return false. Nothing is traversed if b is not greater
+// than a
+func (u *Uint64Keys) IterateRangeUint64(a, b uint64, fn func(n uint64, value []byte) bool) error {
+	if b <= a {
+		return nil
+	}
+	return u.iterate(a, concat(u.prefix, Uint64Key(b)), fn)
+}
+
+// iterate traverse key values from number start until key limit, nil limit means
+// the end of the prefix
+func (u *Uint64Keys) iterate(start uint64, limit []byte, fn func(n uint64, value []byte) bool) error {
+	var err error
+	iterErr := u.trie.IterateFrom(concat(u.prefix, Uint64Key(start)), func(key, value []byte) bool {
+		if !bytes.HasPrefix(key, u.prefix) || (limit != nil && bytes.Compare(key, limit) >= 0) {
+			return false
+		}
+		n, parseErr := ParseUint64Key(key[len(u.prefix):])
+		if parseErr != nil {
+			err = fmt.Errorf("key %x: %v", key, parseErr)
+			return false
+		}
+		return fn(n, value)
+	})
+	if iterErr != nil {
+		return iterErr
+	}
+	return err
+}
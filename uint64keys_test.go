@@ -0,0 +1,62 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUint64Keys(t *testing.T) {
+	trie := NewTrie(EmptyHash, memorydb.New())
+	numbers := []uint64{0, 1, 255, 256, 1000, 65535, 65536, 1 << 40, math.MaxUint64}
+	for _, n := range numbers {
+		trie = trie.Insert(concat([]byte("b"), Uint64Key(n)), Uint64Key(n))
+	}
+	// keys outside the prefix are ignored
+	trie = trie.Insert([]byte("a"), []byte{1})
+	trie = trie.Insert([]byte("c"), []byte{2})
+
+	collect := func(iterate func(fn func(n uint64, value []byte) bool) error) []uint64 {
+		got := make([]uint64, 0)
+		assert.Nil(t, iterate(func(n uint64, value []byte) bool {
+			assert.Equal(t, Uint64Key(n), value)
+			got = append(got, n)
+			return true
+		}))
+		return got
+	}
+	keys := trie.Uint64Keys([]byte("b"))
+	assert.Equal(t, numbers, collect(func(fn func(uint64, []byte) bool) error {
+		return keys.IterateFrom(0, fn)
+	}))
+	assert.Equal(t, numbers[4:], collect(func(fn func(uint64, []byte) bool) error {
+		return keys.IterateFrom(257, fn)
+	}))
+	assert.Equal(t, numbers[2:6], collect(func(fn func(uint64, []byte) bool) error {
+		return keys.IterateRangeUint64(255, 65536, fn)
+	}))
+	// b is exclusive, so the max number is only reached by IterateFrom
+	assert.Equal(t, numbers[7:8], collect(func(fn func(uint64, []byte) bool) error {
+		return keys.IterateRangeUint64(1<<40, math.MaxUint64, fn)
+	}))
+	assert.Empty(t, collect(func(fn func(uint64, []byte) bool) error {
+		return keys.IterateRangeUint64(10, 10, fn)
+	}))
+
+	count := 0
+	assert.Nil(t, keys.IterateFrom(0, func(uint64, []byte) bool {
+		count++
+		return count < 3
+	}))
+	assert.Equal(t, 3, count)
+
+	// keys of other widths fail the iteration
+	trie = trie.Insert(append(concat([]byte("b"), Uint64Key(300)), 0), []byte{3})
+	assert.NotNil(t, trie.Uint64Keys([]byte("b")).IterateFrom(0, func(uint64, []byte) bool { return true }))
+	assert.Nil(t, trie.Uint64Keys([]byte("b")).IterateRangeUint64(0, 300, func(uint64, []byte) bool { return true }))
+}
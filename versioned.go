@@ -0,0 +1,43 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// VersionedValue is a value read by GetVersioned with the version of the read
+type VersionedValue struct {
+	// Value is nil if the key is absent
+	Value []byte
+	// Root is the root of the trie read, it include changes not committed yet
+	Root common.Hash
+	// Seq is the CommitSeq before the read
+	Seq uint64
+}
+
+// CommitSeq return the number of commits of the tries derived from the same NewTrie,
+// whether by Persist, CommitToBatch, Commit or PersistWithPruner. It increase by one
+// when a commit is written, see CommitReport.Written, even if the root isn't
+// changed, and never decrease, so it's a
+// consistency token of the lineage of roots for caches managed by callers: a value
+// read with seq s is up to date while CommitSeq is still s. The sequence is kept in
+// memory and start from 0 for every NewTrie
+func (t *Trie) CommitSeq() uint64 {
+	return atomic.LoadUint64(&t.config.commits)
+}
+
+// GetVersioned return the value of key like TryGet, with the root of the trie and
+// the commit sequence. The sequence is loaded before the read, so a commit racing
+// with the read make the value look older rather than newer
+func (t *Trie) GetVersioned(key []byte) (VersionedValue, error) {
+	seq := t.CommitSeq()
+	value, err := t.TryGet(key)
+	if err != nil {
+		return VersionedValue{}, err
+	}
+	return VersionedValue{Value: value, Root: t.rootHash, Seq: seq}, nil
+}
@@ -0,0 +1,49 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetVersioned(t *testing.T) {
+	memDB := memorydb.New()
+	trie := NewTrie(EmptyHash, memDB)
+	assert.Equal(t, uint64(0), trie.CommitSeq())
+	trie = trie.Insert([]byte{1}, []byte{1})
+	v, err := trie.GetVersioned([]byte{1})
+	assert.Nil(t, err)
+	assert.Equal(t, VersionedValue{Value: []byte{1}, Root: trie.StateRoot(), Seq: 0}, v)
+
+	trie.Persist()
+	next := trie.Insert([]byte{2}, []byte{2})
+	// tries derived from the same trie share the sequence
+	assert.Equal(t, uint64(1), next.CommitSeq())
+	// commits of batches count once the batch is written
+	batch := memDB.NewBatch()
+	report := next.CommitToBatch(batch)
+	assert.Equal(t, uint64(1), trie.CommitSeq())
+	assert.Nil(t, batch.Write())
+	report.Written()
+	report.Written()
+	assert.Equal(t, uint64(2), trie.CommitSeq())
+	_, err = next.Commit()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), trie.CommitSeq())
+	v, err = next.GetVersioned([]byte{3})
+	assert.Nil(t, err)
+	assert.Nil(t, v.Value)
+	assert.Equal(t, uint64(3), v.Seq)
+	assert.Equal(t, next.StateRoot(), v.Root)
+
+	// every NewTrie start a lineage
+	assert.Equal(t, uint64(0), NewTrie(next.StateRoot(), memDB).CommitSeq())
+
+	// errors of reads are returned
+	_, err = NewTrie(trie.StateRoot(), memorydb.New()).GetVersioned([]byte{1})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,38 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+// ReadOnlyView is a read only slice of a trie, keys are relative to the prefix
+// of the view, and keys outside the prefix are invisible
+type ReadOnlyView interface {
+	// Get returns the value for key under the prefix of the view
+	Get(key []byte) []byte
+	// Iterate traverse all key values under the prefix of the view in key order,
+	// keys passed to fn have the prefix stripped
+	Iterate(fn func(key, value []byte) bool) error
+}
+
+type prefixView struct {
+	trie   *Trie
+	prefix []byte
+}
+
+// View return a read only view of key values under prefix, the view is unaffected
+// by any later Insert/Delete because the trie is immutable
+func (t *Trie) View(prefix []byte) ReadOnlyView {
+	return &prefixView{
+		trie:   t,
+		prefix: append([]byte{}, prefix...),
+	}
+}
+
+func (v *prefixView) Get(key []byte) []byte {
+	return v.trie.Get(concat(v.prefix, key))
+}
+
+func (v *prefixView) Iterate(fn func(key, value []byte) bool) error {
+	return v.trie.IteratePrefix(v.prefix, func(key, value []byte) bool {
+		return fn(key[len(v.prefix):], value)
+	})
+}
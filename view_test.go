@@ -0,0 +1,44 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixView(t *testing.T) {
+	prefix := []byte("module/")
+	trie := NewTrie(EmptyHash, memorydb.New())
+	expected := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		elem := newKV()
+		trie = trie.Insert(elem.k, elem.v)
+		// use different value, otherwise leaf nodes may have the same hash
+		value := concat(prefix, elem.v)
+		trie = trie.Insert(concat(prefix, elem.k), value)
+		expected[string(elem.k)] = value
+	}
+	// the prefix itself is visible as empty key
+	trie = trie.Insert(prefix, []byte{0x01})
+	expected[""] = []byte{0x01}
+
+	view := trie.View(prefix)
+	for k, v := range expected {
+		assert.Equal(t, v, view.Get([]byte(k)))
+	}
+	kvs := collectKVs(t, view.Iterate)
+	assert.Equal(t, len(expected), len(kvs))
+	for i, elem := range sortedKVs(expected) {
+		assert.Equal(t, elem.k, append([]byte{}, kvs[i].k...))
+		assert.Equal(t, elem.v, kvs[i].v)
+	}
+
+	// the view is unaffected by later changes
+	newTrie := trie.Delete(prefix)
+	assert.Nil(t, newTrie.View(prefix).Get(nil))
+	assert.Equal(t, []byte{0x01}, view.Get(nil))
+}
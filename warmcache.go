@@ -0,0 +1,108 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lbqds/mpt/internal/varint"
+)
+
+// A warm cache file is the nodes cached by a trie, so a restarted service start
+// with the cache of the previous run rather than reading every hot node from db:
+//
+//	magic | root | (varint size | node)* | varint 0
+//
+// root is the root of the trie when it's saved, nodes are in the order of caching,
+// so the earliest ones are still evicted first after loading
+var warmCacheMagic = []byte("mptwarm1")
+
+// ErrWarmCacheRoot is returned by LoadWarmCache if the cache is saved from a trie of
+// another root
+var ErrWarmCacheRoot = errors.New("warm cache is saved at another root")
+
+// SaveWarmCache write the nodes cached by the trie to w, and return the number of
+// written nodes. Save it after the last commit of the trie, e.g. at shutdown, so
+// the cache can be loaded by the trie of the same root at startup
+func (t *Trie) SaveWarmCache(w io.Writer) (int, error) {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(warmCacheMagic); err != nil {
+		return 0, err
+	}
+	if _, err := bw.Write(t.rootHash[:]); err != nil {
+		return 0, err
+	}
+	count := 0
+	var err error
+	var size []byte
+	t.log.cache.entries(func(key common.Hash, value []byte) bool {
+		size = varint.Append(size[:0], uint64(len(value)))
+		if _, err = bw.Write(size); err != nil {
+			return false
+		}
+		if _, err = bw.Write(value); err != nil {
+			return false
+		}
+		count++
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := bw.WriteByte(0); err != nil {
+		return 0, err
+	}
+	return count, bw.Flush()
+}
+
+// LoadWarmCache read nodes written by SaveWarmCache from r to the cache of the trie,
+// which is shared by tries derived from it, and return the number of loaded nodes.
+// The cache must be saved at the root of the trie, otherwise ErrWarmCacheRoot is
+// returned, since nodes cached at another root may have been pruned from db. Nodes
+// are keyed by their hashes and checked like nodes read from db, so a corrupted
+// file can't poison the cache. Nothing is loaded if the trie has WithNoCache
+func (t *Trie) LoadWarmCache(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	head := make([]byte, len(warmCacheMagic)+common.HashLength)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(head[:len(warmCacheMagic)], warmCacheMagic) {
+		return 0, fmt.Errorf("invalid warm cache file")
+	}
+	if common.BytesToHash(head[len(warmCacheMagic):]) != t.rootHash {
+		return 0, ErrWarmCacheRoot
+	}
+	if t.config.noCache {
+		return 0, nil
+	}
+	count := 0
+	for {
+		size, err := binary.ReadUvarint(br)
+		if err != nil {
+			return count, err
+		}
+		if size == 0 {
+			return count, nil
+		}
+		// the buffer grow as bytes are read, so a corrupted size can't allocate
+		// more than the file
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, br, int64(size)); err != nil {
+			return count, err
+		}
+		encoded := buf.Bytes()
+		if _, err := t.decodeFetched(encoded); err != nil {
+			return count, fmt.Errorf("invalid warm cache node: %v", err)
+		}
+		t.log.cache.put(keccak256Hash(encoded), encoded)
+		count++
+	}
+}
@@ -0,0 +1,61 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarmCache(t *testing.T) {
+	memDB := memorydb.New()
+	trie, kvs := persistedTrie(memDB, 200)
+	for _, elem := range kvs[:100] {
+		assert.Equal(t, elem.v, trie.Get(elem.k))
+	}
+	var buf bytes.Buffer
+	saved, err := trie.SaveWarmCache(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, trie.LogStats().CachedNodes, saved)
+
+	var measured *OpSample
+	restarted := NewTrie(trie.StateRoot(), memDB, WithLatencySink(func(sample OpSample) {
+		measured = &sample
+	}))
+	loaded, err := restarted.LoadWarmCache(bytes.NewReader(buf.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, saved, loaded)
+	assert.Equal(t, trie.CacheSize(), restarted.CacheSize())
+	// hot keys are read from the cache without touching db
+	for _, elem := range kvs[:100] {
+		assert.Equal(t, elem.v, restarted.Get(elem.k))
+		assert.Equal(t, 0, measured.DBReads)
+	}
+
+	// the cache of another root is rejected
+	other := trie.Insert(kvs[0].k, []byte("changed"))
+	other.Persist()
+	_, err = NewTrie(other.StateRoot(), memDB).LoadWarmCache(bytes.NewReader(buf.Bytes()))
+	assert.Equal(t, ErrWarmCacheRoot, err)
+
+	// corrupted nodes are rejected
+	corrupted := append([]byte{}, buf.Bytes()...)
+	corrupted[len(corrupted)-2] ^= 0xff
+	fresh := NewTrie(trie.StateRoot(), memDB)
+	_, err = fresh.LoadWarmCache(bytes.NewReader(corrupted))
+	assert.NotNil(t, err)
+	_, err = fresh.LoadWarmCache(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	assert.NotNil(t, err)
+	_, err = NewTrie(trie.StateRoot(), memDB).LoadWarmCache(bytes.NewReader([]byte("garbage")))
+	assert.NotNil(t, err)
+
+	noCache := NewTrie(trie.StateRoot(), memDB, WithNoCache())
+	loaded, err = noCache.LoadWarmCache(bytes.NewReader(buf.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, loaded)
+	assert.Equal(t, 0, noCache.CacheSize())
+}
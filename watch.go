@@ -0,0 +1,257 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// KVEvent is the change of a key by a commit
+type KVEvent struct {
+	// Root is the root of the commit
+	Root common.Hash
+	Key  []byte
+	// Value is the value after the commit, nil if the key is deleted
+	Value []byte
+	// Previous is the value before the commit, nil if the key is inserted
+	Previous []byte
+}
+
+type subscription struct {
+	prefix []byte
+	ch     chan KVEvent
+}
+
+// Watcher send the key values changed by commits of tries to subscribers of their
+// prefixes, so downstream services can react to changes without polling or diffing
+// tries themselves. Changes are found by walking the committed and the previous
+// trie together under watched prefixes, subtrees with the same hash are skipped, so
+// the cost is proportional to the changes. Events are sent once the commit is
+// written to underlying db, see CommitReport.Written. Changes are relative to the
+// previous commit seen by the watcher, or the committed root the trie derived from
+// for the first one, since a commit make tries of other roots stale, commits sent to a
+// watcher are expected to follow each other. It's safe for concurrent use
+type Watcher struct {
+	lock   sync.Mutex
+	buffer int
+	subs   []*subscription
+	// committed is the root of the previous commit, nil before the first one
+	committed *common.Hash
+}
+
+// NewWatcher create a watcher whose channels buffer up to buffer events
+func NewWatcher(buffer int) *Watcher {
+	return &Watcher{buffer: buffer}
+}
+
+// WithWatcher send the changes of every commit of the trie to subscribers of w
+func WithWatcher(w *Watcher) Option {
+	return func(c *config) {
+		c.watcher = w
+	}
+}
+
+// Watch return a channel receiving events of keys under prefix in key order of every
+// commit. Commits never block on subscribers, a subscriber which doesn't keep up
+// with commits, or whose changes can't be found because nodes are missing, has its
+// channel closed, it should resync by iterating the trie and watch again
+func (w *Watcher) Watch(prefix []byte) <-chan KVEvent {
+	sub := &subscription{prefix: common.CopyBytes(prefix), ch: make(chan KVEvent, w.buffer)}
+	w.lock.Lock()
+	w.subs = append(w.subs, sub)
+	w.lock.Unlock()
+	return sub.ch
+}
+
+// Unwatch close ch and stop sending events to it
+func (w *Watcher) Unwatch(ch <-chan KVEvent) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for i, sub := range w.subs {
+		if (<-chan KVEvent)(sub.ch) == ch {
+			w.remove(i)
+			return
+		}
+	}
+}
+
+// remove close the subscription at i, the lock must be held
+func (w *Watcher) remove(i int) {
+	close(w.subs[i].ch)
+	w.subs = append(w.subs[:i], w.subs[i+1:]...)
+}
+
+// prepare find the changes of the commit of t for subscribers, and return the func
+// sending them once the commit is written. Subscribers watching after prepare
+// receive events from the next commit
+func (w *Watcher) prepare(t *Trie) func() {
+	w.lock.Lock()
+	from := t.baseRoot
+	if w.committed != nil {
+		from = *w.committed
+	}
+	prefixes := make([][]byte, 0, len(w.subs))
+	for _, sub := range w.subs {
+		prefixes = append(prefixes, sub.prefix)
+	}
+	w.lock.Unlock()
+	root := t.rootHash
+	// subscribers of the same prefix share the walk
+	events := make(map[string][]KVEvent)
+	failed := make(map[string]bool)
+	if from != root {
+		previous := t.derive(from, newUpdateLog())
+		for _, prefix := range prefixes {
+			key := string(prefix)
+			if _, ok := events[key]; ok || failed[key] {
+				continue
+			}
+			prefixEvents := make([]KVEvent, 0)
+			err := diffPrefix(previous, t, prefix, func(key, value, prev []byte) {
+				prefixEvents = append(prefixEvents, KVEvent{Root: root, Key: key, Value: value, Previous: prev})
+			})
+			if err != nil {
+				failed[key] = true
+				continue
+			}
+			events[key] = prefixEvents
+		}
+	}
+	return func() {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		w.committed = &root
+		if from == root {
+			return
+		}
+		for i := 0; i < len(w.subs); {
+			sub := w.subs[i]
+			if !failed[string(sub.prefix)] && send(sub.ch, events[string(sub.prefix)]) {
+				i++
+				continue
+			}
+			w.remove(i)
+		}
+	}
+}
+
+// send send events to ch without blocking, and report whether all are sent
+func send(ch chan KVEvent, events []KVEvent) bool {
+	for _, event := range events {
+		select {
+		case ch <- event:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Diff call fn with every key whose value differ between t and other in key order,
+// value is the value in other, nil if the key is absent from it, and prev is the
+// value in t, nil if the key is absent from t. The tries are walked together and
+// subtrees with the same hash are skipped, so the cost is proportional to the
+// changes rather than the size of the tries
+func (t *Trie) Diff(other *Trie, fn func(key, value, prev []byte)) error {
+	return diffPrefix(t, other, nil, fn)
+}
+
+// diffPrefix call fn with every key under prefix whose value differ between the
+// tries, value is nil if the key is absent from to, prev is nil if it's absent from
+// from
+func diffPrefix(from, to *Trie, prefix []byte, fn func(key, value, prev []byte)) (err error) {
+	defer recoverResolveError(&err)
+	d := &differ{from: from, to: to, fn: fn}
+	d.descend(d.root(from), d.root(to), nil, bytesToNibbles(prefix))
+	return nil
+}
+
+// differ walk two tries together, nodes are expanded to branches nibble by nibble,
+// so nodes of different kinds at the same path can be compared
+type differ struct {
+	from, to *Trie
+	fn       func(key, value, prev []byte)
+}
+
+func (d *differ) root(t *Trie) node {
+	if t.empty(t.rootHash) {
+		return nil
+	}
+	return &hashNode{t.rootHash.Bytes()}
+}
+
+// descend follow prefix from the nodes at path, and diff the subtrees at prefix
+func (d *differ) descend(from, to node, path, prefix []byte) {
+	if len(prefix) == 0 {
+		d.diff(from, to, path)
+		return
+	}
+	if same(from, to) {
+		return
+	}
+	_, fromChildren := d.expand(d.from, from)
+	_, toChildren := d.expand(d.to, to)
+	i := prefix[0]
+	d.descend(fromChildren[i], toChildren[i], append(path, i), prefix[1:])
+}
+
+// diff call fn with all keys whose value differ between subtrees at path
+func (d *differ) diff(from, to node, path []byte) {
+	if same(from, to) {
+		return
+	}
+	fromValue, fromChildren := d.expand(d.from, from)
+	toValue, toChildren := d.expand(d.to, to)
+	if (fromValue == nil) != (toValue == nil) || !bytes.Equal(fromValue, toValue) {
+		d.fn(nibblesToBytes(path), toValue, fromValue)
+	}
+	for i := range fromChildren {
+		d.diff(fromChildren[i], toChildren[i], append(path, byte(i)))
+	}
+}
+
+// same report whether the subtrees are known to be the same without expanding them
+func same(a, b node) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	ha, ok1 := a.(*hashNode)
+	hb, ok2 := b.(*hashNode)
+	return ok1 && ok2 && bytes.Equal(ha.hash, hb.hash)
+}
+
+// expand return the value at n, nil if it has no value, and the nodes at the next
+// nibble, nodes with keys are split into their first nibble and the rest
+func (d *differ) expand(t *Trie, n node) ([]byte, [16]node) {
+	var children [16]node
+	switch n := n.(type) {
+	case *leafNode:
+		if len(n.key) == 0 {
+			// a leaf always have a value, even if it's empty
+			return append([]byte{}, n.value...), children
+		}
+		children[n.key[0]] = newLeafNode(n.key[1:], n.value)
+	case *extNode:
+		if len(n.key) == 1 {
+			children[n.key[0]] = n.child
+		} else {
+			children[n.key[0]] = newExtNode(n.key[1:], n.child, n.tagged)
+		}
+	case *branchNode:
+		if n.hasTarget() {
+			return n.target, n.children
+		}
+		return nil, n.children
+	case *hashNode:
+		resolved, err := t.resolveHash(n.Hash())
+		if err != nil {
+			panic(&resolveError{err})
+		}
+		return d.expand(t, resolved)
+	}
+	return nil, children
+}
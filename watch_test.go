@@ -0,0 +1,151 @@
+//go:build !mptcore
+// +build !mptcore
+
+package mpt
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+)
+
+func receive(ch <-chan KVEvent) []KVEvent {
+	events := make([]KVEvent, 0)
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return events
+			}
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	watcher := NewWatcher(16)
+	ch := watcher.Watch([]byte("a"))
+	trie := NewTrie(EmptyHash, memorydb.New(), WithWatcher(watcher))
+	trie = trie.Insert([]byte("a1"), []byte("v1"))
+	trie = trie.Insert([]byte("a2"), []byte("v2"))
+	trie = trie.Insert([]byte("b1"), []byte("v3"))
+	trie.Persist()
+	root := trie.StateRoot()
+	assert.Equal(t, []KVEvent{
+		{Root: root, Key: []byte("a1"), Value: []byte("v1")},
+		{Root: root, Key: []byte("a2"), Value: []byte("v2")},
+	}, receive(ch))
+
+	// changes outside the prefix are not sent
+	trie = trie.Insert([]byte("b2"), []byte("v4"))
+	trie.Persist()
+	assert.Empty(t, receive(ch))
+
+	trie = trie.Insert([]byte("a1"), []byte("v5"))
+	trie = trie.Delete([]byte("a2"))
+	trie = trie.Insert([]byte("a"), []byte{})
+	trie.Persist()
+	root = trie.StateRoot()
+	assert.Equal(t, []KVEvent{
+		{Root: root, Key: []byte("a"), Value: []byte{}},
+		{Root: root, Key: []byte("a1"), Value: []byte("v5"), Previous: []byte("v1")},
+		{Root: root, Key: []byte("a2"), Previous: []byte("v2")},
+	}, receive(ch))
+
+	watcher.Unwatch(ch)
+	_, ok := <-ch
+	assert.False(t, ok)
+}
+
+func TestWatchSlowSubscriber(t *testing.T) {
+	watcher := NewWatcher(1)
+	slow := watcher.Watch(nil)
+	fast := watcher.Watch([]byte{1})
+	trie := NewTrie(EmptyHash, memorydb.New(), WithWatcher(watcher))
+	trie = trie.Insert([]byte{1}, []byte{1})
+	trie = trie.Insert([]byte{2}, []byte{2})
+	trie.Persist()
+	// the slow subscriber is dropped rather than block the commit
+	events := receive(slow)
+	assert.Equal(t, 1, len(events))
+	_, ok := <-slow
+	assert.False(t, ok)
+	assert.Equal(t, 1, len(receive(fast)))
+	trie = trie.Insert([]byte{1}, []byte{3})
+	trie.Persist()
+	assert.Equal(t, []byte{3}, receive(fast)[0].Value)
+}
+
+// TestWatchRandom check events of random commits against the changes of a model
+func TestWatchRandom(t *testing.T) {
+	memDB := memorydb.New()
+	watcher := NewWatcher(1024)
+	prefix := []byte{0x11}
+	ch := watcher.Watch(prefix)
+	trie := NewTrie(EmptyHash, memDB, WithWatcher(watcher))
+	model := make(map[string][]byte)
+	sequence := uint64(0)
+	for round := 0; round < 50; round++ {
+		previous := make(map[string][]byte, len(model))
+		for k, v := range model {
+			previous[k] = v
+		}
+		for i := 0; i < 1+random.Intn(10); i++ {
+			key := randomKey()
+			if random.Intn(3) == 0 {
+				trie = trie.Delete(key)
+				delete(model, string(key))
+				continue
+			}
+			sequence++
+			value := append(Uint64Key(sequence), randomBytes()...)
+			trie = trie.Insert(key, value)
+			model[string(key)] = value
+		}
+		trie.Persist()
+
+		expected := make([]KVEvent, 0)
+		for k, v := range model {
+			if prev, ok := previous[k]; (!ok || !bytes.Equal(prev, v)) && bytes.HasPrefix([]byte(k), prefix) {
+				expected = append(expected, KVEvent{Root: trie.StateRoot(), Key: []byte(k), Value: v, Previous: prev})
+			}
+		}
+		for k, v := range previous {
+			if _, ok := model[k]; !ok && bytes.HasPrefix([]byte(k), prefix) {
+				expected = append(expected, KVEvent{Root: trie.StateRoot(), Key: []byte(k), Previous: v})
+			}
+		}
+		sort.Slice(expected, func(i, j int) bool {
+			return bytes.Compare(expected[i].Key, expected[j].Key) < 0
+		})
+		assert.Equal(t, expected, receive(ch))
+	}
+}
+
+func TestDiff(t *testing.T) {
+	memDB := memorydb.New()
+	from, kvs := persistedTrie(memDB, 100)
+	to := from.Insert(kvs[0].k, []byte("updated"))
+	to = to.Delete(kvs[1].k)
+	to = to.Insert([]byte("new"), []byte("value"))
+	changes := make(map[string][2][]byte)
+	var last []byte
+	assert.Nil(t, from.Diff(to, func(key, value, prev []byte) {
+		assert.True(t, bytes.Compare(last, key) < 0)
+		last = key
+		changes[string(key)] = [2][]byte{value, prev}
+	}))
+	assert.Equal(t, map[string][2][]byte{
+		string(kvs[0].k): {[]byte("updated"), kvs[0].v},
+		string(kvs[1].k): {nil, kvs[1].v},
+		"new":            {[]byte("value"), nil},
+	}, changes)
+	assert.Nil(t, to.Diff(to, func(key, value, prev []byte) {
+		t.Fatal("no change expected")
+	}))
+}
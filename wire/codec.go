@@ -0,0 +1,165 @@
+package wire
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lbqds/mpt/internal/varint"
+)
+
+// ErrInvalidMessage is returned when a message can't be decoded
+var ErrInvalidMessage = errors.New("invalid wire message")
+
+// wire types of protobuf used by messages
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// encoder write fields of a message in order of field number, the output is the
+// same as proto3 encoding, see wire.proto
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) tag(field, wireType int) {
+	e.buf = varint.Append(e.buf, uint64(field<<3|wireType))
+}
+
+// uint64 write a varint field unless v is 0
+func (e *encoder) uint64(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, wireVarint)
+	e.buf = varint.Append(e.buf, v)
+}
+
+// bool write a varint field unless v is false
+func (e *encoder) bool(field int, v bool) {
+	if v {
+		e.uint64(field, 1)
+	}
+}
+
+// bytes write a length-delimited field unless v is empty
+func (e *encoder) bytes(field int, v []byte) {
+	if len(v) > 0 {
+		e.element(field, v)
+	}
+}
+
+// element write a length-delimited field even if v is empty, which is an element
+// of a repeated field or an embedded message
+func (e *encoder) element(field int, v []byte) {
+	e.tag(field, wireBytes)
+	e.buf = varint.Append(e.buf, uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// repeated write every element of a repeated bytes field
+func (e *encoder) repeated(field int, vs [][]byte) {
+	for _, v := range vs {
+		e.element(field, v)
+	}
+}
+
+// decoder read fields of a message, bytes returned alias the input
+type decoder struct {
+	data []byte
+}
+
+func (d *decoder) done() bool {
+	return len(d.data) == 0
+}
+
+func (d *decoder) varint() (uint64, error) {
+	v, rest, ok := varint.Decode(d.data)
+	if !ok {
+		return 0, ErrInvalidMessage
+	}
+	d.data = rest
+	return v, nil
+}
+
+// next return the field number and wire type of the next field
+func (d *decoder) next() (int, int, error) {
+	tag, err := d.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	if tag>>3 == 0 || tag>>3 > 1<<29 {
+		return 0, 0, ErrInvalidMessage
+	}
+	return int(tag >> 3), int(tag & 0x7), nil
+}
+
+func (d *decoder) bytes(wireType int) ([]byte, error) {
+	if wireType != wireBytes {
+		return nil, fmt.Errorf("%v: unexpected wire type %d", ErrInvalidMessage, wireType)
+	}
+	size, err := d.varint()
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(len(d.data)) {
+		return nil, ErrInvalidMessage
+	}
+	v := d.data[:size:size]
+	d.data = d.data[size:]
+	return v, nil
+}
+
+func (d *decoder) uint64(wireType int) (uint64, error) {
+	if wireType != wireVarint {
+		return 0, fmt.Errorf("%v: unexpected wire type %d", ErrInvalidMessage, wireType)
+	}
+	return d.varint()
+}
+
+func (d *decoder) bool(wireType int) (bool, error) {
+	v, err := d.uint64(wireType)
+	return v != 0, err
+}
+
+// skip skip the value of an unknown field, so newer messages can add fields
+func (d *decoder) skip(wireType int) error {
+	switch wireType {
+	case wireVarint:
+		_, err := d.varint()
+		return err
+	case wireBytes:
+		_, err := d.bytes(wireType)
+		return err
+	case 1:
+		return d.advance(8)
+	case 5:
+		return d.advance(4)
+	default:
+		return fmt.Errorf("%v: unexpected wire type %d", ErrInvalidMessage, wireType)
+	}
+}
+
+func (d *decoder) advance(n int) error {
+	if len(d.data) < n {
+		return ErrInvalidMessage
+	}
+	d.data = d.data[n:]
+	return nil
+}
+
+// decodeFields call fn with every field of data, fn read the value of the field
+// from the decoder
+func decodeFields(data []byte, fn func(d *decoder, field, wireType int) error) error {
+	d := &decoder{data: data}
+	for !d.done() {
+		field, wireType, err := d.next()
+		if err != nil {
+			return err
+		}
+		if err := fn(d, field, wireType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,435 @@
+// Package wire define the messages of proof servers, so transports like libp2p, gRPC
+// or QUIC can share the same message layer. Messages are encoded as protobuf, the
+// schema is in wire.proto, and every encoded message is wrapped in an Envelope which
+// tell its kind:
+//
+//	data := wire.Encode(&wire.ProofRequest{ID: 1, Root: root, Keys: keys})
+//	msg, err := wire.Decode(data)
+//
+// Only encoding and proof conversion are needed by clients, so the package builds
+// with tag mptcore as well.
+package wire
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lbqds/mpt"
+)
+
+// Kind is the type of a message, which is its field number in Envelope
+type Kind int
+
+const (
+	KindProofRequest Kind = iota + 1
+	KindProofResponse
+	KindRangeRequest
+	KindRangeResponse
+	KindNodeRequest
+	KindNodeResponse
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindProofRequest:
+		return "ProofRequest"
+	case KindProofResponse:
+		return "ProofResponse"
+	case KindRangeRequest:
+		return "RangeRequest"
+	case KindRangeResponse:
+		return "RangeResponse"
+	case KindNodeRequest:
+		return "NodeRequest"
+	case KindNodeResponse:
+		return "NodeResponse"
+	default:
+		return fmt.Sprintf("Kind(%d)", int(k))
+	}
+}
+
+// Message is a message of the wire protocol, requests and their responses are
+// matched by ID
+type Message interface {
+	Kind() Kind
+	marshal(e *encoder)
+	unmarshal(data []byte) error
+}
+
+// Encode return the encoded Envelope of msg
+func Encode(msg Message) []byte {
+	body := &encoder{}
+	msg.marshal(body)
+	e := &encoder{buf: make([]byte, 0, len(body.buf)+8)}
+	e.element(int(msg.Kind()), body.buf)
+	return e.buf
+}
+
+// Decode decode an Envelope and return the message in it, byte slices of the
+// message alias data
+func Decode(data []byte) (Message, error) {
+	d := &decoder{data: data}
+	field, wireType, err := d.next()
+	if err != nil {
+		return nil, err
+	}
+	body, err := d.bytes(wireType)
+	if err != nil {
+		return nil, err
+	}
+	if !d.done() {
+		return nil, fmt.Errorf("%v: more than one message in envelope", ErrInvalidMessage)
+	}
+	var msg Message
+	switch Kind(field) {
+	case KindProofRequest:
+		msg = &ProofRequest{}
+	case KindProofResponse:
+		msg = &ProofResponse{}
+	case KindRangeRequest:
+		msg = &RangeRequest{}
+	case KindRangeResponse:
+		msg = &RangeResponse{}
+	case KindNodeRequest:
+		msg = &NodeRequest{}
+	case KindNodeResponse:
+		msg = &NodeResponse{}
+	default:
+		return nil, fmt.Errorf("%v: unknown message kind %d", ErrInvalidMessage, field)
+	}
+	if err := msg.unmarshal(body); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func decodeHash(v []byte) (common.Hash, error) {
+	if len(v) != common.HashLength {
+		return common.Hash{}, fmt.Errorf("%v: hash of %d bytes", ErrInvalidMessage, len(v))
+	}
+	return common.BytesToHash(v), nil
+}
+
+// ProofRequest ask for the proofs of keys in the trie of Root
+type ProofRequest struct {
+	ID   uint64
+	Root common.Hash
+	Keys [][]byte
+}
+
+func (m *ProofRequest) Kind() Kind {
+	return KindProofRequest
+}
+
+func (m *ProofRequest) marshal(e *encoder) {
+	e.uint64(1, m.ID)
+	e.bytes(2, m.Root[:])
+	e.repeated(3, m.Keys)
+}
+
+func (m *ProofRequest) unmarshal(data []byte) error {
+	return decodeFields(data, func(d *decoder, field, wireType int) (err error) {
+		switch field {
+		case 1:
+			m.ID, err = d.uint64(wireType)
+		case 2:
+			var v []byte
+			if v, err = d.bytes(wireType); err == nil {
+				m.Root, err = decodeHash(v)
+			}
+		case 3:
+			var v []byte
+			if v, err = d.bytes(wireType); err == nil {
+				m.Keys = append(m.Keys, v)
+			}
+		default:
+			err = d.skip(wireType)
+		}
+		return err
+	})
+}
+
+// ProofValue is the value of a requested key, Present is false if the key is absent
+type ProofValue struct {
+	Value   []byte
+	Present bool
+}
+
+func (v *ProofValue) marshal() []byte {
+	e := &encoder{}
+	e.bytes(1, v.Value)
+	e.bool(2, v.Present)
+	return e.buf
+}
+
+func (v *ProofValue) unmarshal(data []byte) error {
+	err := decodeFields(data, func(d *decoder, field, wireType int) (err error) {
+		switch field {
+		case 1:
+			v.Value, err = d.bytes(wireType)
+		case 2:
+			v.Present, err = d.bool(wireType)
+		default:
+			err = d.skip(wireType)
+		}
+		return err
+	})
+	if err == nil && v.Present && v.Value == nil {
+		v.Value = []byte{}
+	}
+	return err
+}
+
+// ProofResponse carry the proof nodes of all requested keys once, since proofs of
+// keys in a batch share most nodes, and the values of keys in the order of request
+type ProofResponse struct {
+	ID     uint64
+	Nodes  [][]byte
+	Values []ProofValue
+}
+
+// NewProofResponse build the response of items, nodes shared by proofs are included once
+func NewProofResponse(id uint64, items []mpt.ProofItem) *ProofResponse {
+	resp := &ProofResponse{
+		ID:     id,
+		Nodes:  make([][]byte, 0),
+		Values: make([]ProofValue, 0, len(items)),
+	}
+	seen := make(map[string]struct{})
+	for _, item := range items {
+		for _, encoded := range item.Proof {
+			if _, ok := seen[string(encoded)]; ok {
+				continue
+			}
+			seen[string(encoded)] = struct{}{}
+			resp.Nodes = append(resp.Nodes, encoded)
+		}
+		resp.Values = append(resp.Values, ProofValue{Value: item.Value, Present: item.Value != nil})
+	}
+	return resp
+}
+
+// ProofItems return the proof items of keys, which are the keys of the request, the
+// items can be verified by mpt.VerifyProofBatch. Nodes of the response are shared
+// by all items, so they are set to the proof of the first item only
+func (m *ProofResponse) ProofItems(keys [][]byte) ([]mpt.ProofItem, error) {
+	if len(keys) != len(m.Values) {
+		return nil, fmt.Errorf("%d values for %d keys", len(m.Values), len(keys))
+	}
+	items := make([]mpt.ProofItem, 0, len(keys))
+	for i, key := range keys {
+		item := mpt.ProofItem{Key: key}
+		if m.Values[i].Present {
+			item.Value = m.Values[i].Value
+		}
+		if i == 0 {
+			item.Proof = m.Nodes
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (m *ProofResponse) Kind() Kind {
+	return KindProofResponse
+}
+
+func (m *ProofResponse) marshal(e *encoder) {
+	e.uint64(1, m.ID)
+	e.repeated(2, m.Nodes)
+	for i := range m.Values {
+		e.element(3, m.Values[i].marshal())
+	}
+}
+
+func (m *ProofResponse) unmarshal(data []byte) error {
+	return decodeFields(data, func(d *decoder, field, wireType int) (err error) {
+		switch field {
+		case 1:
+			m.ID, err = d.uint64(wireType)
+		case 2:
+			var v []byte
+			if v, err = d.bytes(wireType); err == nil {
+				m.Nodes = append(m.Nodes, v)
+			}
+		case 3:
+			var v []byte
+			if v, err = d.bytes(wireType); err == nil {
+				var value ProofValue
+				if err = value.unmarshal(v); err == nil {
+					m.Values = append(m.Values, value)
+				}
+			}
+		default:
+			err = d.skip(wireType)
+		}
+		return err
+	})
+}
+
+// RangeRequest ask for key values in [Start, Limit) of the trie of Root, nil Limit
+// means no upper bound, and zero MaxBytes means no budget
+type RangeRequest struct {
+	ID       uint64
+	Root     common.Hash
+	Start    []byte
+	Limit    []byte
+	MaxBytes uint64
+}
+
+func (m *RangeRequest) Kind() Kind {
+	return KindRangeRequest
+}
+
+func (m *RangeRequest) marshal(e *encoder) {
+	e.uint64(1, m.ID)
+	e.bytes(2, m.Root[:])
+	e.bytes(3, m.Start)
+	e.bytes(4, m.Limit)
+	e.uint64(5, m.MaxBytes)
+}
+
+func (m *RangeRequest) unmarshal(data []byte) error {
+	return decodeFields(data, func(d *decoder, field, wireType int) (err error) {
+		switch field {
+		case 1:
+			m.ID, err = d.uint64(wireType)
+		case 2:
+			var v []byte
+			if v, err = d.bytes(wireType); err == nil {
+				m.Root, err = decodeHash(v)
+			}
+		case 3:
+			m.Start, err = d.bytes(wireType)
+		case 4:
+			m.Limit, err = d.bytes(wireType)
+		case 5:
+			m.MaxBytes, err = d.uint64(wireType)
+		default:
+			err = d.skip(wireType)
+		}
+		return err
+	})
+}
+
+// RangeResponse is the wire form of mpt.RangeResponse
+type RangeResponse struct {
+	ID     uint64
+	Keys   [][]byte
+	Values [][]byte
+	Proof  [][]byte
+	More   bool
+}
+
+func (m *RangeResponse) Kind() Kind {
+	return KindRangeResponse
+}
+
+func (m *RangeResponse) marshal(e *encoder) {
+	e.uint64(1, m.ID)
+	e.repeated(2, m.Keys)
+	e.repeated(3, m.Values)
+	e.repeated(4, m.Proof)
+	e.bool(5, m.More)
+}
+
+func (m *RangeResponse) unmarshal(data []byte) error {
+	err := decodeFields(data, func(d *decoder, field, wireType int) (err error) {
+		var v []byte
+		switch field {
+		case 1:
+			m.ID, err = d.uint64(wireType)
+		case 2:
+			if v, err = d.bytes(wireType); err == nil {
+				m.Keys = append(m.Keys, v)
+			}
+		case 3:
+			if v, err = d.bytes(wireType); err == nil {
+				m.Values = append(m.Values, v)
+			}
+		case 4:
+			if v, err = d.bytes(wireType); err == nil {
+				m.Proof = append(m.Proof, v)
+			}
+		case 5:
+			m.More, err = d.bool(wireType)
+		default:
+			err = d.skip(wireType)
+		}
+		return err
+	})
+	if err == nil && len(m.Keys) != len(m.Values) {
+		err = fmt.Errorf("%v: %d keys with %d values", ErrInvalidMessage, len(m.Keys), len(m.Values))
+	}
+	return err
+}
+
+// NodeRequest ask for encoded nodes by hash
+type NodeRequest struct {
+	ID     uint64
+	Hashes []common.Hash
+}
+
+func (m *NodeRequest) Kind() Kind {
+	return KindNodeRequest
+}
+
+func (m *NodeRequest) marshal(e *encoder) {
+	e.uint64(1, m.ID)
+	for i := range m.Hashes {
+		e.element(2, m.Hashes[i][:])
+	}
+}
+
+func (m *NodeRequest) unmarshal(data []byte) error {
+	return decodeFields(data, func(d *decoder, field, wireType int) (err error) {
+		switch field {
+		case 1:
+			m.ID, err = d.uint64(wireType)
+		case 2:
+			var v []byte
+			if v, err = d.bytes(wireType); err == nil {
+				var hash common.Hash
+				if hash, err = decodeHash(v); err == nil {
+					m.Hashes = append(m.Hashes, hash)
+				}
+			}
+		default:
+			err = d.skip(wireType)
+		}
+		return err
+	})
+}
+
+// NodeResponse carry encoded nodes in the order of the request, nodes unknown to
+// the server are empty
+type NodeResponse struct {
+	ID    uint64
+	Nodes [][]byte
+}
+
+func (m *NodeResponse) Kind() Kind {
+	return KindNodeResponse
+}
+
+func (m *NodeResponse) marshal(e *encoder) {
+	e.uint64(1, m.ID)
+	e.repeated(2, m.Nodes)
+}
+
+func (m *NodeResponse) unmarshal(data []byte) error {
+	return decodeFields(data, func(d *decoder, field, wireType int) (err error) {
+		switch field {
+		case 1:
+			m.ID, err = d.uint64(wireType)
+		case 2:
+			var v []byte
+			if v, err = d.bytes(wireType); err == nil {
+				m.Nodes = append(m.Nodes, v)
+			}
+		default:
+			err = d.skip(wireType)
+		}
+		return err
+	})
+}
@@ -0,0 +1,38 @@
+//go:build !mptcore
+// +build !mptcore
+
+package wire
+
+import (
+	"github.com/lbqds/mpt"
+)
+
+// NewRangeResponse convert resp to the response of request id
+func NewRangeResponse(id uint64, resp *mpt.RangeResponse) *RangeResponse {
+	return &RangeResponse{
+		ID:     id,
+		Keys:   resp.Keys,
+		Values: resp.Values,
+		Proof:  resp.Proof,
+		More:   resp.More,
+	}
+}
+
+// Response convert the message to mpt.RangeResponse
+func (m *RangeResponse) Response() *mpt.RangeResponse {
+	resp := &mpt.RangeResponse{
+		Keys:   make([][]byte, 0, len(m.Keys)),
+		Values: make([][]byte, 0, len(m.Values)),
+		Proof:  m.Proof,
+		More:   m.More,
+	}
+	resp.Keys = append(resp.Keys, m.Keys...)
+	for _, value := range m.Values {
+		if value == nil {
+			// proto decode empty element as nil, but values are never nil
+			value = []byte{}
+		}
+		resp.Values = append(resp.Values, value)
+	}
+	return resp
+}
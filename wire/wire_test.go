@@ -0,0 +1,138 @@
+//go:build !mptcore
+// +build !mptcore
+
+package wire
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/lbqds/mpt"
+	"github.com/stretchr/testify/assert"
+)
+
+func roundTrip(t *testing.T, msg Message) Message {
+	decoded, err := Decode(Encode(msg))
+	assert.Nil(t, err)
+	assert.Equal(t, msg.Kind(), decoded.Kind())
+	return decoded
+}
+
+func TestRoundTrip(t *testing.T) {
+	root := common.BytesToHash([]byte{1, 2, 3})
+	messages := []Message{
+		&ProofRequest{ID: 1, Root: root, Keys: [][]byte{{1}, {2, 3}}},
+		&ProofResponse{ID: 2, Nodes: [][]byte{{4, 5}}, Values: []ProofValue{{Value: []byte{6}, Present: true}, {}}},
+		&RangeRequest{ID: 3, Root: root, Start: []byte{1}, Limit: []byte{9}, MaxBytes: 1024},
+		&RangeResponse{ID: 4, Keys: [][]byte{{1}, {2}}, Values: [][]byte{{3}, {4}}, Proof: [][]byte{{5}}, More: true},
+		&NodeRequest{ID: 5, Hashes: []common.Hash{root, common.BytesToHash([]byte{4})}},
+		&NodeResponse{ID: 6, Nodes: [][]byte{{7}, {}}},
+	}
+	for _, msg := range messages {
+		assert.Equal(t, msg, roundTrip(t, msg))
+	}
+
+	// empty value of a present key is kept
+	resp := roundTrip(t, &ProofResponse{Values: []ProofValue{{Value: []byte{}, Present: true}}})
+	assert.Equal(t, []byte{}, resp.(*ProofResponse).Values[0].Value)
+}
+
+func TestDecodeUnknownFields(t *testing.T) {
+	body := &encoder{}
+	(&ProofRequest{ID: 1, Keys: [][]byte{{1}}}).marshal(body)
+	body.uint64(100, 7)
+	body.bytes(101, []byte{1, 2})
+	e := &encoder{}
+	e.element(int(KindProofRequest), body.buf)
+	msg, err := Decode(e.buf)
+	assert.Nil(t, err)
+	assert.Equal(t, &ProofRequest{ID: 1, Keys: [][]byte{{1}}}, msg)
+
+	// unknown message kind
+	e = &encoder{}
+	e.element(100, body.buf)
+	_, err = Decode(e.buf)
+	assert.NotNil(t, err)
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	data := Encode(&RangeRequest{ID: 1, Start: []byte{1, 2, 3}})
+	_, err := Decode(nil)
+	assert.NotNil(t, err)
+	_, err = Decode(data[:len(data)-1])
+	assert.NotNil(t, err)
+	_, err = Decode(append(data, data...))
+	assert.NotNil(t, err)
+
+	// root must be a hash
+	body := &encoder{}
+	body.bytes(2, []byte{1})
+	e := &encoder{}
+	e.element(int(KindNodeRequest), body.buf)
+	_, err = Decode(e.buf)
+	assert.NotNil(t, err)
+
+	// keys and values of range response must match
+	_, err = Decode(Encode(&RangeResponse{Keys: [][]byte{{1}}}))
+	assert.NotNil(t, err)
+}
+
+func TestProofResponse(t *testing.T) {
+	trie := mpt.NewTrie(mpt.EmptyHash, memorydb.New())
+	for i := 0; i < 100; i++ {
+		trie = trie.Insert(mpt.Uint64Key(uint64(i)), []byte{byte(i), 1})
+	}
+	trie.Persist()
+
+	var proof [][]byte
+	items := make([]mpt.ProofItem, 0)
+	err := trie.IterateWithProof(nil, func(key, value []byte, step mpt.ProofStep) bool {
+		proof = step.Apply(proof)
+		if len(items) < 10 {
+			items = append(items, mpt.ProofItem{Key: key, Value: value, Proof: proof})
+		}
+		return true
+	})
+	assert.Nil(t, err)
+	keys := make([][]byte, 0, len(items))
+	for _, item := range items {
+		keys = append(keys, item.Key)
+	}
+	// absent key
+	keys = append(keys, mpt.Uint64Key(1000))
+	items = append(items, mpt.ProofItem{Key: mpt.Uint64Key(1000), Proof: items[0].Proof[:1]})
+
+	resp := NewProofResponse(1, items)
+	total := 0
+	for _, item := range items {
+		total += len(item.Proof)
+	}
+	assert.True(t, len(resp.Nodes) < total)
+	decoded := roundTrip(t, resp).(*ProofResponse)
+	assert.Equal(t, resp, decoded)
+
+	verified, err := decoded.ProofItems(keys)
+	assert.Nil(t, err)
+	assert.Nil(t, mpt.VerifyProofBatch(trie.StateRoot(), verified))
+	assert.Nil(t, verified[len(verified)-1].Value)
+
+	// value of another key
+	verified[1].Value = []byte{0xff}
+	assert.NotNil(t, mpt.VerifyProofBatch(trie.StateRoot(), verified))
+	_, err = decoded.ProofItems(keys[1:])
+	assert.NotNil(t, err)
+}
+
+func TestRangeResponse(t *testing.T) {
+	trie := mpt.NewTrie(mpt.EmptyHash, memorydb.New())
+	for i := 0; i < 100; i++ {
+		trie = trie.Insert(mpt.Uint64Key(uint64(i)), []byte{byte(i), 1})
+	}
+	trie = trie.Insert(mpt.Uint64Key(1000), []byte{})
+	resp, err := trie.IterateRange(nil, nil, 0)
+	assert.Nil(t, err)
+	decoded := roundTrip(t, NewRangeResponse(2, resp)).(*RangeResponse)
+	assert.Equal(t, uint64(2), decoded.ID)
+	assert.Equal(t, resp, decoded.Response())
+}